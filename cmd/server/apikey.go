@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/apikey"
+	"github.com/GRFreire/nthmail/pkg/config"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+)
+
+const apikey_usage = `usage:
+  server apikey create -name NAME [-domains a.com,b.com] [-prefixes ci-,qa-] [-permissions read,write,delete] [-rate N] [-- config flags]
+  server apikey list [config flags]
+  server apikey revoke ID [config flags]`
+
+func apikey_cmd(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, apikey_usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "create":
+		apikey_create(args[1:])
+	case "list":
+		store, db := open_apikey_store(args[1:])
+		defer close_db(db)
+
+		keys, err := store.List(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tDOMAINS\tPREFIXES\tPERMISSIONS\tRATE\tLAST USED\tREVOKED")
+		for _, key := range keys {
+			last_used := "never"
+			if key.Last_used_at != nil {
+				last_used = key.Last_used_at.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%t\n", key.Id, key.Name, list_or_any(key.Domains), list_or_any(key.Prefixes), strings.Join(key.Permissions, ","), key.Rate_limit, last_used, key.Revoked)
+		}
+		w.Flush()
+	case "revoke":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, apikey_usage)
+			os.Exit(2)
+		}
+
+		store, db := open_apikey_store(args[2:])
+		defer close_db(db)
+
+		err := store.Revoke(context.Background(), args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("revoked api key %s\n", args[1])
+	default:
+		fmt.Fprintln(os.Stderr, apikey_usage)
+		os.Exit(2)
+	}
+}
+
+func apikey_create(args []string) {
+	flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the key, to tell keys apart")
+	domains := flags.String("domains", "", "comma separated domains the key is limited to, empty for all")
+	prefixes := flags.String("prefixes", "", "comma separated address prefixes the key is limited to, empty for all")
+	permissions := flags.String("permissions", apikey.Read, "comma separated permissions, read, write and/or delete")
+	rate := flags.Int64("rate", 0, "requests per minute, 0 for api.key_requests_per_minute")
+
+	err := flags.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	if *name == "" || *rate < 0 {
+		fmt.Fprintln(os.Stderr, apikey_usage)
+		os.Exit(2)
+	}
+
+	// flags after "--" are config flags
+	store, db := open_apikey_store(flags.Args())
+	defer close_db(db)
+
+	key, token, err := store.Create(context.Background(), apikey.Key{
+		Name:        *name,
+		Domains:     apikey.ParseList(*domains),
+		Prefixes:    apikey.ParseList(*prefixes),
+		Permissions: apikey.ParseList(*permissions),
+		Rate_limit:  *rate,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("created api key %s, its token is shown only once:\n%s\n", key.Id, token)
+}
+
+func open_apikey_store(args []string) (*apikey.Store, *sql.DB) {
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", cfg.DB.Path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = migrations.Apply(db, cfg.Mail.Normalizer(), cfg.Mail.SubaddressSeparators)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return apikey.New(db), db
+}
+
+func list_or_any(list []string) string {
+	if len(list) == 0 {
+		return "*"
+	}
+
+	return strings.Join(list, ",")
+}
@@ -1,47 +1,195 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"github.com/GRFreire/nthmail/pkg/mail_server"
-	"github.com/GRFreire/nthmail/pkg/web_server"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/compose"
+	"github.com/GRFreire/nthmail/pkg/config"
+	"github.com/GRFreire/nthmail/pkg/forward"
+	"github.com/GRFreire/nthmail/pkg/lifecycle"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/mail_server"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	"github.com/GRFreire/nthmail/pkg/relay"
+	"github.com/GRFreire/nthmail/pkg/web_server"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
-	dbPath, exists := os.LookupEnv("DB_PATH")
-	if !exists {
-		dbPath = "./db.db"
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		config_cmd(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "apikey" {
+		apikey_cmd(args[1:])
+		return
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
-	log.Println("Openning sqlite db at", dbPath)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func(db *sql.DB) {
-		defer wg.Done()
-		err = mail_server.Start(db)
-		if err != nil {
-			log.Fatal(err)
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	db, err := sql.Open("sqlite3", cfg.DB.Path)
+	if err != nil {
+		slog.Error("could not open sqlite db", "path", cfg.DB.Path, "err", err)
+		os.Exit(1)
+	}
+	slog.Info("opened sqlite db", "path", cfg.DB.Path)
+
+	err = migrations.Apply(db, cfg.Mail.Normalizer(), cfg.Mail.SubaddressSeparators)
+	if err != nil {
+		slog.Error("could not migrate sqlite db", "err", err)
+		os.Exit(1)
+	}
+
+	register_db_metrics(db)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var group lifecycle.Group
+
+	var forwarder *forward.Forwarder
+	var sender *compose.Sender
+	if cfg.Relay.Host != "" {
+		helo_name := cfg.Relay.HeloName
+		if helo_name == "" {
+			helo_name = cfg.Mail.Domain
+		}
+
+		queue := relay.NewQueue(db, relay.Client{
+			Addr:     cfg.Relay.Host,
+			Username: cfg.Relay.Username,
+			Password: cfg.Relay.Password,
+			TLS:      cfg.Relay.TLS,
+			HeloName: helo_name,
+			Timeout:  cfg.Relay.Timeout,
+		}, cfg.Relay.RetryInterval, cfg.Relay.MaxAge)
+		group.Go("relay queue", queue.Run)
+
+		if cfg.Forward.Enabled {
+			forwarder = forward.New(db, queue, cfg.Forward.SRSSecret, cfg.Mail.Domain, cfg.Web.BaseURL, cfg.Forward.MaxRules, cfg.Forward.ConfirmationTTL, cfg.Forward.ConfirmationsPerDay)
 		}
-	}(db)
-
-	wg.Add(1)
-	go func(db *sql.DB) {
-		defer wg.Done()
-		err = web_server.Start(db)
-		if err != nil {
-			log.Fatal(err)
+
+		if cfg.Send.Enabled {
+			domain_reserved_names, err := cfg.Inbox.ParseDomainReservedNames()
+			if err != nil {
+				slog.Error("could not parse reserved names", "err", err)
+				os.Exit(1)
+			}
+			reserved := address.NewReserved(cfg.Inbox.ReservedNames, domain_reserved_names)
+
+			sender = compose.New(db, queue, cfg.Mail.Domain, reserved, cfg.Send.PerHour, cfg.Send.PerDay, cfg.Send.MaxRecipients, cfg.Send.MaxBodyBytes)
 		}
-	}(db)
+	}
+
+	group.Go("mail server", func(ctx context.Context) error {
+		return mail_server.Start(ctx, db, cfg.Mail, forwarder)
+	})
+	group.Go("web server", func(ctx context.Context) error {
+		return web_server.Start(ctx, db, cfg, forwarder, sender)
+	})
+	if cfg.Metrics.Enabled && cfg.Metrics.Port != 0 {
+		group.Go("metrics server", func(ctx context.Context) error {
+			server := &http.Server{
+				Addr:    net.JoinHostPort(cfg.Metrics.Host, strconv.Itoa(cfg.Metrics.Port)),
+				Handler: metrics.Handler(),
+			}
+
+			slog.Info("starting metrics server", "addr", server.Addr)
+			return lifecycle.ServeHTTP(ctx, server, cfg.Web.ShutdownTimeout)
+		})
+	}
 
-	wg.Wait()
+	err = group.Wait(ctx)
+	if err != nil {
+		slog.Error("server stopped with errors", "err", err)
+	}
+
+	if close_err := close_db(db); close_err != nil {
+		slog.Error("could not close sqlite db", "err", close_err)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func register_db_metrics(db *sql.DB) {
+	metrics.NewGaugeFunc("nthmail_db_size_bytes", "Size of the sqlite database.", func() (float64, error) {
+		var size float64
+		err := db.QueryRow("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+		return size, err
+	})
+
+	metrics.NewGaugeFunc("nthmail_mails", "Mails currently stored.", func() (float64, error) {
+		var count float64
+		err := db.QueryRow("SELECT COUNT(*) FROM mails").Scan(&count)
+		return count, err
+	})
+
+	metrics.NewGaugeFunc("nthmail_relay_queued", "Outbound mails waiting for delivery.", func() (float64, error) {
+		var count float64
+		err := db.QueryRow("SELECT COUNT(*) FROM outbound_queue WHERE failed = 0").Scan(&count)
+		return count, err
+	})
+}
+
+// close_db checkpoints the WAL into the main database file before closing,
+// so a stopped server leaves a self-contained db file behind.
+func close_db(db *sql.DB) error {
+	_, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("could not checkpoint wal: %w", err)
+	}
+
+	return db.Close()
+}
+
+func config_cmd(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: server config print [flags]")
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cfg.Print(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -4,6 +4,8 @@ go 1.23.0
 
 toolchain go1.23.5
 
+require golang.org/x/crypto v0.40.0
+
 require (
 	github.com/a-h/templ v0.3.943 // indirect
 	github.com/aymerick/douceur v0.2.0 // indirect
@@ -15,4 +17,6 @@ require (
 	github.com/microcosm-cc/bluemonday v1.0.27 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	golang.org/x/net v0.42.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
 )
@@ -0,0 +1,140 @@
+package address
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// max_local_part is the longest local part RFC 5321 allows, in octets.
+const max_local_part = 64
+
+var (
+	ErrEmptyLocalPart   = errors.New("the name is empty")
+	ErrLocalPartTooLong = errors.New("the name is longer than 64 characters")
+	ErrQuotedLocalPart  = errors.New("quoted names are not supported")
+	ErrInvalidDots      = errors.New("the name cannot start or end with a dot, or have two dots in a row")
+	ErrInvalidCharacter = errors.New("the name has a character not allowed in mail addresses")
+	ErrInvalidUTF8      = errors.New("the name is not valid UTF-8")
+)
+
+// is_atext reports whether c may appear in an atom of a local part.
+func is_atext(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+	}
+}
+
+// ValidateLocalPart checks that local is a dot-string local part as of
+// RFC 5321: atoms of letters, digits and !#$%&'*+-/=?^_`{|}~ separated by
+// single dots, at most 64 octets long. Non-ASCII characters are allowed as
+// of RFC 6531. Quoted strings are refused.
+func ValidateLocalPart(local string) error {
+	switch {
+	case local == "":
+		return ErrEmptyLocalPart
+	case len(local) > max_local_part:
+		return ErrLocalPartTooLong
+	case !utf8.ValidString(local):
+		return ErrInvalidUTF8
+	case strings.HasPrefix(local, `"`):
+		return ErrQuotedLocalPart
+	case strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, ".."):
+		return ErrInvalidDots
+	}
+
+	for _, r := range local {
+		if r >= utf8.RuneSelf {
+			if !unicode.IsGraphic(r) || unicode.IsSpace(r) {
+				return ErrInvalidCharacter
+			}
+			continue
+		}
+		if r != '.' && !is_atext(byte(r)) {
+			return ErrInvalidCharacter
+		}
+	}
+
+	return nil
+}
+
+// IsASCII reports whether addr needs no SMTPUTF8.
+func IsASCII(addr string) bool {
+	for i := 0; i < len(addr); i++ {
+		if addr[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reserved holds the local parts that cannot be chosen as inbox names, on
+// every domain or on a single one.
+type Reserved struct {
+	all       map[string]bool
+	by_domain map[string]map[string]bool
+}
+
+// reserved_key folds the variants of a name, so reserving "noreply" also
+// reserves "No-Reply" and "no.reply".
+func reserved_key(local string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(local))
+}
+
+func NewReserved(names []string, domain_names map[string][]string) *Reserved {
+	reserved := &Reserved{
+		all:       make(map[string]bool, len(names)),
+		by_domain: make(map[string]map[string]bool, len(domain_names)),
+	}
+
+	for _, name := range names {
+		reserved.all[reserved_key(name)] = true
+	}
+
+	for domain, names := range domain_names {
+		domain = strings.ToLower(domain)
+		if reserved.by_domain[domain] == nil {
+			reserved.by_domain[domain] = make(map[string]bool, len(names))
+		}
+		for _, name := range names {
+			reserved.by_domain[domain][reserved_key(name)] = true
+		}
+	}
+
+	return reserved
+}
+
+// Is reports whether local is reserved at domain.
+func (reserved *Reserved) Is(local, domain string) bool {
+	key := reserved_key(local)
+	return reserved.all[key] || reserved.by_domain[strings.ToLower(domain)][key]
+}
+
+// Split separates the sub-address of addr at the first of separators:
+// with "+" among them, "name+tag@domain" is split into "name@domain" and
+// "tag". An address without a separator, or with nothing before or after
+// it, is returned whole with an empty tag.
+func Split(addr, separators string) (string, string) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 || separators == "" {
+		return addr, ""
+	}
+
+	local, domain := addr[:at], addr[at:]
+	index := strings.IndexAny(local, separators)
+	if index <= 0 || index == len(local)-1 {
+		return addr, ""
+	}
+
+	return local[:index] + domain, local[index+1:]
+}
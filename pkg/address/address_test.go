@@ -0,0 +1,109 @@
+package address
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateLocalPart(t *testing.T) {
+	tests := []struct {
+		local string
+		err   error
+	}{
+		{local: "alice"},
+		{local: "alice.smith"},
+		{local: "a!#$%&'*+-/=?^_`{|}~z"},
+		{local: strings.Repeat("a", 64)},
+		{local: "josé"},
+		{local: "用户"},
+		{local: strings.Repeat("é", 32)},
+		{local: strings.Repeat("é", 33), err: ErrLocalPartTooLong},
+		{local: "alice\xff", err: ErrInvalidUTF8},
+		{local: "alice\u00a0smith", err: ErrInvalidCharacter},
+		{local: "alice\u200bsmith", err: ErrInvalidCharacter},
+		{local: "", err: ErrEmptyLocalPart},
+		{local: strings.Repeat("a", 65), err: ErrLocalPartTooLong},
+		{local: `"alice"`, err: ErrQuotedLocalPart},
+		{local: ".alice", err: ErrInvalidDots},
+		{local: "alice.", err: ErrInvalidDots},
+		{local: "alice..smith", err: ErrInvalidDots},
+		{local: "alice smith", err: ErrInvalidCharacter},
+		{local: "alice@smith", err: ErrInvalidCharacter},
+		{local: "alice(smith)", err: ErrInvalidCharacter},
+		{local: "alice\r\nsmith", err: ErrInvalidCharacter},
+	}
+
+	for _, test := range tests {
+		if err := ValidateLocalPart(test.local); !errors.Is(err, test.err) {
+			t.Errorf("ValidateLocalPart(%q) = %v, want %v", test.local, err, test.err)
+		}
+	}
+}
+
+func TestIsASCII(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"alice@nthmail.test", true},
+		{"", true},
+		{"josé@nthmail.test", false},
+		{"alice@bücher.example", false},
+	}
+
+	for _, test := range tests {
+		if got := IsASCII(test.addr); got != test.want {
+			t.Errorf("IsASCII(%q) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestReserved(t *testing.T) {
+	reserved := NewReserved([]string{"postmaster", "no-reply"}, map[string][]string{"Example.com": {"admin"}})
+
+	tests := []struct {
+		local, domain string
+		want          bool
+	}{
+		{"postmaster", "nthmail.test", true},
+		{"PostMaster", "nthmail.test", true},
+		{"noreply", "nthmail.test", true},
+		{"No_Reply", "nthmail.test", true},
+		{"no.reply", "example.com", true},
+		{"admin", "example.com", true},
+		{"admin", "EXAMPLE.com", true},
+		{"admin", "nthmail.test", false},
+		{"alice", "example.com", false},
+	}
+
+	for _, test := range tests {
+		if got := reserved.Is(test.local, test.domain); got != test.want {
+			t.Errorf("Is(%q, %q) = %v, want %v", test.local, test.domain, got, test.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		addr, separators string
+		want, tag        string
+	}{
+		{"alice+news@nthmail.test", "+", "alice@nthmail.test", "news"},
+		{"alice+news+daily@nthmail.test", "+", "alice@nthmail.test", "news+daily"},
+		{"alice-news@nthmail.test", "+-", "alice@nthmail.test", "news"},
+		{"alice-news@nthmail.test", "+", "alice-news@nthmail.test", ""},
+		{"alice+news@nthmail.test", "", "alice+news@nthmail.test", ""},
+		{"+news@nthmail.test", "+", "+news@nthmail.test", ""},
+		{"alice+@nthmail.test", "+", "alice+@nthmail.test", ""},
+		{"alice@nthmail.test", "+", "alice@nthmail.test", ""},
+		{"alice+news", "+", "alice+news", ""},
+	}
+
+	for _, test := range tests {
+		got, tag := Split(test.addr, test.separators)
+		if got != test.want || tag != test.tag {
+			t.Errorf("Split(%q, %q) = %q, %q, want %q, %q", test.addr, test.separators, got, tag, test.want, test.tag)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package address
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrMissingDomain = errors.New("the address has no domain")
+	ErrInvalidDomain = errors.New("invalid domain")
+)
+
+// NormalizeDomain returns domain lower cased and in its ASCII form, with
+// internationalized labels encoded as punycode.
+func NormalizeDomain(domain string) (string, error) {
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil || ascii == "" {
+		return "", fmt.Errorf("%w %q", ErrInvalidDomain, domain)
+	}
+
+	return strings.ToLower(ascii), nil
+}
+
+// Normalizer gives every spelling of an address the form it is stored and
+// looked up with. The domain is always normalized and the local part put in
+// Unicode NFC as RFC 6532 asks, then lower cased when FoldCase is set and
+// stripped of its dots when StripDots is set.
+type Normalizer struct {
+	FoldCase  bool
+	StripDots bool
+}
+
+// Normalize returns the normalized form of addr.
+func (normalizer Normalizer) Normalize(addr string) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return "", ErrMissingDomain
+	}
+
+	domain, err := NormalizeDomain(addr[at+1:])
+	if err != nil {
+		return "", err
+	}
+
+	local := norm.NFC.String(addr[:at])
+	if normalizer.FoldCase {
+		local = strings.ToLower(local)
+	}
+	if normalizer.StripDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+
+	return local + "@" + domain, nil
+}
@@ -0,0 +1,39 @@
+package address
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name       string
+		normalizer Normalizer
+		addr       string
+		want       string
+		err        error
+	}{
+		{name: "keep case", addr: "Alice.Smith@NthMail.Test", want: "Alice.Smith@nthmail.test"},
+		{name: "fold case", normalizer: Normalizer{FoldCase: true}, addr: "Alice.Smith@NthMail.Test", want: "alice.smith@nthmail.test"},
+		{name: "strip dots", normalizer: Normalizer{StripDots: true}, addr: "alice.smith@nthmail.test", want: "alicesmith@nthmail.test"},
+		{name: "fold case and strip dots", normalizer: Normalizer{FoldCase: true, StripDots: true}, addr: "A.l.i.c.e@nthmail.test", want: "alice@nthmail.test"},
+		{name: "composed local part", addr: "jose\u0301@nthmail.test", want: "jos\u00e9@nthmail.test"},
+		{name: "fold non-ASCII case", normalizer: Normalizer{FoldCase: true}, addr: "JOSÉ@nthmail.test", want: "josé@nthmail.test"},
+		{name: "internationalized domain", addr: "alice@Bücher.example", want: "alice@xn--bcher-kva.example"},
+		{name: "punycode domain", addr: "alice@XN--BCHER-KVA.example", want: "alice@xn--bcher-kva.example"},
+		{name: "root domain", addr: "alice@nthmail.test.", want: "alice@nthmail.test"},
+		{name: "at in the local part", addr: `"a@b"@nthmail.test`, want: `"a@b"@nthmail.test`},
+		{name: "no domain", addr: "alice", err: ErrMissingDomain},
+		{name: "empty domain", addr: "alice@", err: ErrInvalidDomain},
+		{name: "invalid domain", addr: "alice@nth_mail.test", err: ErrInvalidDomain},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.normalizer.Normalize(test.addr)
+			if got != test.want || !errors.Is(err, test.err) {
+				t.Errorf("Normalize(%q) = %q, %v, want %q, %v", test.addr, got, err, test.want, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/metrics"
+)
+
+// Keys are handed out as nthk_<id>_<secret>. The id is stored as is to find
+// the key, the secret only as a SHA-256 digest.
+const Prefix = "nthk_"
+
+const (
+	Read   = "read"
+	Write  = "write"
+	Delete = "delete"
+)
+
+// last_used_interval is how stale last_used_at may get, to save a write on
+// every request.
+const last_used_interval = time.Minute
+
+var (
+	ErrInvalidKey        = errors.New("invalid api key")
+	ErrInvalidPermission = errors.New("invalid permission")
+	ErrNotFound          = errors.New("no such api key")
+)
+
+// Key grants Permissions on the inboxes whose domain is one of Domains and
+// whose address starts with one of Prefixes. An empty list matches all.
+// Rate_limit is in requests per minute, 0 for the server default.
+type Key struct {
+	Id           string     `json:"id"`
+	Name         string     `json:"name"`
+	Domains      []string   `json:"domains"`
+	Prefixes     []string   `json:"prefixes"`
+	Permissions  []string   `json:"permissions"`
+	Rate_limit   int64      `json:"rate_limit"`
+	Created_at   time.Time  `json:"created_at"`
+	Last_used_at *time.Time `json:"last_used_at"`
+	Revoked      bool       `json:"revoked"`
+}
+
+// Allows reports whether key grants permission on rcpt_addr.
+func (key Key) Allows(rcpt_addr, permission string) bool {
+	if key.Revoked || !slices.Contains(key.Permissions, permission) {
+		return false
+	}
+
+	rcpt_addr = strings.ToLower(rcpt_addr)
+	index := strings.LastIndex(rcpt_addr, "@")
+	if index < 0 {
+		return false
+	}
+
+	if len(key.Domains) != 0 && !slices.Contains(key.Domains, rcpt_addr[index+1:]) {
+		return false
+	}
+
+	if len(key.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range key.Prefixes {
+		if strings.HasPrefix(rcpt_addr, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Store struct {
+	db *sql.DB
+}
+
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// ParseList splits a comma separated list, lower cased and without empty
+// entries.
+func ParseList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// Create stores key and returns it with its id, along with the token to
+// give to its user, which cannot be recovered later.
+func (store *Store) Create(ctx context.Context, key Key) (Key, string, error) {
+	if len(key.Permissions) == 0 {
+		return key, "", ErrInvalidPermission
+	}
+	for _, permission := range key.Permissions {
+		if permission != Read && permission != Write && permission != Delete {
+			return key, "", ErrInvalidPermission
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err == nil {
+		_, err = rand.Read(secret)
+	}
+	if err != nil {
+		return key, "", fmt.Errorf("could not generate api key: %w", err)
+	}
+
+	key.Id = hex.EncodeToString(id)
+	key.Created_at = time.Now().UTC()
+	key.Last_used_at = nil
+	key.Revoked = false
+	encoded_secret := base64.RawURLEncoding.EncodeToString(secret)
+
+	_, err = store.db.ExecContext(ctx, "INSERT INTO api_keys (id, name, secret_hash, domains, prefixes, permissions, rate_limit, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		key.Id, key.Name, hash_secret(encoded_secret), strings.Join(key.Domains, ","), strings.Join(key.Prefixes, ","), strings.Join(key.Permissions, ","), key.Rate_limit, key.Created_at.Unix())
+	if err != nil {
+		return key, "", fmt.Errorf("could not insert api key: %w", err)
+	}
+
+	return key, Prefix + key.Id + "_" + encoded_secret, nil
+}
+
+const select_keys = "SELECT id, name, domains, prefixes, permissions, rate_limit, created_at, last_used_at, revoked_at IS NOT NULL FROM api_keys"
+
+func scan_key(row interface{ Scan(...any) error }) (Key, error) {
+	var key Key
+	var domains, prefixes, permissions string
+	var created_at int64
+	var last_used_at sql.NullInt64
+	err := row.Scan(&key.Id, &key.Name, &domains, &prefixes, &permissions, &key.Rate_limit, &created_at, &last_used_at, &key.Revoked)
+	if err != nil {
+		return key, err
+	}
+
+	key.Domains = ParseList(domains)
+	key.Prefixes = ParseList(prefixes)
+	key.Permissions = ParseList(permissions)
+	key.Created_at = time.Unix(created_at, 0)
+	if last_used_at.Valid {
+		t := time.Unix(last_used_at.Int64, 0)
+		key.Last_used_at = &t
+	}
+
+	return key, nil
+}
+
+func (store *Store) List(ctx context.Context) ([]Key, error) {
+	query_start := time.Now()
+	rows, err := store.db.QueryContext(ctx, select_keys+" ORDER BY created_at, id")
+	if err != nil {
+		return nil, fmt.Errorf("could not query api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	for rows.Next() {
+		key, err := scan_key(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+
+		keys = append(keys, key)
+	}
+	metrics.DBQueryDuration.Since(query_start, "api_keys")
+
+	return keys, rows.Err()
+}
+
+func (store *Store) Revoke(ctx context.Context, id string) error {
+	result, err := store.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("could not revoke api key: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Authenticate returns the unrevoked key of token and records its use.
+func (store *Store) Authenticate(ctx context.Context, token string) (Key, error) {
+	var key Key
+
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, Prefix), "_")
+	if !ok || !strings.HasPrefix(token, Prefix) {
+		return key, ErrInvalidKey
+	}
+
+	query_start := time.Now()
+	var secret_hash string
+	row := store.db.QueryRowContext(ctx, "SELECT secret_hash FROM api_keys WHERE id = ? AND revoked_at IS NULL", id)
+	err := row.Scan(&secret_hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrInvalidKey
+	}
+	if err != nil {
+		return key, fmt.Errorf("could not query api key: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash_secret(secret)), []byte(secret_hash)) != 1 {
+		return key, ErrInvalidKey
+	}
+
+	key, err = scan_key(store.db.QueryRowContext(ctx, select_keys+" WHERE id = ?", id))
+	metrics.DBQueryDuration.Since(query_start, "api_keys")
+	if err != nil {
+		return key, fmt.Errorf("could not query api key: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if key.Last_used_at == nil || now.Sub(*key.Last_used_at) > last_used_interval {
+		_, err = store.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", now.Unix(), id)
+		if err != nil {
+			return key, fmt.Errorf("could not update api key: %w", err)
+		}
+	}
+
+	return key, nil
+}
+
+func hash_secret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,193 @@
+package blocklist
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/metrics"
+)
+
+const (
+	IP      = "ip"
+	Address = "address"
+	Domain  = "domain"
+)
+
+// refresh_interval is how long Blocked trusts its cached copy of the
+// blocklist, so entries added from the web server reach the smtp server.
+const refresh_interval = 10 * time.Second
+
+var (
+	ErrInvalidEntry = errors.New("invalid blocklist entry")
+	ErrNotFound     = errors.New("no such blocklist entry")
+)
+
+// Entry blocks mail from an IP address or network, a sender address or a
+// sender domain.
+type Entry struct {
+	Id         int
+	Kind       string
+	Value      string
+	Created_at time.Time
+}
+
+type Store struct {
+	db *sql.DB
+
+	mu        sync.Mutex
+	entries   []Entry
+	networks  []*net.IPNet
+	loaded_at time.Time
+}
+
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// normalize validates value for kind, returning its canonical form.
+func normalize(kind, value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch kind {
+	case IP:
+		// single addresses are stored as networks of one address
+		if ip := net.ParseIP(value); ip != nil {
+			if ip.To4() != nil {
+				return ip.String() + "/32", nil
+			}
+			return ip.String() + "/128", nil
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", ErrInvalidEntry
+		}
+		return network.String(), nil
+	case Address:
+		index := strings.LastIndex(value, "@")
+		if index <= 0 || index == len(value)-1 {
+			return "", ErrInvalidEntry
+		}
+		return value, nil
+	case Domain:
+		value = strings.TrimPrefix(value, "@")
+		if value == "" || strings.ContainsAny(value, "@ ") {
+			return "", ErrInvalidEntry
+		}
+		return value, nil
+	default:
+		return "", ErrInvalidEntry
+	}
+}
+
+func (store *Store) Add(ctx context.Context, kind, value string) error {
+	value, err := normalize(kind, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.db.ExecContext(ctx, "INSERT OR IGNORE INTO blocklist (kind, value, created_at) VALUES (?, ?, ?)", kind, value, time.Now().UTC().Unix())
+	if err != nil {
+		return fmt.Errorf("could not insert blocklist entry: %w", err)
+	}
+
+	store.invalidate()
+	return nil
+}
+
+func (store *Store) Remove(ctx context.Context, id int) error {
+	result, err := store.db.ExecContext(ctx, "DELETE FROM blocklist WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("could not delete blocklist entry: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	store.invalidate()
+	return nil
+}
+
+func (store *Store) List(ctx context.Context) ([]Entry, error) {
+	query_start := time.Now()
+	rows, err := store.db.QueryContext(ctx, "SELECT id, kind, value, created_at FROM blocklist ORDER BY kind, value")
+	if err != nil {
+		return nil, fmt.Errorf("could not query blocklist: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var entry Entry
+		var created_at int64
+		err = rows.Scan(&entry.Id, &entry.Kind, &entry.Value, &created_at)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+		entry.Created_at = time.Unix(created_at, 0)
+
+		entries = append(entries, entry)
+	}
+	metrics.DBQueryDuration.Since(query_start, "blocklist")
+
+	return entries, rows.Err()
+}
+
+func (store *Store) invalidate() {
+	store.mu.Lock()
+	store.loaded_at = time.Time{}
+	store.mu.Unlock()
+}
+
+// Blocked reports whether mail from ip with the envelope sender from is
+// blocked, returning the matching entry.
+func (store *Store) Blocked(ctx context.Context, ip net.IP, from string) (Entry, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if time.Since(store.loaded_at) > refresh_interval {
+		entries, err := store.List(ctx)
+		if err != nil {
+			return Entry{}, false, err
+		}
+
+		store.entries = entries
+		store.networks = make([]*net.IPNet, len(entries))
+		for i, entry := range entries {
+			if entry.Kind == IP {
+				_, store.networks[i], _ = net.ParseCIDR(entry.Value)
+			}
+		}
+		store.loaded_at = time.Now()
+	}
+
+	from = strings.ToLower(from)
+	from_domain := ""
+	if index := strings.LastIndex(from, "@"); index >= 0 {
+		from_domain = from[index+1:]
+	}
+
+	for i, entry := range store.entries {
+		switch entry.Kind {
+		case IP:
+			if ip != nil && store.networks[i] != nil && store.networks[i].Contains(ip) {
+				return entry, true, nil
+			}
+		case Address:
+			if from == entry.Value {
+				return entry, true, nil
+			}
+		case Domain:
+			if from_domain == entry.Value || strings.HasSuffix(from_domain, "."+entry.Value) {
+				return entry, true, nil
+			}
+		}
+	}
+
+	return Entry{}, false, nil
+}
@@ -0,0 +1,220 @@
+package claim
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/metrics"
+)
+
+var claim_events = metrics.NewCounter(
+	"nthmail_inbox_claims_total",
+	"Inbox claims and logins, by result.",
+	"result",
+)
+
+var (
+	ErrAlreadyClaimed     = errors.New("inbox already claimed")
+	ErrPasswordTooShort   = errors.New("password too short")
+	ErrInvalidCredentials = errors.New("invalid password or token")
+)
+
+const (
+	kind_access  = "access"
+	kind_session = "session"
+)
+
+// Store keeps the claims of inboxes. A claimed inbox can only be read with
+// one of its tokens: the access token handed out when claiming it, or a
+// session token from logging in with its password. Claims and their tokens
+// expire ttl after the inbox was claimed, after which the inbox is open
+// again.
+type Store struct {
+	db                  *sql.DB
+	ttl                 time.Duration
+	min_password_length int
+}
+
+func New(db *sql.DB, ttl time.Duration, min_password_length int) *Store {
+	return &Store{
+		db:                  db,
+		ttl:                 ttl,
+		min_password_length: min_password_length,
+	}
+}
+
+// Claimed reports whether rcpt_addr has an unexpired claim.
+func (store *Store) Claimed(ctx context.Context, rcpt_addr string) (bool, error) {
+	query_start := time.Now()
+	var claimed bool
+	err := store.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM inbox_claims WHERE rcpt_addr = ? AND expires_at > ?)", rcpt_addr, time.Now().UTC().Unix()).Scan(&claimed)
+	metrics.DBQueryDuration.Since(query_start, "inbox_claims")
+	if err != nil {
+		return false, fmt.Errorf("could not query inbox claim: %w", err)
+	}
+
+	return claimed, nil
+}
+
+// Claim claims rcpt_addr, protected by password when it is not empty, and
+// returns its access token.
+func (store *Store) Claim(ctx context.Context, rcpt_addr, password string) (string, error) {
+	if password != "" && len(password) < store.min_password_length {
+		return "", ErrPasswordTooShort
+	}
+
+	var password_hash sql.NullString
+	if password != "" {
+		hash, err := hash_password(password)
+		if err != nil {
+			return "", err
+		}
+		password_hash = sql.NullString{String: hash, Valid: true}
+	}
+
+	token, err := new_token()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("DELETE FROM inbox_claims WHERE rcpt_addr = ? AND expires_at <= ?", rcpt_addr, now.Unix())
+	if err != nil {
+		return "", fmt.Errorf("could not delete expired inbox claim: %w", err)
+	}
+	expires_at := now.Add(store.ttl).Unix()
+	result, err := tx.Exec("INSERT OR IGNORE INTO inbox_claims (rcpt_addr, password_hash, created_at, expires_at) VALUES (?, ?, ?, ?)", rcpt_addr, password_hash, now.Unix(), expires_at)
+	if err != nil {
+		return "", fmt.Errorf("could not insert inbox claim: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		claim_events.Inc("already_claimed")
+		return "", ErrAlreadyClaimed
+	}
+
+	// tokens left from an earlier claim must not open the new one
+	_, err = tx.Exec("DELETE FROM claim_tokens WHERE rcpt_addr = ?", rcpt_addr)
+	if err != nil {
+		return "", fmt.Errorf("could not delete earlier claim tokens: %w", err)
+	}
+
+	_, err = tx.Exec("INSERT INTO claim_tokens (token_hash, rcpt_addr, kind, created_at, expires_at) VALUES (?, ?, ?, ?, ?)", hash_token(token), rcpt_addr, kind_access, now.Unix(), expires_at)
+	if err != nil {
+		return "", fmt.Errorf("could not insert claim token: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", fmt.Errorf("could not commit db transaction: %w", err)
+	}
+
+	claim_events.Inc("claimed")
+	return token, nil
+}
+
+// Login checks the password of rcpt_addr and returns a new session token.
+func (store *Store) Login(ctx context.Context, rcpt_addr, password string) (string, error) {
+	now := time.Now().UTC()
+
+	var password_hash sql.NullString
+	var expires_at int64
+	err := store.db.QueryRowContext(ctx, "SELECT password_hash, expires_at FROM inbox_claims WHERE rcpt_addr = ? AND expires_at > ?", rcpt_addr, now.Unix()).Scan(&password_hash, &expires_at)
+	if errors.Is(err, sql.ErrNoRows) {
+		claim_events.Inc("login_failed")
+		return "", ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not query inbox claim: %w", err)
+	}
+
+	if !password_hash.Valid {
+		claim_events.Inc("login_failed")
+		return "", ErrInvalidCredentials
+	}
+
+	ok, err := check_password(password_hash.String, password)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		claim_events.Inc("login_failed")
+		return "", ErrInvalidCredentials
+	}
+
+	token, err := new_token()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = store.db.ExecContext(ctx, "INSERT INTO claim_tokens (token_hash, rcpt_addr, kind, created_at, expires_at) VALUES (?, ?, ?, ?, ?)", hash_token(token), rcpt_addr, kind_session, now.Unix(), expires_at)
+	if err != nil {
+		return "", fmt.Errorf("could not insert claim token: %w", err)
+	}
+
+	claim_events.Inc("login")
+	return token, nil
+}
+
+// Authorize reports whether token may read rcpt_addr. Unclaimed inboxes are
+// open to anyone.
+func (store *Store) Authorize(ctx context.Context, rcpt_addr, token string) (bool, error) {
+	claimed, err := store.Claimed(ctx, rcpt_addr)
+	if err != nil || !claimed {
+		return !claimed, err
+	}
+
+	if token == "" {
+		return false, nil
+	}
+
+	query_start := time.Now()
+	var valid bool
+	err = store.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM claim_tokens WHERE token_hash = ? AND rcpt_addr = ? AND expires_at > ?)", hash_token(token), rcpt_addr, time.Now().UTC().Unix()).Scan(&valid)
+	metrics.DBQueryDuration.Since(query_start, "claim_tokens")
+	if err != nil {
+		return false, fmt.Errorf("could not query claim token: %w", err)
+	}
+
+	return valid, nil
+}
+
+// Expire deletes expired claims and tokens.
+func (store *Store) Expire(ctx context.Context) error {
+	now := time.Now().UTC().Unix()
+
+	_, err := store.db.ExecContext(ctx, "DELETE FROM inbox_claims WHERE expires_at <= ?", now)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.db.ExecContext(ctx, "DELETE FROM claim_tokens WHERE expires_at <= ?", now)
+	return err
+}
+
+// RunExpiry calls Expire every interval until ctx is cancelled.
+func (store *Store) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := store.Expire(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("could not expire inbox claims", "err", err)
+			}
+		}
+	}
+}
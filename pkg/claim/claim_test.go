@@ -0,0 +1,153 @@
+package claim
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func new_store(t *testing.T) (*Store, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(db, time.Hour, 8), db
+}
+
+func TestClaim(t *testing.T) {
+	store, _ := new_store(t)
+	ctx := context.Background()
+
+	open, err := store.Authorize(ctx, "alice@nthmail.test", "")
+	if err != nil || !open {
+		t.Fatalf("unclaimed inbox: Authorize = %v, %v", open, err)
+	}
+
+	_, err = store.Claim(ctx, "alice@nthmail.test", "short")
+	if !errors.Is(err, ErrPasswordTooShort) {
+		t.Errorf("err = %v for a short password", err)
+	}
+
+	access, err := store.Claim(ctx, "alice@nthmail.test", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Claim(ctx, "alice@nthmail.test", "")
+	if !errors.Is(err, ErrAlreadyClaimed) {
+		t.Errorf("err = %v when claiming twice", err)
+	}
+
+	_, err = store.Login(ctx, "alice@nthmail.test", "wrong horse")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("err = %v for a wrong password", err)
+	}
+	session, err := store.Login(ctx, "alice@nthmail.test", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a claim without a password cannot be logged into
+	_, err = store.Claim(ctx, "bob@nthmail.test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Login(ctx, "bob@nthmail.test", "")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("err = %v logging into a claim without password", err)
+	}
+
+	tests := []struct {
+		name  string
+		rcpt  string
+		token string
+		want  bool
+	}{
+		{"access token", "alice@nthmail.test", access, true},
+		{"session token", "alice@nthmail.test", session, true},
+		{"no token", "alice@nthmail.test", "", false},
+		{"unknown token", "alice@nthmail.test", "not-a-token", false},
+		{"token of another inbox", "bob@nthmail.test", access, false},
+		{"unclaimed inbox", "carol@nthmail.test", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := store.Authorize(ctx, test.rcpt, test.token)
+			if err != nil || got != test.want {
+				t.Errorf("Authorize = %v, %v, want %v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	store, db := new_store(t)
+	ctx := context.Background()
+
+	token, err := store.Claim(ctx, "alice@nthmail.test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a claim and its tokens last ttl from the claim
+	var claim_expires, token_expires int64
+	err = db.QueryRow("SELECT c.expires_at, t.expires_at FROM inbox_claims c JOIN claim_tokens t USING (rcpt_addr)").Scan(&claim_expires, &token_expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour).Unix()
+	if claim_expires < until-5 || claim_expires > until || token_expires != claim_expires {
+		t.Errorf("claim expires at %d and token at %d, want %d", claim_expires, token_expires, until)
+	}
+
+	// once expired the inbox is open
+	expired := time.Now().Unix()
+	_, err = db.Exec("UPDATE inbox_claims SET expires_at = ?", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE claim_tokens SET expires_at = ?", expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open, err := store.Authorize(ctx, "alice@nthmail.test", "")
+	if err != nil || !open {
+		t.Errorf("expired claim: Authorize = %v, %v", open, err)
+	}
+
+	err = store.Expire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = db.QueryRow("SELECT (SELECT COUNT(*) FROM inbox_claims) + (SELECT COUNT(*) FROM claim_tokens)").Scan(&count)
+	if err != nil || count != 0 {
+		t.Errorf("%d claims and tokens left after Expire, %v", count, err)
+	}
+
+	_, err = store.Claim(ctx, "alice@nthmail.test", "")
+	if err != nil {
+		t.Errorf("claiming an expired inbox: %v", err)
+	}
+	valid, err := store.Authorize(ctx, "alice@nthmail.test", token)
+	if err != nil || valid {
+		t.Errorf("the token of the expired claim: Authorize = %v, %v", valid, err)
+	}
+}
@@ -0,0 +1,87 @@
+package claim
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passwords are hashed with Argon2id, with the parameters OWASP recommends,
+// and stored in the PHC string format
+//
+//	$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+//
+// Tokens are random, so a plain SHA-256 of them is enough.
+
+const (
+	argon2_time    = 2
+	argon2_memory  = 19 * 1024
+	argon2_threads = 1
+	salt_length    = 16
+	key_length     = 32
+	token_length   = 32
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+func hash_password(password string) (string, error) {
+	salt := make([]byte, salt_length)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("could not generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2_time, argon2_memory, argon2_threads, key_length)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2_memory, argon2_time, argon2_threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func check_password(encoded, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, errInvalidHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil || memory == 0 || time == 0 || threads == 0 {
+		return false, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(expected) == 0 {
+		return false, errInvalidHash
+	}
+
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+func new_token() (string, error) {
+	b := make([]byte, token_length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("could not generate token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash_token(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
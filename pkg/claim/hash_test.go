@@ -0,0 +1,88 @@
+package claim
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var argon2id_format = regexp.MustCompile(`^\$argon2id\$v=19\$m=19456,t=2,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`)
+
+func TestHashPassword(t *testing.T) {
+	first, err := hash_password("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := hash_password("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !argon2id_format.MatchString(first) {
+		t.Errorf("hash %q is not an argon2id PHC string", first)
+	}
+	if first == second {
+		t.Error("two hashes of a password share their salt")
+	}
+
+	for _, encoded := range []string{first, second} {
+		ok, err := check_password(encoded, "correct horse")
+		if err != nil || !ok {
+			t.Errorf("check_password(%q) = %v, %v", encoded, ok, err)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	// an argon2id hash with other parameters than the ones hash_password uses
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("password"), salt, 1, 64, 2, 16)
+	argon2id := fmt.Sprintf("$argon2id$v=19$m=64,t=1,p=2$%s$%s", base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	tests := []struct {
+		name     string
+		encoded  string
+		password string
+		want     bool
+		err      error
+	}{
+		{name: "argon2id", encoded: argon2id, password: "password", want: true},
+		{name: "argon2id wrong password", encoded: argon2id, password: "Password"},
+		{name: "argon2i", encoded: "$argon2i$v=19$m=64,t=1,p=2$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", err: errInvalidHash},
+		{name: "other version", encoded: "$argon2id$v=16$m=64,t=1,p=2$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", err: errInvalidHash},
+		{name: "zero memory", encoded: "$argon2id$v=19$m=0,t=1,p=2$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", err: errInvalidHash},
+		{name: "bad parameters", encoded: "$argon2id$v=19$t=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", err: errInvalidHash},
+		{name: "bad salt", encoded: "$argon2id$v=19$m=64,t=1,p=2$!!$AAAA", err: errInvalidHash},
+		{name: "empty key", encoded: "$argon2id$v=19$m=64,t=1,p=2$MDEyMzQ1Njc4OWFiY2RlZg$", err: errInvalidHash},
+		{name: "unknown scheme", encoded: "bcrypt$x", err: errInvalidHash},
+		{name: "empty", encoded: "", err: errInvalidHash},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := check_password(test.encoded, test.password)
+			if got != test.want || !errors.Is(err, test.err) {
+				t.Errorf("got %v, %v, want %v, %v", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	token, err := new_token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 43 {
+		t.Errorf("token %q is not 32 bytes in base64", token)
+	}
+
+	// SHA-256 of "abc", FIPS 180-2
+	if got := hash_token("abc"); got != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("hash_token(abc) = %s", got)
+	}
+}
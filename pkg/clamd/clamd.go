@@ -0,0 +1,179 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Client talks to a clamd daemon (or anything speaking its protocol) over
+// tcp or a unix socket.
+type Client struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// ParseAddress splits "tcp://host:port" or "unix:///path/to/clamd.sock"
+// into a network and address for net.Dial.
+func ParseAddress(addr string) (string, string, error) {
+	network, address, found := strings.Cut(addr, "://")
+	if !found || address == "" {
+		return "", "", fmt.Errorf("clamd address %q must look like tcp://host:port or unix:///path", addr)
+	}
+
+	if network != "tcp" && network != "unix" {
+		return "", "", fmt.Errorf("clamd address %q: unsupported network %s", addr, network)
+	}
+
+	return network, address, nil
+}
+
+// New returns a client for addr, see ParseAddress.
+func New(addr string, timeout time.Duration) (*Client, error) {
+	network, address, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{Network: network, Address: address, Timeout: timeout}, nil
+}
+
+type Verdict struct {
+	Infected bool
+	// name of the signature that matched, empty when clean
+	Signature string
+}
+
+func (v Verdict) String() string {
+	if v.Infected {
+		return v.Signature
+	}
+
+	return "clean"
+}
+
+// chunk_size must stay below clamd's StreamMaxLength of a single chunk.
+const chunk_size = 64 * 1024
+
+func (c Client) dial(ctx context.Context) (net.Conn, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to clamd: %w", err)
+	}
+
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	return conn, nil
+}
+
+// Scan streams r to clamd with the INSTREAM command and returns its verdict.
+func (c Client) Scan(ctx context.Context, r io.Reader) (Verdict, error) {
+	var verdict Verdict
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return verdict, err
+	}
+	defer conn.Close()
+
+	writer := bufio.NewWriter(conn)
+	writer.WriteString("zINSTREAM\x00")
+
+	buf := make([]byte, chunk_size)
+	size := make([]byte, 4)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			writer.Write(size)
+			writer.Write(buf[:n])
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return verdict, fmt.Errorf("could not read message: %w", err)
+		}
+	}
+
+	// a zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	writer.Write(size)
+
+	err = writer.Flush()
+	if err != nil {
+		return verdict, fmt.Errorf("could not send message to clamd: %w", err)
+	}
+
+	reply, err := read_reply(conn)
+	if err != nil {
+		return verdict, err
+	}
+
+	// "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR"
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return verdict, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		verdict.Infected = true
+		verdict.Signature = strings.TrimSuffix(reply, " FOUND")
+		return verdict, nil
+	default:
+		return verdict, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// Ping checks that clamd answers the PING command.
+func (c Client) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("zPING\x00"))
+	if err != nil {
+		return fmt.Errorf("could not send ping to clamd: %w", err)
+	}
+
+	reply, err := read_reply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply to ping: %s", reply)
+	}
+
+	return nil
+}
+
+// read_reply reads a null terminated reply, as sent for z-prefixed commands.
+func read_reply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && !(errors.Is(err, io.EOF) && len(reply) > 0) {
+		return "", fmt.Errorf("could not read clamd reply: %w", err)
+	}
+
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
@@ -0,0 +1,204 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fake_clamd answers the z-prefixed PING and INSTREAM commands on l. A
+// stream holding "EICAR" is infected, one holding "BROKEN" gets an error and
+// one holding "HANG" gets no reply. Every stream is sent on streams.
+func fake_clamd(t *testing.T, l net.Listener) <-chan []byte {
+	t.Helper()
+	t.Cleanup(func() { l.Close() })
+
+	streams := make(chan []byte, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString(0)
+				if err != nil {
+					return
+				}
+
+				switch command {
+				case "zPING\x00":
+					conn.Write([]byte("PONG\x00"))
+
+				case "zINSTREAM\x00":
+					var stream []byte
+					size := make([]byte, 4)
+					for {
+						_, err = io.ReadFull(reader, size)
+						if err != nil {
+							return
+						}
+						n := binary.BigEndian.Uint32(size)
+						if n == 0 {
+							break
+						}
+						if n > chunk_size {
+							conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+							return
+						}
+
+						chunk := make([]byte, n)
+						_, err = io.ReadFull(reader, chunk)
+						if err != nil {
+							return
+						}
+						stream = append(stream, chunk...)
+					}
+					streams <- stream
+
+					switch {
+					case bytes.Contains(stream, []byte("EICAR")):
+						conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+					case bytes.Contains(stream, []byte("BROKEN")):
+						conn.Write([]byte("stream: Can't allocate memory ERROR\x00"))
+					case bytes.Contains(stream, []byte("HANG")):
+						time.Sleep(time.Second)
+					default:
+						conn.Write([]byte("stream: OK\x00"))
+					}
+
+				default:
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				}
+			}()
+		}
+	}()
+
+	return streams
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+		err     string
+	}{
+		{addr: "tcp://127.0.0.1:3310", network: "tcp", address: "127.0.0.1:3310"},
+		{addr: "unix:///run/clamd.sock", network: "unix", address: "/run/clamd.sock"},
+		{addr: "127.0.0.1:3310", err: "must look like"},
+		{addr: "tcp://", err: "must look like"},
+		{addr: "udp://127.0.0.1:3310", err: "unsupported network udp"},
+	}
+
+	for _, test := range tests {
+		network, address, err := ParseAddress(test.addr)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ParseAddress(%q) err = %v, want %s", test.addr, err, test.err)
+			}
+			continue
+		}
+		if err != nil || network != test.network || address != test.address {
+			t.Errorf("ParseAddress(%q) = %s, %s, %v", test.addr, network, address, err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "clamd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type fake struct {
+		client  *Client
+		streams <-chan []byte
+	}
+	clients := make(map[string]fake)
+	for _, l := range []net.Listener{tcp, unix} {
+		streams := fake_clamd(t, l)
+		client, err := New(l.Addr().Network()+"://"+l.Addr().String(), 200*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[l.Addr().Network()] = fake{client, streams}
+	}
+
+	tests := []struct {
+		name    string
+		message []byte
+		want    Verdict
+		err     string
+	}{
+		{name: "clean", message: []byte("Subject: hi\r\n\r\nhello\r\n"), want: Verdict{}},
+		{name: "empty", message: nil, want: Verdict{}},
+		{name: "infected", message: []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR"), want: Verdict{Infected: true, Signature: "Eicar-Signature"}},
+		{name: "several chunks", message: bytes.Repeat([]byte("0123456789abcdef"), 3*chunk_size/16+5), want: Verdict{}},
+		{name: "error", message: []byte("BROKEN"), err: "clamd: Can't allocate memory ERROR"},
+		{name: "timeout", message: []byte("HANG"), err: "could not read clamd reply"},
+	}
+
+	for network, c := range clients {
+		for _, test := range tests {
+			t.Run(network+"/"+test.name, func(t *testing.T) {
+				got, err := c.client.Scan(context.Background(), bytes.NewReader(test.message))
+				if test.err != "" {
+					if err == nil || !strings.Contains(err.Error(), test.err) {
+						t.Errorf("err = %v, want %s", err, test.err)
+					}
+				} else if err != nil || got != test.want {
+					t.Errorf("got %v, %v, want %v", got, err, test.want)
+				}
+
+				if stream := <-c.streams; !bytes.Equal(stream, test.message) {
+					t.Errorf("clamd got %d bytes, want %d", len(stream), len(test.message))
+				}
+			})
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake_clamd(t, l)
+
+	client := Client{Network: "tcp", Address: l.Addr().String(), Timeout: time.Second}
+	err = client.Ping(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	l.Close()
+	err = client.Ping(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "could not connect to clamd") {
+		t.Errorf("err = %v after clamd went away", err)
+	}
+}
+
+func TestVerdictString(t *testing.T) {
+	if got := (Verdict{}).String(); got != "clean" {
+		t.Errorf("clean verdict = %q", got)
+	}
+	if got := (Verdict{Infected: true, Signature: "Eicar-Signature"}).String(); got != "Eicar-Signature" {
+		t.Errorf("infected verdict = %q", got)
+	}
+}
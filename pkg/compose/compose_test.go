@@ -0,0 +1,230 @@
+package compose
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"mime"
+	"net/mail"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	"github.com/GRFreire/nthmail/pkg/relay"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// new_sender returns a sender for nthmail.test, allowing 2 mails an hour to
+// 2 recipients, along with its database. The relay queue is not run.
+func new_sender(t *testing.T) (*Sender, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := relay.NewQueue(db, relay.Client{}, time.Minute, time.Hour)
+	reserved := address.NewReserved([]string{"postmaster"}, nil)
+
+	return New(db, queue, "nthmail.test", reserved, 2, 10, 2, 100), db
+}
+
+func TestBuildHeaderInjection(t *testing.T) {
+	msg := Message{
+		From:        "bob@nthmail.test",
+		To:          []string{"alice@example.com"},
+		Subject:     "hi\r\nBcc: eve@example.net",
+		In_reply_to: "<1@example.com>\r\nBcc: eve@example.net",
+		References:  "<0@example.com>\n<1@example.com>\rBcc: eve@example.net",
+		Text:        "hello\r\n\r\nBcc: eve@example.net\r\n",
+	}
+
+	data, err := msg.Build("nthmail.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := m.Header["Bcc"]; exists {
+		t.Errorf("Bcc header injected:\n%s", data)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header, got, want string
+	}{
+		{"Subject", subject, "hi Bcc: eve@example.net"},
+		{"In-Reply-To", m.Header.Get("In-Reply-To"), "<1@example.com> Bcc: eve@example.net"},
+		{"References", m.Header.Get("References"), "<0@example.com> <1@example.com> Bcc: eve@example.net"},
+		{"To", m.Header.Get("To"), "<alice@example.com>"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %q, want %q", test.header, test.got, test.want)
+		}
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"alice@example.com", []string{"alice@example.com"}},
+		{"Alice <alice@example.com>, carol@example.org", []string{"alice@example.com", "carol@example.org"}},
+		{"", nil},
+		{"alice", nil},
+		{"alice@example.com\r\nBcc: eve@example.net", nil},
+		{"alice@example.com\nRCPT TO:<eve@example.net>", nil},
+	}
+
+	for _, test := range tests {
+		to, err := ParseRecipients(test.s)
+		if !slices.Equal(to, test.want) {
+			t.Errorf("ParseRecipients(%q) = %q, want %q", test.s, to, test.want)
+		}
+		if test.want == nil && !errors.Is(err, ErrInvalidRecipient) {
+			t.Errorf("ParseRecipients(%q) = %v, want %v", test.s, err, ErrInvalidRecipient)
+		}
+	}
+}
+
+func TestSendRefused(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcpt_addr string
+		to        []string
+		text      string
+		want      error
+	}{
+		{name: "other domain", rcpt_addr: "bob@example.com", to: []string{"alice@example.com"}, want: ErrInvalidSender},
+		{name: "reserved", rcpt_addr: "Post.Master@nthmail.test", to: []string{"alice@example.com"}, want: ErrReservedSender},
+		{name: "no recipient", rcpt_addr: "bob@nthmail.test", want: ErrInvalidRecipient},
+		{name: "too many recipients", rcpt_addr: "bob@nthmail.test", to: []string{"a@example.com", "b@example.com", "c@example.com"}, want: ErrTooManyRecipients},
+		{name: "body too large", rcpt_addr: "bob@nthmail.test", to: []string{"alice@example.com"}, text: strings.Repeat("a", 101), want: ErrBodyTooLarge},
+		{name: "line break in recipient", rcpt_addr: "bob@nthmail.test", to: []string{"alice@example.com\r\nBcc: eve@example.net"}, want: ErrInvalidRecipient},
+		{name: "quoted line break in recipient", rcpt_addr: "bob@nthmail.test", to: []string{"\"a\r\nb\"@example.com"}, want: ErrInvalidRecipient},
+		{name: "recipient with a name", rcpt_addr: "bob@nthmail.test", to: []string{"Alice <alice@example.com>"}, want: ErrInvalidRecipient},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender, db := new_sender(t)
+
+			err := sender.Send(context.Background(), test.rcpt_addr, Message{To: test.to, Subject: "hi", Text: test.text})
+			if !errors.Is(err, test.want) {
+				t.Fatalf("Send() = %v, want %v", err, test.want)
+			}
+
+			var sent, queued int
+			err = db.QueryRow("SELECT (SELECT COUNT(*) FROM sent_mails), (SELECT COUNT(*) FROM outbound_queue)").Scan(&sent, &queued)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sent != 0 || queued != 0 {
+				t.Errorf("%d mails recorded and %d queued, want none", sent, queued)
+			}
+		})
+	}
+}
+
+func TestSent(t *testing.T) {
+	ctx := context.Background()
+	sender, db := new_sender(t)
+
+	msg := Message{To: []string{"alice@example.com", "carol@example.org"}, Subject: "Lunch\r\ntomorrow", Text: "See you at noon."}
+	err := sender.Send(ctx, "bob@nthmail.test", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mails, err := sender.Sent(ctx, "bob@nthmail.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 {
+		t.Fatalf("%d sent mails, want 1", len(mails))
+	}
+	m := mails[0]
+	if m.From != "bob@nthmail.test" || !slices.Equal(m.To, msg.To) || m.Subject != "Lunch tomorrow" || m.Text != msg.Text {
+		t.Errorf("Sent() = %+v", m)
+	}
+	if time.Since(m.Sent_at) > time.Minute {
+		t.Errorf("sent at %s, want now", m.Sent_at)
+	}
+
+	// not listed in other inboxes
+	others, err := sender.Sent(ctx, "alice@nthmail.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(others) != 0 {
+		t.Errorf("%d sent mails of another inbox, want 0", len(others))
+	}
+
+	// one queued copy per recipient, of the recorded message
+	rows, err := db.Query("SELECT mail_from, rcpt_to, data FROM outbound_queue ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var data []byte
+	err = db.QueryRow("SELECT data FROM sent_mails").Scan(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rcpts []string
+	for rows.Next() {
+		var from, rcpt string
+		var queued []byte
+		err = rows.Scan(&from, &rcpt, &queued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != "bob@nthmail.test" || !bytes.Equal(queued, data) {
+			t.Errorf("queued from %s, with the recorded message %t", from, bytes.Equal(queued, data))
+		}
+		rcpts = append(rcpts, rcpt)
+	}
+	if !slices.Equal(rcpts, msg.To) {
+		t.Errorf("queued to %q, want %q", rcpts, msg.To)
+	}
+}
+
+func TestSendQuota(t *testing.T) {
+	ctx := context.Background()
+	sender, _ := new_sender(t)
+
+	for i, want := range []error{nil, nil, ErrQuotaExceeded} {
+		err := sender.Send(ctx, "bob@nthmail.test", Message{To: []string{"alice@example.com"}, Text: "hi"})
+		if !errors.Is(err, want) {
+			t.Errorf("send %d = %v, want %v", i+1, err, want)
+		}
+	}
+
+	// the quota is per inbox
+	err := sender.Send(ctx, "carol@nthmail.test", Message{To: []string{"alice@example.com"}, Text: "hi"})
+	if err != nil {
+		t.Errorf("send from another inbox = %v", err)
+	}
+}
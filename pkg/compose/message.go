@@ -0,0 +1,108 @@
+package compose
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+)
+
+// Message is a mail written in the web UI. Text is markdown, sent as is in
+// the text/plain part and rendered in the text/html one.
+type Message struct {
+	From        string
+	To          []string
+	Subject     string
+	In_reply_to string
+	References  string
+	Text        string
+}
+
+var html_policy = bluemonday.UGCPolicy()
+
+// Build renders msg as a multipart/alternative MIME message, with a
+// Message-Id at domain.
+func (msg Message) Build(domain string) ([]byte, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate message id: %w", err)
+	}
+
+	to := make([]string, len(msg.To))
+	for i, addr := range msg.To {
+		to[i] = (&mail.Address{Address: addr}).String()
+	}
+
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+
+	fmt.Fprintf(&b, "From: %s\r\n", (&mail.Address{Address: msg.From}).String())
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", header_value(msg.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	if msg.In_reply_to != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", header_value(msg.In_reply_to))
+	}
+	if msg.References != "" {
+		fmt.Fprintf(&b, "References: %s\r\n", header_value(msg.References))
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n", writer.Boundary())
+	b.WriteString("\r\n")
+
+	text := strings.ReplaceAll(msg.Text, "\r\n", "\n")
+	html := html_policy.SanitizeBytes(blackfriday.Run([]byte(text)))
+
+	err = write_part(writer, "text/plain; charset=utf-8", []byte(text))
+	if err != nil {
+		return nil, err
+	}
+
+	err = write_part(writer, "text/html; charset=utf-8", html)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func write_part(writer *multipart.Writer, content_type string, data []byte) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", content_type)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+	_, err = qp.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
+
+// header_value strips line breaks, which would let a user inject headers.
+func header_value(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
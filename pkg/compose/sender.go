@@ -0,0 +1,193 @@
+package compose
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/GRFreire/nthmail/pkg/relay"
+)
+
+var sent_messages = metrics.NewCounter(
+	"nthmail_sent_messages_total",
+	"Mails sent from inboxes through the web UI, or refused, by result.",
+	"result",
+)
+
+var (
+	ErrInvalidSender     = errors.New("mail can only be sent from an inbox of this domain")
+	ErrReservedSender    = errors.New("mail cannot be sent from a reserved address")
+	ErrInvalidRecipient  = errors.New("invalid recipient address")
+	ErrTooManyRecipients = errors.New("too many recipients")
+	ErrBodyTooLarge      = errors.New("message too large")
+	ErrQuotaExceeded     = errors.New("send quota exceeded")
+)
+
+// Sent_mail is a copy of a mail sent from an inbox.
+type Sent_mail struct {
+	Id      int
+	Sent_at time.Time
+	From    string
+	To      []string
+	Subject string
+	Text    string
+}
+
+// Sender queues mail written in the web UI on the relay queue, keeping a
+// copy of each and refusing inboxes over their hourly or daily quota.
+type Sender struct {
+	db             *sql.DB
+	queue          *relay.Queue
+	domain         string
+	per_hour       int
+	per_day        int
+	max_recipients int
+	max_body_bytes int64
+	// names like postmaster or abuse that nobody may send as
+	reserved *address.Reserved
+}
+
+func New(db *sql.DB, queue *relay.Queue, domain string, reserved *address.Reserved, per_hour, per_day, max_recipients int, max_body_bytes int64) *Sender {
+	return &Sender{
+		db:             db,
+		queue:          queue,
+		domain:         domain,
+		reserved:       reserved,
+		per_hour:       per_hour,
+		per_day:        per_day,
+		max_recipients: max_recipients,
+		max_body_bytes: max_body_bytes,
+	}
+}
+
+// ParseRecipients parses a comma separated list of addresses.
+func ParseRecipients(s string) ([]string, error) {
+	addrs, err := mail.ParseAddressList(s)
+	if err != nil || len(addrs) == 0 {
+		return nil, ErrInvalidRecipient
+	}
+
+	to := make([]string, len(addrs))
+	for i, addr := range addrs {
+		to[i] = addr.Address
+	}
+
+	return to, nil
+}
+
+// Send queues msg from rcpt_addr to every address of msg.To.
+func (sender *Sender) Send(ctx context.Context, rcpt_addr string, msg Message) error {
+	err := sender.send(ctx, rcpt_addr, msg)
+	switch {
+	case err == nil:
+		sent_messages.Inc("sent")
+	case errors.Is(err, ErrQuotaExceeded):
+		sent_messages.Inc("quota")
+	case errors.Is(err, ErrInvalidSender), errors.Is(err, ErrReservedSender), errors.Is(err, ErrInvalidRecipient),
+		errors.Is(err, ErrTooManyRecipients), errors.Is(err, ErrBodyTooLarge):
+		sent_messages.Inc("invalid")
+	default:
+		sent_messages.Inc("error")
+	}
+
+	return err
+}
+
+func (sender *Sender) send(ctx context.Context, rcpt_addr string, msg Message) error {
+	index := strings.LastIndex(rcpt_addr, "@")
+	if index <= 0 || !strings.EqualFold(rcpt_addr[index+1:], sender.domain) {
+		return ErrInvalidSender
+	}
+	if sender.reserved.Is(rcpt_addr[:index], sender.domain) {
+		return ErrReservedSender
+	}
+	msg.From = rcpt_addr
+
+	if len(msg.To) == 0 {
+		return ErrInvalidRecipient
+	}
+	if len(msg.To) > sender.max_recipients {
+		return ErrTooManyRecipients
+	}
+	// bare addresses only, a line break would inject headers or smtp
+	// commands
+	for _, to := range msg.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil || addr.Address != to {
+			return ErrInvalidRecipient
+		}
+	}
+	if int64(len(msg.Text)) > sender.max_body_bytes {
+		return ErrBodyTooLarge
+	}
+
+	data, err := msg.Build(sender.domain)
+	if err != nil {
+		return err
+	}
+
+	// the quota is checked in the insert itself so concurrent requests
+	// cannot both slip under it
+	now := time.Now().UTC()
+	query_start := time.Now()
+	result, err := sender.db.ExecContext(ctx, `INSERT INTO sent_mails (sent_at, from_addr, to_addrs, subject, body, data)
+		SELECT ?, ?, ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM sent_mails WHERE from_addr = ? AND sent_at >= ?) < ?
+		AND (SELECT COUNT(*) FROM sent_mails WHERE from_addr = ? AND sent_at >= ?) < ?`,
+		now.Unix(), rcpt_addr, strings.Join(msg.To, ","), header_value(msg.Subject), msg.Text, data,
+		rcpt_addr, now.Add(-time.Hour).Unix(), sender.per_hour,
+		rcpt_addr, now.Add(-24*time.Hour).Unix(), sender.per_day,
+	)
+	metrics.DBQueryDuration.Since(query_start, "sent_mails_insert")
+	if err != nil {
+		return fmt.Errorf("could not insert sent mail: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrQuotaExceeded
+	}
+
+	for _, to := range msg.To {
+		err = sender.queue.Enqueue(ctx, rcpt_addr, to, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	logging.FromContext(ctx).Info("queued sent mail", "from", rcpt_addr, "rcpts", len(msg.To))
+	return nil
+}
+
+// Sent lists the mails sent from rcpt_addr, newest first.
+func (sender *Sender) Sent(ctx context.Context, rcpt_addr string) ([]Sent_mail, error) {
+	query_start := time.Now()
+	rows, err := sender.db.QueryContext(ctx, "SELECT id, sent_at, from_addr, to_addrs, subject, body FROM sent_mails WHERE from_addr = ? ORDER BY sent_at DESC, id DESC", rcpt_addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not query sent mails: %w", err)
+	}
+	defer rows.Close()
+
+	var mails []Sent_mail
+	for rows.Next() {
+		var m Sent_mail
+		var sent_at int64
+		var to string
+		err = rows.Scan(&m.Id, &sent_at, &m.From, &to, &m.Subject, &m.Text)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+		m.Sent_at = time.Unix(sent_at, 0)
+		m.To = strings.Split(to, ",")
+
+		mails = append(mails, m)
+	}
+	metrics.DBQueryDuration.Since(query_start, "sent_mails")
+
+	return mails, rows.Err()
+}
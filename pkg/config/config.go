@@ -0,0 +1,933 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/clamd"
+	"github.com/GRFreire/nthmail/pkg/ratelimit"
+	"github.com/GRFreire/nthmail/pkg/rig"
+)
+
+// Config holds every setting of the server. Values are resolved in order:
+// built-in defaults, the config file, environment variables and finally
+// command-line flags, each one overriding the previous.
+//
+// Every leaf field is addressed by its dotted toml path (e.g. "mail.port"),
+// which is also the name of its command-line flag.
+type Config struct {
+	DB        DB        `toml:"db"`
+	Mail      Mail      `toml:"mail"`
+	Web       Web       `toml:"web"`
+	Metrics   Metrics   `toml:"metrics"`
+	Log       Log       `toml:"log"`
+	Relay     Relay     `toml:"relay"`
+	Forward   Forward   `toml:"forward"`
+	Send      Send      `toml:"send"`
+	Claim     Claim     `toml:"claim"`
+	API       API       `toml:"api"`
+	Admin     Admin     `toml:"admin"`
+	Inbox     Inbox     `toml:"inbox"`
+	Signature Signature `toml:"signature"`
+}
+
+type DB struct {
+	Path string `toml:"path" env:"DB_PATH" help:"path to the sqlite database"`
+}
+
+type Mail struct {
+	Domain               string        `toml:"domain" env:"MAIL_SERVER_DOMAIN" help:"domain the mail server accepts mail for"`
+	Port                 int           `toml:"port" env:"MAIL_SERVER_PORT" help:"port the smtp server listens on"`
+	ReadTimeout          time.Duration `toml:"read_timeout" env:"MAIL_SERVER_READ_TIMEOUT" help:"smtp connection read timeout"`
+	WriteTimeout         time.Duration `toml:"write_timeout" env:"MAIL_SERVER_WRITE_TIMEOUT" help:"smtp connection write timeout"`
+	MaxMessageBytes      int64         `toml:"max_message_bytes" env:"MAIL_SERVER_MAX_MESSAGE_BYTES" help:"maximum size of an accepted message"`
+	MaxRecipients        int           `toml:"max_recipients" env:"MAIL_SERVER_MAX_RECIPIENTS" help:"maximum recipients per message"`
+	AllowInsecureAuth    bool          `toml:"allow_insecure_auth" env:"MAIL_SERVER_ALLOW_INSECURE_AUTH" help:"allow AUTH without TLS"`
+	ShutdownTimeout      time.Duration `toml:"shutdown_timeout" env:"MAIL_SERVER_SHUTDOWN_TIMEOUT" help:"how long to wait for smtp sessions on shutdown"`
+	SubaddressSeparators string        `toml:"subaddress_separators" env:"MAIL_SERVER_SUBADDRESS_SEPARATORS" help:"characters separating an inbox name from a tag, empty disables sub-addressing"`
+	FoldLocalCase        bool          `toml:"fold_local_case" env:"MAIL_SERVER_FOLD_LOCAL_CASE" help:"treat the names of inboxes case insensitively"`
+	StripLocalDots       bool          `toml:"strip_local_dots" env:"MAIL_SERVER_STRIP_LOCAL_DOTS" help:"ignore the dots in the names of inboxes"`
+
+	Auth      MailAuth      `toml:"auth"`
+	RateLimit MailRateLimit `toml:"ratelimit"`
+	Greylist  MailGreylist  `toml:"greylist"`
+	Spam      MailSpam      `toml:"spam"`
+	Antivirus MailAntivirus `toml:"antivirus"`
+}
+
+type MailAuth struct {
+	Enabled   bool          `toml:"enabled" env:"MAIL_AUTH_ENABLED" help:"verify SPF, DKIM and DMARC of incoming mail"`
+	DNSServer string        `toml:"dns_server" env:"MAIL_AUTH_DNS_SERVER" help:"host:port of the DNS server used for verification, empty uses the system resolver"`
+	Timeout   time.Duration `toml:"timeout" env:"MAIL_AUTH_TIMEOUT" help:"time limit for verifying a message"`
+}
+
+type Web struct {
+	Port            int           `toml:"port" env:"WEB_SERVER_PORT" help:"port the web server listens on"`
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" env:"WEB_SERVER_SHUTDOWN_TIMEOUT" help:"how long to wait for http requests on shutdown"`
+	BaseURL         string        `toml:"base_url" env:"WEB_SERVER_BASE_URL" help:"public url of the web server, used in links sent by mail"`
+}
+
+type Metrics struct {
+	Enabled bool   `toml:"enabled" env:"METRICS_ENABLED" help:"expose prometheus metrics at /metrics"`
+	Host    string `toml:"host" env:"METRICS_HOST" help:"address the separate metrics server listens on"`
+	Port    int    `toml:"port" env:"METRICS_PORT" help:"port of a separate metrics server, 0 serves them on the web port behind admin.token"`
+}
+
+type Log struct {
+	Level  string `toml:"level" env:"LOG_LEVEL" help:"minimum log level: debug, info, warn or error"`
+	Format string `toml:"format" env:"LOG_FORMAT" help:"log output format: text or json"`
+}
+
+// MailRateLimit limits are per minute, 0 disables a limit.
+type MailRateLimit struct {
+	ConnectionsPerMinute   int64    `toml:"connections_per_minute" env:"MAIL_RATELIMIT_CONNECTIONS_PER_MINUTE" help:"smtp sessions per client ip per minute"`
+	MessagesPerMinute      int64    `toml:"messages_per_minute" env:"MAIL_RATELIMIT_MESSAGES_PER_MINUTE" help:"messages per client ip per minute"`
+	InboxMessagesPerMinute int64    `toml:"inbox_messages_per_minute" env:"MAIL_RATELIMIT_INBOX_MESSAGES_PER_MINUTE" help:"messages per recipient inbox per minute"`
+	BytesPerMinute         int64    `toml:"bytes_per_minute" env:"MAIL_RATELIMIT_BYTES_PER_MINUTE" help:"message bytes per client ip per minute"`
+	Allowlist              []string `toml:"allowlist" env:"MAIL_RATELIMIT_ALLOWLIST" help:"comma separated CIDRs exempt from rate limits"`
+}
+
+type MailGreylist struct {
+	Enabled       bool          `toml:"enabled" env:"MAIL_GREYLIST_ENABLED" help:"temp-fail the first delivery from an unseen (client /24, sender, recipient) triplet"`
+	Delay         time.Duration `toml:"delay" env:"MAIL_GREYLIST_DELAY" help:"how long a sender must wait before retrying"`
+	RetryWindow   time.Duration `toml:"retry_window" env:"MAIL_GREYLIST_RETRY_WINDOW" help:"how long a greylisted triplet waits for a retry before it is forgotten"`
+	WhitelistTTL  time.Duration `toml:"whitelist_ttl" env:"MAIL_GREYLIST_WHITELIST_TTL" help:"how long senders that retried are exempt from greylisting"`
+	BypassDomains []string      `toml:"bypass_domains" env:"MAIL_GREYLIST_BYPASS_DOMAINS" help:"comma separated sender or recipient domains that are never greylisted"`
+}
+
+type MailSpam struct {
+	Enabled     bool          `toml:"enabled" env:"MAIL_SPAM_ENABLED" help:"score incoming mail for spam"`
+	TagScore    float64       `toml:"tag_score" env:"MAIL_SPAM_TAG_SCORE" help:"score from which mail is tagged as spam, 0 never tags"`
+	RejectScore float64       `toml:"reject_score" env:"MAIL_SPAM_REJECT_SCORE" help:"score from which mail is rejected, 0 never rejects"`
+	DNSBLs      []string      `toml:"dnsbls" env:"MAIL_SPAM_DNSBLS" help:"comma separated DNSBL zones the client ip is looked up in"`
+	URLPatterns []string      `toml:"url_patterns" env:"MAIL_SPAM_URL_PATTERNS" help:"comma separated regular expressions of suspicious links"`
+	Timeout     time.Duration `toml:"timeout" env:"MAIL_SPAM_TIMEOUT" help:"time limit for scoring a message"`
+}
+
+type MailAntivirus struct {
+	Enabled  bool          `toml:"enabled" env:"MAIL_ANTIVIRUS_ENABLED" help:"scan incoming mail with clamd"`
+	Address  string        `toml:"address" env:"MAIL_ANTIVIRUS_ADDRESS" help:"clamd address, tcp://host:port or unix:///path/to/clamd.sock"`
+	Action   string        `toml:"action" env:"MAIL_ANTIVIRUS_ACTION" help:"what to do with infected mail: reject or quarantine"`
+	FailOpen bool          `toml:"fail_open" env:"MAIL_ANTIVIRUS_FAIL_OPEN" help:"accept mail unscanned when clamd is unavailable instead of deferring it"`
+	Timeout  time.Duration `toml:"timeout" env:"MAIL_ANTIVIRUS_TIMEOUT" help:"time limit for scanning a message"`
+}
+
+type Relay struct {
+	Host          string        `toml:"host" env:"RELAY_HOST" help:"host:port of the smarthost outbound mail is sent through, empty disables outbound mail"`
+	Username      string        `toml:"username" env:"RELAY_USERNAME" help:"smarthost AUTH PLAIN username, empty skips authentication"`
+	Password      string        `toml:"password" env:"RELAY_PASSWORD" help:"smarthost AUTH PLAIN password" secret:"true"`
+	TLS           string        `toml:"tls" env:"RELAY_TLS" help:"how to secure the smarthost connection: starttls, tls or none"`
+	HeloName      string        `toml:"helo_name" env:"RELAY_HELO_NAME" help:"name sent in EHLO, empty uses mail.domain"`
+	Timeout       time.Duration `toml:"timeout" env:"RELAY_TIMEOUT" help:"time limit for each smarthost command"`
+	RetryInterval time.Duration `toml:"retry_interval" env:"RELAY_RETRY_INTERVAL" help:"delay before the first retry of a deferred message, doubled on every attempt"`
+	MaxAge        time.Duration `toml:"max_age" env:"RELAY_MAX_AGE" help:"how long a deferred message is retried before it is given up"`
+}
+
+type Forward struct {
+	Enabled         bool          `toml:"enabled" env:"FORWARD_ENABLED" help:"let inboxes forward mail to a confirmed address, requires relay.host"`
+	SRSSecret       string        `toml:"srs_secret" env:"FORWARD_SRS_SECRET" help:"secret signing the SRS rewritten envelope senders" secret:"true"`
+	MaxRules        int           `toml:"max_rules" env:"FORWARD_MAX_RULES" help:"maximum forwarding rules per inbox"`
+	ConfirmationTTL time.Duration `toml:"confirmation_ttl" env:"FORWARD_CONFIRMATION_TTL" help:"how long a forwarding confirmation link is valid"`
+
+	RulesPerHour        int64 `toml:"rules_per_hour" env:"FORWARD_RULES_PER_HOUR" help:"forwarding rules a client ip may create per hour, 0 disables the limit"`
+	GlobalRulesPerHour  int64 `toml:"global_rules_per_hour" env:"FORWARD_GLOBAL_RULES_PER_HOUR" help:"forwarding rules all clients may create per hour, 0 disables the limit"`
+	ConfirmationsPerDay int64 `toml:"confirmations_per_day" env:"FORWARD_CONFIRMATIONS_PER_DAY" help:"confirmation mails per day per forwarding address, 0 disables the limit"`
+}
+
+type Send struct {
+	Enabled       bool  `toml:"enabled" env:"SEND_ENABLED" help:"let inboxes send and reply to mail, requires relay.host"`
+	PerHour       int   `toml:"per_hour" env:"SEND_PER_HOUR" help:"mails an inbox may send per hour"`
+	PerDay        int   `toml:"per_day" env:"SEND_PER_DAY" help:"mails an inbox may send per day"`
+	MaxRecipients int   `toml:"max_recipients" env:"SEND_MAX_RECIPIENTS" help:"maximum recipients of a sent mail"`
+	MaxBodyBytes  int64 `toml:"max_body_bytes" env:"SEND_MAX_BODY_BYTES" help:"maximum size of the text of a sent mail"`
+
+	ClientPerHour int64 `toml:"client_per_hour" env:"SEND_CLIENT_PER_HOUR" help:"mails a client ip may send per hour, 0 disables the limit"`
+	GlobalPerHour int64 `toml:"global_per_hour" env:"SEND_GLOBAL_PER_HOUR" help:"mails all clients may send per hour, 0 disables the limit"`
+	RequireClaim  bool  `toml:"require_claim" env:"SEND_REQUIRE_CLAIM" help:"only let claimed inboxes send mail, requires claim.enabled"`
+}
+
+type Claim struct {
+	Enabled           bool          `toml:"enabled" env:"CLAIM_ENABLED" help:"let inboxes be claimed with a password or access token"`
+	TTL               time.Duration `toml:"ttl" env:"CLAIM_TTL" help:"how long a claim lasts before the inbox is open again"`
+	MinPasswordLength int           `toml:"min_password_length" env:"CLAIM_MIN_PASSWORD_LENGTH" help:"minimum length of the password of a claimed inbox"`
+	LoginsPerMinute   int64         `toml:"logins_per_minute" env:"CLAIM_LOGINS_PER_MINUTE" help:"password attempts per minute per inbox"`
+
+	ClientLoginsPerMinute int64 `toml:"client_logins_per_minute" env:"CLAIM_CLIENT_LOGINS_PER_MINUTE" help:"password attempts per minute per client ip, 0 disables the limit"`
+	ClaimsPerHour         int64 `toml:"claims_per_hour" env:"CLAIM_CLAIMS_PER_HOUR" help:"inboxes a client ip may claim per hour, 0 disables the limit"`
+}
+
+type API struct {
+	RequireKey           bool  `toml:"require_key" env:"API_REQUIRE_KEY" help:"require an api key on the json inbox routes"`
+	KeyRequestsPerMinute int64 `toml:"key_requests_per_minute" env:"API_KEY_REQUESTS_PER_MINUTE" help:"requests per minute of api keys without their own limit"`
+}
+
+type Admin struct {
+	Token string `toml:"token" env:"ADMIN_TOKEN" help:"bearer token of the admin api, empty disables it" secret:"true"`
+}
+
+type Inbox struct {
+	Locale        string   `toml:"locale" env:"INBOX_LOCALE" help:"locale of the words of random inbox names"`
+	Pattern       string   `toml:"pattern" env:"INBOX_PATTERN" help:"pattern of random inbox names, empty uses the one of the locale"`
+	DomainLocales []string `toml:"domain_locales" env:"INBOX_DOMAIN_LOCALES" help:"comma separated domain=locale pairs overriding inbox.locale per domain"`
+	WordsDir      string   `toml:"words_dir" env:"INBOX_WORDS_DIR" help:"directory of extra word lists and blocklist, empty uses the built-in ones"`
+
+	ReservedNames       []string `toml:"reserved_names" env:"INBOX_RESERVED_NAMES" help:"comma separated names that cannot be chosen as inbox names"`
+	DomainReservedNames []string `toml:"domain_reserved_names" env:"INBOX_DOMAIN_RESERVED_NAMES" help:"comma separated domain=name pairs reserving a name on a single domain"`
+}
+
+type Signature struct {
+	TrustedCerts string `toml:"trusted_certs" env:"SIGNATURE_TRUSTED_CERTS" help:"PEM file of the CA and signer certificates S/MIME signatures are trusted from"`
+	SystemRoots  bool   `toml:"system_roots" env:"SIGNATURE_SYSTEM_ROOTS" help:"also trust S/MIME signers certified by the system CAs"`
+}
+
+// parse_domain_pairs splits domain=value pairs, lower cased, with the
+// domains normalized.
+func parse_domain_pairs(pairs []string) ([][2]string, error) {
+	parsed := make([][2]string, 0, len(pairs))
+	for _, pair := range pairs {
+		domain, value, ok := strings.Cut(pair, "=")
+		domain, value = strings.TrimSpace(domain), strings.ToLower(strings.TrimSpace(value))
+		if !ok || domain == "" || value == "" {
+			return nil, fmt.Errorf("%q is not a domain=value pair", pair)
+		}
+		domain, err := address.NormalizeDomain(domain)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pair, err)
+		}
+		parsed = append(parsed, [2]string{domain, value})
+	}
+
+	return parsed, nil
+}
+
+// ParseDomainLocales maps the domains of DomainLocales to their locale.
+func (inbox Inbox) ParseDomainLocales() (map[string]string, error) {
+	pairs, err := parse_domain_pairs(inbox.DomainLocales)
+	if err != nil {
+		return nil, err
+	}
+
+	locales := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		locales[pair[0]] = pair[1]
+	}
+
+	return locales, nil
+}
+
+// ParseDomainReservedNames maps the domains of DomainReservedNames to their
+// reserved names.
+func (inbox Inbox) ParseDomainReservedNames() (map[string][]string, error) {
+	pairs, err := parse_domain_pairs(inbox.DomainReservedNames)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string][]string)
+	for _, pair := range pairs {
+		names[pair[0]] = append(names[pair[0]], pair[1])
+	}
+
+	return names, nil
+}
+
+func Default() Config {
+	return Config{
+		DB: DB{
+			Path: "./db.db",
+		},
+		Mail: Mail{
+			Domain:               "localhost",
+			Port:                 1025,
+			ReadTimeout:          60 * time.Second,
+			WriteTimeout:         60 * time.Second,
+			MaxMessageBytes:      1024 * 1024,
+			MaxRecipients:        50,
+			AllowInsecureAuth:    true,
+			ShutdownTimeout:      30 * time.Second,
+			SubaddressSeparators: "+",
+			FoldLocalCase:        true,
+			Auth: MailAuth{
+				Enabled: true,
+				Timeout: 10 * time.Second,
+			},
+			RateLimit: MailRateLimit{
+				ConnectionsPerMinute:   60,
+				MessagesPerMinute:      30,
+				InboxMessagesPerMinute: 30,
+				BytesPerMinute:         20 * 1024 * 1024,
+				Allowlist:              []string{"127.0.0.0/8", "::1/128"},
+			},
+			Greylist: MailGreylist{
+				Enabled:      false,
+				Delay:        5 * time.Minute,
+				RetryWindow:  24 * time.Hour,
+				WhitelistTTL: 36 * 24 * time.Hour,
+			},
+			Spam: MailSpam{
+				Enabled:     true,
+				TagScore:    5,
+				RejectScore: 0,
+				URLPatterns: []string{
+					`^https?://\d+\.\d+\.\d+\.\d+([:/]|$)`,
+					`^https?://[^/]*@`,
+					`^https?://(bit\.ly|tinyurl\.com|goo\.gl|is\.gd|ow\.ly|cutt\.ly)/`,
+				},
+				Timeout: 10 * time.Second,
+			},
+			Antivirus: MailAntivirus{
+				Enabled: false,
+				Address: "tcp://127.0.0.1:3310",
+				Action:  "reject",
+				Timeout: 30 * time.Second,
+			},
+		},
+		Web: Web{
+			Port:            3000,
+			ShutdownTimeout: 10 * time.Second,
+			BaseURL:         "http://localhost:3000",
+		},
+		Metrics: Metrics{
+			Enabled: true,
+			Host:    "127.0.0.1",
+			Port:    9091,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Relay: Relay{
+			TLS:           "starttls",
+			Timeout:       30 * time.Second,
+			RetryInterval: time.Minute,
+			MaxAge:        48 * time.Hour,
+		},
+		Forward: Forward{
+			Enabled:         false,
+			MaxRules:        5,
+			ConfirmationTTL: 24 * time.Hour,
+
+			RulesPerHour:        5,
+			GlobalRulesPerHour:  100,
+			ConfirmationsPerDay: 3,
+		},
+		Send: Send{
+			Enabled:       false,
+			PerHour:       5,
+			PerDay:        20,
+			MaxRecipients: 3,
+			MaxBodyBytes:  64 * 1024,
+
+			ClientPerHour: 10,
+			GlobalPerHour: 200,
+			RequireClaim:  true,
+		},
+		Claim: Claim{
+			Enabled:           false,
+			TTL:               7 * 24 * time.Hour,
+			MinPasswordLength: 8,
+			LoginsPerMinute:   5,
+
+			ClientLoginsPerMinute: 10,
+			ClaimsPerHour:         10,
+		},
+		API: API{
+			RequireKey:           false,
+			KeyRequestsPerMinute: 120,
+		},
+		Admin: Admin{
+			Token: "",
+		},
+		Inbox: Inbox{
+			Locale:  "en",
+			Pattern: "",
+			ReservedNames: []string{
+				"postmaster", "abuse", "hostmaster", "webmaster", "admin", "administrator",
+				"root", "security", "noreply", "mailer-daemon", "support", "info",
+			},
+		},
+		Signature: Signature{
+			TrustedCerts: "",
+			SystemRoots:  true,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the config file given by
+// -config (or env:CONFIG_PATH), the environment and the flags in args, and
+// validates the result.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+	fields := cfg.fields()
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	config_path := flags.String("config", os.Getenv("CONFIG_PATH"), "path to the config file (env CONFIG_PATH)")
+	for _, f := range fields {
+		usage := fmt.Sprintf("%s (env %s, default %s)", f.help, f.env, format_toml_value(f.value.Interface()))
+		if f.value.Kind() == reflect.Bool {
+			// lets "-key" stand for "-key=true"
+			flags.Var(&bool_flag{}, f.key, usage)
+			continue
+		}
+		flags.String(f.key, "", usage)
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	if flags.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	if *config_path != "" {
+		err = cfg.load_file(*config_path)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, f := range fields {
+		value, exists := os.LookupEnv(f.env)
+		if !exists {
+			continue
+		}
+
+		err = set_from_string(f.value, value)
+		if err != nil {
+			return cfg, fmt.Errorf("env:%s: %w", f.env, err)
+		}
+	}
+
+	flags.Visit(func(fl *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		for _, f := range fields {
+			if f.key == fl.Name {
+				err = set_from_string(f.value, fl.Value.String())
+				if err != nil {
+					err = fmt.Errorf("flag -%s: %w", f.key, err)
+				}
+				return
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return cfg, err
+	}
+
+	// addresses are compared in their normalized form
+	cfg.Mail.Domain, _ = address.NormalizeDomain(cfg.Mail.Domain)
+
+	return cfg, nil
+}
+
+// Normalizer normalizes addresses as set in mail.
+func (mail Mail) Normalizer() address.Normalizer {
+	return address.Normalizer{
+		FoldCase:  mail.FoldLocalCase,
+		StripDots: mail.StripLocalDots,
+	}
+}
+
+func (cfg *Config) load_file(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open config file: %w", err)
+	}
+	defer file.Close()
+
+	values, err := Parse_toml(file)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	fields := cfg.fields()
+	for key, value := range values {
+		found := false
+		for _, f := range fields {
+			if f.key != key {
+				continue
+			}
+
+			found = true
+			err = set_from_toml(f.value, value)
+			if err != nil {
+				return fmt.Errorf("config file %s: %s: %w", path, key, err)
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("config file %s: unknown key %s", path, key)
+		}
+	}
+
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (cfg Config) Validate() error {
+	var errs []error
+	invalid := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.DB.Path == "" {
+		invalid("db.path", "must not be empty")
+	}
+
+	if cfg.Mail.Domain == "" {
+		invalid("mail.domain", "must not be empty")
+	} else if _, err := address.NormalizeDomain(cfg.Mail.Domain); err != nil {
+		invalid("mail.domain", "%q is not a valid domain", cfg.Mail.Domain)
+	}
+
+	if cfg.Mail.Port <= 0 || cfg.Mail.Port > 65535 {
+		invalid("mail.port", "must be between 1 and 65535, got %d", cfg.Mail.Port)
+	}
+
+	if cfg.Web.Port <= 0 || cfg.Web.Port > 65535 {
+		invalid("web.port", "must be between 1 and 65535, got %d", cfg.Web.Port)
+	}
+
+	if cfg.Mail.Port == cfg.Web.Port {
+		invalid("web.port", "must be different from mail.port (%d)", cfg.Mail.Port)
+	}
+
+	if cfg.Metrics.Port < 0 || cfg.Metrics.Port > 65535 {
+		invalid("metrics.port", "must be 0 or between 1 and 65535, got %d", cfg.Metrics.Port)
+	} else if cfg.Metrics.Port != 0 && (cfg.Metrics.Port == cfg.Mail.Port || cfg.Metrics.Port == cfg.Web.Port) {
+		invalid("metrics.port", "must be different from mail.port and web.port")
+	} else if cfg.Metrics.Enabled && cfg.Metrics.Port == 0 && cfg.Admin.Token == "" {
+		invalid("metrics.port", "0 serves metrics on the web port behind admin.token, which is not set")
+	}
+
+	if cfg.Mail.ReadTimeout <= 0 {
+		invalid("mail.read_timeout", "must be positive, got %s", cfg.Mail.ReadTimeout)
+	}
+
+	if cfg.Mail.WriteTimeout <= 0 {
+		invalid("mail.write_timeout", "must be positive, got %s", cfg.Mail.WriteTimeout)
+	}
+
+	if cfg.Mail.MaxMessageBytes <= 0 {
+		invalid("mail.max_message_bytes", "must be positive, got %d", cfg.Mail.MaxMessageBytes)
+	}
+
+	if cfg.Mail.MaxRecipients <= 0 {
+		invalid("mail.max_recipients", "must be positive, got %d", cfg.Mail.MaxRecipients)
+	}
+
+	if cfg.Mail.ShutdownTimeout <= 0 {
+		invalid("mail.shutdown_timeout", "must be positive, got %s", cfg.Mail.ShutdownTimeout)
+	}
+
+	if strings.Trim(cfg.Mail.SubaddressSeparators, "+-=_~") != "" {
+		invalid("mail.subaddress_separators", "must only hold + - = _ or ~, got %q", cfg.Mail.SubaddressSeparators)
+	}
+
+	if cfg.Mail.Auth.Timeout <= 0 {
+		invalid("mail.auth.timeout", "must be positive, got %s", cfg.Mail.Auth.Timeout)
+	}
+
+	if _, err := ratelimit.ParseAllowlist(cfg.Mail.RateLimit.Allowlist); err != nil {
+		invalid("mail.ratelimit.allowlist", "%s", err)
+	}
+
+	if cfg.Mail.RateLimit.BytesPerMinute > 0 && cfg.Mail.RateLimit.BytesPerMinute < cfg.Mail.MaxMessageBytes {
+		invalid("mail.ratelimit.bytes_per_minute", "must be at least mail.max_message_bytes (%d) or 0", cfg.Mail.MaxMessageBytes)
+	}
+
+	if cfg.Mail.Greylist.Delay < 0 {
+		invalid("mail.greylist.delay", "must not be negative, got %s", cfg.Mail.Greylist.Delay)
+	}
+
+	if cfg.Mail.Greylist.RetryWindow <= cfg.Mail.Greylist.Delay {
+		invalid("mail.greylist.retry_window", "must be longer than mail.greylist.delay (%s)", cfg.Mail.Greylist.Delay)
+	}
+
+	if cfg.Mail.Greylist.WhitelistTTL < 0 {
+		invalid("mail.greylist.whitelist_ttl", "must not be negative, got %s", cfg.Mail.Greylist.WhitelistTTL)
+	}
+
+	for _, domain := range cfg.Mail.Greylist.BypassDomains {
+		if _, err := address.NormalizeDomain(domain); err != nil {
+			invalid("mail.greylist.bypass_domains", "%s", err)
+		}
+	}
+
+	if cfg.Mail.Spam.TagScore < 0 {
+		invalid("mail.spam.tag_score", "must not be negative, got %g", cfg.Mail.Spam.TagScore)
+	}
+
+	if cfg.Mail.Spam.RejectScore < 0 {
+		invalid("mail.spam.reject_score", "must not be negative, got %g", cfg.Mail.Spam.RejectScore)
+	}
+
+	if cfg.Mail.Spam.TagScore > 0 && cfg.Mail.Spam.RejectScore > 0 && cfg.Mail.Spam.RejectScore < cfg.Mail.Spam.TagScore {
+		invalid("mail.spam.reject_score", "must not be lower than mail.spam.tag_score (%g)", cfg.Mail.Spam.TagScore)
+	}
+
+	for _, pattern := range cfg.Mail.Spam.URLPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			invalid("mail.spam.url_patterns", "%s", err)
+		}
+	}
+
+	if cfg.Mail.Spam.Timeout <= 0 {
+		invalid("mail.spam.timeout", "must be positive, got %s", cfg.Mail.Spam.Timeout)
+	}
+
+	if _, _, err := clamd.ParseAddress(cfg.Mail.Antivirus.Address); cfg.Mail.Antivirus.Enabled && err != nil {
+		invalid("mail.antivirus.address", "%s", err)
+	}
+
+	if cfg.Mail.Antivirus.Action != "reject" && cfg.Mail.Antivirus.Action != "quarantine" {
+		invalid("mail.antivirus.action", "must be reject or quarantine, got %q", cfg.Mail.Antivirus.Action)
+	}
+
+	if cfg.Mail.Antivirus.Timeout <= 0 {
+		invalid("mail.antivirus.timeout", "must be positive, got %s", cfg.Mail.Antivirus.Timeout)
+	}
+
+	if cfg.Relay.Host != "" {
+		if _, _, err := net.SplitHostPort(cfg.Relay.Host); err != nil {
+			invalid("relay.host", "%q is not a host:port", cfg.Relay.Host)
+		}
+	}
+
+	if cfg.Relay.TLS != "starttls" && cfg.Relay.TLS != "tls" && cfg.Relay.TLS != "none" {
+		invalid("relay.tls", "must be starttls, tls or none, got %q", cfg.Relay.TLS)
+	}
+
+	if cfg.Relay.Timeout <= 0 {
+		invalid("relay.timeout", "must be positive, got %s", cfg.Relay.Timeout)
+	}
+
+	if cfg.Relay.RetryInterval <= 0 {
+		invalid("relay.retry_interval", "must be positive, got %s", cfg.Relay.RetryInterval)
+	}
+
+	if cfg.Relay.MaxAge < cfg.Relay.RetryInterval {
+		invalid("relay.max_age", "must be at least relay.retry_interval (%s)", cfg.Relay.RetryInterval)
+	}
+
+	if cfg.Forward.Enabled && cfg.Relay.Host == "" {
+		invalid("forward.enabled", "requires relay.host")
+	}
+
+	if cfg.Forward.Enabled && cfg.Forward.SRSSecret == "" {
+		invalid("forward.srs_secret", "must not be empty when forwarding is enabled")
+	}
+
+	if cfg.Forward.MaxRules < 1 {
+		invalid("forward.max_rules", "must be at least 1, got %d", cfg.Forward.MaxRules)
+	}
+
+	if cfg.Forward.ConfirmationTTL <= 0 {
+		invalid("forward.confirmation_ttl", "must be positive, got %s", cfg.Forward.ConfirmationTTL)
+	}
+
+	if cfg.Send.Enabled && cfg.Relay.Host == "" {
+		invalid("send.enabled", "requires relay.host")
+	}
+
+	if cfg.Send.Enabled && cfg.Send.RequireClaim && !cfg.Claim.Enabled {
+		invalid("send.require_claim", "requires claim.enabled")
+	}
+
+	if cfg.Send.PerHour < 1 {
+		invalid("send.per_hour", "must be at least 1, got %d", cfg.Send.PerHour)
+	}
+
+	if cfg.Send.PerDay < cfg.Send.PerHour {
+		invalid("send.per_day", "must be at least send.per_hour (%d)", cfg.Send.PerHour)
+	}
+
+	if cfg.Send.MaxRecipients < 1 {
+		invalid("send.max_recipients", "must be at least 1, got %d", cfg.Send.MaxRecipients)
+	}
+
+	if cfg.Send.MaxBodyBytes < 1 {
+		invalid("send.max_body_bytes", "must be at least 1, got %d", cfg.Send.MaxBodyBytes)
+	}
+
+	if cfg.Claim.TTL <= 0 {
+		invalid("claim.ttl", "must be positive, got %s", cfg.Claim.TTL)
+	}
+
+	if cfg.Claim.MinPasswordLength < 1 {
+		invalid("claim.min_password_length", "must be at least 1, got %d", cfg.Claim.MinPasswordLength)
+	}
+
+	if cfg.Claim.LoginsPerMinute < 1 {
+		invalid("claim.logins_per_minute", "must be at least 1, got %d", cfg.Claim.LoginsPerMinute)
+	}
+
+	if cfg.API.KeyRequestsPerMinute < 1 {
+		invalid("api.key_requests_per_minute", "must be at least 1, got %d", cfg.API.KeyRequestsPerMinute)
+	}
+
+	if cfg.Admin.Token != "" && len(cfg.Admin.Token) < 16 {
+		invalid("admin.token", "must be at least 16 characters")
+	}
+
+	if cfg.Inbox.Locale == "" {
+		invalid("inbox.locale", "must not be empty")
+	}
+
+	if _, err := rig.ParsePattern(cfg.Inbox.Pattern); cfg.Inbox.Pattern != "" && err != nil {
+		invalid("inbox.pattern", "%q is not a valid pattern", cfg.Inbox.Pattern)
+	}
+
+	if _, err := cfg.Inbox.ParseDomainLocales(); err != nil {
+		invalid("inbox.domain_locales", "%s", err)
+	}
+
+	if _, err := cfg.Inbox.ParseDomainReservedNames(); err != nil {
+		invalid("inbox.domain_reserved_names", "%s", err)
+	}
+
+	if u, err := url.Parse(cfg.Web.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("web.base_url", "%q is not an http or https url", cfg.Web.BaseURL)
+	}
+
+	if cfg.Web.ShutdownTimeout <= 0 {
+		invalid("web.shutdown_timeout", "must be positive, got %s", cfg.Web.ShutdownTimeout)
+	}
+
+	var level slog.Level
+	if level.UnmarshalText([]byte(cfg.Log.Level)) != nil {
+		invalid("log.level", "must be one of debug, info, warn or error, got %q", cfg.Log.Level)
+	}
+
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		invalid("log.format", "must be text or json, got %q", cfg.Log.Format)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// Print writes the configuration in the config file format. Secrets that
+// are set are commented out rather than shown.
+func (cfg Config) Print(w io.Writer) error {
+	table := ""
+	for _, f := range cfg.fields() {
+		index := strings.LastIndex(f.key, ".")
+		if f.key[:index] != table {
+			if table != "" {
+				fmt.Fprintln(w)
+			}
+			table = f.key[:index]
+			fmt.Fprintf(w, "[%s]\n", table)
+		}
+
+		var err error
+		if f.secret && !f.value.IsZero() {
+			_, err = fmt.Fprintf(w, "# %s = <redacted>\n", f.key[index+1:])
+		} else {
+			_, err = fmt.Fprintf(w, "%s = %s\n", f.key[index+1:], format_toml_value(f.value.Interface()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bool_flag keeps the raw value like the string flags, but is parsed as a
+// boolean flag by the flag package.
+type bool_flag struct {
+	value string
+}
+
+func (b *bool_flag) String() string {
+	return b.value
+}
+
+func (b *bool_flag) Set(value string) error {
+	b.value = value
+	return nil
+}
+
+func (b *bool_flag) IsBoolFlag() bool {
+	return true
+}
+
+type field struct {
+	key, env, help string
+	// never printed, from the secret:"true" tag
+	secret bool
+	value  reflect.Value
+}
+
+func (cfg *Config) fields() []field {
+	var fields []field
+
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			key := prefix + sf.Tag.Get("toml")
+
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+
+			fields = append(fields, field{
+				key:    key,
+				env:    sf.Tag.Get("env"),
+				help:   sf.Tag.Get("help"),
+				secret: sf.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+
+	return fields
+}
+
+var duration_type = reflect.TypeOf(time.Duration(0))
+
+func set_from_string(v reflect.Value, s string) error {
+	if v.Type() == duration_type {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		v.SetInt(i)
+
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		v.SetFloat(f)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		v.SetBool(b)
+
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+
+	return nil
+}
+
+func set_from_toml(v reflect.Value, value any) error {
+	if v.Type() == duration_type {
+		s, ok := value.(string)
+		if !ok {
+			return errors.New("expected a duration string like \"60s\"")
+		}
+		return set_from_string(v, s)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return errors.New("expected a string")
+		}
+		v.SetString(s)
+
+	case reflect.Int, reflect.Int64:
+		i, ok := value.(int64)
+		if !ok {
+			return errors.New("expected an integer")
+		}
+		v.SetInt(i)
+
+	case reflect.Float64:
+		switch n := value.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		default:
+			return errors.New("expected a number")
+		}
+
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return errors.New("expected a boolean")
+		}
+		v.SetBool(b)
+
+	case reflect.Slice:
+		array, ok := value.([]any)
+		if !ok {
+			return errors.New("expected an array of strings")
+		}
+		items := make([]string, len(array))
+		for i, item := range array {
+			s, ok := item.(string)
+			if !ok {
+				return errors.New("expected an array of strings")
+			}
+			items[i] = s
+		}
+		v.Set(reflect.ValueOf(items))
+
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+
+	return nil
+}
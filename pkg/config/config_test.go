@@ -0,0 +1,189 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write_config(t *testing.T, doc string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(doc), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := write_config(t, `
+[db]
+path = "file.db"
+
+[mail]
+domain = "Example.COM"
+port = 2525
+read_timeout = "30s"
+`)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(cfg Config) bool
+	}{
+		{
+			name:  "defaults",
+			check: func(cfg Config) bool { return reflect.DeepEqual(cfg, Default()) },
+		},
+		{
+			name: "file",
+			args: []string{"-config", path},
+			check: func(cfg Config) bool {
+				return cfg.DB.Path == "file.db" && cfg.Mail.Port == 2525 && cfg.Mail.ReadTimeout == 30*time.Second
+			},
+		},
+		{
+			name:  "domain is normalized",
+			args:  []string{"-config", path},
+			check: func(cfg Config) bool { return cfg.Mail.Domain == "example.com" },
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"CONFIG_PATH": path, "DB_PATH": "env.db"},
+			check: func(cfg Config) bool {
+				return cfg.DB.Path == "env.db" && cfg.Mail.Port == 2525
+			},
+		},
+		{
+			name: "flags over env",
+			env:  map[string]string{"DB_PATH": "env.db", "MAIL_SERVER_PORT": "26"},
+			args: []string{"-config", path, "-db.path", "flag.db"},
+			check: func(cfg Config) bool {
+				return cfg.DB.Path == "flag.db" && cfg.Mail.Port == 26
+			},
+		},
+		{
+			name:  "boolean flag",
+			args:  []string{"-mail.strip_local_dots"},
+			check: func(cfg Config) bool { return cfg.Mail.StripLocalDots },
+		},
+		{
+			name: "list from env",
+			env:  map[string]string{"MAIL_RATELIMIT_ALLOWLIST": "10.0.0.0/8, ::1/128,"},
+			check: func(cfg Config) bool {
+				return reflect.DeepEqual(cfg.Mail.RateLimit.Allowlist, []string{"10.0.0.0/8", "::1/128"})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("CONFIG_PATH", "")
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := Load(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(cfg) {
+				t.Errorf("unexpected configuration %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{name: "unknown key", doc: "[mail]\nprot = 25", err: "unknown key mail.prot"},
+		{name: "wrong type", doc: "[mail]\nport = \"25\"", err: "mail.port: expected an integer"},
+		{name: "bad duration", doc: "[mail]\nread_timeout = 30", err: "expected a duration string"},
+		{name: "bad env", env: map[string]string{"MAIL_SERVER_PORT": "x"}, err: `env:MAIL_SERVER_PORT: "x" is not a number`},
+		{name: "bad flag", args: []string{"-mail.read_timeout", "soon"}, err: `flag -mail.read_timeout: invalid duration "soon"`},
+		{name: "argument", args: []string{"serve"}, err: `unexpected argument "serve"`},
+		{name: "invalid", args: []string{"-db.path", ""}, err: "db.path: must not be empty"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("CONFIG_PATH", "")
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			args := test.args
+			if test.doc != "" {
+				args = append([]string{"-config", write_config(t, test.doc)}, args...)
+			}
+
+			_, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := Default()
+	cfg.Relay.Password = "relay-password"
+	cfg.Forward.SRSSecret = "srs-secret"
+	cfg.Admin.Token = "admin-token"
+
+	var out bytes.Buffer
+	err := cfg.Print(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"relay-password", "srs-secret", "admin-token"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("printed the secret %q", secret)
+		}
+	}
+	for _, line := range []string{"# password = <redacted>", "# srs_secret = <redacted>", "# token = <redacted>"} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+
+	// the printed configuration loads back to the one printed, secrets aside
+	t.Setenv("CONFIG_PATH", "")
+	loaded, err := Load([]string{"-config", write_config(t, out.String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var again bytes.Buffer
+	err = loaded.Print(&again)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Relay.Password = ""
+	cfg.Forward.SRSSecret = ""
+	cfg.Admin.Token = ""
+	out.Reset()
+	err = cfg.Print(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != out.String() {
+		t.Errorf("loaded\n%s\nwant\n%s", again.String(), out.String())
+	}
+}
@@ -0,0 +1,279 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The config file is a small subset of TOML: [tables] (dotted names
+// allowed), `key = value` pairs, comments, and values that are strings,
+// integers, floats, booleans or (possibly multi-line) arrays of those.
+// Nothing in the configuration needs more than that, so we do not pull in
+// a full TOML implementation.
+
+// Parse_toml returns the values of the document keyed by their full dotted
+// path, e.g. "mail.port".
+func Parse_toml(r io.Reader) (map[string]any, error) {
+	values := make(map[string]any)
+	prefix := ""
+
+	scanner := bufio.NewScanner(r)
+	line_no := 0
+	pending := ""
+	pending_line := 0
+
+	for scanner.Scan() {
+		line_no++
+		line := strip_comment(scanner.Text())
+
+		if pending != "" {
+			pending += " " + line
+			if bracket_depth(pending) > 0 {
+				continue
+			}
+			line = pending
+			pending = ""
+		} else {
+			pending_line = line_no
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && !strings.Contains(line, "=") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header %q", line_no, line)
+			}
+
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			key, err := parse_key(name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line_no, err)
+			}
+			prefix = key + "."
+			continue
+		}
+
+		index := strings.Index(line, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", line_no)
+		}
+
+		raw_value := strings.TrimSpace(line[index+1:])
+		if bracket_depth(raw_value) > 0 {
+			pending = line
+			continue
+		}
+
+		key, err := parse_key(strings.TrimSpace(line[:index]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", pending_line, err)
+		}
+
+		value, err := parse_value(raw_value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", pending_line, prefix+key, err)
+		}
+
+		if _, exists := values[prefix+key]; exists {
+			return nil, fmt.Errorf("line %d: duplicated key %s", pending_line, prefix+key)
+		}
+		values[prefix+key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if pending != "" {
+		return nil, fmt.Errorf("line %d: unterminated array", pending_line)
+	}
+
+	return values, nil
+}
+
+func strip_comment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func bracket_depth(s string) int {
+	var quote rune
+	escaped := false
+	depth := 0
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+
+	return depth
+}
+
+func parse_key(s string) (string, error) {
+	parts := strings.Split(s, ".")
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if len(p) >= 2 && (p[0] == '"' || p[0] == '\'') && p[len(p)-1] == p[0] {
+			p = p[1 : len(p)-1]
+		} else if p == "" || strings.IndexFunc(p, func(r rune) bool {
+			return !(r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		}) >= 0 {
+			return "", fmt.Errorf("invalid key %q", s)
+		}
+		parts[i] = p
+	}
+
+	return strings.Join(parts, "."), nil
+}
+
+func parse_value(s string) (any, error) {
+	switch {
+	case s == "":
+		return nil, errors.New("missing value")
+
+	case s == "true":
+		return true, nil
+
+	case s == "false":
+		return false, nil
+
+	case strings.HasPrefix(s, `"`):
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+			return nil, errors.New("unterminated string")
+		}
+		str, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", s)
+		}
+		return str, nil
+
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, errors.New("unterminated string")
+		}
+		return s[1 : len(s)-1], nil
+
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, errors.New("unterminated array")
+		}
+		return parse_array(s[1 : len(s)-1])
+	}
+
+	number := strings.ReplaceAll(s, "_", "")
+	if i, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("invalid value %s", s)
+}
+
+func parse_array(s string) ([]any, error) {
+	var items []any
+
+	var quote rune
+	escaped := false
+	depth := 0
+	start := 0
+	split := func(end int) error {
+		item := strings.TrimSpace(s[start:end])
+		start = end + 1
+		if item == "" {
+			return nil
+		}
+		v, err := parse_value(item)
+		if err != nil {
+			return err
+		}
+		items = append(items, v)
+		return nil
+	}
+
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			if err := split(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := split(len(s)); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func format_toml_value(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case time.Duration:
+		return strconv.Quote(v.String())
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
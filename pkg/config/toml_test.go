@@ -0,0 +1,122 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseToml(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want map[string]any
+	}{
+		{
+			name: "empty",
+			doc:  "# only a comment\n\n",
+			want: map[string]any{},
+		},
+		{
+			name: "scalars",
+			doc: `
+s = "a \"quoted\" # string"
+raw = 'C:\path'
+i = 1_000
+hex = 0x10
+f = 0.5
+yes = true
+no = false
+`,
+			want: map[string]any{
+				"s":   `a "quoted" # string`,
+				"raw": `C:\path`,
+				"i":   int64(1000),
+				"hex": int64(16),
+				"f":   0.5,
+				"yes": true,
+				"no":  false,
+			},
+		},
+		{
+			name: "tables",
+			doc: `
+top = 1
+[mail]
+port = 25 # the smtp port
+[mail.auth]
+enabled = true
+[ "web" ]
+"base_url" = "http://localhost"
+`,
+			want: map[string]any{
+				"top":               int64(1),
+				"mail.port":         int64(25),
+				"mail.auth.enabled": true,
+				"web.base_url":      "http://localhost",
+			},
+		},
+		{
+			name: "arrays",
+			doc: `
+empty = []
+one = ["a"]
+mixed = [1, "b,c", 'd]', true]
+nested = [[1, 2], []]
+multi = [
+    "x", # first
+    "y",
+]
+`,
+			want: map[string]any{
+				"empty":  []any(nil),
+				"one":    []any{"a"},
+				"mixed":  []any{int64(1), "b,c", "d]", true},
+				"nested": []any{[]any{int64(1), int64(2)}, []any(nil)},
+				"multi":  []any{"x", "y"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse_toml(strings.NewReader(test.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTomlErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		err  string
+	}{
+		{"no value", "a =", "line 1: a: missing value"},
+		{"no key", "= 1", "line 1: expected key = value"},
+		{"no equals", "a", "line 1: expected key = value"},
+		{"bad key", "a b = 1", `line 1: invalid key "a b"`},
+		{"bad value", "a = yes", "line 1: a: invalid value yes"},
+		{"unterminated string", `a = "b`, "line 1: a: unterminated string"},
+		{"bad escape", `a = "\q"`, `line 1: a: invalid string "\q"`},
+		{"array of tables", "[[a]]", `line 1: invalid table header "[[a]]"`},
+		{"bad table", "[a", `line 1: invalid table header "[a"`},
+		{"duplicated key", "[a]\nb = 1\nb = 2", "line 3: duplicated key a.b"},
+		{"unterminated array", "a = [\n1,\n", "line 1: unterminated array"},
+		{"bad array item", "\na = [\n1,\nx]", "line 2: a: invalid value x"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse_toml(strings.NewReader(test.doc))
+			if err == nil || err.Error() != test.err {
+				t.Errorf("err = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
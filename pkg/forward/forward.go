@@ -0,0 +1,340 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/GRFreire/nthmail/pkg/ratelimit"
+	"github.com/GRFreire/nthmail/pkg/relay"
+	"github.com/GRFreire/nthmail/pkg/srs"
+)
+
+var forwarded = metrics.NewCounter(
+	"nthmail_forwarded_messages_total",
+	"Messages queued for forwarding, or skipped, by result.",
+	"result",
+)
+
+var (
+	ErrInvalidInbox  = errors.New("invalid inbox address")
+	ErrInvalidTarget = errors.New("invalid forwarding address")
+	ErrRateLimited   = errors.New("too many confirmation mails to this address")
+	ErrTooManyRules  = errors.New("too many forwarding rules for this inbox")
+	ErrInvalidToken  = errors.New("invalid or expired confirmation link")
+	ErrNotFound      = errors.New("no such forwarding rule")
+)
+
+// max_received is the number of Received headers after which a message is
+// assumed to be looping between forwarders.
+const max_received = 25
+
+// Rule forwards the mail of an inbox to Target_addr once confirmed. The
+// Match_ fields are case-insensitive substrings, empty matches everything.
+type Rule struct {
+	Id            int       `json:"id"`
+	Rcpt_addr     string    `json:"rcpt_addr"`
+	Target_addr   string    `json:"target_addr"`
+	Match_from    string    `json:"match_from,omitempty"`
+	Match_subject string    `json:"match_subject,omitempty"`
+	Created_at    time.Time `json:"created_at"`
+	Confirmed     bool      `json:"confirmed"`
+}
+
+func (rule Rule) Matches(from, subject string) bool {
+	return strings.Contains(strings.ToLower(from), strings.ToLower(rule.Match_from)) &&
+		strings.Contains(strings.ToLower(subject), strings.ToLower(rule.Match_subject))
+}
+
+type Forwarder struct {
+	db               *sql.DB
+	queue            *relay.Queue
+	srs              srs.Rewriter
+	domain           string
+	base_url         string
+	max_rules        int
+	confirmation_ttl time.Duration
+	// confirmation mails per target address
+	confirmation_limit *ratelimit.Limiter
+}
+
+func New(db *sql.DB, queue *relay.Queue, srs_secret, domain, base_url string, max_rules int, confirmation_ttl time.Duration, confirmations_per_day int64) *Forwarder {
+	return &Forwarder{
+		db:               db,
+		queue:            queue,
+		srs:              srs.Rewriter{Secret: []byte(srs_secret), Domain: domain},
+		domain:           domain,
+		base_url:         strings.TrimSuffix(base_url, "/"),
+		max_rules:        max_rules,
+		confirmation_ttl: confirmation_ttl,
+
+		confirmation_limit: ratelimit.Per(confirmations_per_day, 24*time.Hour),
+	}
+}
+
+func (forwarder *Forwarder) Rules(ctx context.Context, rcpt_addr string) ([]Rule, error) {
+	query_start := time.Now()
+	rows, err := forwarder.db.QueryContext(ctx, "SELECT id, rcpt_addr, target_addr, match_from, match_subject, created_at, confirmed_at IS NOT NULL FROM forward_rules WHERE rcpt_addr = ? ORDER BY id", rcpt_addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not query forward rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		var rule Rule
+		var created_at int64
+		err = rows.Scan(&rule.Id, &rule.Rcpt_addr, &rule.Target_addr, &rule.Match_from, &rule.Match_subject, &created_at, &rule.Confirmed)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+		rule.Created_at = time.Unix(created_at, 0)
+
+		rules = append(rules, rule)
+	}
+	metrics.DBQueryDuration.Since(query_start, "forward_rules")
+
+	return rules, rows.Err()
+}
+
+// Create adds an unconfirmed rule and mails a confirmation link to its
+// target address.
+func (forwarder *Forwarder) Create(ctx context.Context, rcpt_addr, target_addr, match_from, match_subject string) (Rule, error) {
+	var rule Rule
+
+	// the inbox goes into the confirmation mail
+	index := strings.LastIndex(rcpt_addr, "@")
+	if index < 0 || !strings.EqualFold(rcpt_addr[index+1:], forwarder.domain) {
+		return rule, ErrInvalidInbox
+	}
+	if address.ValidateLocalPart(rcpt_addr[:index]) != nil {
+		return rule, ErrInvalidInbox
+	}
+
+	addr, err := mail.ParseAddress(target_addr)
+	if err != nil {
+		return rule, ErrInvalidTarget
+	}
+	target_addr = addr.Address
+
+	// mail to our own domain would come straight back
+	index = strings.LastIndex(target_addr, "@")
+	if strings.EqualFold(target_addr[index+1:], forwarder.domain) {
+		return rule, ErrInvalidTarget
+	}
+
+	if !forwarder.confirmation_limit.Allow(strings.ToLower(target_addr)) {
+		return rule, ErrRateLimited
+	}
+
+	token, err := new_token()
+	if err != nil {
+		return rule, err
+	}
+
+	tx, err := forwarder.db.BeginTx(ctx, nil)
+	if err != nil {
+		return rule, fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("DELETE FROM forward_rules WHERE confirmed_at IS NULL AND created_at < ?", now.Add(-forwarder.confirmation_ttl).Unix())
+	if err != nil {
+		return rule, fmt.Errorf("could not delete expired forward rules: %w", err)
+	}
+
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM forward_rules WHERE rcpt_addr = ?", rcpt_addr).Scan(&count)
+	if err != nil {
+		return rule, fmt.Errorf("could not count forward rules: %w", err)
+	}
+	if count >= forwarder.max_rules {
+		return rule, ErrTooManyRules
+	}
+
+	result, err := tx.Exec("INSERT INTO forward_rules (rcpt_addr, target_addr, match_from, match_subject, token, created_at) VALUES (?, ?, ?, ?, ?, ?)", rcpt_addr, target_addr, match_from, match_subject, token, now.Unix())
+	if err != nil {
+		return rule, fmt.Errorf("could not insert forward rule: %w", err)
+	}
+	id, _ := result.LastInsertId()
+
+	err = tx.Commit()
+	if err != nil {
+		return rule, fmt.Errorf("could not commit db transaction: %w", err)
+	}
+
+	rule = Rule{
+		Id:            int(id),
+		Rcpt_addr:     rcpt_addr,
+		Target_addr:   target_addr,
+		Match_from:    match_from,
+		Match_subject: match_subject,
+		Created_at:    now,
+	}
+
+	err = forwarder.queue.Enqueue(ctx, "postmaster@"+forwarder.domain, target_addr, forwarder.confirmation_mail(rule, token))
+	return rule, err
+}
+
+func new_token() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("could not generate token: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (forwarder *Forwarder) confirmation_mail(rule Rule, token string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: nthmail <postmaster@%s>\r\n", forwarder.domain)
+	fmt.Fprintf(&b, "To: <%s>\r\n", rule.Target_addr)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", header_value("Confirm forwarding from "+rule.Rcpt_addr)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: <%s@%s>\r\n", token, forwarder.domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "Someone asked to forward the mail of the disposable inbox %s to this address.\r\n\r\n", header_value(rule.Rcpt_addr))
+	fmt.Fprintf(&b, "Open this link within %s to confirm:\r\n\r\n", forwarder.confirmation_ttl)
+	fmt.Fprintf(&b, "%s/forward/confirm/%s\r\n\r\n", forwarder.base_url, token)
+	b.WriteString("If you did not ask for this, ignore this mail and nothing will be forwarded.\r\n")
+
+	return b.Bytes()
+}
+
+// header_value folds the line breaks and runs of white space of s, which
+// would end a header, into single spaces.
+func header_value(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Confirm activates the rule of token.
+func (forwarder *Forwarder) Confirm(ctx context.Context, token string) (Rule, error) {
+	var rule Rule
+
+	now := time.Now().UTC()
+	result, err := forwarder.db.ExecContext(ctx, "UPDATE forward_rules SET confirmed_at = ? WHERE token = ? AND confirmed_at IS NULL AND created_at >= ?", now.Unix(), token, now.Add(-forwarder.confirmation_ttl).Unix())
+	if err != nil {
+		return rule, fmt.Errorf("could not confirm forward rule: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return rule, ErrInvalidToken
+	}
+
+	err = forwarder.db.QueryRowContext(ctx, "SELECT id, rcpt_addr, target_addr FROM forward_rules WHERE token = ?", token).Scan(&rule.Id, &rule.Rcpt_addr, &rule.Target_addr)
+	rule.Confirmed = true
+
+	return rule, err
+}
+
+func (forwarder *Forwarder) Delete(ctx context.Context, rcpt_addr string, id int) error {
+	result, err := forwarder.db.ExecContext(ctx, "DELETE FROM forward_rules WHERE rcpt_addr = ? AND id = ?", rcpt_addr, id)
+	if err != nil {
+		return fmt.Errorf("could not delete forward rule: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Forward queues data for the target of every confirmed rule of rcpt_addr
+// matching the From and Subject of the mail. The envelope sender mail_from
+// is rewritten with SRS.
+func (forwarder *Forwarder) Forward(ctx context.Context, rcpt_addr, mail_from, from, subject string, data []byte) error {
+	logger := logging.FromContext(ctx)
+
+	rules, err := forwarder.Rules(ctx, rcpt_addr)
+	if err != nil {
+		return err
+	}
+
+	var targets []string
+	for _, rule := range rules {
+		if rule.Confirmed && rule.Matches(from, subject) {
+			targets = append(targets, rule.Target_addr)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	if looping(data, rcpt_addr) {
+		forwarded.Inc("loop")
+		logger.Warn("not forwarding looping message", "rcpt", rcpt_addr)
+		return nil
+	}
+
+	data = append([]byte("X-Loop: "+rcpt_addr+"\r\n"), data...)
+	envelope_from := forwarder.srs.Forward(mail_from)
+	for _, target := range targets {
+		err = forwarder.queue.Enqueue(ctx, envelope_from, target, data)
+		if err != nil {
+			return err
+		}
+
+		forwarded.Inc("queued")
+		logger.Info("forwarding message", "rcpt", rcpt_addr, "target", target)
+	}
+
+	return nil
+}
+
+// looping reports whether the message already went through rcpt_addr, or
+// through more hops than any sane path has.
+func looping(data []byte, rcpt_addr string) bool {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return false
+	}
+
+	if len(header.Values("Received")) >= max_received {
+		return true
+	}
+
+	for _, value := range header.Values("X-Loop") {
+		if strings.EqualFold(strings.TrimSpace(value), rcpt_addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsBounce reports whether rcpt is an SRS address of a message we forwarded.
+func (forwarder *Forwarder) IsBounce(rcpt string) bool {
+	_, err := forwarder.srs.Reverse(rcpt)
+	return err == nil
+}
+
+// Bounce queues data, a bounce sent to the SRS address rcpt, for the
+// original sender of the forwarded message.
+func (forwarder *Forwarder) Bounce(ctx context.Context, rcpt string, data []byte) error {
+	original, err := forwarder.srs.Reverse(rcpt)
+	if err != nil {
+		return err
+	}
+
+	forwarded.Inc("bounce")
+	logging.FromContext(ctx).Info("returning bounce to original sender", "srs_addr", rcpt, "rcpt", original)
+
+	// bounces are sent with the null sender so they cannot bounce again
+	return forwarder.queue.Enqueue(ctx, "", original, data)
+}
@@ -0,0 +1,291 @@
+package forward
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	"github.com/GRFreire/nthmail/pkg/relay"
+	"github.com/emersion/go-smtp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type relayed struct {
+	from, to, data string
+}
+
+// smarthost is a local SMTP stand-in that accepts every message and sends
+// it on mails.
+type smarthost chan relayed
+
+func (mails smarthost) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{mails: mails}, nil
+}
+
+type session struct {
+	mails smarthost
+	mail  relayed
+}
+
+func (s *session) AuthPlain(username, password string) error      { return smtp.ErrAuthUnsupported }
+func (s *session) Mail(from string, opts *smtp.MailOptions) error { s.mail.from = from; return nil }
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error   { s.mail.to = to; return nil }
+func (s *session) Reset()                                         { s.mail = relayed{} }
+func (s *session) Logout() error                                  { return nil }
+
+func (s *session) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	s.mail.data = string(data)
+	s.mails <- s.mail
+	return err
+}
+
+// new_forwarder returns a forwarder for nthmail.test whose relay queue
+// delivers to a local SMTP stand-in, and the mails the stand-in gets.
+func new_forwarder(t *testing.T, confirmations_per_day int64) (*Forwarder, <-chan relayed) {
+	t.Helper()
+
+	mails := make(smarthost, 16)
+	server := smtp.NewServer(mails)
+	server.Domain = "smarthost.test"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := relay.Client{Addr: l.Addr().String(), TLS: "none", HeloName: "nthmail.test", Timeout: 5 * time.Second}
+	queue := relay.NewQueue(db, client, time.Minute, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		queue.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return New(db, queue, "secret", "nthmail.test", "http://nthmail.test/", 2, time.Hour, confirmations_per_day), mails
+}
+
+func receive(t *testing.T, mails <-chan relayed) relayed {
+	t.Helper()
+
+	select {
+	case mail := <-mails:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Fatal("the smarthost got no mail")
+		return relayed{}
+	}
+}
+
+var confirm_link = regexp.MustCompile(`http://nthmail\.test/forward/confirm/([0-9a-f]{32})\r\n`)
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rcpt   string
+		target string
+		err    error
+	}{
+		{name: "valid", rcpt: "alice@nthmail.test", target: "Bob <bob@example.com>"},
+		{name: "other domain", rcpt: "alice@example.com", target: "bob@example.com", err: ErrInvalidInbox},
+		{name: "no domain", rcpt: "alice", target: "bob@example.com", err: ErrInvalidInbox},
+		{name: "header injection", rcpt: "alice\r\nBcc: eve@example.com\r\n@nthmail.test", target: "bob@example.com", err: ErrInvalidInbox},
+		{name: "invalid target", rcpt: "alice@nthmail.test", target: "bob", err: ErrInvalidTarget},
+		{name: "target at our domain", rcpt: "alice@nthmail.test", target: "carol@NTHMAIL.test", err: ErrInvalidTarget},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwarder, mails := new_forwarder(t, 3)
+
+			rule, err := forwarder.Create(context.Background(), test.rcpt, test.target, "", "")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+
+			mail := receive(t, mails)
+			if mail.from != "postmaster@nthmail.test" || mail.to != "bob@example.com" || rule.Target_addr != "bob@example.com" {
+				t.Errorf("confirmation sent from %s to %s for %+v", mail.from, mail.to, rule)
+			}
+			for _, line := range []string{"To: <bob@example.com>\r\n", "Subject: Confirm forwarding from alice@nthmail.test\r\n"} {
+				if !strings.Contains(mail.data, line) {
+					t.Errorf("confirmation misses %q:\n%s", line, mail.data)
+				}
+			}
+			if !confirm_link.MatchString(mail.data) {
+				t.Errorf("confirmation has no link:\n%s", mail.data)
+			}
+		})
+	}
+}
+
+func TestCreateLimits(t *testing.T) {
+	forwarder, mails := new_forwarder(t, 2)
+	ctx := context.Background()
+
+	// two rules per inbox, two confirmation mails per target and day
+	steps := []struct {
+		rcpt, target string
+		err          error
+	}{
+		{"alice@nthmail.test", "bob@example.com", nil},
+		{"carol@nthmail.test", "BOB@example.com", nil},
+		{"dave@nthmail.test", "bob@example.com", ErrRateLimited},
+		{"alice@nthmail.test", "erin@example.com", nil},
+		{"alice@nthmail.test", "frank@example.com", ErrTooManyRules},
+	}
+
+	for i, step := range steps {
+		_, err := forwarder.Create(ctx, step.rcpt, step.target, "", "")
+		if !errors.Is(err, step.err) {
+			t.Fatalf("step %d: err = %v, want %v", i, err, step.err)
+		}
+		if err == nil {
+			receive(t, mails)
+		}
+	}
+}
+
+func TestConfirmAndForward(t *testing.T) {
+	forwarder, mails := new_forwarder(t, 3)
+	ctx := context.Background()
+
+	_, err := forwarder.Create(ctx, "alice@nthmail.test", "bob@example.com", "", "invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := confirm_link.FindStringSubmatch(receive(t, mails).data)[1]
+
+	// unconfirmed rules forward nothing
+	err = forwarder.Forward(ctx, "alice@nthmail.test", "carol@example.org", "carol@example.org", "invoice", []byte("Subject: invoice\r\n\r\nhi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = forwarder.Confirm(ctx, "0123")
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("err = %v for an unknown token", err)
+	}
+	rule, err := forwarder.Confirm(ctx, token)
+	if err != nil || !rule.Confirmed || rule.Target_addr != "bob@example.com" {
+		t.Fatalf("Confirm = %+v, %v", rule, err)
+	}
+	_, err = forwarder.Confirm(ctx, token)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("err = %v when confirming twice", err)
+	}
+
+	tests := []struct {
+		name      string
+		mail_from string
+		subject   string
+		data      string
+		forwarded bool
+	}{
+		{name: "other subject", mail_from: "carol@example.org", subject: "hello", data: "Subject: hello\r\n\r\nhi\r\n"},
+		{name: "matching subject", mail_from: "carol@example.org", subject: "Your INVOICE", data: "Subject: Your INVOICE\r\n\r\nhi\r\n", forwarded: true},
+		{name: "null sender", subject: "invoice", data: "Subject: invoice\r\n\r\nhi\r\n", forwarded: true},
+		{name: "loop", mail_from: "carol@example.org", subject: "invoice", data: "X-Loop: ALICE@nthmail.test\r\nSubject: invoice\r\n\r\nhi\r\n"},
+		{name: "too many hops", mail_from: "carol@example.org", subject: "invoice", data: strings.Repeat("Received: from a by b\r\n", max_received) + "Subject: invoice\r\n\r\nhi\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := forwarder.Forward(ctx, "alice@nthmail.test", test.mail_from, test.mail_from, test.subject, []byte(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.forwarded {
+				return
+			}
+
+			mail := receive(t, mails)
+			if mail.to != "bob@example.com" || mail.data != "X-Loop: alice@nthmail.test\r\n"+test.data {
+				t.Errorf("forwarded %+v", mail)
+			}
+			if test.mail_from == "" {
+				if mail.from != "" {
+					t.Errorf("null sender rewritten to %q", mail.from)
+				}
+				return
+			}
+			if !strings.HasPrefix(mail.from, "SRS0=") || !forwarder.IsBounce(mail.from) {
+				t.Errorf("envelope sender %q is not an SRS address", mail.from)
+			}
+
+			// a bounce to the rewritten sender goes back to the original one
+			err = forwarder.Bounce(ctx, mail.from, []byte("Subject: Undelivered\r\n\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bounce := receive(t, mails)
+			if bounce.from != "" || bounce.to != test.mail_from {
+				t.Errorf("bounce sent from %q to %q", bounce.from, bounce.to)
+			}
+		})
+	}
+
+	// nothing else was relayed
+	select {
+	case mail := <-mails:
+		t.Errorf("unexpected mail %+v", mail)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = forwarder.Delete(ctx, "alice@nthmail.test", rule.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = forwarder.Delete(ctx, "alice@nthmail.test", rule.Id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v when deleting twice", err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		rule          Rule
+		from, subject string
+		want          bool
+	}{
+		{Rule{}, "anyone@example.com", "anything", true},
+		{Rule{Match_from: "@Example.com"}, "Carol <carol@example.COM>", "", true},
+		{Rule{Match_from: "@example.com"}, "carol@example.org", "", false},
+		{Rule{Match_from: "carol", Match_subject: "invoice"}, "carol@example.org", "Invoice 12", true},
+		{Rule{Match_from: "carol", Match_subject: "invoice"}, "carol@example.org", "receipt", false},
+	}
+
+	for _, test := range tests {
+		if got := test.rule.Matches(test.from, test.subject); got != test.want {
+			t.Errorf("%+v matches %q, %q = %v, want %v", test.rule, test.from, test.subject, got, test.want)
+		}
+	}
+}
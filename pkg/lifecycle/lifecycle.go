@@ -0,0 +1,112 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Group runs long-lived components together. A component runs until its
+// context is cancelled and must then stop accepting work, drain what is in
+// progress and return. When the parent context is cancelled (e.g. on
+// SIGTERM) or any component returns on its own, every other component is
+// asked to stop.
+type Group struct {
+	components []component
+}
+
+type component struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func (g *Group) Go(name string, run func(ctx context.Context) error) {
+	g.components = append(g.components, component{name: name, run: run})
+}
+
+type result struct {
+	name string
+	err  error
+}
+
+// Wait starts every component and blocks until all of them have returned.
+// The returned error names the component that stopped first, if it exited
+// before a shutdown was requested, and any component that failed to stop
+// cleanly.
+func (g *Group) Wait(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	results := make(chan result, len(g.components))
+	var wg sync.WaitGroup
+	for _, c := range g.components {
+		wg.Add(1)
+		go func(c component) {
+			defer wg.Done()
+			results <- result{name: c.name, err: c.run(ctx)}
+		}(c)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var errs []error
+	for r := range results {
+		shutting_down := ctx.Err() != nil
+
+		switch {
+		case !shutting_down && r.err != nil:
+			errs = append(errs, fmt.Errorf("%s exited early: %w", r.name, r.err))
+		case !shutting_down:
+			errs = append(errs, fmt.Errorf("%s exited early", r.name))
+		case r.err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", r.name, r.err))
+		default:
+			slog.Info("stopped component", "component", r.name)
+		}
+
+		if !shutting_down {
+			slog.Info("shutting down", "stopped_component", r.name)
+			cancel()
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ServeHTTP runs server until ctx is cancelled, then gracefully shuts it
+// down, waiting at most timeout for in-flight requests.
+func ServeHTTP(ctx context.Context, server *http.Server, timeout time.Duration) error {
+	serve_err := make(chan error, 1)
+	go func() {
+		serve_err <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serve_err:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdown_ctx)
+	if err != nil {
+		server.Close()
+		return fmt.Errorf("could not drain http requests: %w", err)
+	}
+
+	err = <-serve_err
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
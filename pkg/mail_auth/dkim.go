@@ -0,0 +1,310 @@
+package mail_auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM signature verification as described in RFC 6376 and RFC 8463.
+
+type DKIMResult struct {
+	Result   Result `json:"result"`
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// check_dkim verifies every DKIM-Signature header of the message.
+func check_dkim(ctx context.Context, resolver Resolver, headers []raw_header, body []byte) []DKIMResult {
+	var results []DKIMResult
+
+	for i, h := range headers {
+		if !strings.EqualFold(h.key, "DKIM-Signature") {
+			continue
+		}
+
+		results = append(results, verify_signature(ctx, resolver, headers, i, body))
+	}
+
+	return results
+}
+
+type dkim_error struct {
+	result Result
+	reason string
+}
+
+func (e *dkim_error) Error() string {
+	return e.reason
+}
+
+func dkim_perm(format string, args ...any) error {
+	return &dkim_error{result: PermError, reason: fmt.Sprintf(format, args...)}
+}
+
+func dkim_fail(format string, args ...any) error {
+	return &dkim_error{result: Fail, reason: fmt.Sprintf(format, args...)}
+}
+
+func verify_signature(ctx context.Context, resolver Resolver, headers []raw_header, index int, body []byte) DKIMResult {
+	tags := parse_tags(headers[index].value())
+	result := DKIMResult{
+		Domain:   strings.ToLower(tags["d"]),
+		Selector: tags["s"],
+	}
+
+	err := verify(ctx, resolver, tags, headers, index, body)
+	if err == nil {
+		result.Result = Pass
+		return result
+	}
+
+	var dkim_err *dkim_error
+	if errors.As(err, &dkim_err) {
+		result.Result = dkim_err.result
+	} else {
+		result.Result = PermError
+	}
+	result.Reason = err.Error()
+
+	return result
+}
+
+func verify(ctx context.Context, resolver Resolver, tags map[string]string, headers []raw_header, index int, body []byte) error {
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, exists := tags[required]; !exists {
+			return dkim_perm("missing tag %s", required)
+		}
+	}
+
+	if tags["v"] != "1" {
+		return dkim_perm("unsupported version %s", tags["v"])
+	}
+
+	signed_headers := strings.Split(strip_whitespace(tags["h"]), ":")
+	from_signed := false
+	for _, name := range signed_headers {
+		if strings.EqualFold(name, "From") {
+			from_signed = true
+		}
+	}
+	if !from_signed {
+		return dkim_perm("From header is not signed")
+	}
+
+	if x, exists := tags["x"]; exists {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err == nil && time.Now().Unix() > expires {
+			return dkim_fail("signature expired")
+		}
+	}
+
+	var hash_func crypto.Hash
+	var new_hash func() hash.Hash
+	key_type := "rsa"
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		hash_func, new_hash = crypto.SHA256, sha256.New
+	case "rsa-sha1":
+		// RFC 8301 section 3.1
+		return dkim_perm("rsa-sha1 signatures are not accepted")
+	case "ed25519-sha256":
+		hash_func, new_hash = crypto.SHA256, sha256.New
+		key_type = "ed25519"
+	default:
+		return dkim_perm("unsupported algorithm %s", tags["a"])
+	}
+
+	header_canon, body_canon := "simple", "simple"
+	if c, exists := tags["c"]; exists {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		header_canon = parts[0]
+		if len(parts) == 2 {
+			body_canon = parts[1]
+		}
+	}
+	if (header_canon != "simple" && header_canon != "relaxed") || (body_canon != "simple" && body_canon != "relaxed") {
+		return dkim_perm("unsupported canonicalization %s", tags["c"])
+	}
+
+	// body hash
+	canonical_body := canonicalize_body(body, body_canon)
+	if l, exists := tags["l"]; exists {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 {
+			return dkim_perm("invalid body length %s", l)
+		}
+		if length < len(canonical_body) {
+			canonical_body = canonical_body[:length]
+		}
+	}
+
+	body_hash := new_hash()
+	body_hash.Write(canonical_body)
+	expected_bh, err := base64.StdEncoding.DecodeString(strip_whitespace(tags["bh"]))
+	if err != nil {
+		return dkim_perm("invalid body hash encoding")
+	}
+	if !bytes.Equal(body_hash.Sum(nil), expected_bh) {
+		return dkim_fail("body hash did not verify")
+	}
+
+	// header hash
+	header_hash := new_hash()
+	used := make(map[int]bool)
+	for _, name := range signed_headers {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || i == index || !strings.EqualFold(headers[i].key, name) {
+				continue
+			}
+
+			used[i] = true
+			header_hash.Write([]byte(canonicalize_header(headers[i].raw, header_canon)))
+			break
+		}
+	}
+
+	signature_header := canonicalize_header(strip_b_tag(headers[index].raw), header_canon)
+	header_hash.Write([]byte(strings.TrimSuffix(signature_header, "\r\n")))
+	digest := header_hash.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(strip_whitespace(tags["b"]))
+	if err != nil {
+		return dkim_perm("invalid signature encoding")
+	}
+
+	key, err := lookup_key(ctx, resolver, tags["s"], tags["d"], key_type)
+	if err != nil {
+		return err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, hash_func, digest, signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, signature) {
+			err = errors.New("invalid signature")
+		}
+	}
+	if err != nil {
+		return dkim_fail("signature did not verify")
+	}
+
+	return nil
+}
+
+func lookup_key(ctx context.Context, resolver Resolver, selector, domain, key_type string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if is_not_found(err) {
+			return nil, dkim_perm("no key for signature at %s", name)
+		}
+		return nil, &dkim_error{result: TempError, reason: "key lookup failed: " + err.Error()}
+	}
+	if len(txts) == 0 {
+		return nil, dkim_perm("no key for signature at %s", name)
+	}
+
+	tags := parse_tags(strings.Join(txts, ""))
+	if v, exists := tags["v"]; exists && v != "DKIM1" {
+		return nil, dkim_perm("invalid key record version %s", v)
+	}
+
+	if k, exists := tags["k"]; exists && !strings.EqualFold(k, key_type) {
+		return nil, dkim_perm("key type %s does not match algorithm", k)
+	}
+
+	p := strip_whitespace(tags["p"])
+	if p == "" {
+		return nil, dkim_perm("key revoked")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, dkim_perm("invalid key encoding")
+	}
+
+	if key_type == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, dkim_perm("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(data), nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		rsa_key, rsa_err := x509.ParsePKCS1PublicKey(data)
+		if rsa_err != nil {
+			return nil, dkim_perm("invalid rsa key")
+		}
+		return rsa_key, nil
+	}
+
+	rsa_key, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, dkim_perm("key is not an rsa key")
+	}
+
+	return rsa_key, nil
+}
+
+var b_tag = regexp.MustCompile(`(^|[;:\s])(b\s*=)[^;]*`)
+
+// strip_b_tag empties the value of the b= tag of a DKIM-Signature header.
+func strip_b_tag(raw string) string {
+	index := strings.Index(raw, ":")
+	return raw[:index+1] + b_tag.ReplaceAllString(raw[index+1:], "$1$2")
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+func canonicalize_header(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+
+	index := strings.Index(raw, ":")
+	key := strings.ToLower(strings.TrimSpace(raw[:index]))
+	value := unfold(raw[index+1:])
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+
+	return key + ":" + value + "\r\n"
+}
+
+func canonicalize_body(body []byte, canon string) []byte {
+	if canon == "relaxed" {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, line := range lines {
+			line = wsp.ReplaceAll(line, []byte(" "))
+			lines[i] = bytes.TrimRight(line, " ")
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+
+	if len(body) == 0 {
+		if canon == "relaxed" {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+
+	return append(body, '\r', '\n')
+}
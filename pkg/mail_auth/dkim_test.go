@@ -0,0 +1,250 @@
+package mail_auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const test_message = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@localhost\r\n" +
+	"Subject:  Hello\r\n" +
+	"\tthere\r\n" +
+	"\r\n" +
+	"Hi  Bob,\r\n" +
+	"\r\n" +
+	"bye\r\n" +
+	"\r\n"
+
+// sign returns message with a relaxed/relaxed DKIM-Signature of the From, To
+// and Subject fields prepended, with extra tags added before b=.
+func sign(t *testing.T, key crypto.Signer, domain, selector, extra, message string) string {
+	t.Helper()
+
+	algorithm := "rsa-sha256"
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+
+	headers, body := split_message([]byte(message))
+	body_hash := sha256.Sum256(canonicalize_body(body, "relaxed"))
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\th=from:to:subject; %sbh=%s;\r\n\tb=\r\n",
+		algorithm, domain, selector, extra, base64.StdEncoding.EncodeToString(body_hash[:]))
+
+	hash := sha256.New()
+	for _, h := range headers {
+		hash.Write([]byte(canonicalize_header(h.raw, "relaxed")))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalize_header(signature, "relaxed"), "\r\n")))
+	digest := hash.Sum(nil)
+
+	var b []byte
+	var err error
+	if ed_key, ok := key.(ed25519.PrivateKey); ok {
+		b = ed25519.Sign(ed_key, digest)
+	} else {
+		b, err = key.Sign(rand.Reader, digest, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return strings.TrimSuffix(signature, "\r\n") + base64.StdEncoding.EncodeToString(b) + "\r\n" + message
+}
+
+func key_record(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+
+	if ed_key, ok := key.(ed25519.PrivateKey); ok {
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(ed_key.Public().(ed25519.PublicKey))
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+func TestDKIM(t *testing.T) {
+	ed_key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txt := map[string][]string{
+		"ed._domainkey.example.com":      {key_record(t, ed_key)},
+		"rsa._domainkey.example.com":     {key_record(t, rsa_key)},
+		"revoked._domainkey.example.com": {"v=DKIM1; p="},
+		"wrong._domainkey.example.com":   {"v=DKIM1; k=rsa; p=" + strings.Fields(key_record(t, ed_key))[2][2:]},
+	}
+
+	tests := []struct {
+		name    string
+		message func() string
+		want    Result
+		reason  string
+	}{
+		{
+			name:    "ed25519",
+			message: func() string { return sign(t, ed_key, "example.com", "ed", "", test_message) },
+			want:    Pass,
+		},
+		{
+			name:    "rsa",
+			message: func() string { return sign(t, rsa_key, "example.com", "rsa", "", test_message) },
+			want:    Pass,
+		},
+		{
+			name: "relaxed whitespace changes",
+			message: func() string {
+				signed := sign(t, ed_key, "example.com", "ed", "", test_message)
+				signed = strings.Replace(signed, "Subject:  Hello", "subject: Hello ", 1)
+				return strings.Replace(signed, "Hi  Bob,", "Hi Bob, \t", 1) + "\r\n\r\n"
+			},
+			want: Pass,
+		},
+		{
+			name: "lone LF line endings",
+			message: func() string {
+				return strings.ReplaceAll(sign(t, ed_key, "example.com", "ed", "", test_message), "\r\n", "\n")
+			},
+			want: Pass,
+		},
+		{
+			name: "body length",
+			message: func() string {
+				return sign(t, ed_key, "example.com", "ed", "l=16; ", test_message) + "appended\r\n"
+			},
+			want: Pass,
+		},
+		{
+			name: "changed body",
+			message: func() string {
+				return strings.Replace(sign(t, ed_key, "example.com", "ed", "", test_message), "bye", "buy", 1)
+			},
+			want:   Fail,
+			reason: "body hash did not verify",
+		},
+		{
+			name: "changed header",
+			message: func() string {
+				return strings.Replace(sign(t, rsa_key, "example.com", "rsa", "", test_message), "bob@localhost", "eve@localhost", 1)
+			},
+			want:   Fail,
+			reason: "signature did not verify",
+		},
+		{
+			name:    "expired",
+			message: func() string { return sign(t, ed_key, "example.com", "ed", "x=1; ", test_message) },
+			want:    Fail,
+			reason:  "signature expired",
+		},
+		{
+			name:    "no key",
+			message: func() string { return sign(t, ed_key, "example.com", "missing", "", test_message) },
+			want:    PermError,
+			reason:  "no key for signature at missing._domainkey.example.com",
+		},
+		{
+			name:    "revoked key",
+			message: func() string { return sign(t, ed_key, "example.com", "revoked", "", test_message) },
+			want:    PermError,
+			reason:  "key revoked",
+		},
+		{
+			name:    "key type mismatch",
+			message: func() string { return sign(t, ed_key, "example.com", "wrong", "", test_message) },
+			want:    PermError,
+			reason:  "key type rsa does not match algorithm",
+		},
+		{
+			name:    "key lookup failure",
+			message: func() string { return sign(t, ed_key, "fail.example", "ed", "", test_message) },
+			want:    TempError,
+		},
+		{
+			name: "rsa-sha1",
+			message: func() string {
+				return strings.Replace(sign(t, rsa_key, "example.com", "rsa", "", test_message), "rsa-sha256", "rsa-sha1", 1)
+			},
+			want:   PermError,
+			reason: "rsa-sha1 signatures are not accepted",
+		},
+		{
+			name: "from not signed",
+			message: func() string {
+				return strings.Replace(sign(t, ed_key, "example.com", "ed", "", test_message), "h=from:", "h=", 1)
+			},
+			want:   PermError,
+			reason: "From header is not signed",
+		},
+		{
+			name: "missing tag",
+			message: func() string {
+				return "DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=ed; h=from\r\n" + test_message
+			},
+			want:   PermError,
+			reason: "missing tag b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &stub_resolver{txt: txt, fail: map[string]bool{"ed._domainkey.fail.example": true}}
+			headers, body := split_message([]byte(test.message()))
+
+			got := check_dkim(context.Background(), resolver, headers, body)
+			if len(got) != 1 {
+				t.Fatalf("got %d results, want 1", len(got))
+			}
+			if got[0].Result != test.want || (test.reason != "" && got[0].Reason != test.reason) {
+				t.Errorf("got %s (%s), want %s (%s)", got[0].Result, got[0].Reason, test.want, test.reason)
+			}
+		})
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	// the example of RFC 6376 section 3.4.5
+	headers, body := split_message([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+
+	tests := []struct {
+		canon   string
+		headers []string
+		body    string
+	}{
+		{"simple", []string{"A: X\r\n", "B : Y\t\r\n\tZ  \r\n"}, " C \r\nD \t E\r\n"},
+		{"relaxed", []string{"a:X\r\n", "b:Y Z\r\n"}, " C\r\nD E\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.canon, func(t *testing.T) {
+			for i, h := range headers {
+				if got := canonicalize_header(h.raw, test.canon); got != test.headers[i] {
+					t.Errorf("header %d = %q, want %q", i, got, test.headers[i])
+				}
+			}
+			if got := string(canonicalize_body(body, test.canon)); got != test.body {
+				t.Errorf("body = %q, want %q", got, test.body)
+			}
+		})
+	}
+
+	if got := string(canonicalize_body(nil, "simple")); got != "\r\n" {
+		t.Errorf("empty simple body = %q", got)
+	}
+	if got := canonicalize_body([]byte("\r\n\r\n"), "relaxed"); len(got) != 0 {
+		t.Errorf("empty relaxed body = %q", got)
+	}
+}
@@ -0,0 +1,128 @@
+package mail_auth
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC evaluation as described in RFC 7489.
+
+type DMARCResult struct {
+	Result     Result `json:"result"`
+	FromDomain string `json:"from_domain"`
+	Policy     string `json:"policy,omitempty"`
+}
+
+type dmarc_record struct {
+	policy, subdomain_policy string
+	adkim, aspf              string
+}
+
+func check_dmarc(ctx context.Context, resolver Resolver, headers []raw_header, spf Result, spf_domain string, dkim []DKIMResult) DMARCResult {
+	var result DMARCResult
+
+	var from_headers []raw_header
+	for _, h := range headers {
+		if strings.EqualFold(h.key, "From") {
+			from_headers = append(from_headers, h)
+		}
+	}
+	if len(from_headers) != 1 {
+		result.Result = PermError
+		return result
+	}
+
+	addrs, err := mail.ParseAddressList(from_headers[0].value())
+	if err != nil || len(addrs) != 1 {
+		result.Result = PermError
+		return result
+	}
+
+	index := strings.LastIndex(addrs[0].Address, "@")
+	from_domain := strings.ToLower(addrs[0].Address[index+1:])
+	result.FromDomain = from_domain
+
+	org_domain := organizational_domain(from_domain)
+	record, res := lookup_dmarc(ctx, resolver, from_domain)
+	if res == None && org_domain != from_domain {
+		record, res = lookup_dmarc(ctx, resolver, org_domain)
+		if res == "" {
+			record.policy = record.subdomain_policy
+		}
+	}
+	if res != "" {
+		result.Result = res
+		return result
+	}
+	result.Policy = record.policy
+
+	aligned := func(domain, mode string) bool {
+		domain = strings.ToLower(domain)
+		if mode == "s" {
+			return domain == from_domain
+		}
+		return organizational_domain(domain) == org_domain
+	}
+
+	if spf == Pass && aligned(spf_domain, record.aspf) {
+		result.Result = Pass
+		return result
+	}
+
+	for _, d := range dkim {
+		if d.Result == Pass && aligned(d.Domain, record.adkim) {
+			result.Result = Pass
+			return result
+		}
+	}
+
+	result.Result = Fail
+	return result
+}
+
+func lookup_dmarc(ctx context.Context, resolver Resolver, domain string) (dmarc_record, Result) {
+	var record dmarc_record
+
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil && !is_not_found(err) {
+		return record, TempError
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		return record, None
+	}
+
+	tags := parse_tags(records[0])
+	record.policy = strings.ToLower(tags["p"])
+	if record.policy != "none" && record.policy != "quarantine" && record.policy != "reject" {
+		return record, PermError
+	}
+
+	record.subdomain_policy = strings.ToLower(tags["sp"])
+	if record.subdomain_policy == "" {
+		record.subdomain_policy = record.policy
+	}
+
+	record.adkim = strings.ToLower(tags["adkim"])
+	record.aspf = strings.ToLower(tags["aspf"])
+
+	return record, ""
+}
+
+func organizational_domain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return org
+}
@@ -0,0 +1,126 @@
+package mail_auth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDMARC(t *testing.T) {
+	txt := map[string][]string{
+		"_dmarc.example.com":     {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.example":  {"v=DMARC1; p=none; adkim=s; aspf=s"},
+		"_dmarc.invalid.example": {"v=DMARC1; p=maybe"},
+		"_dmarc.two.example":     {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+	}
+
+	tests := []struct {
+		name       string
+		from       string
+		spf        Result
+		spf_domain string
+		dkim       []DKIMResult
+		want       DMARCResult
+	}{
+		{
+			name:       "aligned spf",
+			from:       "From: alice@example.com\r\n",
+			spf:        Pass,
+			spf_domain: "example.com",
+			want:       DMARCResult{Result: Pass, FromDomain: "example.com", Policy: "reject"},
+		},
+		{
+			name:       "relaxed spf alignment",
+			from:       "From: alice@example.com\r\n",
+			spf:        Pass,
+			spf_domain: "bounces.example.com",
+			want:       DMARCResult{Result: Pass, FromDomain: "example.com", Policy: "reject"},
+		},
+		{
+			name:       "unaligned spf",
+			from:       "From: alice@example.com\r\n",
+			spf:        Pass,
+			spf_domain: "example.net",
+			want:       DMARCResult{Result: Fail, FromDomain: "example.com", Policy: "reject"},
+		},
+		{
+			name: "aligned dkim",
+			from: "From: Alice <alice@example.com>\r\n",
+			spf:  Fail,
+			dkim: []DKIMResult{{Result: Fail, Domain: "example.com"}, {Result: Pass, Domain: "mail.example.com"}},
+			want: DMARCResult{Result: Pass, FromDomain: "example.com", Policy: "reject"},
+		},
+		{
+			name: "failed dkim",
+			from: "From: alice@example.com\r\n",
+			dkim: []DKIMResult{{Result: Fail, Domain: "example.com"}},
+			want: DMARCResult{Result: Fail, FromDomain: "example.com", Policy: "reject"},
+		},
+		{
+			name: "subdomain policy",
+			from: "From: alice@mail.example.com\r\n",
+			dkim: []DKIMResult{{Result: Pass, Domain: "example.com"}},
+			want: DMARCResult{Result: Pass, FromDomain: "mail.example.com", Policy: "quarantine"},
+		},
+		{
+			name: "strict dkim alignment",
+			from: "From: alice@strict.example\r\n",
+			dkim: []DKIMResult{{Result: Pass, Domain: "mail.strict.example"}},
+			want: DMARCResult{Result: Fail, FromDomain: "strict.example", Policy: "none"},
+		},
+		{
+			name:       "strict spf alignment",
+			from:       "From: alice@strict.example\r\n",
+			spf:        Pass,
+			spf_domain: "STRICT.example",
+			want:       DMARCResult{Result: Pass, FromDomain: "strict.example", Policy: "none"},
+		},
+		{
+			name: "no record",
+			from: "From: alice@example.net\r\n",
+			spf:  Pass,
+			want: DMARCResult{Result: None, FromDomain: "example.net"},
+		},
+		{
+			name: "several records",
+			from: "From: alice@two.example\r\n",
+			want: DMARCResult{Result: None, FromDomain: "two.example"},
+		},
+		{
+			name: "invalid policy",
+			from: "From: alice@invalid.example\r\n",
+			want: DMARCResult{Result: PermError, FromDomain: "invalid.example"},
+		},
+		{
+			name: "lookup failure",
+			from: "From: alice@fail.example\r\n",
+			want: DMARCResult{Result: TempError, FromDomain: "fail.example"},
+		},
+		{
+			name: "two from fields",
+			from: "From: alice@example.com\r\nFrom: eve@example.net\r\n",
+			want: DMARCResult{Result: PermError},
+		},
+		{
+			name: "two from addresses",
+			from: "From: alice@example.com, eve@example.net\r\n",
+			want: DMARCResult{Result: PermError},
+		},
+		{
+			name: "no from",
+			from: "Sender: alice@example.com\r\n",
+			want: DMARCResult{Result: PermError},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &stub_resolver{txt: txt, fail: map[string]bool{"_dmarc.fail.example": true}}
+			headers, _ := split_message([]byte(test.from + "\r\nbody\r\n"))
+
+			got := check_dmarc(context.Background(), resolver, headers, test.spf, test.spf_domain, test.dkim)
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package mail_auth
+
+import (
+	"bytes"
+	"strings"
+)
+
+// raw_header is a header field exactly as it appears in the message,
+// including folding and the trailing CRLF, as DKIM needs it.
+type raw_header struct {
+	key string
+	raw string
+}
+
+func (h raw_header) value() string {
+	index := strings.Index(h.raw, ":")
+	return strings.TrimSpace(unfold(h.raw[index+1:]))
+}
+
+func unfold(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "")
+	return strings.ReplaceAll(s, "\n", "")
+}
+
+// to_crlf turns lone LF line endings into CRLF.
+func to_crlf(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) {
+		return data
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(data))
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+	}
+
+	return out.Bytes()
+}
+
+// split_message returns the header fields in order and the body of a message
+// with CRLF line endings.
+func split_message(data []byte) ([]raw_header, []byte) {
+	data = to_crlf(data)
+
+	var header_block, body []byte
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		body = data[2:]
+	} else if index := bytes.Index(data, []byte("\r\n\r\n")); index >= 0 {
+		header_block = data[:index+2]
+		body = data[index+4:]
+	} else {
+		header_block = data
+	}
+
+	var headers []raw_header
+	for _, line := range strings.SplitAfter(string(header_block), "\r\n") {
+		if line == "" {
+			continue
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].raw += line
+			continue
+		}
+
+		index := strings.Index(line, ":")
+		if index < 0 {
+			continue
+		}
+
+		headers = append(headers, raw_header{
+			key: strings.TrimSpace(line[:index]),
+			raw: line,
+		})
+	}
+
+	return headers, body
+}
+
+// parse_tags parses a "tag=value; tag=value" list as used by DKIM, DMARC and
+// DKIM key records.
+func parse_tags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		index := strings.Index(part, "=")
+		if index < 0 {
+			continue
+		}
+
+		key := strings.TrimSpace(part[:index])
+		value := strings.TrimSpace(part[index+1:])
+		if key == "" {
+			continue
+		}
+
+		if _, exists := tags[key]; !exists {
+			tags[key] = value
+		}
+	}
+
+	return tags
+}
+
+func strip_whitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
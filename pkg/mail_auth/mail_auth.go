@@ -0,0 +1,178 @@
+package mail_auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Results are the SPF, DKIM and DMARC verdicts of a message.
+type Results struct {
+	SPF       Result       `json:"spf"`
+	SPFDomain string       `json:"spf_domain"`
+	DKIM      []DKIMResult `json:"dkim"`
+	DMARC     DMARCResult  `json:"dmarc"`
+}
+
+// DKIMSummary folds every signature result into one: pass if any signature
+// verified, none if the message is unsigned, otherwise the first failure.
+func (r Results) DKIMSummary() Result {
+	if len(r.DKIM) == 0 {
+		return None
+	}
+
+	for _, d := range r.DKIM {
+		if d.Result == Pass {
+			return Pass
+		}
+	}
+
+	return r.DKIM[0].Result
+}
+
+type Verifier struct {
+	Resolver Resolver
+	Timeout  time.Duration
+}
+
+// Verify checks SPF for the client ip, HELO name and MAIL FROM address, every
+// DKIM signature of data and the DMARC alignment of the results.
+func (v Verifier) Verify(ctx context.Context, ip net.IP, helo, mail_from string, data []byte) Results {
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+
+	var results Results
+	headers, body := split_message(data)
+
+	results.SPF, results.SPFDomain = check_spf(ctx, v.Resolver, ip, helo, mail_from)
+	results.DKIM = check_dkim(ctx, v.Resolver, headers, body)
+	results.DMARC = check_dmarc(ctx, v.Resolver, headers, results.SPF, results.SPFDomain, results.DKIM)
+
+	return results
+}
+
+// Header formats the results as an Authentication-Results header field
+// (RFC 8601), including the trailing CRLF.
+func (r Results) Header(authserv_id, mail_from string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Authentication-Results: %s", authserv_id)
+
+	if mail_from != "" {
+		fmt.Fprintf(&b, ";\r\n\tspf=%s smtp.mailfrom=%s", r.SPF, mail_from)
+	} else {
+		fmt.Fprintf(&b, ";\r\n\tspf=%s smtp.helo=%s", r.SPF, r.SPFDomain)
+	}
+
+	if len(r.DKIM) == 0 {
+		b.WriteString(";\r\n\tdkim=none")
+	}
+	for _, d := range r.DKIM {
+		fmt.Fprintf(&b, ";\r\n\tdkim=%s header.d=%s header.s=%s", d.Result, d.Domain, d.Selector)
+		if d.Reason != "" {
+			fmt.Fprintf(&b, " (%s)", strings.ReplaceAll(d.Reason, ")", ""))
+		}
+	}
+
+	fmt.Fprintf(&b, ";\r\n\tdmarc=%s", r.DMARC.Result)
+	if r.DMARC.FromDomain != "" {
+		fmt.Fprintf(&b, " header.from=%s", r.DMARC.FromDomain)
+	}
+	if r.DMARC.Policy != "" {
+		fmt.Fprintf(&b, " policy.dmarc=%s", r.DMARC.Policy)
+	}
+	b.WriteString("\r\n")
+
+	return b.String()
+}
+
+// StripResults removes the Authentication-Results header fields of data
+// that claim to come from authserv_id, as RFC 8601 section 5 asks of a
+// receiver adding its own, since a sender could forge them. The rest of the
+// message is left as is.
+func StripResults(data []byte, authserv_id string) []byte {
+	var out []byte
+	field_start, field_end := -1, 0
+
+	flush := func() {
+		if field_start >= 0 && !is_results_of(data[field_start:field_end], authserv_id) {
+			out = append(out, data[field_start:field_end]...)
+		}
+	}
+
+	for pos := 0; pos < len(data); {
+		next := len(data)
+		if end := bytes.IndexByte(data[pos:], '\n'); end >= 0 {
+			next = pos + end + 1
+		}
+		line := data[pos:next]
+
+		// the empty line ending the header
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			flush()
+			return append(out, data[pos:]...)
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			field_end = next
+		} else {
+			flush()
+			field_start, field_end = pos, next
+		}
+		pos = next
+	}
+
+	flush()
+	return out
+}
+
+// is_results_of tells whether field is an Authentication-Results header
+// field of authserv_id.
+func is_results_of(field []byte, authserv_id string) bool {
+	name, value, ok := strings.Cut(string(field), ":")
+	if !ok || !strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") {
+		return false
+	}
+
+	// the authserv-id comes first, with an optional version and comments
+	id, _, _ := strings.Cut(unfold(value), ";")
+	id = strip_comments(id)
+	fields := strings.Fields(id)
+
+	return len(fields) != 0 && strings.EqualFold(fields[0], authserv_id)
+}
+
+// strip_comments removes the (possibly nested) comments of a header value.
+func strip_comments(s string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range s {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
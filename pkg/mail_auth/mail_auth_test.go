@@ -0,0 +1,129 @@
+package mail_auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	resolver := &stub_resolver{txt: map[string][]string{
+		"example.com":               {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"ed._domainkey.example.com": {key_record(t, key)},
+		"_dmarc.example.com":        {"v=DMARC1; p=reject"},
+	}}
+	verifier := Verifier{Resolver: resolver}
+
+	tests := []struct {
+		name      string
+		ip        string
+		mail_from string
+		data      string
+		header    string
+	}{
+		{
+			name:      "signed from an allowed ip",
+			ip:        "192.0.2.1",
+			mail_from: "alice@example.com",
+			data:      sign(t, key, "example.com", "ed", "", test_message),
+			header: "Authentication-Results: mx.localhost;\r\n" +
+				"\tspf=pass smtp.mailfrom=alice@example.com;\r\n" +
+				"\tdkim=pass header.d=example.com header.s=ed;\r\n" +
+				"\tdmarc=pass header.from=example.com policy.dmarc=reject\r\n",
+		},
+		{
+			name:      "unsigned from another ip",
+			ip:        "198.51.100.1",
+			mail_from: "alice@example.com",
+			data:      test_message,
+			header: "Authentication-Results: mx.localhost;\r\n" +
+				"\tspf=fail smtp.mailfrom=alice@example.com;\r\n" +
+				"\tdkim=none;\r\n" +
+				"\tdmarc=fail header.from=example.com policy.dmarc=reject\r\n",
+		},
+		{
+			name: "bounce with a bad signature",
+			ip:   "198.51.100.1",
+			data: sign(t, key, "example.com", "missing", "", test_message),
+			header: "Authentication-Results: mx.localhost;\r\n" +
+				"\tspf=none smtp.helo=mx.example.net;\r\n" +
+				"\tdkim=permerror header.d=example.com header.s=missing (no key for signature at missing._domainkey.example.com);\r\n" +
+				"\tdmarc=fail header.from=example.com policy.dmarc=reject\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results := verifier.Verify(context.Background(), net.ParseIP(test.ip), "mx.example.net", test.mail_from, []byte(test.data))
+			if got := results.Header("mx.localhost", test.mail_from); got != test.header {
+				t.Errorf("got\n%s\nwant\n%s", got, test.header)
+			}
+		})
+	}
+}
+
+func TestDKIMSummary(t *testing.T) {
+	tests := []struct {
+		dkim []DKIMResult
+		want Result
+	}{
+		{nil, None},
+		{[]DKIMResult{{Result: Fail}, {Result: Pass}}, Pass},
+		{[]DKIMResult{{Result: TempError}, {Result: Fail}}, TempError},
+	}
+
+	for _, test := range tests {
+		if got := (Results{DKIM: test.dkim}).DKIMSummary(); got != test.want {
+			t.Errorf("DKIMSummary(%v) = %s, want %s", test.dkim, got, test.want)
+		}
+	}
+}
+
+func TestStripResults(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "ours",
+			data: "Authentication-Results: mx.localhost; spf=pass\r\nFrom: a@b.c\r\n\r\nbody\r\n",
+			want: "From: a@b.c\r\n\r\nbody\r\n",
+		},
+		{
+			name: "folded, with a version and comments",
+			data: "From: a@b.c\r\nauthentication-results: (forged) MX.localhost 1;\r\n\tdkim=pass\r\nTo: d@e.f\r\n\r\nbody\r\n",
+			want: "From: a@b.c\r\nTo: d@e.f\r\n\r\nbody\r\n",
+		},
+		{
+			name: "another server's",
+			data: "Authentication-Results: mx.example.com; spf=pass\r\n\r\nbody\r\n",
+			want: "Authentication-Results: mx.example.com; spf=pass\r\n\r\nbody\r\n",
+		},
+		{
+			name: "prefix of another server",
+			data: "Authentication-Results: mx.localhost.example; spf=pass\n\n",
+			want: "Authentication-Results: mx.localhost.example; spf=pass\n\n",
+		},
+		{
+			name: "in the body",
+			data: "From: a@b.c\n\nAuthentication-Results: mx.localhost; spf=pass\n",
+			want: "From: a@b.c\n\nAuthentication-Results: mx.localhost; spf=pass\n",
+		},
+		{
+			name: "no body",
+			data: "Authentication-Results: mx.localhost; spf=pass\r\nFrom: a@b.c\r\n",
+			want: "From: a@b.c\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(StripResults([]byte(test.data), "mx.localhost")); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package mail_auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Resolver is the subset of DNS lookups the verifiers need. *net.Resolver
+// implements it; tests can plug in a stub.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// NewResolver returns the system resolver, or one that sends every query to
+// server (host:port) when it is not empty.
+func NewResolver(server string, timeout time.Duration) Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: timeout}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// is_not_found reports whether err means the name has no such records, as
+// opposed to a temporary lookup failure.
+func is_not_found(err error) bool {
+	var dns_err *net.DNSError
+	if errors.As(err, &dns_err) {
+		return dns_err.IsNotFound
+	}
+
+	return false
+}
@@ -0,0 +1,65 @@
+package mail_auth
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// stub_resolver answers from its maps. Names missing from them do not exist,
+// and names in fail time out.
+type stub_resolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+
+	queries []string
+}
+
+func (r *stub_resolver) lookup(kind, name string, records map[string][]string) ([]string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	r.queries = append(r.queries, kind+" "+name)
+
+	if r.fail[name] {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true, IsTemporary: true}
+	}
+
+	values, exists := records[name]
+	if !exists {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return values, nil
+}
+
+func (r *stub_resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.lookup("txt", name, r.txt)
+}
+
+func (r *stub_resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	values, err := r.lookup("ip", host, r.ip)
+
+	var addrs []net.IPAddr
+	for _, value := range values {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(value)})
+	}
+
+	return addrs, err
+}
+
+func (r *stub_resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	values, err := r.lookup("mx", name, r.mx)
+
+	var mxs []*net.MX
+	for _, value := range values {
+		mxs = append(mxs, &net.MX{Host: value + ".", Pref: 10})
+	}
+
+	return mxs, err
+}
+
+func (r *stub_resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.lookup("ptr", addr, r.ptr)
+}
@@ -0,0 +1,559 @@
+package mail_auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SPF evaluation as described in RFC 7208.
+
+const (
+	spf_max_lookups      = 10
+	spf_max_void_lookups = 2
+	spf_max_mx_names     = 10
+)
+
+var errSPFPerm = errors.New("permerror")
+var errSPFTemp = errors.New("temperror")
+
+type spf_checker struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+
+	lookups      int
+	void_lookups int
+}
+
+// check_spf evaluates the SPF policy of the MAIL FROM domain, or of the HELO
+// name for the null reverse-path, for a client connecting from ip. It returns
+// the result and the domain that was checked.
+func check_spf(ctx context.Context, resolver Resolver, ip net.IP, helo, mail_from string) (Result, string) {
+	sender := mail_from
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+
+	index := strings.LastIndex(sender, "@")
+	if index < 0 {
+		sender = "postmaster@" + sender
+		index = strings.LastIndex(sender, "@")
+	}
+	domain := strings.ToLower(strings.TrimSuffix(sender[index+1:], "."))
+
+	checker := &spf_checker{
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+
+	return checker.check_host(ctx, domain), domain
+}
+
+func (c *spf_checker) check_host(ctx context.Context, domain string) Result {
+	if !valid_domain(domain) {
+		return None
+	}
+
+	record, result := c.lookup_record(ctx, domain)
+	if record == "" {
+		return result
+	}
+
+	terms := strings.Fields(record)[1:]
+	redirect := ""
+
+	for _, term := range terms {
+		if name, value, ok := spf_modifier(term); ok {
+			if name == "redirect" {
+				if redirect != "" {
+					return PermError
+				}
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier = Fail
+			term = term[1:]
+		case '~':
+			qualifier = SoftFail
+			term = term[1:]
+		case '?':
+			qualifier = Neutral
+			term = term[1:]
+		}
+
+		match, err := c.match(ctx, domain, term)
+		switch {
+		case errors.Is(err, errSPFTemp):
+			return TempError
+		case err != nil:
+			return PermError
+		case match:
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		err := c.count_lookup()
+		if err != nil {
+			return PermError
+		}
+
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return PermError
+		}
+
+		result := c.check_host(ctx, target)
+		if result == None {
+			return PermError
+		}
+		return result
+	}
+
+	return Neutral
+}
+
+func (c *spf_checker) lookup_record(ctx context.Context, domain string) (string, Result) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil && !is_not_found(err) {
+		return "", TempError
+	}
+
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", None
+	case 1:
+		return records[0], ""
+	default:
+		return "", PermError
+	}
+}
+
+func spf_modifier(term string) (string, string, bool) {
+	index := strings.Index(term, "=")
+	if index <= 0 || strings.ContainsAny(term[:index], ":/") {
+		return "", "", false
+	}
+
+	return strings.ToLower(term[:index]), term[index+1:], true
+}
+
+func (c *spf_checker) count_lookup() error {
+	c.lookups++
+	if c.lookups > spf_max_lookups {
+		return errSPFPerm
+	}
+
+	return nil
+}
+
+func (c *spf_checker) count_void() error {
+	c.void_lookups++
+	if c.void_lookups > spf_max_void_lookups {
+		return errSPFPerm
+	}
+
+	return nil
+}
+
+func (c *spf_checker) match(ctx context.Context, domain, term string) (bool, error) {
+	name, arg := term, ""
+	if index := strings.IndexAny(term, ":/"); index >= 0 {
+		name, arg = term[:index], term[index:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return arg == "", nil
+
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+		if err := c.count_lookup(); err != nil {
+			return false, err
+		}
+
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+
+		switch c.check_host(ctx, target) {
+		case Pass:
+			return true, nil
+		case TempError:
+			return false, errSPFTemp
+		case PermError, None:
+			return false, errSPFPerm
+		default:
+			return false, nil
+		}
+
+	case "a", "mx":
+		if err := c.count_lookup(); err != nil {
+			return false, err
+		}
+
+		target, cidr4, cidr6, err := c.domain_spec_cidr(arg, domain)
+		if err != nil {
+			return false, err
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := c.resolver.LookupMX(ctx, target)
+			if err != nil && !is_not_found(err) {
+				return false, errSPFTemp
+			}
+			if len(mxs) == 0 {
+				return false, c.count_void()
+			}
+			if len(mxs) > spf_max_mx_names {
+				return false, errSPFPerm
+			}
+
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			addrs, err := c.resolver.LookupIPAddr(ctx, host)
+			if err != nil && !is_not_found(err) {
+				return false, errSPFTemp
+			}
+			if len(addrs) == 0 && name == "a" {
+				return false, c.count_void()
+			}
+
+			for _, addr := range addrs {
+				if ip_matches(c.ip, addr.IP, cidr4, cidr6) {
+					return true, nil
+				}
+			}
+		}
+
+		return false, nil
+
+	case "ptr":
+		if err := c.count_lookup(); err != nil {
+			return false, err
+		}
+
+		target := domain
+		if strings.HasPrefix(arg, ":") {
+			expanded, err := c.expand(arg[1:], domain)
+			if err != nil {
+				return false, err
+			}
+			target = expanded
+		}
+
+		names, err := c.resolver.LookupAddr(ctx, c.ip.String())
+		if err != nil {
+			return false, nil
+		}
+
+		for i, n := range names {
+			if i >= spf_max_mx_names {
+				break
+			}
+
+			n = strings.ToLower(strings.TrimSuffix(n, "."))
+			if n != target && !strings.HasSuffix(n, "."+target) {
+				continue
+			}
+
+			addrs, err := c.resolver.LookupIPAddr(ctx, n)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				if addr.IP.Equal(c.ip) {
+					return true, nil
+				}
+			}
+		}
+
+		return false, nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+
+		_, ip_net, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, errSPFPerm
+		}
+
+		return ip_net.Contains(c.ip), nil
+
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFPerm
+		}
+		if err := c.count_lookup(); err != nil {
+			return false, err
+		}
+
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+
+		addrs, err := c.resolver.LookupIPAddr(ctx, target)
+		if err != nil && !is_not_found(err) {
+			return false, errSPFTemp
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return true, nil
+			}
+		}
+
+		return false, c.count_void()
+	}
+
+	return false, errSPFPerm
+}
+
+// domain_spec_cidr parses the argument of the a and mx mechanisms:
+// [":" domain-spec] ["/" ip4-cidr-length] ["//" ip6-cidr-length]
+func (c *spf_checker) domain_spec_cidr(arg, domain string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+
+	if index := strings.Index(arg, "//"); index >= 0 {
+		n, err := strconv.Atoi(arg[index+2:])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+		cidr6 = n
+		arg = arg[:index]
+	}
+
+	if index := strings.LastIndex(arg, "/"); index >= 0 {
+		n, err := strconv.Atoi(arg[index+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+		cidr4 = n
+		arg = arg[:index]
+	}
+
+	if arg == "" {
+		return domain, cidr4, cidr6, nil
+	}
+
+	if !strings.HasPrefix(arg, ":") {
+		return "", 0, 0, errSPFPerm
+	}
+
+	target, err := c.expand(arg[1:], domain)
+	return target, cidr4, cidr6, err
+}
+
+func ip_matches(client, candidate net.IP, cidr4, cidr6 int) bool {
+	if client4, candidate4 := client.To4(), candidate.To4(); client4 != nil || candidate4 != nil {
+		if client4 == nil || candidate4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(cidr4, 32)
+		return client4.Mask(mask).Equal(candidate4.Mask(mask))
+	}
+
+	mask := net.CIDRMask(cidr6, 128)
+	return client.Mask(mask).Equal(candidate.Mask(mask))
+}
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7).
+func (c *spf_checker) expand(spec, domain string) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+
+		i++
+		if i >= len(spec) {
+			return "", errSPFPerm
+		}
+
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 0 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		value, err := c.expand_macro(macro, domain)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+	}
+
+	return strings.TrimSuffix(strings.ToLower(out.String()), "."), nil
+}
+
+func (c *spf_checker) expand_macro(macro, domain string) (string, error) {
+	if macro == "" {
+		return "", errSPFPerm
+	}
+
+	letter := macro[0]
+	escape := letter >= 'A' && letter <= 'Z'
+
+	local, sender_domain := c.sender, c.sender
+	if index := strings.LastIndex(c.sender, "@"); index >= 0 {
+		local, sender_domain = c.sender[:index], c.sender[index+1:]
+	}
+
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = sender_domain
+	case 'd':
+		value = domain
+	case 'i':
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			var nibbles []string
+			for _, b := range c.ip.To16() {
+				nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	case 'p':
+		value = "unknown"
+	case 'v':
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'h':
+		value = c.helo
+	default:
+		return "", errSPFPerm
+	}
+
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", errSPFPerm
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+
+	reverse := false
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		reverse = true
+		rest = rest[1:]
+	}
+
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errSPFPerm
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+
+	if escape {
+		value = url.PathEscape(value)
+	}
+
+	return value, nil
+}
+
+func valid_domain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+
+	return true
+}
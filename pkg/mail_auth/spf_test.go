@@ -0,0 +1,223 @@
+package mail_auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestSPF(t *testing.T) {
+	tests := []struct {
+		name      string
+		ip        string
+		mail_from string
+		txt       map[string][]string
+		ip_addrs  map[string][]string
+		mx        map[string][]string
+		ptr       map[string][]string
+		fail      []string
+		want      Result
+		domain    string
+	}{
+		{
+			name: "no record",
+			want: None,
+		},
+		{
+			name: "ip4 pass",
+			txt:  map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.0/24 -all"}},
+			want: Pass,
+		},
+		{
+			name: "ip4 host",
+			txt:  map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.1 -all"}},
+			want: Pass,
+		},
+		{
+			name: "ip6",
+			ip:   "2001:db8::1",
+			txt:  map[string][]string{"example.com": {"v=spf1 ip6:2001:db8::/32 -all"}},
+			want: Pass,
+		},
+		{
+			name: "fail",
+			txt:  map[string][]string{"example.com": {"v=spf1 ip4:198.51.100.0/24 -all"}},
+			want: Fail,
+		},
+		{
+			name: "softfail",
+			txt:  map[string][]string{"example.com": {"v=spf1 ~all"}},
+			want: SoftFail,
+		},
+		{
+			name: "neutral",
+			txt:  map[string][]string{"example.com": {"v=spf1 ?all"}},
+			want: Neutral,
+		},
+		{
+			name: "no match is neutral",
+			txt:  map[string][]string{"example.com": {"v=spf1 ip4:198.51.100.1"}},
+			want: Neutral,
+		},
+		{
+			name: "other txt records are ignored",
+			txt:  map[string][]string{"example.com": {"google-site-verification=x", "V=SPF1 +all"}},
+			want: Pass,
+		},
+		{
+			name: "two records",
+			txt:  map[string][]string{"example.com": {"v=spf1 +all", "v=spf1 -all"}},
+			want: PermError,
+		},
+		{
+			name: "lookup failure",
+			fail: []string{"example.com"},
+			want: TempError,
+		},
+		{
+			name: "a",
+			txt:  map[string][]string{"example.com": {"v=spf1 a -all"}},
+			ip_addrs: map[string][]string{
+				"example.com": {"192.0.2.1"},
+			},
+			want: Pass,
+		},
+		{
+			name: "a with cidr",
+			txt:  map[string][]string{"example.com": {"v=spf1 a:other.example/24 -all"}},
+			ip_addrs: map[string][]string{
+				"other.example": {"192.0.2.200"},
+			},
+			want: Pass,
+		},
+		{
+			name: "mx",
+			txt:  map[string][]string{"example.com": {"v=spf1 mx -all"}},
+			mx:   map[string][]string{"example.com": {"mx1.example.com", "mx2.example.com"}},
+			ip_addrs: map[string][]string{
+				"mx1.example.com": {"198.51.100.1"},
+				"mx2.example.com": {"192.0.2.1"},
+			},
+			want: Pass,
+		},
+		{
+			name: "include pass",
+			txt: map[string][]string{
+				"example.com":   {"v=spf1 include:_spf.provider -all"},
+				"_spf.provider": {"v=spf1 ip4:192.0.2.0/24 -all"},
+			},
+			want: Pass,
+		},
+		{
+			name: "include fail does not match",
+			txt: map[string][]string{
+				"example.com":   {"v=spf1 include:_spf.provider ~all"},
+				"_spf.provider": {"v=spf1 -all"},
+			},
+			want: SoftFail,
+		},
+		{
+			name: "include without record",
+			txt:  map[string][]string{"example.com": {"v=spf1 include:missing.example -all"}},
+			want: PermError,
+		},
+		{
+			name: "redirect",
+			txt: map[string][]string{
+				"example.com":   {"v=spf1 redirect=_spf.provider"},
+				"_spf.provider": {"v=spf1 -all"},
+			},
+			want: Fail,
+		},
+		{
+			name: "redirect to nothing",
+			txt:  map[string][]string{"example.com": {"v=spf1 redirect=missing.example"}},
+			want: PermError,
+		},
+		{
+			name: "exists with macros",
+			txt: map[string][]string{
+				"mail.example.com": {"v=spf1 exists:%{ir}.%{l1r-}.%{d2}.spf.example -all"},
+			},
+			mail_from: "first-second@mail.example.com",
+			ip_addrs: map[string][]string{
+				"1.2.0.192.first.example.com.spf.example": {"127.0.0.2"},
+			},
+			domain: "mail.example.com",
+			want:   Pass,
+		},
+		{
+			name: "ptr",
+			txt:  map[string][]string{"example.com": {"v=spf1 ptr -all"}},
+			ptr:  map[string][]string{"192.0.2.1": {"mail.example.com."}},
+			ip_addrs: map[string][]string{
+				"mail.example.com": {"192.0.2.1"},
+			},
+			want: Pass,
+		},
+		{
+			name: "too many void lookups",
+			txt: map[string][]string{
+				"example.com": {"v=spf1 a:a.example a:b.example a:c.example +all"},
+			},
+			want: PermError,
+		},
+		{
+			name: "unknown mechanism",
+			txt:  map[string][]string{"example.com": {"v=spf1 foo:bar +all"}},
+			want: PermError,
+		},
+		{
+			name:      "null sender checks the helo",
+			mail_from: "-",
+			txt:       map[string][]string{"mx.example.net": {"v=spf1 +all"}},
+			domain:    "mx.example.net",
+			want:      Pass,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &stub_resolver{txt: test.txt, ip: test.ip_addrs, mx: test.mx, ptr: test.ptr, fail: make(map[string]bool)}
+			for _, name := range test.fail {
+				resolver.fail[name] = true
+			}
+
+			ip := test.ip
+			if ip == "" {
+				ip = "192.0.2.1"
+			}
+			mail_from := test.mail_from
+			switch mail_from {
+			case "":
+				mail_from = "alice@example.com"
+			case "-":
+				mail_from = ""
+			}
+			domain := test.domain
+			if domain == "" {
+				domain = "example.com"
+			}
+
+			got, got_domain := check_spf(context.Background(), resolver, net.ParseIP(ip), "mx.example.net", mail_from)
+			if got != test.want || got_domain != domain {
+				t.Errorf("got %s for %s, want %s for %s (queries %q)", got, got_domain, test.want, domain, resolver.queries)
+			}
+		})
+	}
+}
+
+func TestSPFLookupLimit(t *testing.T) {
+	txt := map[string][]string{}
+	for i := 0; i < 11; i++ {
+		txt[fmt.Sprintf("l%d.example", i)] = []string{fmt.Sprintf("v=spf1 include:l%d.example", i+1)}
+	}
+	txt["l11.example"] = []string{"v=spf1 +all"}
+	txt["example.com"] = []string{"v=spf1 include:l0.example -all"}
+
+	got, _ := check_spf(context.Background(), &stub_resolver{txt: txt}, net.ParseIP("192.0.2.1"), "", "alice@example.com")
+	if got != PermError {
+		t.Errorf("got %s, want %s", got, PermError)
+	}
+}
@@ -0,0 +1,187 @@
+package mail_server
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/blocklist"
+	"github.com/GRFreire/nthmail/pkg/clamd"
+	"github.com/GRFreire/nthmail/pkg/forward"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	"github.com/GRFreire/nthmail/pkg/relay"
+	"github.com/GRFreire/nthmail/pkg/spam"
+	"github.com/GRFreire/nthmail/pkg/srs"
+	"github.com/emersion/go-smtp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const bounce_secret = "secret"
+
+// infected_clamd is a clamd stand-in that finds a virus in every stream, and
+// returns its address.
+func infected_clamd(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				_, err := reader.ReadString(0)
+				if err != nil {
+					return
+				}
+				// drain the stream until the zero length chunk
+				size := make([]byte, 4)
+				for {
+					_, err = io.ReadFull(reader, size)
+					if err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					_, err = io.CopyN(io.Discard, reader, int64(n))
+					if err != nil {
+						return
+					}
+				}
+				conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+			}()
+		}
+	}()
+
+	return "tcp://" + l.Addr().String()
+}
+
+func new_bounce_session(t *testing.T, backend *Backend) *Session {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the queue is not run, queued bounces stay in outbound_queue
+	queue := relay.NewQueue(db, relay.Client{}, time.Minute, time.Hour)
+
+	backend.db = db
+	backend.domain = "nthmail.test"
+	backend.blocklist = blocklist.New(db)
+	backend.forwarder = forward.New(db, queue, bounce_secret, "nthmail.test", "http://nthmail.test", 10, time.Hour, 10)
+
+	return &Session{
+		ctx:       context.Background(),
+		backend:   backend,
+		domain:    "nthmail.test",
+		remote_ip: net.IPv4(192, 0, 2, 1),
+	}
+}
+
+func TestBounce(t *testing.T) {
+	srs_addr := srs.Rewriter{Secret: []byte(bounce_secret), Domain: "nthmail.test"}.Forward("carol@example.org")
+
+	tests := []struct {
+		name   string
+		from   string
+		rcpts  []string
+		scorer *spam.Scorer
+		clamd  bool
+		rcpt   int
+		data   int
+		queued int
+		stored int
+	}{
+		{name: "null sender", rcpts: []string{srs_addr}, queued: 1},
+		{name: "sender set", from: "mallory@example.com", rcpts: []string{srs_addr}, rcpt: 550},
+		{name: "spam", rcpts: []string{srs_addr}, scorer: &spam.Scorer{TagScore: 1}, data: 550},
+		{name: "quarantined", rcpts: []string{srs_addr}, clamd: true, data: 554},
+		{name: "spam with a local recipient", rcpts: []string{srs_addr, "alice@nthmail.test"}, scorer: &spam.Scorer{TagScore: 1}, stored: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &Backend{scorer: test.scorer}
+			if test.clamd {
+				client, err := clamd.New(infected_clamd(t), 5*time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				backend.clamd = client
+				backend.quarantine = true
+			}
+			session := new_bounce_session(t, backend)
+
+			err := session.Mail(test.from, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rcpt := range test.rcpts {
+				err = session.Rcpt(rcpt, nil)
+				if code := smtp_code(err); code != test.rcpt {
+					t.Fatalf("Rcpt(%s) = %v, want code %d", rcpt, err, test.rcpt)
+				}
+			}
+			if test.rcpt != 0 {
+				return
+			}
+
+			data := "From: MAILER-DAEMON@example.org\r\nTo: " + strings.Join(test.rcpts, ", ") + "\r\nSubject: Undelivered Mail\r\n\r\nreturned\r\n"
+			err = session.Data(strings.NewReader(data))
+			if code := smtp_code(err); code != test.data {
+				t.Fatalf("Data() = %v, want code %d", err, test.data)
+			}
+
+			var queued, stored int
+			err = backend.db.QueryRow("SELECT COUNT(*) FROM outbound_queue").Scan(&queued)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = backend.db.QueryRow("SELECT COUNT(*) FROM mails").Scan(&stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if queued != test.queued || stored != test.stored {
+				t.Errorf("queued %d and stored %d, want %d and %d", queued, stored, test.queued, test.stored)
+			}
+		})
+	}
+}
+
+// smtp_code is the reply code of err, 0 for nil.
+func smtp_code(err error) int {
+	var smtp_err *smtp.SMTPError
+	if errors.As(err, &smtp_err) {
+		return smtp_err.Code
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package mail_server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/emersion/go-smtp"
+)
+
+// SelfCheck connects to the smtp server at addr, waits for the greeting and
+// performs an EHLO, checking that the server accepts and serves sessions.
+func SelfCheck(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client := smtp.NewClient(conn)
+	defer client.Close()
+
+	err = client.Hello("localhost")
+	if err != nil {
+		return fmt.Errorf("EHLO failed: %w", err)
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,202 @@
+package mail_server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/config"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/emersion/go-smtp"
+)
+
+var errGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Greylisted, please try again later",
+}
+
+// Greylist temp-fails the first delivery attempt of every unseen
+// (client network, MAIL FROM, RCPT TO) triplet. Senders that retry after
+// delay are accepted and their client network and domain are whitelisted.
+type Greylist struct {
+	db             *sql.DB
+	delay          time.Duration
+	retry_window   time.Duration
+	whitelist_ttl  time.Duration
+	bypass_domains map[string]bool
+}
+
+func NewGreylist(db *sql.DB, cfg config.MailGreylist) *Greylist {
+	greylist := &Greylist{
+		db:             db,
+		delay:          cfg.Delay,
+		retry_window:   cfg.RetryWindow,
+		whitelist_ttl:  cfg.WhitelistTTL,
+		bypass_domains: make(map[string]bool),
+	}
+
+	for _, domain := range cfg.BypassDomains {
+		greylist.bypass_domains[normalize_domain(domain)] = true
+	}
+
+	return greylist
+}
+
+// client_net is the /24 of an ipv4 address or the /64 of an ipv6 one, as
+// large senders retry from different hosts of the same network.
+func client_net(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	if ip == nil {
+		return ""
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// normalize_domain gives domain the form bypass_domains and the whitelist
+// are keyed by, lower cased when it is not a valid domain.
+func normalize_domain(domain string) string {
+	normalized, err := address.NormalizeDomain(domain)
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+
+	return normalized
+}
+
+func addr_domain(addr string) string {
+	index := strings.LastIndex(addr, "@")
+	if index < 0 {
+		return ""
+	}
+
+	return normalize_domain(addr[index+1:])
+}
+
+// Check reports whether a delivery from ip and from to rcpt may proceed,
+// recording the attempt. Database errors let the message through.
+func (greylist *Greylist) Check(ctx context.Context, ip net.IP, from, rcpt string) error {
+	from, rcpt = strings.ToLower(from), strings.ToLower(rcpt)
+	from_domain := addr_domain(from)
+
+	if greylist.bypass_domains[from_domain] || greylist.bypass_domains[addr_domain(rcpt)] {
+		smtp_greylist.Inc("bypassed")
+		return nil
+	}
+
+	passed, err := greylist.check(ctx, client_net(ip), from, from_domain, rcpt)
+	if err != nil {
+		logging.FromContext(ctx).Error("could not check greylist", "err", err)
+		return nil
+	}
+
+	if !passed {
+		smtp_greylist.Inc("greylisted")
+		logging.FromContext(ctx).Info("greylisted recipient", "from", from, "rcpt", rcpt)
+		return errGreylisted
+	}
+
+	return nil
+}
+
+func (greylist *Greylist) check(ctx context.Context, network, from, from_domain, rcpt string) (bool, error) {
+	query_start := time.Now()
+	defer metrics.DBQueryDuration.Since(query_start, "greylist")
+
+	now := time.Now().UTC()
+
+	tx, err := greylist.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var passed_at int64
+	err = tx.QueryRow("SELECT passed_at FROM greylist_whitelist WHERE client_net = ? AND from_domain = ?", network, from_domain).Scan(&passed_at)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if err == nil && now.Sub(time.Unix(passed_at, 0)) < greylist.whitelist_ttl {
+		smtp_greylist.Inc("whitelisted")
+		return true, nil
+	}
+
+	var first_seen int64
+	err = tx.QueryRow("SELECT first_seen FROM greylist WHERE client_net = ? AND from_addr = ? AND rcpt_addr = ?", network, from, rcpt).Scan(&first_seen)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	waited := now.Sub(time.Unix(first_seen, 0))
+	if errors.Is(err, sql.ErrNoRows) || waited > greylist.retry_window {
+		_, err = tx.Exec("INSERT OR REPLACE INTO greylist (client_net, from_addr, rcpt_addr, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)", network, from, rcpt, now.Unix(), now.Unix())
+		if err != nil {
+			return false, err
+		}
+
+		return false, tx.Commit()
+	}
+
+	if waited < greylist.delay {
+		_, err = tx.Exec("UPDATE greylist SET last_seen = ? WHERE client_net = ? AND from_addr = ? AND rcpt_addr = ?", now.Unix(), network, from, rcpt)
+		if err != nil {
+			return false, err
+		}
+
+		return false, tx.Commit()
+	}
+
+	_, err = tx.Exec("DELETE FROM greylist WHERE client_net = ? AND from_addr = ? AND rcpt_addr = ?", network, from, rcpt)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO greylist_whitelist (client_net, from_domain, passed_at) VALUES (?, ?, ?)", network, from_domain, now.Unix())
+	if err != nil {
+		return false, err
+	}
+
+	smtp_greylist.Inc("passed")
+	return true, tx.Commit()
+}
+
+// Expire deletes triplets that were never retried and whitelist entries
+// past their ttl.
+func (greylist *Greylist) Expire(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	_, err := greylist.db.ExecContext(ctx, "DELETE FROM greylist WHERE last_seen < ?", now.Add(-greylist.retry_window).Unix())
+	if err != nil {
+		return err
+	}
+
+	_, err = greylist.db.ExecContext(ctx, "DELETE FROM greylist_whitelist WHERE passed_at < ?", now.Add(-greylist.whitelist_ttl).Unix())
+	return err
+}
+
+// run_expiry calls Expire every interval until ctx is cancelled.
+func (greylist *Greylist) run_expiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := greylist.Expire(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("could not expire greylist", "err", err)
+			}
+		}
+	}
+}
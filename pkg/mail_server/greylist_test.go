@@ -0,0 +1,172 @@
+package mail_server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/config"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func new_greylist(t *testing.T, bypass_domains ...string) (*Greylist, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	greylist := NewGreylist(db, config.MailGreylist{
+		Delay:         time.Minute,
+		RetryWindow:   time.Hour,
+		WhitelistTTL:  24 * time.Hour,
+		BypassDomains: bypass_domains,
+	})
+
+	return greylist, db
+}
+
+// backdate moves every greylist and whitelist entry d into the past.
+func backdate(t *testing.T, db *sql.DB, d time.Duration) {
+	t.Helper()
+
+	seconds := int64(d / time.Second)
+	_, err := db.Exec("UPDATE greylist SET first_seen = first_seen - ?, last_seen = last_seen - ?", seconds, seconds)
+	if err == nil {
+		_, err = db.Exec("UPDATE greylist_whitelist SET passed_at = passed_at - ?", seconds)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientNet(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.0/24"},
+		{"192.0.2.254", "192.0.2.0/24"},
+		{"::ffff:192.0.2.1", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::/64"},
+		{"2001:db8::ffff:1", "2001:db8::/64"},
+		{"2001:db8:0:1::1", "2001:db8:0:1::/64"},
+	}
+
+	for _, test := range tests {
+		if got := client_net(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("client_net(%s) = %s, want %s", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	ctx := context.Background()
+	ip := net.ParseIP("192.0.2.1")
+
+	check := func(t *testing.T, greylist *Greylist, ip net.IP, from, rcpt string, want error) {
+		t.Helper()
+
+		err := greylist.Check(ctx, ip, from, rcpt)
+		if !errors.Is(err, want) {
+			t.Fatalf("Check(%s, %s, %s) = %v, want %v", ip, from, rcpt, err, want)
+		}
+	}
+
+	t.Run("retry after the delay", func(t *testing.T) {
+		greylist, db := new_greylist(t)
+
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+		// too soon
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+
+		backdate(t, db, 2*time.Minute)
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", nil)
+	})
+
+	t.Run("triplet keying", func(t *testing.T) {
+		greylist, db := new_greylist(t)
+
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+		backdate(t, db, 2*time.Minute)
+
+		// the first attempt of another sender or recipient is greylisted
+		check(t, greylist, ip, "carol@example.org", "bob@nthmail.test", errGreylisted)
+		check(t, greylist, net.ParseIP("198.51.100.1"), "alice@example.com", "bob@nthmail.test", errGreylisted)
+
+		// a retry from another host of the /24 is the same triplet
+		check(t, greylist, net.ParseIP("192.0.2.200"), "Alice@Example.com", "bob@nthmail.test", nil)
+	})
+
+	t.Run("ipv6 /64", func(t *testing.T) {
+		greylist, db := new_greylist(t)
+
+		check(t, greylist, net.ParseIP("2001:db8::1"), "alice@example.com", "bob@nthmail.test", errGreylisted)
+		backdate(t, db, 2*time.Minute)
+
+		check(t, greylist, net.ParseIP("2001:db8:0:1::1"), "alice@example.com", "bob@nthmail.test", errGreylisted)
+		check(t, greylist, net.ParseIP("2001:db8::ffff:1"), "alice@example.com", "bob@nthmail.test", nil)
+	})
+
+	t.Run("retry window", func(t *testing.T) {
+		greylist, db := new_greylist(t)
+
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+
+		// a retry after the window starts over
+		backdate(t, db, 2*time.Hour)
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+
+		backdate(t, db, 2*time.Minute)
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", nil)
+	})
+
+	t.Run("whitelist", func(t *testing.T) {
+		greylist, db := new_greylist(t)
+
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+		backdate(t, db, 2*time.Minute)
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", nil)
+
+		// the network and sender domain that retried are whitelisted
+		check(t, greylist, net.ParseIP("192.0.2.9"), "dave@example.com", "erin@nthmail.test", nil)
+		check(t, greylist, ip, "carol@example.org", "erin@nthmail.test", errGreylisted)
+
+		// until the whitelist ttl passes
+		backdate(t, db, 25*time.Hour)
+		check(t, greylist, ip, "dave@example.com", "frank@nthmail.test", errGreylisted)
+	})
+
+	t.Run("bypass", func(t *testing.T) {
+		greylist, db := new_greylist(t, "Bücher.Example", "partner.example.")
+
+		check(t, greylist, ip, "alice@xn--bcher-kva.example", "bob@nthmail.test", nil)
+		check(t, greylist, ip, "alice@BÜCHER.example", "bob@nthmail.test", nil)
+		check(t, greylist, ip, "alice@partner.example", "bob@nthmail.test", nil)
+		check(t, greylist, ip, "alice@example.com", "bob@bücher.example", nil)
+		check(t, greylist, ip, "alice@example.com", "bob@nthmail.test", errGreylisted)
+
+		// bypassed deliveries are not recorded
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM greylist").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%d triplets recorded, want 1", count)
+		}
+	})
+}
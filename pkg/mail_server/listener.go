@@ -0,0 +1,50 @@
+package mail_server
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// limited_listener refuses connections over the connection rate limit of
+// their client ip before the smtp server sees them. go-smtp starts a new
+// session on every HELO and EHLO, so connections cannot be counted there.
+type limited_listener struct {
+	net.Listener
+	backend *Backend
+}
+
+func remote_ip(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
+
+func (l limited_listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remote_ip(conn)
+		if l.backend.allowlist.Contains(ip) || l.backend.connections_limit.Allow(ip.String()) {
+			return conn, nil
+		}
+
+		smtp_ratelimited.Inc("connections")
+		slog.Warn("rate limited smtp connection", "limit", "connections", "remote_addr", conn.RemoteAddr().String())
+
+		// a slow client must not hold up the next connections
+		go reject_connection(conn)
+	}
+}
+
+func reject_connection(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("421 4.7.0 Too many connections, try again later\r\n"))
+}
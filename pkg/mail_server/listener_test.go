@@ -0,0 +1,106 @@
+package mail_server
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/ratelimit"
+	"github.com/emersion/go-smtp"
+)
+
+// serve_limited runs an smtp server for backend behind limited_listener and
+// returns its address.
+func serve_limited(t *testing.T, backend *Backend) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := smtp.NewServer(backend)
+	server.Domain = "nthmail.test"
+	go server.Serve(limited_listener{Listener: l, backend: backend})
+	t.Cleanup(func() { server.Close() })
+
+	return l.Addr().String()
+}
+
+// dial connects to addr and returns the connection along with the code of
+// the greeting.
+func dial(t *testing.T, addr string) (*textproto.Conn, int) {
+	t.Helper()
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	code, _, err := conn.ReadResponse(0)
+	if err != nil && code == 0 {
+		t.Fatal(err)
+	}
+
+	return conn, code
+}
+
+func TestConnectionLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist []string
+		// greeting codes of successive connections
+		want []int
+	}{
+		{name: "limited", want: []int{220, 220, 421}},
+		{name: "allowlisted", allowlist: []string{"127.0.0.0/8"}, want: []int{220, 220, 220}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowlist, err := ratelimit.ParseAllowlist(test.allowlist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := serve_limited(t, &Backend{domain: "nthmail.test", allowlist: allowlist, connections_limit: ratelimit.Per(2, time.Hour)})
+
+			for i, want := range test.want {
+				_, code := dial(t, addr)
+				if code != want {
+					t.Errorf("connection %d greeted with %d, want %d", i+1, code, want)
+				}
+			}
+		})
+	}
+}
+
+// go-smtp starts a session on every EHLO, they must not count as
+// connections.
+func TestConnectionLimitRepeatedEhlo(t *testing.T) {
+	addr := serve_limited(t, &Backend{domain: "nthmail.test", connections_limit: ratelimit.Per(1, time.Hour)})
+
+	conn, code := dial(t, addr)
+	if code != 220 {
+		t.Fatalf("greeted with %d, want 220", code)
+	}
+
+	for i := 0; i < 3; i++ {
+		id, err := conn.Cmd("EHLO client.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.StartResponse(id)
+		code, _, err := conn.ReadResponse(250)
+		conn.EndResponse(id)
+		if err != nil {
+			t.Fatalf("EHLO %d: %d %v", i+1, code, err)
+		}
+	}
+
+	_, code = dial(t, addr)
+	if code != 421 {
+		t.Errorf("second connection greeted with %d, want 421", code)
+	}
+}
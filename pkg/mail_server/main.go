@@ -1,17 +1,30 @@
 package mail_server
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
-	"strconv"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/blocklist"
+	"github.com/GRFreire/nthmail/pkg/clamd"
+	"github.com/GRFreire/nthmail/pkg/config"
+	"github.com/GRFreire/nthmail/pkg/forward"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/mail_auth"
 	"github.com/GRFreire/nthmail/pkg/mail_utils"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/GRFreire/nthmail/pkg/ratelimit"
+	"github.com/GRFreire/nthmail/pkg/spam"
 	"github.com/emersion/go-smtp"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -19,30 +32,152 @@ import (
 type Backend struct {
 	db     *sql.DB
 	domain string
+	// empty when sub-addressing is disabled
+	subaddress_separators string
+	normalizer            address.Normalizer
+
+	// nil when verification is disabled
+	verifier *mail_auth.Verifier
+
+	// nil limiters are unlimited
+	connections_limit *ratelimit.Limiter
+	messages_limit    *ratelimit.Limiter
+	inbox_limit       *ratelimit.Limiter
+	bytes_limit       *ratelimit.Limiter
+	allowlist         ratelimit.Allowlist
+
+	// nil when greylisting is disabled
+	greylist *Greylist
+
+	// nil when spam scoring is disabled
+	scorer *spam.Scorer
+
+	// nil when forwarding is disabled
+	forwarder *forward.Forwarder
+
+	// nil when antivirus scanning is disabled
+	clamd           *clamd.Client
+	quarantine      bool
+	clamd_fail_open bool
+
+	blocklist *blocklist.Store
+}
+
+var errSpam = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected as spam",
+}
+
+var errVirus = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected, it contains a virus",
+}
+
+var errScanUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Virus scanner unavailable, try again later",
+}
+
+var errNotBounce = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Only bounces are accepted for this address",
+}
+
+var errBlocked = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Sender blocked",
+}
+
+// max_rejections is how many rejected messages are kept for the admin
+// dashboard.
+const max_rejections = 1000
+
+// RFC 6531 3.7.1
+var errNeedsSMTPUTF8 = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "Non-ASCII addresses require SMTPUTF8",
+}
+
+var errRateLimited = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Rate limit exceeded, try again later",
 }
 
 func (backend *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	tx, err := backend.db.Begin()
-	if err != nil {
-		return nil, err
-	}
+	smtp_sessions.Inc()
+
+	logger := slog.Default().With(
+		"session_id", logging.NewID(),
+		"remote_addr", c.Conn().RemoteAddr().String(),
+	)
+	logger.Debug("smtp session opened")
+
+	// connections are rate limited by limited_listener
+	ip := remote_ip(c.Conn())
 
 	return &Session{
-		tx:     tx,
-		domain: backend.domain,
+		ctx:       logging.WithLogger(context.Background(), logger),
+		backend:   backend,
+		limited:   !backend.allowlist.Contains(ip),
+		domain:    backend.domain,
+		verifier:  backend.verifier,
+		remote_ip: ip,
+		helo:      c.Hostname(),
 	}, nil
 }
 
 type Session struct {
-	tx         *sql.Tx
-	from, rcpt string
+	ctx        context.Context
+	from       string
+	rcpts      []string
 	arrived_at int64
 	domain     string
+	// set when MAIL FROM asked for SMTPUTF8
+	utf8 bool
+
+	verifier  *mail_auth.Verifier
+	remote_ip net.IP
+	helo      string
+
+	backend *Backend
+	// false when remote_ip is in the rate limit allowlist
+	limited bool
+	// SRS addresses of forwarded messages this message bounces back to
+	bounces []string
 }
 
-func append_addrs_with_domain(addrs []string, domain string, with_domain *[]string) {
+// rate_limited takes n tokens for key from limiter, reporting and logging
+// when the limit is exceeded.
+func (session *Session) rate_limited(limiter *ratelimit.Limiter, limit, key string, n float64) bool {
+	if !session.limited || limiter.AllowN(key, n) {
+		return false
+	}
+
+	smtp_ratelimited.Inc(limit)
+	logging.FromContext(session.ctx).Warn("rate limited smtp session",
+		"limit", limit,
+		"key", key,
+		"from", session.from,
+	)
+
+	return true
+}
+
+func append_addrs_with_domain(addrs []string, domain string, normalizer address.Normalizer, with_domain *[]string) {
 	for _, a := range addrs {
-		index := strings.Index(a, "@")
+		a, err := normalizer.Normalize(a)
+		if err != nil {
+			continue
+		}
+
+		index := strings.LastIndex(a, "@")
 		if index > 0 && a[index+1:] == domain {
 			*with_domain = append(*with_domain, a)
 		}
@@ -54,106 +189,446 @@ func (session *Session) AuthPlain(username, password string) error {
 }
 
 func (session *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if session.rate_limited(session.backend.messages_limit, "messages", session.remote_ip.String(), 1) {
+		return errRateLimited
+	}
+
 	session.arrived_at = time.Now().UTC().Unix()
 
+	session.utf8 = opts != nil && opts.UTF8
+	if !session.utf8 && !address.IsASCII(from) {
+		return errNeedsSMTPUTF8
+	}
+
 	session.from = from
+
+	entry, blocked, err := session.backend.blocklist.Blocked(session.ctx, session.remote_ip, from)
+	if err != nil {
+		logging.FromContext(session.ctx).Error("could not check blocklist", "err", err)
+	}
+	if blocked {
+		logging.FromContext(session.ctx).Info("sender blocked", "kind", entry.Kind, "value", entry.Value)
+		return session.reject("blocked", 0, errBlocked)
+	}
+
 	return nil
 }
 
 func (session *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	session.rcpt = to
+	if !session.utf8 && !address.IsASCII(to) {
+		return errNeedsSMTPUTF8
+	}
+
+	// SRS addresses are kept as they are
+	if forwarder := session.backend.forwarder; forwarder != nil && forwarder.IsBounce(to) {
+		// bounces have a null reverse-path (RFC 5321 4.5.5), anything else
+		// would turn the SRS address into an open relay
+		if session.from != "" {
+			return errNotBounce
+		}
+
+		if session.rate_limited(session.backend.inbox_limit, "inbox", strings.ToLower(to), 1) {
+			return errRateLimited
+		}
+
+		session.bounces = append(session.bounces, to)
+		return nil
+	}
+
+	if normalized, err := session.backend.normalizer.Normalize(to); err == nil {
+		to = normalized
+	}
+
+	// the tags of an inbox share its limit
+	inbox, _ := address.Split(to, session.backend.subaddress_separators)
+	if session.rate_limited(session.backend.inbox_limit, "inbox", inbox, 1) {
+		return errRateLimited
+	}
+
+	if session.backend.greylist != nil && session.limited {
+		err := session.backend.greylist.Check(session.ctx, session.remote_ip, session.from, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	session.rcpts = append(session.rcpts, to)
 
 	return nil
 }
 
-func (session *Session) Data(reader io.Reader) error {
-	defer session.tx.Rollback()
+// reject records why a message was refused and returns err to the client.
+func (session *Session) reject(reason string, size int, err error) error {
+	smtp_rejected.Inc(reason)
+	logging.FromContext(session.ctx).Warn("rejected message",
+		"reason", reason,
+		"from", session.from,
+		"rcpts", session.rcpts,
+		"size", size,
+		"err", err,
+	)
+
+	session.record_rejection(reason, err)
+	return err
+}
+
+// record_rejection stores the rejection for the admin dashboard, keeping
+// only the last max_rejections.
+func (session *Session) record_rejection(reason string, err error) {
+	db := session.backend.db
 
+	result, db_err := db.ExecContext(session.ctx, "INSERT INTO smtp_rejections (rejected_at, remote_ip, from_addr, rcpts, reason, error) VALUES (?, ?, ?, ?, ?, ?)",
+		time.Now().UTC().Unix(), session.remote_ip.String(), session.from, strings.Join(session.rcpts, ","), reason, err.Error())
+	if db_err == nil {
+		id, _ := result.LastInsertId()
+		_, db_err = db.ExecContext(session.ctx, "DELETE FROM smtp_rejections WHERE id <= ?", id-max_rejections)
+	}
+	if db_err != nil {
+		logging.FromContext(session.ctx).Error("could not record rejection", "err", db_err)
+	}
+}
+
+func (session *Session) Data(reader io.Reader) error {
 	bytes, err := io.ReadAll(reader)
+	smtp_received_bytes.Add(float64(len(bytes)))
+	if errors.Is(err, smtp.ErrDataTooLarge) {
+		return session.reject("too_large", len(bytes), err)
+	}
 	if err != nil {
-		return err
+		return session.reject("read_error", len(bytes), err)
+	}
+
+	if session.rate_limited(session.backend.bytes_limit, "bytes", session.remote_ip.String(), float64(len(bytes))) {
+		return session.reject("rate_limited", len(bytes), errRateLimited)
 	}
 
 	mail_obj, err := mail_utils.Parse_mail(bytes, true)
 	if err != nil {
-		return err
+		parse_failures.Inc()
+		return session.reject("parse_error", len(bytes), err)
 	}
 
 	var addrs []string
-	append_addrs_with_domain(mail_obj.To, session.domain, &addrs)
-	append_addrs_with_domain(mail_obj.Cc, session.domain, &addrs)
-	append_addrs_with_domain(mail_obj.Bcc, session.domain, &addrs)
+	append_addrs_with_domain(mail_obj.To, session.domain, session.backend.normalizer, &addrs)
+	append_addrs_with_domain(mail_obj.Cc, session.domain, session.backend.normalizer, &addrs)
+	append_addrs_with_domain(mail_obj.Bcc, session.domain, session.backend.normalizer, &addrs)
+
+	if forwarder := session.backend.forwarder; forwarder != nil {
+		// bounces are relayed, not stored in an inbox named after the SRS
+		// address
+		addrs = slices.DeleteFunc(addrs, forwarder.IsBounce)
+	}
 
+	if len(addrs) <= 0 && len(session.bounces) <= 0 {
+		return session.reject("no_local_recipient", len(bytes), errors.New("Not a single addr from to, cc and cc has the domain available in this server"))
+	}
+
+	var auth_results *mail_auth.Results
+	var spf_result, dkim_result, dmarc_result sql.NullString
+	if session.verifier != nil {
+		results := session.verifier.Verify(session.ctx, session.remote_ip, session.helo, session.from, bytes)
+		auth_results = &results
+		spf_result = sql.NullString{String: string(results.SPF), Valid: true}
+		dkim_result = sql.NullString{String: string(results.DKIMSummary()), Valid: true}
+		dmarc_result = sql.NullString{String: string(results.DMARC.Result), Valid: true}
+	}
+
+	var spam_score sql.NullFloat64
+	var spam_hits sql.NullString
+	is_spam := false
+	if scorer := session.backend.scorer; scorer != nil {
+		msg := spam.Message{IP: session.remote_ip, Data: bytes, Auth: auth_results}
+		// the bodies are only needed for scoring, a message we cannot render
+		// is still delivered
+		if full, err := mail_utils.Parse_mail(bytes, false); err == nil {
+			msg.Mail = &full
+		}
+
+		result := scorer.Score(session.ctx, msg)
+		action := scorer.Action(result.Score)
+		smtp_spam_score.Observe(result.Score)
+		smtp_spam.Inc(string(action))
+
+		if action == spam.Reject {
+			logging.FromContext(session.ctx).Info("spam score", "score", result.Score, "rules", result.Rules())
+			return session.reject("spam", len(bytes), errSpam)
+		}
+
+		hits, err := json.Marshal(result.Hits)
+		if err != nil {
+			return session.reject("db_error", len(bytes), fmt.Errorf("could not encode spam hits: %w", err))
+		}
+
+		spam_score = sql.NullFloat64{Float64: result.Score, Valid: true}
+		spam_hits = sql.NullString{String: string(hits), Valid: true}
+		is_spam = action == spam.Tag
+
+		bytes = append([]byte(result.Header(is_spam)), bytes...)
+	}
+
+	var virus_result sql.NullString
+	quarantined := false
+	if session.backend.clamd != nil {
+		verdict, err := session.backend.clamd.Scan(session.ctx, strings.NewReader(string(bytes)))
+		switch {
+		case err != nil && session.backend.clamd_fail_open:
+			smtp_virus_scans.Inc("error")
+			logging.FromContext(session.ctx).Error("could not scan message, accepting it unscanned", "err", err)
+		case err != nil:
+			smtp_virus_scans.Inc("error")
+			return session.reject("scan_error", len(bytes), errScanUnavailable)
+		case verdict.Infected && !session.backend.quarantine:
+			smtp_virus_scans.Inc("infected")
+			logging.FromContext(session.ctx).Info("virus found", "signature", verdict.Signature)
+			return session.reject("virus", len(bytes), errVirus)
+		default:
+			result := "clean"
+			if verdict.Infected {
+				result = "infected"
+				quarantined = true
+				logging.FromContext(session.ctx).Info("virus found, quarantining message", "signature", verdict.Signature)
+			}
+			smtp_virus_scans.Inc(result)
+
+			virus_result = sql.NullString{String: verdict.String(), Valid: true}
+			bytes = append([]byte(fmt.Sprintf("X-Virus-Scanned: clamd; %s\r\n", verdict)), bytes...)
+		}
+	}
+
+	// results claiming to be ours are forged
+	bytes = mail_auth.StripResults(bytes, session.domain)
+	if auth_results != nil {
+		bytes = append([]byte(auth_results.Header(session.domain, session.from)), bytes...)
+	}
+
+	// spam and quarantined mail is kept here, not relayed
+	bounces := session.bounces
+	if len(bounces) > 0 && (is_spam || quarantined) {
+		logging.FromContext(session.ctx).Info("bounce not relayed", "rcpts", bounces, "spam", is_spam, "quarantined", quarantined)
+		bounces = nil
+
+		if len(addrs) <= 0 && quarantined {
+			return session.reject("virus", len(bytes), errVirus)
+		}
+		if len(addrs) <= 0 {
+			return session.reject("spam", len(bytes), errSpam)
+		}
+	}
+
+	for _, bounce := range bounces {
+		err = session.backend.forwarder.Bounce(session.ctx, bounce, bytes)
+		if err != nil {
+			return session.reject("db_error", len(bytes), err)
+		}
+	}
 	if len(addrs) <= 0 {
-		return errors.New("Not a single addr from to, cc and cc has the domain available in this server")
+		smtp_accepted.Inc()
+		return nil
 	}
 
+	query_start := time.Now()
+	tx, err := session.backend.db.Begin()
+	if err != nil {
+		return session.reject("db_error", len(bytes), fmt.Errorf("could not begin db transaction: %w", err))
+	}
+	defer tx.Rollback()
+
+	var message_id, thread_subject sql.NullString
+	if mail_obj.Header.Message_id != "" {
+		message_id = sql.NullString{String: mail_obj.Header.Message_id, Valid: true}
+	}
+	if subject := mail_utils.Normalize_subject(mail_obj.Subject); subject != "" {
+		thread_subject = sql.NullString{String: subject, Valid: true}
+	}
+
+	// mail to name+tag is stored in the name inbox, once per inbox
+	var inboxes []string
 	for _, addr := range addrs {
-		stmt, err := session.tx.Prepare("INSERT INTO mails (arrived_at, rcpt_addr, from_addr, subject, data) VALUES (?, ?, ?, ?, ?)")
+		inbox, tag := address.Split(addr, session.backend.subaddress_separators)
+		if slices.Contains(inboxes, inbox) {
+			continue
+		}
+		inboxes = append(inboxes, inbox)
+
+		var rcpt_tag sql.NullString
+		if tag != "" {
+			rcpt_tag = sql.NullString{String: tag, Valid: true}
+		}
+
+		thread_id, err := find_thread(tx, inbox, mail_obj.Header, thread_subject.String, session.arrived_at)
 		if err != nil {
-			println(err)
-			return err
+			return session.reject("db_error", len(bytes), err)
+		}
+
+		stmt, err := tx.Prepare("INSERT INTO mails (arrived_at, rcpt_addr, rcpt_tag, from_addr, subject, data, spf_result, dkim_result, dmarc_result, spam_score, spam_hits, spam, virus_result, quarantined, message_id, thread_id, thread_subject) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			return session.reject("db_error", len(bytes), fmt.Errorf("could not prepare db stmt: %w", err))
 		}
 		defer stmt.Close()
 
-		_, err = stmt.Exec(session.arrived_at, addr, mail_obj.From, mail_obj.Subject, bytes)
+		result, err := stmt.Exec(session.arrived_at, inbox, rcpt_tag, mail_obj.From, mail_obj.Subject, bytes, spf_result, dkim_result, dmarc_result, spam_score, spam_hits, is_spam, virus_result, quarantined, message_id, thread_id, thread_subject)
 		if err != nil {
-			return err
+			return session.reject("db_error", len(bytes), fmt.Errorf("could not insert mail: %w", err))
 		}
 
+		// a mail starting a thread names it
+		if !thread_id.Valid {
+			id, _ := result.LastInsertId()
+			_, err = tx.Exec("UPDATE mails SET thread_id = ? WHERE id = ?", id, id)
+			if err != nil {
+				return session.reject("db_error", len(bytes), fmt.Errorf("could not start thread: %w", err))
+			}
+		}
 	}
 
-	err = session.tx.Commit()
+	err = tx.Commit()
+	metrics.DBQueryDuration.Since(query_start, "insert_mail")
 	if err != nil {
-		return err
+		return session.reject("db_error", len(bytes), fmt.Errorf("could not commit db transaction: %w", err))
+	}
+
+	smtp_accepted.Inc()
+	logging.FromContext(session.ctx).Info("delivered message",
+		"from", session.from,
+		"rcpts", session.rcpts,
+		"stored_for", inboxes,
+		"size", len(bytes),
+		"spf", spf_result.String,
+		"dkim", dkim_result.String,
+		"dmarc", dmarc_result.String,
+		"spam_score", spam_score.Float64,
+		"spam", is_spam,
+		"virus", virus_result.String,
+		"quarantined", quarantined,
+	)
+
+	if forwarder := session.backend.forwarder; forwarder != nil && !is_spam && !quarantined {
+		for _, inbox := range inboxes {
+			err = forwarder.Forward(session.ctx, inbox, session.from, mail_obj.From, mail_obj.Subject, bytes)
+			if err != nil {
+				// the mail is stored, the sender does not need to retry
+				logging.FromContext(session.ctx).Error("could not forward message", "rcpt", inbox, "err", err)
+			}
+		}
 	}
 
 	return nil
 }
 
-func (session *Session) Reset() {}
+func (session *Session) Reset() {
+	session.from = ""
+	session.utf8 = false
+	session.rcpts = nil
+	session.bounces = nil
+}
 
 func (session *Session) Logout() error {
+	logging.FromContext(session.ctx).Debug("smtp session closed")
+
 	return nil
 }
 
-func Start(db *sql.DB) error {
-	domain, exists := os.LookupEnv("MAIL_SERVER_DOMAIN")
-	if !exists {
-		domain = "localhost"
+// Start runs the smtp server until ctx is cancelled. It then stops accepting
+// connections and waits up to cfg.ShutdownTimeout for the open sessions to
+// finish before closing them. forwarder is nil when forwarding is disabled.
+func Start(ctx context.Context, db *sql.DB, cfg config.Mail, forwarder *forward.Forwarder) error {
+	backend := &Backend{
+		db:        db,
+		domain:    cfg.Domain,
+		forwarder: forwarder,
+		blocklist: blocklist.New(db),
+
+		subaddress_separators: cfg.SubaddressSeparators,
+		normalizer:            cfg.Normalizer(),
+	}
+
+	allowlist, err := ratelimit.ParseAllowlist(cfg.RateLimit.Allowlist)
+	if err != nil {
+		return fmt.Errorf("could not parse rate limit allowlist: %w", err)
+	}
+	backend.allowlist = allowlist
+	backend.connections_limit = ratelimit.PerMinute(cfg.RateLimit.ConnectionsPerMinute)
+	backend.messages_limit = ratelimit.PerMinute(cfg.RateLimit.MessagesPerMinute)
+	backend.inbox_limit = ratelimit.PerMinute(cfg.RateLimit.InboxMessagesPerMinute)
+	backend.bytes_limit = ratelimit.PerMinute(cfg.RateLimit.BytesPerMinute)
+
+	if cfg.Greylist.Enabled {
+		backend.greylist = NewGreylist(db, cfg.Greylist)
+		go backend.greylist.run_expiry(ctx, time.Hour)
 	}
 
-	var port int
-	var err error
-	port_str, exists := os.LookupEnv("MAIL_SERVER_PORT")
-	if exists {
-		port, err = strconv.Atoi(port_str)
+	if cfg.Auth.Enabled {
+		backend.verifier = &mail_auth.Verifier{
+			Resolver: mail_auth.NewResolver(cfg.Auth.DNSServer, cfg.Auth.Timeout),
+			Timeout:  cfg.Auth.Timeout,
+		}
+	}
+
+	if cfg.Antivirus.Enabled {
+		backend.clamd, err = clamd.New(cfg.Antivirus.Address, cfg.Antivirus.Timeout)
 		if err != nil {
-			return errors.New("env:MAIL_SERVER_PORT is not a number")
+			return err
 		}
-	} else {
-		port = 1025
+		backend.quarantine = cfg.Antivirus.Action == "quarantine"
+		backend.clamd_fail_open = cfg.Antivirus.FailOpen
 	}
 
-	backend := &Backend{
-		db:     db,
-		domain: domain,
+	if cfg.Spam.Enabled {
+		backend.scorer = &spam.Scorer{
+			Resolver:    mail_auth.NewResolver(cfg.Auth.DNSServer, cfg.Spam.Timeout),
+			DNSBLs:      cfg.Spam.DNSBLs,
+			Timeout:     cfg.Spam.Timeout,
+			TagScore:    cfg.Spam.TagScore,
+			RejectScore: cfg.Spam.RejectScore,
+		}
+
+		for _, pattern := range cfg.Spam.URLPatterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("could not compile spam url pattern: %w", err)
+			}
+			backend.scorer.URLPatterns = append(backend.scorer.URLPatterns, re)
+		}
 	}
 
 	server := smtp.NewServer(backend)
 
-	server.Addr = fmt.Sprintf(":%d", port)
-	server.Domain = domain
-	server.WriteTimeout = 60 * time.Second
-	server.ReadTimeout = 60 * time.Second
-	server.MaxMessageBytes = 1024 * 1024
-	server.MaxRecipients = 50
-	server.AllowInsecureAuth = true
+	server.Addr = fmt.Sprintf(":%d", cfg.Port)
+	server.Domain = cfg.Domain
+	server.WriteTimeout = cfg.WriteTimeout
+	server.ReadTimeout = cfg.ReadTimeout
+	server.MaxMessageBytes = cfg.MaxMessageBytes
+	server.MaxRecipients = cfg.MaxRecipients
+	server.AllowInsecureAuth = cfg.AllowInsecureAuth
+	server.EnableSMTPUTF8 = true
+	server.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
 
-	log.Println("Starting mail server at", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	serve_err := make(chan error, 1)
+	go func() {
+		slog.Info("starting mail server", "addr", server.Addr)
+		serve_err <- server.Serve(limited_listener{Listener: l, backend: backend})
+	}()
+
+	select {
+	case err := <-serve_err:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down mail server")
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdown_ctx)
+	if err != nil {
+		server.Close()
+		return fmt.Errorf("could not drain smtp sessions: %w", err)
+	}
+
+	return <-serve_err
 }
@@ -0,0 +1,52 @@
+package mail_server
+
+import "github.com/GRFreire/nthmail/pkg/metrics"
+
+var (
+	smtp_sessions = metrics.NewCounter(
+		"nthmail_smtp_sessions_total",
+		"SMTP sessions opened.",
+	)
+	smtp_accepted = metrics.NewCounter(
+		"nthmail_smtp_messages_accepted_total",
+		"Messages accepted and stored.",
+	)
+	smtp_rejected = metrics.NewCounter(
+		"nthmail_smtp_messages_rejected_total",
+		"Messages rejected at DATA, by reason.",
+		"reason",
+	)
+	smtp_ratelimited = metrics.NewCounter(
+		"nthmail_smtp_ratelimited_total",
+		"Sessions, messages and recipients refused by a rate limit, by limit.",
+		"limit",
+	)
+	smtp_greylist = metrics.NewCounter(
+		"nthmail_smtp_greylist_total",
+		"Greylist checks, by result.",
+		"result",
+	)
+	smtp_spam = metrics.NewCounter(
+		"nthmail_smtp_spam_total",
+		"Scored messages, by action taken.",
+		"action",
+	)
+	smtp_spam_score = metrics.NewHistogram(
+		"nthmail_smtp_spam_score",
+		"Spam score of scored messages.",
+		[]float64{0, 1, 2, 3, 5, 7.5, 10, 15, 20},
+	)
+	smtp_virus_scans = metrics.NewCounter(
+		"nthmail_smtp_virus_scans_total",
+		"Antivirus scans, by result.",
+		"result",
+	)
+	parse_failures = metrics.NewCounter(
+		"nthmail_mail_parse_failures_total",
+		"Received messages that could not be parsed.",
+	)
+	smtp_received_bytes = metrics.NewCounter(
+		"nthmail_smtp_received_bytes_total",
+		"Bytes of message data received.",
+	)
+)
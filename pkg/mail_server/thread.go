@@ -0,0 +1,63 @@
+package mail_server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+)
+
+const (
+	// thread_window is how recent the last mail of a thread with the same
+	// subject must be for a mail without references to join it.
+	thread_window = 7 * 24 * time.Hour
+	// max_thread_refs is how many of the latest References are looked up.
+	max_thread_refs = 50
+)
+
+// find_thread returns the thread of inbox a mail belongs to: the one of a
+// mail it replies to or references, else the latest one with the same
+// normalized subject within thread_window. It is invalid when the mail
+// starts a thread.
+func find_thread(tx *sql.Tx, inbox string, header mail_utils.Mail_header, thread_subject string, arrived_at int64) (sql.NullInt64, error) {
+	var thread_id sql.NullInt64
+
+	refs := header.References
+	if len(refs) > max_thread_refs {
+		refs = refs[len(refs)-max_thread_refs:]
+	}
+
+	args := []any{inbox}
+	for _, id := range header.In_reply_to {
+		args = append(args, id)
+	}
+	for _, id := range refs {
+		args = append(args, id)
+	}
+
+	if len(args) > 1 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)-1), ", ")
+		err := tx.QueryRow("SELECT thread_id FROM mails WHERE rcpt_addr = ? AND message_id IN ("+placeholders+") ORDER BY id DESC LIMIT 1", args...).Scan(&thread_id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return thread_id, fmt.Errorf("could not find thread: %w", err)
+		}
+		if thread_id.Valid {
+			return thread_id, nil
+		}
+	}
+
+	if thread_subject == "" {
+		return thread_id, nil
+	}
+
+	since := arrived_at - int64(thread_window/time.Second)
+	err := tx.QueryRow("SELECT thread_id FROM mails WHERE rcpt_addr = ? AND thread_subject = ? AND arrived_at >= ? ORDER BY id DESC LIMIT 1", inbox, thread_subject, since).Scan(&thread_id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return thread_id, fmt.Errorf("could not find thread: %w", err)
+	}
+
+	return thread_id, nil
+}
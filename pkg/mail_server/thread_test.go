@@ -0,0 +1,80 @@
+package mail_server
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestFindThread(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	day := int64(24 * time.Hour / time.Second)
+	mails := []struct {
+		arrived_at       int64
+		rcpt, message_id string
+		thread_id        int64
+		thread_subject   string
+	}{
+		{now - day, "alice@nthmail.test", "1@example.com", 1, "lunch"},
+		{now - 10*day, "alice@nthmail.test", "2@example.com", 2, "report"},
+		{now - 10*day, "alice@nthmail.test", "3@example.com", 3, "lunch"},
+		{now, "bob@nthmail.test", "4@example.com", 4, "lunch"},
+		{now - day/2, "alice@nthmail.test", "5@example.com", 5, "lunch"},
+	}
+	for _, m := range mails {
+		_, err = db.Exec("INSERT INTO mails (arrived_at, rcpt_addr, from_addr, data, message_id, thread_id, thread_subject) VALUES (?, ?, '', '', ?, ?, ?)", m.arrived_at, m.rcpt, m.message_id, m.thread_id, m.thread_subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		header  mail_utils.Mail_header
+		subject string
+		want    int64
+	}{
+		{name: "reply", header: mail_utils.Mail_header{In_reply_to: []string{"2@example.com"}}, subject: "lunch", want: 2},
+		{name: "references", header: mail_utils.Mail_header{References: []string{"9@example.com", "3@example.com"}}, want: 3},
+		{name: "latest of the mails referenced", header: mail_utils.Mail_header{References: []string{"1@example.com", "3@example.com"}}, want: 3},
+		{name: "reference to another inbox", header: mail_utils.Mail_header{References: []string{"4@example.com"}}},
+		{name: "unknown reference, same subject", header: mail_utils.Mail_header{In_reply_to: []string{"9@example.com"}}, subject: "lunch", want: 5},
+		{name: "same subject", subject: "lunch", want: 5},
+		{name: "same subject, too long ago", subject: "report"},
+		{name: "no subject"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			got, err := find_thread(tx, "alice@nthmail.test", test.header, test.subject, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Valid != (test.want != 0) || got.Int64 != test.want {
+				t.Errorf("thread %v, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package mail_utils
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Address is a mailbox of an address header, with its decoded display name.
+type Address struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Address
+	}
+
+	return a.Name + " <" + a.Address + ">"
+}
+
+// Header_field is a header field as it appears in the message, unfolded and
+// with its encoded words decoded.
+type Header_field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Mail_header holds the standard header fields of a message, parsed. Fields
+// that are missing or malformed are left empty.
+type Mail_header struct {
+	From     []Address
+	Sender   *Address
+	Reply_to []Address
+	To       []Address
+	Cc       []Address
+	Bcc      []Address
+	// envelope sender, empty for the null sender
+	Return_path string
+	// date the message was written, zero when missing or invalid
+	Date time.Time
+	// message ids, without angle brackets
+	Message_id  string
+	In_reply_to []string
+	References  []string
+	// unsubscribe uris, without angle brackets
+	List_unsubscribe []string
+	Subject          string
+
+	// every field, in order
+	Fields []Header_field
+}
+
+func parse_header(header mail.Header, data []byte) Mail_header {
+	var h Mail_header
+
+	h.From = address_list(header, "From")
+	h.Reply_to = address_list(header, "Reply-To")
+	h.To = address_list(header, "To")
+	h.Cc = address_list(header, "Cc")
+	h.Bcc = address_list(header, "Bcc")
+	if sender := address_list(header, "Sender"); len(sender) != 0 {
+		h.Sender = &sender[0]
+	}
+
+	h.Return_path = strings.Trim(strings.TrimSpace(header.Get("Return-Path")), "<>")
+	if date, err := header.Date(); err == nil {
+		h.Date = date
+	}
+
+	if ids := bracketed(header.Get("Message-Id")); len(ids) != 0 {
+		h.Message_id = ids[0]
+	}
+	h.In_reply_to = bracketed(header.Get("In-Reply-To"))
+	h.References = bracketed(header.Get("References"))
+	h.List_unsubscribe = bracketed(header.Get("List-Unsubscribe"))
+
+	dec := new(mime.WordDecoder)
+	h.Subject, _ = dec.DecodeHeader(header.Get("Subject"))
+
+	h.Fields = parse_fields(data)
+
+	return h
+}
+
+// address_list parses the addresses of a header, decoding their names. A
+// malformed list yields nothing.
+func address_list(header mail.Header, key string) []Address {
+	list, err := header.AddressList(key)
+	if err != nil {
+		return nil
+	}
+
+	addrs := make([]Address, len(list))
+	for i, a := range list {
+		addrs[i] = Address{Name: a.Name, Address: a.Address}
+	}
+
+	return addrs
+}
+
+// bracketed returns the <...> items of value, like message ids and
+// List-Unsubscribe uris.
+func bracketed(value string) []string {
+	var items []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+
+		if item := strings.TrimSpace(value[start+1 : start+end]); item != "" {
+			items = append(items, item)
+		}
+		value = value[start+end+1:]
+	}
+
+	return items
+}
+
+// parse_fields reads the header fields of a raw message in order, up to the
+// first empty line.
+func parse_fields(data []byte) []Header_field {
+	dec := new(mime.WordDecoder)
+
+	var fields []Header_field
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+
+		// folded lines continue the previous field
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) != 0 {
+				fields[len(fields)-1].Value += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, Header_field{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+
+	for i, f := range fields {
+		if decoded, err := dec.DecodeHeader(f.Value); err == nil {
+			fields[i].Value = decoded
+		}
+	}
+
+	return fields
+}
+
+// subject_prefix matches a reply or forward prefix, like "Re:", "Fwd:" or
+// "AW:", or a [list] tag.
+var subject_prefix = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|wg|sv|vs|antw|tr)(\[\d+\])?\s*:|\[[^\]]*\])\s*`)
+
+// Normalize_subject strips the reply and forward prefixes and list tags of
+// subject, and folds its case and spaces, so that mails of a conversation
+// share it.
+func Normalize_subject(subject string) string {
+	for {
+		loc := subject_prefix.FindStringIndex(subject)
+		if loc == nil || loc[1] == 0 {
+			break
+		}
+		subject = subject[loc[1]:]
+	}
+
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
@@ -0,0 +1,112 @@
+package mail_utils
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestParseHeader(t *testing.T) {
+	data := crlf(`Return-Path: <bounces@lists.example.com>
+From: =?utf-8?q?Bj=C3=B6rn?= <bjorn@example.com>, carol@example.org
+Sender: lists@example.com
+Reply-To: "Replies" <replies@example.com>
+To: Alice <alice@nthmail.test>
+Cc: not an address
+Date: Mon, 02 Jan 2006 15:04:05 -0700
+Message-Id: <1@example.com>
+In-Reply-To: <0@example.com>
+References: <a@example.com>
+ <0@example.com>
+List-Unsubscribe: <mailto:leave@lists.example.com>, <https://lists.example.com/leave>
+Subject: =?utf-8?q?caf=C3=A9?= time
+
+body
+`)
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := parse_header(msg.Header, data)
+
+	tests := []struct {
+		field     string
+		got, want any
+	}{
+		{"From", h.From, []Address{{"Björn", "bjorn@example.com"}, {"", "carol@example.org"}}},
+		{"Sender", *h.Sender, Address{"", "lists@example.com"}},
+		{"Reply-To", h.Reply_to, []Address{{"Replies", "replies@example.com"}}},
+		{"To", h.To, []Address{{"Alice", "alice@nthmail.test"}}},
+		{"Cc", h.Cc, []Address(nil)},
+		{"Return-Path", h.Return_path, "bounces@lists.example.com"},
+		{"Date", h.Date.UTC(), time.Date(2006, 1, 2, 22, 4, 5, 0, time.UTC)},
+		{"Message-Id", h.Message_id, "1@example.com"},
+		{"In-Reply-To", h.In_reply_to, []string{"0@example.com"}},
+		{"References", h.References, []string{"a@example.com", "0@example.com"}},
+		{"List-Unsubscribe", h.List_unsubscribe, []string{"mailto:leave@lists.example.com", "https://lists.example.com/leave"}},
+		{"Subject", h.Subject, "café time"},
+		{"Fields", len(h.Fields), 12},
+		{"folded field", h.Fields[9], Header_field{"References", "<a@example.com> <0@example.com>"}},
+		{"decoded field", h.Fields[1], Header_field{"From", "Björn <bjorn@example.com>, carol@example.org"}},
+	}
+
+	for _, test := range tests {
+		if fmt.Sprintf("%#v", test.got) != fmt.Sprintf("%#v", test.want) {
+			t.Errorf("%s = %#v, want %#v", test.field, test.got, test.want)
+		}
+	}
+}
+
+func TestBracketed(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"1@example.com", nil},
+		{"<1@example.com>", []string{"1@example.com"}},
+		{" <1@example.com>\t<2@example.com> ", []string{"1@example.com", "2@example.com"}},
+		{"<> < 3@example.com >", []string{"3@example.com"}},
+		{"<1@example.com> <unclosed", []string{"1@example.com"}},
+	}
+
+	for _, test := range tests {
+		if got := bracketed(test.value); fmt.Sprint(got) != fmt.Sprint(test.want) || len(got) != len(test.want) {
+			t.Errorf("bracketed(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestAddressString(t *testing.T) {
+	if got := (Address{Address: "alice@nthmail.test"}).String(); got != "alice@nthmail.test" {
+		t.Errorf("got %q", got)
+	}
+	if got := (Address{Name: "Alice", Address: "alice@nthmail.test"}).String(); got != "Alice <alice@nthmail.test>" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		want    string
+	}{
+		{"Lunch", "lunch"},
+		{"Re: Lunch", "lunch"},
+		{"RE: re: Fwd: Lunch", "lunch"},
+		{"Re[2]: Lunch", "lunch"},
+		{"AW: WG: Lunch", "lunch"},
+		{"[team] Re: [team]  Lunch   on Friday ", "lunch on friday"},
+		{"Re:", ""},
+		{"Regarding lunch", "regarding lunch"},
+		{"Lunch: Re: today", "lunch: re: today"},
+	}
+
+	for _, test := range tests {
+		if got := Normalize_subject(test.subject); got != test.want {
+			t.Errorf("Normalize_subject(%q) = %q, want %q", test.subject, got, test.want)
+		}
+	}
+}
@@ -34,6 +34,31 @@ type Mail_body struct {
 	Data     string
 }
 
+// Auth_results are the SPF, DKIM and DMARC verdicts recorded when the mail
+// was received. Empty when the mail was not verified.
+type Auth_results struct {
+	SPF, DKIM, DMARC string
+}
+
+func (a Auth_results) Verified() bool {
+	return a.SPF != "" || a.DKIM != "" || a.DMARC != ""
+}
+
+type Spam_hit struct {
+	Rule   string  `json:"rule"`
+	Score  float64 `json:"score"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+// Spam_results are the spam score and rule hits recorded when the mail was
+// received. Scored is false when spam scoring was disabled.
+type Spam_results struct {
+	Scored bool
+	Score  float64
+	Hits   []Spam_hit
+	Spam   bool
+}
+
 type Mail_obj struct {
 	Id      int
 	From    string
@@ -42,6 +67,28 @@ type Mail_obj struct {
 	Cc      []string
 	Bcc     []string
 	Subject string
+	// raw Message-Id, References and Reply-To, to thread replies
+	Message_id string
+	References string
+	Reply_to   string
+	Auth       Auth_results
+	Spam       Spam_results
+	// antivirus verdict, "clean" or the matched signature, empty when the
+	// mail was not scanned
+	Virus string
+	// tag of the name+tag address the mail was sent to
+	Tag string
+	// id of the thread of the mail within its inbox
+	Thread_id int
+	// every header of the message, empty for inbox listings
+	Header Mail_header
+	// nil unless the message is signed or encrypted
+	Signature *Signature
+	// message/rfc822 parts, like forwarded mail and the mail a bounce
+	// returns
+	Messages []Mail_obj
+	// how many messages the message is nested in
+	nesting int
 
 	Body []Mail_body
 	MediaType
@@ -70,7 +117,12 @@ func Parse_mime_format(s string) (MIMEType, bool) {
 }
 
 func Parse_mail(m_data []byte, header_only bool) (Mail_obj, error) {
+	return parse_mail(m_data, header_only, 0)
+}
+
+func parse_mail(m_data []byte, header_only bool, nesting int) (Mail_obj, error) {
 	var m Mail_obj
+	m.nesting = nesting
 
 	mail_msg, err := mail.ReadMessage(bytes.NewReader(m_data))
 	if err != nil {
@@ -78,49 +130,70 @@ func Parse_mail(m_data []byte, header_only bool) (Mail_obj, error) {
 	}
 
 	// HEADERS
+	m.Header = parse_header(mail_msg.Header, m_data)
+
 	dec := new(mime.WordDecoder)
 	m.From, _ = dec.DecodeHeader(mail_msg.Header.Get("From"))
-	m.Subject, _ = dec.DecodeHeader(mail_msg.Header.Get("Subject"))
+	m.Subject = m.Header.Subject
+	m.Message_id = mail_msg.Header.Get("Message-Id")
+	m.References = mail_msg.Header.Get("References")
 
-	to_addrs, _ := mail_msg.Header.AddressList("To")
-	m.To = make([]string, len(to_addrs))
-	for i, a := range to_addrs {
-		m.To[i] = a.Address
+	if len(m.Header.Reply_to) != 0 {
+		m.Reply_to = m.Header.Reply_to[0].Address
 	}
 
-	cc_addrs, _ := mail_msg.Header.AddressList("Cc")
-	m.Cc = make([]string, len(to_addrs))
-	for i, a := range cc_addrs {
-		m.Cc[i] = a.Address
-	}
-
-	bcc_addrs, _ := mail_msg.Header.AddressList("Bcc")
-	m.Bcc = make([]string, len(to_addrs))
-	for i, a := range bcc_addrs {
-		m.Bcc[i] = a.Address
-	}
+	m.To = addresses(m.Header.To)
+	m.Cc = addresses(m.Header.Cc)
+	m.Bcc = addresses(m.Header.Bcc)
 
 	if header_only {
 		return m, nil
 	}
 
-	content_type := mail_msg.Header.Get("Content-Type")
+	err = parse_body(&m, mail_msg.Header, mail_msg.Body)
+
+	return m, err
+}
+
+// parse_body parses the body of an entity into the bodies of m.
+func parse_body(m *Mail_obj, header Header, data io.Reader) error {
+	content_type := header.Get("Content-Type")
+	if content_type == "" {
+		content_type = default_content_type
+	}
 	mediaType, params, err := mime.ParseMediaType(content_type)
 	if err != nil {
-		return m, err
+		return err
 	}
 
-	if content_type == "" || !strings.HasPrefix(mediaType, "multipart/") {
-		txt_bytes, err := io.ReadAll(mail_msg.Body)
+	switch mediaType {
+	case "multipart/signed":
+		return parse_signed(m, params, data)
+	case "multipart/encrypted":
+		return parse_encrypted(m, params)
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return parse_pkcs7_mime(m, header, params, data)
+	case "message/rfc822", "message/global":
+		message, err := parse_message(header, data, m.nesting+1)
 		if err != nil {
-			return m, err
+			return err
+		}
+		m.MediaType = NotMultipart
+		m.Messages = append(m.Messages, message)
+		return nil
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		txt_bytes, err := io.ReadAll(data)
+		if err != nil {
+			return err
 		}
 
 		var body Mail_body
 
-		mail_body, err := Parse_mail_part(mail_msg.Header, txt_bytes)
+		mail_body, err := Parse_mail_part(header, txt_bytes)
 		if err != nil {
-			return m, err
+			return err
 		}
 
 		body.Data = mail_body.Data
@@ -129,27 +202,34 @@ func Parse_mail(m_data []byte, header_only bool) (Mail_obj, error) {
 		m.MediaType = NotMultipart
 		m.Body = append(m.Body, body)
 
-		return m, nil
+		return nil
 	}
 
-	if mediaType == "multipart/mixed" {
+	// a delivery report is read like mixed content
+	if mediaType == "multipart/mixed" || mediaType == "multipart/report" {
 		m.MediaType = Mixed
 	} else if mediaType == "multipart/alternative" {
 		m.MediaType = Alternative
 	} else {
-		return m, errors.New("Not supported multipart type")
+		return errors.New("Not supported multipart type")
 	}
 
-	body, err := Parse_mail_multipart(mail_msg.Body, params["boundary"])
-	if err != nil {
-		return m, err
-	}
+	return parse_multipart(m, data, params["boundary"])
+}
 
-	m.Body = body
+func addresses(list []Address) []string {
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.Address
+	}
 
-	return m, nil
+	return addrs
 }
 
+// default_content_type is the type of a part without Content-Type, as of
+// RFC 2045.
+const default_content_type = "text/plain"
+
 type Header interface {
 	Get(string) string
 }
@@ -157,6 +237,9 @@ type Header interface {
 func Parse_mail_part(header Header, body []byte) (Mail_body, error) {
 	content_transfer_encoding := header.Get("Content-Transfer-Encoding")
 	content_type := header.Get("Content-Type")
+	if content_type == "" {
+		content_type = default_content_type
+	}
 
 	var mail_body Mail_body
 
@@ -167,40 +250,52 @@ func Parse_mail_part(header Header, body []byte) (Mail_body, error) {
 		mail_body.MimeType = Markdown
 	case strings.HasPrefix(content_type, "text/html"):
 		mail_body.MimeType = Html
+	// the parts of delivery reports meant to be read
+	case strings.HasPrefix(content_type, "message/delivery-status"),
+		strings.HasPrefix(content_type, "message/global-delivery-status"),
+		strings.HasPrefix(content_type, "text/rfc822-headers"),
+		strings.HasPrefix(content_type, "message/global-headers"):
+		mail_body.MimeType = PlainText
 	default:
 		return mail_body, errors.New("Content type not supported: " + content_type)
 	}
 
+	decoded_content, err := decode_transfer(content_transfer_encoding, body)
+	if err != nil {
+		return mail_body, err
+	}
+	mail_body.Data = string(decoded_content)
+
+	return mail_body, nil
+}
+
+// decode_transfer decodes body from its Content-Transfer-Encoding.
+func decode_transfer(content_transfer_encoding string, body []byte) ([]byte, error) {
 	switch {
 	case strings.EqualFold(content_transfer_encoding, "BASE64"):
-		decoded_content, err := base64.StdEncoding.DecodeString(string(body))
-		if err != nil {
-			return mail_body, err
-		}
-
-		mail_body.Data = string(decoded_content)
+		return base64.StdEncoding.DecodeString(string(body))
 
 	case strings.EqualFold(content_transfer_encoding, "QUOTED-PRINTABLE"):
-		decoded_content, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
-		if err != nil {
-			return mail_body, err
-		}
-
-		mail_body.Data = string(decoded_content)
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
 
 	default:
-		mail_body.Data = string(body)
+		return body, nil
 	}
-
-	return mail_body, nil
 }
 
 func Parse_mail_multipart(mime_data io.Reader, boundary string) ([]Mail_body, error) {
-	var body []Mail_body
+	var m Mail_obj
+	err := parse_multipart(&m, mime_data, boundary)
 
+	return m.Body, err
+}
+
+// parse_multipart parses the parts of a multipart body into the bodies and
+// messages of m.
+func parse_multipart(m *Mail_obj, mime_data io.Reader, boundary string) error {
 	reader := multipart.NewReader(mime_data, boundary)
 	if reader == nil {
-		return body, nil
+		return nil
 	}
 
 	for {
@@ -210,39 +305,87 @@ func Parse_mail_multipart(mime_data io.Reader, boundary string) ([]Mail_body, er
 		}
 
 		if err != nil {
-			return body, err
+			return err
 		}
 
-		mediaType, params, err := mime.ParseMediaType(new_part.Header.Get("Content-Type"))
+		content_type := new_part.Header.Get("Content-Type")
+		if content_type == "" {
+			content_type = default_content_type
+		}
+		mediaType, params, err := mime.ParseMediaType(content_type)
 
 		if err != nil {
-			return body, err
+			return err
 		}
 
-		if strings.HasPrefix(mediaType, "multipart/") {
-			body_part, err := Parse_mail_multipart(new_part, params["boundary"])
+		if is_secured(mediaType) {
+			// the content of a signed part, its signature is not kept
+			nested := Mail_obj{nesting: m.nesting}
+			err = parse_body(&nested, new_part.Header, new_part)
+			if err != nil {
+				return err
+			}
+
+			m.Body = append(m.Body, nested.Body...)
+			m.Messages = append(m.Messages, nested.Messages...)
+
+		} else if strings.HasPrefix(mediaType, "multipart/") {
+			err = parse_multipart(m, new_part, params["boundary"])
 			if err != nil {
-				return body, err
+				return err
 			}
 
-			body = append(body, body_part...)
+		} else if mediaType == "message/rfc822" || mediaType == "message/global" {
+			message, err := parse_message(new_part.Header, new_part, m.nesting+1)
+			if err != nil {
+				return err
+			}
+			m.Messages = append(m.Messages, message)
 
 		} else {
 
 			part_data, err := io.ReadAll(new_part)
 			if err != nil {
-				return body, err
+				return err
 			}
 			part_body, err := Parse_mail_part(new_part.Header, part_data)
 			if err != nil {
-				return body, err
+				return err
 			}
-			body = append(body, part_body)
+			m.Body = append(m.Body, part_body)
 
 		}
 	}
 
-	return body, nil
+	return nil
+}
+
+// max_nesting is how deep messages are parsed within messages, deeper ones
+// only keep their headers.
+const max_nesting = 8
+
+// parse_message parses a message/rfc822 part. A message whose body cannot
+// be parsed keeps its headers rather than failing the one holding it.
+func parse_message(header Header, data io.Reader, nesting int) (Mail_obj, error) {
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return Mail_obj{}, err
+	}
+	raw, err = decode_transfer(header.Get("Content-Transfer-Encoding"), raw)
+	if err != nil {
+		return Mail_obj{}, err
+	}
+
+	message, err := parse_mail(raw, nesting > max_nesting, nesting)
+	if err != nil {
+		message, err = parse_mail(raw, true, nesting)
+	}
+	if err != nil {
+		return message, err
+	}
+	message.Date = message.Header.Date
+
+	return message, nil
 }
 
 func Set_format_index(m Mail_obj, format MIMEType, pref bool) Mail_obj {
@@ -263,5 +406,9 @@ func Set_format_index(m Mail_obj, format MIMEType, pref bool) Mail_obj {
 		}
 	}
 
+	for i := range m.Messages {
+		m.Messages[i] = Set_format_index(m.Messages[i], format, pref)
+	}
+
 	return m
 }
@@ -0,0 +1,304 @@
+package mail_utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crlf turns the line breaks of a message written in the source into CRLF.
+func crlf(message string) []byte {
+	return []byte(strings.ReplaceAll(message, "\n", "\r\n"))
+}
+
+var (
+	media_types = map[MediaType]string{NotMultipart: "single", Alternative: "alternative", Mixed: "mixed"}
+	mime_types  = map[MIMEType]string{PlainText: "text", Html: "html", Markdown: "md"}
+)
+
+// outline describes the bodies and nested messages of m on a line.
+func outline(m Mail_obj) string {
+	var b strings.Builder
+	b.WriteString(media_types[m.MediaType])
+	for _, body := range m.Body {
+		fmt.Fprintf(&b, " %s:%q", mime_types[body.MimeType], body.Data)
+	}
+	for _, message := range m.Messages {
+		fmt.Fprintf(&b, " (%q %s)", message.Subject, outline(message))
+	}
+
+	return b.String()
+}
+
+const forwarded = `From: Bob <bob@example.com>
+To: alice@nthmail.test
+Subject: Original
+Date: Mon, 02 Jan 2006 15:04:05 +0000
+
+see you
+`
+
+func TestParseMail(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{
+			name:    "no content type",
+			message: "Subject: hi\n\nhello\n",
+			want:    `single text:"hello\r\n"`,
+		},
+		{
+			name:    "quoted-printable",
+			message: "Content-Type: text/html; charset=utf-8\nContent-Transfer-Encoding: quoted-printable\n\n<p>caf=C3=A9</p>=\n\n",
+			want:    `single html:"<p>café</p>\r\n"`,
+		},
+		{
+			name:    "base64",
+			message: "Content-Type: text/markdown\nContent-Transfer-Encoding: base64\n\nIyBoZWxsbw==\n",
+			want:    `single md:"# hello"`,
+		},
+		{
+			name: "alternative",
+			message: `Content-Type: multipart/alternative; boundary=b
+
+--b
+Content-Type: text/plain
+
+hello
+--b
+Content-Type: text/html
+
+<p>hello</p>
+--b--
+`,
+			want: `alternative text:"hello" html:"<p>hello</p>"`,
+		},
+		{
+			name: "mixed holding alternative",
+			message: `Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain
+
+hello
+--inner
+Content-Type: text/html
+
+<p>hello</p>
+--inner--
+--outer
+Content-Type: text/plain; name=notes.txt
+Content-Disposition: attachment
+
+notes
+--outer--
+`,
+			want: `mixed text:"hello" html:"<p>hello</p>" text:"notes"`,
+		},
+		{
+			name: "forwarded message",
+			message: `Content-Type: multipart/mixed; boundary=b
+
+--b
+Content-Type: text/plain
+
+see below
+--b
+Content-Type: message/rfc822
+
+` + forwarded + `--b--
+`,
+			want: `mixed text:"see below" ("Original" single text:"see you")`,
+		},
+		{
+			name: "base64 forwarded message",
+			message: `Content-Type: multipart/mixed; boundary=b
+
+--b
+Content-Type: message/rfc822
+Content-Transfer-Encoding: base64
+
+U3ViamVjdDogT3JpZ2luYWwKCnNlZSB5b3UK
+--b--
+`,
+			want: `mixed ("Original" single text:"see you\n")`,
+		},
+		{
+			name:    "message body",
+			message: "Subject: Fwd: Original\nContent-Type: message/rfc822\n\n" + forwarded,
+			want:    `single ("Original" single text:"see you\r\n")`,
+		},
+		{
+			name: "forwarded message with an unsupported body",
+			message: `Content-Type: multipart/mixed; boundary=b
+
+--b
+Content-Type: message/rfc822
+
+Subject: Picture
+Content-Type: image/png
+
+PNG
+--b--
+`,
+			want: `mixed ("Picture" single)`,
+		},
+		{
+			name: "delivery report",
+			message: `Content-Type: multipart/report; report-type=delivery-status; boundary=b
+
+--b
+Content-Type: text/plain
+
+could not deliver
+--b
+Content-Type: message/delivery-status
+
+Final-Recipient: rfc822; bob@example.com
+Status: 5.1.1
+--b
+Content-Type: text/rfc822-headers
+
+Subject: Original
+--b--
+`,
+			want: `mixed text:"could not deliver" text:"Final-Recipient: rfc822; bob@example.com\r\nStatus: 5.1.1" text:"Subject: Original"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := Parse_mail(crlf(test.message), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := outline(m); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMailErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		err     string
+	}{
+		{name: "no header", message: "hello", err: "Could not read message"},
+		{name: "malformed content type", message: "Content-Type: text/plain; charset\n\nhello\n", err: "mime: invalid media parameter"},
+		{name: "unsupported multipart", message: "Content-Type: multipart/related; boundary=b\n\n--b\n\nhello\n--b--\n", err: "Not supported multipart type"},
+		{name: "unsupported content type", message: "Content-Type: application/pdf\n\n%PDF\n", err: "Content type not supported: application/pdf"},
+		{name: "unsupported part", message: "Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: image/png\n\nPNG\n--b--\n", err: "Content type not supported: image/png"},
+		{name: "bad base64", message: "Content-Transfer-Encoding: base64\n\n!!!\n", err: "illegal base64 data"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse_mail(crlf(test.message), false)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseMailHeaders(t *testing.T) {
+	m, err := Parse_mail(crlf(`From: =?utf-8?q?Bj=C3=B6rn?= <bjorn@example.com>
+To: Alice <alice@nthmail.test>, carol@example.org
+Cc: dave@example.org
+Reply-To: replies@example.com
+Message-Id: <1@example.com>
+References: <0@example.com>
+Subject: =?utf-8?q?caf=C3=A9?=
+Content-Type: image/png
+
+PNG
+`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.From != "Björn <bjorn@example.com>" || m.Subject != "café" || m.Reply_to != "replies@example.com" {
+		t.Errorf("From %q, Subject %q, Reply-To %q", m.From, m.Subject, m.Reply_to)
+	}
+	if strings.Join(m.To, ",") != "alice@nthmail.test,carol@example.org" || strings.Join(m.Cc, ",") != "dave@example.org" || len(m.Bcc) != 0 {
+		t.Errorf("To %v, Cc %v, Bcc %v", m.To, m.Cc, m.Bcc)
+	}
+	if m.Message_id != "<1@example.com>" || m.References != "<0@example.com>" {
+		t.Errorf("Message-Id %q, References %q", m.Message_id, m.References)
+	}
+	// the body is left alone, so that an unsupported one is no error
+	if len(m.Body) != 0 {
+		t.Errorf("parsed the body of a header only message: %s", outline(m))
+	}
+}
+
+func TestParseMailNesting(t *testing.T) {
+	message := "Subject: 0\n\nhello\n"
+	for i := 1; i <= max_nesting+2; i++ {
+		message = fmt.Sprintf("Subject: %d\nContent-Type: message/rfc822\n\n%s", i, message)
+	}
+
+	m, err := Parse_mail(crlf(message), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages deeper than max_nesting only keep their headers
+	depth := 0
+	for len(m.Messages) != 0 {
+		m = m.Messages[0]
+		depth++
+	}
+	if depth != max_nesting+1 || m.Subject != fmt.Sprint(1) {
+		t.Errorf("parsed %d messages down to %q", depth, m.Subject)
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+	m, err := Parse_mail(crlf("Content-Type: message/rfc822\n\n"+forwarded), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	if len(m.Messages) != 1 || !m.Messages[0].Date.Equal(want) {
+		t.Errorf("forwarded message dated %v, want %v", m.Messages, want)
+	}
+}
+
+func TestSetFormatIndex(t *testing.T) {
+	m := Mail_obj{
+		Body: []Mail_body{{MimeType: PlainText}, {MimeType: Html}, {MimeType: Markdown}},
+		Messages: []Mail_obj{
+			{Body: []Mail_body{{MimeType: Markdown}, {MimeType: PlainText}}},
+			{},
+		},
+	}
+
+	tests := []struct {
+		format   MIMEType
+		pref     bool
+		want     int
+		want_sub []int
+	}{
+		{format: PlainText, want: 1, want_sub: []int{0, -1}},
+		{format: PlainText, pref: true, want: 0, want_sub: []int{1, -1}},
+		{format: Markdown, pref: true, want: 2, want_sub: []int{0, -1}},
+	}
+
+	for _, test := range tests {
+		got := Set_format_index(m, test.format, test.pref)
+		sub := []int{got.Messages[0].PreferedBodyIndex, got.Messages[1].PreferedBodyIndex}
+		if got.PreferedBodyIndex != test.want || fmt.Sprint(sub) != fmt.Sprint(test.want_sub) {
+			t.Errorf("format %d, pref %v: index %d, %v, want %d, %v", test.format, test.pref, got.PreferedBodyIndex, sub, test.want, test.want_sub)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package mail_utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/smime"
+)
+
+// Signed and encrypted messages, as of RFC 1847 (multipart/signed and
+// multipart/encrypted), RFC 3156 (PGP/MIME) and RFC 8551 (S/MIME).
+
+const (
+	Signature_pgp   = "pgp"
+	Signature_smime = "smime"
+)
+
+const (
+	// the signature matches and its signer is trusted
+	Signature_valid = "valid"
+	// the signature matches but its signer is not trusted
+	Signature_untrusted = "untrusted"
+	// the signature does not match the content or is malformed
+	Signature_invalid = "invalid"
+	// the signature was not checked
+	Signature_unverified = "unverified"
+	// the message is encrypted and cannot be read
+	Signature_encrypted = "encrypted"
+)
+
+// Signature is how a message is signed or encrypted. Parse_mail leaves
+// signatures unverified, with what verifying them takes.
+type Signature struct {
+	// Signature_pgp or Signature_smime
+	Kind   string
+	Status string
+	// certificate subject or address of the signer, once verified
+	Signer string
+	// why the signature is not valid, once verified
+	Detail string
+	// the signing time the signer claims, zero when unknown
+	SigningTime time.Time
+
+	// the signed entity in canonical form, nil when Data holds it
+	Content []byte
+	// the PKCS #7 structure or the armored PGP signature
+	Data []byte
+}
+
+const encrypted_notice = "This message is encrypted and cannot be shown."
+
+func is_secured(media_type string) bool {
+	switch media_type {
+	case "multipart/signed", "multipart/encrypted", "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	default:
+		return false
+	}
+}
+
+// parse_signed parses the signed entity of a multipart/signed and keeps its
+// signature.
+func parse_signed(m *Mail_obj, params map[string]string, data io.Reader) error {
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	parts, err := split_multipart(raw, params["boundary"])
+	if err != nil {
+		return err
+	}
+	if len(parts) != 2 {
+		return errors.New("Malformed multipart/signed")
+	}
+
+	content, err := mail.ReadMessage(bytes.NewReader(parts[0]))
+	if err != nil {
+		return errors.New("Could not read signed content")
+	}
+	err = parse_body(m, content.Header, content.Body)
+	if err != nil {
+		return err
+	}
+
+	sig := &Signature{Status: Signature_unverified, Content: canonical(parts[0])}
+	switch strings.ToLower(params["protocol"]) {
+	case "application/pgp-signature":
+		sig.Kind = Signature_pgp
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		sig.Kind = Signature_smime
+	default:
+		// an unknown kind of signature, only its content is shown
+		return nil
+	}
+
+	// a signature part that cannot be read fails verification
+	if sig_part, err := mail.ReadMessage(bytes.NewReader(parts[1])); err == nil {
+		sig_data, _ := io.ReadAll(sig_part.Body)
+		sig.Data, _ = decode_transfer(sig_part.Header.Get("Content-Transfer-Encoding"), sig_data)
+	}
+
+	m.Signature = sig
+	return nil
+}
+
+// parse_encrypted shows a notice in place of an encrypted message.
+func parse_encrypted(m *Mail_obj, params map[string]string) error {
+	sig := &Signature{Status: Signature_encrypted}
+	if strings.EqualFold(params["protocol"], "application/pgp-encrypted") {
+		sig.Kind = Signature_pgp
+	}
+
+	m.Signature = sig
+	m.MediaType = NotMultipart
+	m.Body = append(m.Body, Mail_body{MimeType: PlainText, Data: encrypted_notice})
+
+	return nil
+}
+
+// parse_pkcs7_mime parses an S/MIME message, the entity of signed data or a
+// notice for enveloped data.
+func parse_pkcs7_mime(m *Mail_obj, header Header, params map[string]string, data io.Reader) error {
+	switch strings.ToLower(params["smime-type"]) {
+	case "enveloped-data", "authenveloped-data":
+		m.Signature = &Signature{Kind: Signature_smime, Status: Signature_encrypted}
+		m.MediaType = NotMultipart
+		m.Body = append(m.Body, Mail_body{MimeType: PlainText, Data: encrypted_notice})
+		return nil
+	}
+
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	der, err := decode_transfer(header.Get("Content-Transfer-Encoding"), raw)
+	if err != nil {
+		return err
+	}
+
+	signed, err := smime.Parse(der)
+	if errors.Is(err, smime.ErrNotSigned) {
+		return errors.New("Not supported S/MIME type")
+	}
+	if err != nil {
+		return err
+	}
+	if signed.Content == nil {
+		return errors.New("S/MIME signed data without content")
+	}
+
+	content, err := mail.ReadMessage(bytes.NewReader(signed.Content))
+	if err != nil {
+		return errors.New("Could not read signed content")
+	}
+	err = parse_body(m, content.Header, content.Body)
+	if err != nil {
+		return err
+	}
+
+	m.Signature = &Signature{Kind: Signature_smime, Status: Signature_unverified, Data: der}
+	return nil
+}
+
+// split_multipart returns the raw parts of a multipart body, headers
+// included, as they were signed: without the line break before each
+// delimiter.
+func split_multipart(body []byte, boundary string) ([][]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("Multipart without boundary")
+	}
+	delimiter := []byte("--" + boundary)
+
+	var parts [][]byte
+	start := -1
+	for offset := 0; offset < len(body); {
+		next := len(body)
+		if end := bytes.IndexByte(body[offset:], '\n'); end >= 0 {
+			next = offset + end + 1
+		}
+
+		line := bytes.TrimRight(body[offset:next], " \t\r\n")
+		if bytes.HasPrefix(line, delimiter) {
+			rest := line[len(delimiter):]
+			closing := bytes.Equal(rest, []byte("--"))
+
+			if len(rest) == 0 || closing {
+				if start >= 0 {
+					end := offset
+					if end > start && body[end-1] == '\n' {
+						end--
+					}
+					if end > start && body[end-1] == '\r' {
+						end--
+					}
+					parts = append(parts, body[start:end])
+				}
+				if closing {
+					return parts, nil
+				}
+				start = next
+			}
+		}
+
+		offset = next
+	}
+
+	return nil, errors.New("Multipart without closing delimiter")
+}
+
+// canonical turns the line breaks of an entity into CRLF, the form it is
+// signed in.
+func canonical(entity []byte) []byte {
+	lf := bytes.ReplaceAll(entity, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+}
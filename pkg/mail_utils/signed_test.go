@@ -0,0 +1,224 @@
+package mail_utils
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/GRFreire/nthmail/pkg/smime"
+)
+
+// signed_data encodes a PKCS #7 SignedData holding content, with no signer.
+func signed_data(t *testing.T, content string) string {
+	t.Helper()
+
+	type encap_content_info struct {
+		Type    asn1.ObjectIdentifier
+		Content []byte `asn1:"explicit,tag:0"`
+	}
+	type signed_data struct {
+		Version     int
+		Digests     []asn1.RawValue `asn1:"set"`
+		Encap       encap_content_info
+		SignerInfos []asn1.RawValue `asn1:"set"`
+	}
+	type content_info struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue
+	}
+
+	sd, err := asn1.Marshal(signed_data{Version: 1, Encap: encap_content_info{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}, []byte(content)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(content_info{
+		Type:    asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestParseSigned(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+		// kind, status, signed content and signature data
+		signature string
+		// the signature data is the PKCS #7 structure of the message
+		pkcs7 bool
+	}{
+		{
+			name: "pgp",
+			message: `Content-Type: multipart/signed; protocol="application/pgp-signature"; micalg=pgp-sha256; boundary=b
+
+--b
+Content-Type: text/plain
+
+hello
+--b
+Content-Type: application/pgp-signature
+
+-----BEGIN PGP SIGNATURE-----
+--b--
+`,
+			want:      `single text:"hello"`,
+			signature: `pgp unverified "Content-Type: text/plain\r\n\r\nhello" "-----BEGIN PGP SIGNATURE-----"`,
+		},
+		{
+			name: "smime",
+			message: `Content-Type: multipart/signed; protocol="application/pkcs7-signature"; boundary=b
+
+--b
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain
+
+hello
+--inner
+Content-Type: text/html
+
+<p>hello</p>
+--inner--
+--b
+Content-Type: application/pkcs7-signature
+Content-Transfer-Encoding: base64
+
+c2lnbmF0dXJl
+--b--
+`,
+			want:      `alternative text:"hello" html:"<p>hello</p>"`,
+			signature: `smime unverified "Content-Type: multipart/alternative; boundary=inner\r\n\r\n--inner\r\nContent-Type: text/plain\r\n\r\nhello\r\n--inner\r\nContent-Type: text/html\r\n\r\n<p>hello</p>\r\n--inner--" "signature"`,
+		},
+		{
+			name: "unknown protocol",
+			message: `Content-Type: multipart/signed; protocol="application/x-other"; boundary=b
+
+--b
+
+hello
+--b
+
+signature
+--b--
+`,
+			want: `single text:"hello"`,
+		},
+		{
+			name: "signed part of mixed content",
+			message: `Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: multipart/signed; protocol="application/pgp-signature"; boundary=b
+
+--b
+
+hello
+--b
+
+signature
+--b--
+--outer
+
+notes
+--outer--
+`,
+			want: `mixed text:"hello" text:"notes"`,
+		},
+		{
+			name:      "pgp encrypted",
+			message:   "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=b\n\n--b\n\nVersion: 1\n--b--\n",
+			want:      `single text:"` + encrypted_notice + `"`,
+			signature: `pgp encrypted "" ""`,
+		},
+		{
+			name:      "smime enveloped",
+			message:   "Content-Type: application/pkcs7-mime; smime-type=enveloped-data\nContent-Transfer-Encoding: base64\n\nMAA=\n",
+			want:      `single text:"` + encrypted_notice + `"`,
+			signature: `smime encrypted "" ""`,
+		},
+		{
+			name:      "smime signed data",
+			message:   "Content-Type: application/pkcs7-mime; smime-type=signed-data\nContent-Transfer-Encoding: base64\n\n" + signed_data(t, "Content-Type: text/html\r\n\r\n<p>hello</p>") + "\n",
+			want:      `single html:"<p>hello</p>"`,
+			signature: `smime unverified "" ""`,
+			pkcs7:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := Parse_mail(crlf(test.message), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := outline(m); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+
+			var signature string
+			if sig := m.Signature; sig != nil {
+				data := string(sig.Data)
+				if test.pkcs7 {
+					if _, err := smime.Parse(sig.Data); err != nil {
+						t.Errorf("signature data: %v", err)
+					}
+					data = ""
+				}
+				signature = fmt.Sprintf("%s %s %q %q", sig.Kind, sig.Status, sig.Content, data)
+			}
+			if signature != test.signature {
+				t.Errorf("signature %s, want %s", signature, test.signature)
+			}
+		})
+	}
+}
+
+func TestParseSignedErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		err     string
+	}{
+		{name: "no boundary", message: "Content-Type: multipart/signed\n\nhello\n", err: "Multipart without boundary"},
+		{name: "unclosed", message: "Content-Type: multipart/signed; boundary=b\n\n--b\n\nhello\n--b\n\nsig\n", err: "Multipart without closing delimiter"},
+		{name: "one part", message: "Content-Type: multipart/signed; boundary=b\n\n--b\n\nhello\n--b--\n", err: "Malformed multipart/signed"},
+		{name: "not signed data", message: "Content-Type: application/pkcs7-mime\nContent-Transfer-Encoding: base64\n\nMAsGCSqGSIb3DQEHAQ==\n", err: "Not supported S/MIME type"},
+		{name: "malformed signed data", message: "Content-Type: application/pkcs7-mime\nContent-Transfer-Encoding: base64\n\nMAA=\n", err: "malformed PKCS #7 structure"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse_mail(crlf(test.message), false)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSplitMultipart(t *testing.T) {
+	body := "preamble\n--b\nContent-Type: text/plain\n\nhello\n\n--b  \r\n\nsig\r\n--bb\r\n--b--\nepilogue\n"
+	parts, err := split_multipart([]byte(body), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Content-Type: text/plain\n\nhello\n", "\nsig\r\n--bb"}
+	if fmt.Sprintf("%q", parts) != fmt.Sprintf("%q", want) {
+		t.Errorf("got %q, want %q", parts, want)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	if got := string(canonical([]byte("a\nb\r\nc\n"))); got != "a\r\nb\r\nc\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,319 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny implementation of the Prometheus text exposition format. Metrics
+// register themselves in a process-wide registry when created and are
+// served by Handler.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry struct {
+	sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.names == nil {
+		registry.names = make(map[string]bool)
+	}
+	if registry.names[name] {
+		panic("metrics: duplicated metric " + name)
+	}
+	registry.names[name] = true
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Handler serves every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		registry.Lock()
+		metrics := append([]metric(nil), registry.metrics...)
+		registry.Unlock()
+
+		for _, m := range metrics {
+			m.write(res)
+		}
+	})
+}
+
+// vec keeps one value per combination of label values.
+type vec[T any] struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*T
+	init   func() *T
+}
+
+func (v *vec[T]) get(label_values []string) *T {
+	if len(label_values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(label_values)))
+	}
+
+	// "\xff" never appears in valid UTF-8, so it cannot split a value
+	valid := make([]string, len(label_values))
+	for i, value := range label_values {
+		valid[i] = strings.ToValidUTF8(value, "\uFFFD")
+	}
+	key := strings.Join(valid, "\xff")
+	value, exists := v.values[key]
+	if !exists {
+		value = v.init()
+		v.values[key] = value
+	}
+
+	return value
+}
+
+func (v *vec[T]) sorted_keys() []string {
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (v *vec[T]) label_pairs(key string, extra ...string) string {
+	var pairs []string
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, v.labels[i], escape(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return label_escaper.Replace(s)
+}
+
+func write_header(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func format_float(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type Counter struct {
+	vec[float64]
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec[float64]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*float64),
+		init:   func() *float64 { return new(float64) },
+	}}
+	register(name, c)
+	if len(labels) == 0 {
+		c.get(nil)
+	}
+
+	return c
+}
+
+func (c *Counter) Inc(label_values ...string) {
+	c.Add(1, label_values...)
+}
+
+func (c *Counter) Add(v float64, label_values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	*c.get(label_values) += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	write_header(w, c.name, c.help, "counter")
+	for _, key := range c.sorted_keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.label_pairs(key), format_float(*c.values[key]))
+	}
+}
+
+type Gauge struct {
+	vec[float64]
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec[float64]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*float64),
+		init:   func() *float64 { return new(float64) },
+	}}
+	register(name, g)
+	if len(labels) == 0 {
+		g.get(nil)
+	}
+
+	return g
+}
+
+func (g *Gauge) Set(v float64, label_values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	*g.get(label_values) = v
+}
+
+func (g *Gauge) Add(v float64, label_values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	*g.get(label_values) += v
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	write_header(w, g.name, g.help, "gauge")
+	for _, key := range g.sorted_keys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.label_pairs(key), format_float(*g.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge whose value is computed on every scrape.
+type GaugeFunc struct {
+	name, help string
+	fn         func() (float64, error)
+}
+
+func NewGaugeFunc(name, help string, fn func() (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	register(name, g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	v, err := g.fn()
+	if err != nil {
+		return
+	}
+
+	write_header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, format_float(v))
+}
+
+// DefaultBuckets are latency buckets in seconds, from 1ms to 10s.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram_value struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type Histogram struct {
+	vec[histogram_value]
+	buckets []float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.vec = vec[histogram_value]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*histogram_value),
+		init: func() *histogram_value {
+			return &histogram_value{counts: make([]uint64, len(buckets))}
+		},
+	}
+	register(name, h)
+	if len(labels) == 0 {
+		h.get(nil)
+	}
+
+	return h
+}
+
+func (h *Histogram) Observe(v float64, label_values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	value := h.get(label_values)
+	for i, upper := range h.buckets {
+		if v <= upper {
+			value.counts[i]++
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+// Since observes the seconds elapsed from start.
+func (h *Histogram) Since(start time.Time, label_values ...string) {
+	h.Observe(time.Since(start).Seconds(), label_values...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	write_header(w, h.name, h.help, "histogram")
+	for _, key := range h.sorted_keys() {
+		value := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.label_pairs(key, "le", format_float(upper)), value.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.label_pairs(key, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.label_pairs(key), format_float(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.label_pairs(key), value.count)
+	}
+}
+
+// DBQueryDuration is shared by every package that talks to the database.
+var DBQueryDuration = NewHistogram(
+	"nthmail_db_query_duration_seconds",
+	"Latency of database queries.",
+	DefaultBuckets,
+	"query",
+)
@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric func() metric
+		want   string
+	}{
+		{
+			name: "counter",
+			metric: func() metric {
+				c := NewCounter("test_counter_total", "A counter.")
+				c.Inc()
+				c.Add(1.5)
+				return c
+			},
+			want: `# HELP test_counter_total A counter.
+# TYPE test_counter_total counter
+test_counter_total 2.5
+`,
+		},
+		{
+			name: "counter with labels",
+			metric: func() metric {
+				c := NewCounter("test_labeled_total", "A labeled counter.", "code", "path")
+				c.Inc("200", "/b")
+				c.Inc("200", "/a")
+				c.Inc("200", "/a")
+				c.Inc("500", "say \"hi\"\\\n\xff")
+				return c
+			},
+			want: `# HELP test_labeled_total A labeled counter.
+# TYPE test_labeled_total counter
+test_labeled_total{code="200",path="/a"} 2
+test_labeled_total{code="200",path="/b"} 1
+test_labeled_total{code="500",path="say \"hi\"\\\n` + "�" + `"} 1
+`,
+		},
+		{
+			name: "labeled counter without values",
+			metric: func() metric {
+				return NewCounter("test_unused_total", "Never incremented.", "code")
+			},
+			want: `# HELP test_unused_total Never incremented.
+# TYPE test_unused_total counter
+`,
+		},
+		{
+			name: "gauge",
+			metric: func() metric {
+				g := NewGauge("test_gauge", "A gauge.", "queue")
+				g.Set(3, "out")
+				g.Add(-1, "out")
+				g.Set(math.Inf(1), "in")
+				return g
+			},
+			want: `# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge{queue="in"} +Inf
+test_gauge{queue="out"} 2
+`,
+		},
+		{
+			name: "gauge func",
+			metric: func() metric {
+				return NewGaugeFunc("test_gauge_func", "A computed gauge.", func() (float64, error) { return 1e-7, nil })
+			},
+			want: `# HELP test_gauge_func A computed gauge.
+# TYPE test_gauge_func gauge
+test_gauge_func 1e-07
+`,
+		},
+		{
+			name: "failing gauge func",
+			metric: func() metric {
+				return NewGaugeFunc("test_failing_gauge_func", "Fails.", func() (float64, error) { return 0, errors.New("no db") })
+			},
+			want: "",
+		},
+		{
+			name: "histogram",
+			metric: func() metric {
+				h := NewHistogram("test_seconds", "A histogram.", []float64{0.1, 1}, "op")
+				h.Observe(0.05, "read")
+				h.Observe(0.1, "read")
+				h.Observe(0.5, "read")
+				h.Observe(2, "read")
+				return h
+			},
+			want: `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="read",le="0.1"} 2
+test_seconds_bucket{op="read",le="1"} 3
+test_seconds_bucket{op="read",le="+Inf"} 4
+test_seconds_sum{op="read"} 2.65
+test_seconds_count{op="read"} 4
+`,
+		},
+		{
+			name: "histogram without labels",
+			metric: func() metric {
+				return NewHistogram("test_empty_seconds", "Empty.", []float64{1})
+			},
+			want: `# HELP test_empty_seconds Empty.
+# TYPE test_empty_seconds histogram
+test_empty_seconds_bucket{le="1"} 0
+test_empty_seconds_bucket{le="+Inf"} 0
+test_empty_seconds_sum 0
+test_empty_seconds_count 0
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			test.metric().write(&out)
+			if out.String() != test.want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Served by the handler.").Inc()
+
+	res := httptest.NewRecorder()
+	Handler().ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+
+	if content_type := res.Header().Get("Content-Type"); content_type != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", content_type)
+	}
+	for _, line := range []string{"test_handler_total 1\n", "# TYPE nthmail_db_query_duration_seconds histogram\n"} {
+		if !strings.Contains(res.Body.String(), line) {
+			t.Errorf("missing %q in\n%s", line, res.Body.String())
+		}
+	}
+}
+
+func TestPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"duplicated name", func() {
+			NewGauge("test_duplicated", "First.")
+			NewGauge("test_duplicated", "Second.")
+		}},
+		{"wrong label count", func() {
+			NewCounter("test_wrong_labels_total", "Two labels.", "a", "b").Inc("a")
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("did not panic")
+				}
+			}()
+			test.fn()
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+)
+
+// Migrations live in sql/ as NNNN_description.sql, or in go_migrations when
+// they need more than SQL, and are applied in order. The number of the last applied migration is kept in the database's
+// user_version pragma.
+
+//go:embed sql/*.sql
+var files embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+	run     func(tx *sql.Tx, opts options) error
+}
+
+// options are the settings the Go migrations need.
+type options struct {
+	// the one new addresses are stored with
+	normalizer address.Normalizer
+	// the configured mail.subaddress_separators
+	subaddress_separators string
+}
+
+var go_migrations = []migration{
+	{version: 11, name: "0011_subaddress.go", run: subaddress},
+	{version: 12, name: "0012_normalize_addresses.go", run: normalize_addresses},
+}
+
+func load() ([]migration, error) {
+	entries, err := fs.ReadDir(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := append([]migration(nil), go_migrations...)
+	for _, entry := range entries {
+		name := entry.Name()
+		index := strings.Index(name, "_")
+		if index <= 0 {
+			return nil, fmt.Errorf("invalid migration name %s", name)
+		}
+
+		version, err := strconv.Atoi(name[:index])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration name %s", name)
+		}
+
+		data, err := files.ReadFile("sql/" + name)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %s and %s", migrations[i-1].name, migrations[i].name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Latest is the schema version this build expects.
+func Latest() int {
+	migrations, err := load()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].version
+}
+
+// Version returns the schema version of db.
+func Version(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+
+	return version, err
+}
+
+// Apply runs every migration newer than the schema version of db, each one
+// in its own transaction. normalizer is the one new addresses are stored
+// with and subaddress_separators the configured sub-address separators.
+func Apply(db *sql.DB, normalizer address.Normalizer, subaddress_separators string) error {
+	return apply(db, options{normalizer: normalizer, subaddress_separators: subaddress_separators}, Latest())
+}
+
+func apply(db *sql.DB, opts options, until int) error {
+	migrations, err := load()
+	if err != nil {
+		return fmt.Errorf("could not load migrations: %w", err)
+	}
+
+	current, err := Version(db)
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > until {
+			continue
+		}
+
+		// journal_mode cannot be changed inside a transaction
+		pragmas, statements := split_pragmas(m.sql)
+		for _, p := range pragmas {
+			_, err = db.Exec(p)
+			if err != nil {
+				return fmt.Errorf("migration %s: %w", m.name, err)
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+
+		if m.run != nil {
+			err = m.run(tx, opts)
+		} else {
+			_, err = tx.Exec(statements)
+		}
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", m.version))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+
+		slog.Info("applied migration", "migration", m.name)
+	}
+
+	return nil
+}
+
+func split_pragmas(sql string) ([]string, string) {
+	var pragmas []string
+	var rest []string
+	for _, line := range strings.Split(sql, "\n") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line)), "pragma ") {
+			pragmas = append(pragmas, line)
+		} else {
+			rest = append(rest, line)
+		}
+	}
+
+	return pragmas, strings.Join(rest, "\n")
+}
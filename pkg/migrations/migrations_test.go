@@ -0,0 +1,246 @@
+package migrations
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func open_db(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func exec(t *testing.T, db *sql.DB, query string, args ...any) {
+	t.Helper()
+
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func strings_of(t *testing.T, db *sql.DB, query string) []string {
+	t.Helper()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+
+	return values
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestApply(t *testing.T) {
+	db := open_db(t)
+
+	err := Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Latest() {
+		t.Errorf("version = %d, want %d", version, Latest())
+	}
+
+	// applying again is a no-op
+	err = Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubaddressBackfill(t *testing.T) {
+	addrs := []string{"bob+news@example.com", "bob-news@example.com", "bob@example.com", "+news@example.com", "bob+@example.com", "bob+a-b@example.com"}
+
+	tests := []struct {
+		separators string
+		want       []string
+	}{
+		{
+			separators: "+",
+			want: []string{
+				"bob@example.com news",
+				"bob-news@example.com -",
+				"bob@example.com -",
+				"+news@example.com -",
+				"bob+@example.com -",
+				"bob@example.com a-b",
+			},
+		},
+		{
+			separators: "-",
+			want: []string{
+				"bob+news@example.com -",
+				"bob@example.com news",
+				"bob@example.com -",
+				"+news@example.com -",
+				"bob+@example.com -",
+				"bob+a@example.com b",
+			},
+		},
+		{
+			separators: "",
+			want: []string{
+				"bob+news@example.com -",
+				"bob-news@example.com -",
+				"bob@example.com -",
+				"+news@example.com -",
+				"bob+@example.com -",
+				"bob+a-b@example.com -",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.separators, func(t *testing.T) {
+			db := open_db(t)
+
+			err := apply(db, options{}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, addr := range addrs {
+				exec(t, db, "INSERT INTO mails (rcpt_addr, from_addr, arrived_at, data) VALUES (?, 'alice@example.com', 0, '')", addr)
+			}
+
+			err = apply(db, options{subaddress_separators: test.separators}, 11)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := strings_of(t, db, "SELECT rcpt_addr || ' ' || coalesce(rcpt_tag, '-') FROM mails ORDER BY id")
+			if !equal(got, test.want) {
+				t.Errorf("mails = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeAddresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		normalizer address.Normalizer
+		mails      []string
+		claims     []string
+		tokens     []string
+	}{
+		{
+			name:       "fold case",
+			normalizer: address.Normalizer{FoldCase: true},
+			mails:      []string{"a.lice@example.com", "alice@example.com", "bob@xn--bcher-kva.example"},
+			claims:     []string{"a.lice@example.com", "alice@example.com"},
+			tokens:     []string{"a.lice@example.com", "alice@example.com"},
+		},
+		{
+			name:       "keep case",
+			normalizer: address.Normalizer{},
+			mails:      []string{"Alice@example.com", "a.lice@example.com", "alice@example.com", "bob@xn--bcher-kva.example"},
+			claims:     []string{"Alice@example.com", "a.lice@example.com", "alice@example.com"},
+			tokens:     []string{"Alice@example.com", "a.lice@example.com", "alice@example.com"},
+		},
+		{
+			name:       "strip dots",
+			normalizer: address.Normalizer{FoldCase: true, StripDots: true},
+			mails:      []string{"alice@example.com", "bob@xn--bcher-kva.example"},
+			claims:     []string{"alice@example.com"},
+			tokens:     []string{"alice@example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := open_db(t)
+
+			err := apply(db, options{}, 11)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, addr := range []string{"alice@example.com", "Alice@EXAMPLE.com", "a.lice@example.com", "bob@Bücher.example", "no-domain"} {
+				exec(t, db, "INSERT INTO mails (rcpt_addr, from_addr, arrived_at, data) VALUES (?, 'carol@example.com', 0, '')", addr)
+			}
+
+			// the claim of Alice@EXAMPLE.com is the oldest, a.lice's the newest
+			claims := []struct {
+				addr       string
+				created_at int64
+			}{
+				{"alice@example.com", 2},
+				{"Alice@EXAMPLE.com", 1},
+				{"a.lice@example.com", 3},
+			}
+			for _, c := range claims {
+				exec(t, db, "INSERT INTO inbox_claims (rcpt_addr, created_at, expires_at) VALUES (?, ?, 10)", c.addr, c.created_at)
+				exec(t, db, "INSERT INTO claim_tokens (token_hash, rcpt_addr, kind, created_at, expires_at) VALUES (?, ?, 'access', ?, 10)", c.addr, c.addr, c.created_at)
+			}
+
+			err = apply(db, options{normalizer: test.normalizer}, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := strings_of(t, db, "SELECT DISTINCT rcpt_addr FROM mails WHERE rcpt_addr <> 'no-domain' ORDER BY rcpt_addr")
+			if !equal(got, test.mails) {
+				t.Errorf("mails = %q, want %q", got, test.mails)
+			}
+
+			got = strings_of(t, db, "SELECT rcpt_addr FROM inbox_claims ORDER BY rcpt_addr")
+			if !equal(got, test.claims) {
+				t.Errorf("claims = %q, want %q", got, test.claims)
+			}
+
+			got = strings_of(t, db, "SELECT rcpt_addr FROM claim_tokens ORDER BY rcpt_addr")
+			if !equal(got, test.tokens) {
+				t.Errorf("tokens = %q, want %q", got, test.tokens)
+			}
+
+			// the kept claim is the oldest one, Alice@EXAMPLE.com's
+			if test.normalizer.FoldCase {
+				got = strings_of(t, db, "SELECT token_hash FROM claim_tokens WHERE rcpt_addr = 'alice@example.com'")
+				if !equal(got, []string{"Alice@EXAMPLE.com"}) {
+					t.Errorf("kept token = %q, want the oldest claim's", got)
+				}
+			}
+		})
+	}
+}
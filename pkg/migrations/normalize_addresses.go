@@ -0,0 +1,138 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+)
+
+// normalize_addresses gives the addresses stored before normalization the
+// form the configured normalizer gives new ones. Addresses that do not
+// normalize are left as they are.
+func normalize_addresses(tx *sql.Tx, opts options) error {
+	normalizer := opts.normalizer
+	columns := []struct {
+		table  string
+		column string
+	}{
+		{"mails", "rcpt_addr"},
+		{"forward_rules", "rcpt_addr"},
+		{"sent_mails", "from_addr"},
+		{"greylist", "rcpt_addr"},
+	}
+	for _, c := range columns {
+		err := normalize_column(tx, normalizer, c.table, c.column)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := normalize_claims(tx, normalizer)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func normalize_column(tx *sql.Tx, normalizer address.Normalizer, table, column string) error {
+	renames, err := distinct_renames(tx, normalizer, fmt.Sprintf("SELECT DISTINCT %s FROM %s", column, table))
+	if err != nil {
+		return fmt.Errorf("%s.%s: %w", table, column, err)
+	}
+
+	// rows that would collide with one already stored under the normalized
+	// address, as greylist entries can, are dropped
+	for _, r := range renames {
+		if r.from == r.to {
+			continue
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("UPDATE OR IGNORE %s SET %s = ? WHERE %s = ?", table, column, column), r.to, r.from)
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, column), r.from)
+		}
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", table, column, err)
+		}
+	}
+
+	return nil
+}
+
+// normalize_claims keeps, of an inbox claimed under several spellings, the
+// oldest claim, and drops the others along with their tokens.
+func normalize_claims(tx *sql.Tx, normalizer address.Normalizer) error {
+	renames, err := distinct_renames(tx, normalizer, "SELECT rcpt_addr FROM inbox_claims ORDER BY created_at, rowid")
+	if err != nil {
+		return fmt.Errorf("inbox_claims: %w", err)
+	}
+
+	kept := make(map[string]bool)
+	for _, r := range renames {
+		if !kept[r.to] {
+			kept[r.to] = true
+			continue
+		}
+
+		_, err = tx.Exec("DELETE FROM claim_tokens WHERE rcpt_addr = ?", r.from)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM inbox_claims WHERE rcpt_addr = ?", r.from)
+		}
+		if err != nil {
+			return fmt.Errorf("inbox_claims: %w", err)
+		}
+		slog.Warn("dropped the claim of another spelling of a claimed inbox", "rcpt_addr", r.from, "inbox", r.to)
+	}
+
+	for _, r := range renames {
+		if r.from == r.to {
+			continue
+		}
+
+		_, err = tx.Exec("UPDATE inbox_claims SET rcpt_addr = ? WHERE rcpt_addr = ?", r.to, r.from)
+		if err == nil {
+			_, err = tx.Exec("UPDATE claim_tokens SET rcpt_addr = ? WHERE rcpt_addr = ?", r.to, r.from)
+		}
+		if err != nil {
+			return fmt.Errorf("inbox_claims: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type rename struct {
+	from string
+	to   string
+}
+
+// distinct_renames returns the addresses selected by query along with their
+// normalized form, in the order of the query. Addresses that do not
+// normalize map to themselves.
+func distinct_renames(tx *sql.Tx, normalizer address.Normalizer, query string) ([]rename, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var renames []rename
+	for rows.Next() {
+		var addr string
+		err = rows.Scan(&addr)
+		if err != nil {
+			return nil, err
+		}
+
+		normalized, err := normalizer.Normalize(addr)
+		if err != nil {
+			normalized = addr
+		}
+		renames = append(renames, rename{from: addr, to: normalized})
+	}
+
+	return renames, rows.Err()
+}
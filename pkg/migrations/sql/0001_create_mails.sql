@@ -1,6 +1,6 @@
 pragma journal_mode = wal;
 
-CREATE TABLE mails (
+CREATE TABLE IF NOT EXISTS mails (
     id integer not null primary key,
     arrived_at integer not null,
     rcpt_addr text not null,
@@ -0,0 +1,3 @@
+ALTER TABLE mails ADD COLUMN spf_result text;
+ALTER TABLE mails ADD COLUMN dkim_result text;
+ALTER TABLE mails ADD COLUMN dmarc_result text;
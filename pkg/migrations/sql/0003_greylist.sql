@@ -0,0 +1,15 @@
+CREATE TABLE greylist (
+    client_net text not null,
+    from_addr text not null,
+    rcpt_addr text not null,
+    first_seen integer not null,
+    last_seen integer not null,
+    PRIMARY KEY (client_net, from_addr, rcpt_addr)
+);
+
+CREATE TABLE greylist_whitelist (
+    client_net text not null,
+    from_domain text not null,
+    passed_at integer not null,
+    PRIMARY KEY (client_net, from_domain)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE mails ADD COLUMN spam_score real;
+ALTER TABLE mails ADD COLUMN spam_hits text;
+ALTER TABLE mails ADD COLUMN spam integer not null default 0;
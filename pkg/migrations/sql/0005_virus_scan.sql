@@ -0,0 +1,2 @@
+ALTER TABLE mails ADD COLUMN virus_result text;
+ALTER TABLE mails ADD COLUMN quarantined integer not null default 0;
@@ -0,0 +1,26 @@
+CREATE TABLE outbound_queue (
+    id integer not null primary key,
+    created_at integer not null,
+    next_attempt_at integer not null,
+    attempts integer not null default 0,
+    mail_from text not null,
+    rcpt_to text not null,
+    data blob not null,
+    last_error text,
+    failed integer not null default 0
+);
+
+CREATE INDEX outbound_queue_due ON outbound_queue (failed, next_attempt_at);
+
+CREATE TABLE forward_rules (
+    id integer not null primary key,
+    rcpt_addr text not null,
+    target_addr text not null,
+    match_from text not null default '',
+    match_subject text not null default '',
+    token text not null unique,
+    created_at integer not null,
+    confirmed_at integer
+);
+
+CREATE INDEX forward_rules_rcpt_addr ON forward_rules (rcpt_addr);
@@ -0,0 +1,11 @@
+CREATE TABLE sent_mails (
+    id integer not null primary key,
+    sent_at integer not null,
+    from_addr text not null,
+    to_addrs text not null,
+    subject text not null,
+    body text not null,
+    data blob not null
+);
+
+CREATE INDEX sent_mails_from_addr ON sent_mails (from_addr, sent_at);
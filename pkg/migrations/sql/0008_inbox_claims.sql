@@ -0,0 +1,16 @@
+CREATE TABLE inbox_claims (
+    rcpt_addr text not null primary key,
+    password_hash text,
+    created_at integer not null,
+    expires_at integer not null
+);
+
+CREATE TABLE claim_tokens (
+    token_hash text not null primary key,
+    rcpt_addr text not null,
+    kind text not null,
+    created_at integer not null,
+    expires_at integer not null
+);
+
+CREATE INDEX claim_tokens_rcpt_addr ON claim_tokens (rcpt_addr);
@@ -0,0 +1,12 @@
+CREATE TABLE api_keys (
+    id text not null primary key,
+    name text not null,
+    secret_hash text not null,
+    domains text not null default '',
+    prefixes text not null default '',
+    permissions text not null,
+    rate_limit integer not null default 0,
+    created_at integer not null,
+    last_used_at integer,
+    revoked_at integer
+);
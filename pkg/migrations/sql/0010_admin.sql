@@ -0,0 +1,20 @@
+CREATE TABLE smtp_rejections (
+    id integer not null primary key,
+    rejected_at integer not null,
+    remote_ip text not null,
+    from_addr text not null,
+    rcpts text not null,
+    reason text not null,
+    error text not null
+);
+
+CREATE TABLE blocklist (
+    id integer not null primary key,
+    kind text not null,
+    value text not null,
+    created_at integer not null,
+    UNIQUE (kind, value)
+);
+
+CREATE INDEX mails_arrived_at ON mails (arrived_at);
+CREATE INDEX mails_from_addr ON mails (from_addr);
@@ -0,0 +1,10 @@
+ALTER TABLE mails ADD COLUMN message_id text;
+ALTER TABLE mails ADD COLUMN thread_id integer;
+ALTER TABLE mails ADD COLUMN thread_subject text;
+
+-- mails received before threading are threads of their own
+UPDATE mails SET thread_id = id;
+
+CREATE INDEX mails_rcpt_addr_message_id ON mails (rcpt_addr, message_id);
+CREATE INDEX mails_rcpt_addr_thread_id ON mails (rcpt_addr, thread_id);
+CREATE INDEX mails_rcpt_addr_thread_subject ON mails (rcpt_addr, thread_subject);
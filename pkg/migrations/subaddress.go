@@ -0,0 +1,59 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+)
+
+// subaddress adds the tag column to mails and moves the mail received for
+// name+tag@domain before sub-addressing to the name inbox, split at the
+// configured separators. Nothing is moved when sub-addressing is disabled.
+func subaddress(tx *sql.Tx, opts options) error {
+	_, err := tx.Exec("ALTER TABLE mails ADD COLUMN rcpt_tag text")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX mails_rcpt_addr_tag ON mails (rcpt_addr, rcpt_tag)")
+	if err != nil {
+		return err
+	}
+
+	if opts.subaddress_separators == "" {
+		return nil
+	}
+
+	rows, err := tx.Query("SELECT DISTINCT rcpt_addr FROM mails")
+	if err != nil {
+		return err
+	}
+	var addrs []string
+	for rows.Next() {
+		var addr string
+		err = rows.Scan(&addr)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		inbox, tag := address.Split(addr, opts.subaddress_separators)
+		if tag == "" {
+			continue
+		}
+
+		_, err = tx.Exec("UPDATE mails SET rcpt_addr = ?, rcpt_tag = ? WHERE rcpt_addr = ?", inbox, tag, addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets, one per key, each refilled at rate
+// tokens per second up to burst tokens. A nil *Limiter allows everything.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	last_sweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// PerMinute returns a limiter allowing n events per minute per key, with
+// bursts of up to n. It returns nil, an unlimited limiter, when n <= 0.
+func PerMinute(n int64) *Limiter {
+	return Per(n, time.Minute)
+}
+
+// Per returns a limiter allowing n events per period per key, with bursts
+// of up to n. It returns nil, an unlimited limiter, when n <= 0.
+func Per(n int64, period time.Duration) *Limiter {
+	if n <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		rate:    float64(n) / period.Seconds(),
+		burst:   float64(n),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *Limiter) Allow(key string) bool {
+	return l.AllowN(key, 1)
+}
+
+// AllowN takes n tokens from the bucket of key, reporting whether there
+// were enough.
+func (l *Limiter) AllowN(key string, n float64) bool {
+	if l == nil {
+		return true
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// sweep drops the buckets that have refilled completely, as they are
+// equivalent to a missing one.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.last_sweep) < time.Minute {
+		return
+	}
+	l.last_sweep = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Allowlist is a set of networks exempt from limits.
+type Allowlist []*net.IPNet
+
+// ParseAllowlist parses CIDRs such as "10.0.0.0/8" or plain addresses.
+func ParseAllowlist(cidrs []string) (Allowlist, error) {
+	var list Allowlist
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ip_net, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ip_net)
+	}
+
+	return list, nil
+}
+
+func (list Allowlist) Contains(ip net.IP) bool {
+	for _, ip_net := range list {
+		if ip_net.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
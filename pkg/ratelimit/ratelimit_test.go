@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := PerMinute(3)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("192.0.2.1") {
+			t.Fatalf("event %d of a burst of 3 refused", i+1)
+		}
+	}
+	if l.Allow("192.0.2.1") {
+		t.Error("fourth event of a burst of 3 allowed")
+	}
+	if !l.Allow("192.0.2.2") {
+		t.Error("another key shares the bucket")
+	}
+
+	// a second later a twentieth of a token came back
+	l.buckets["192.0.2.1"].last = time.Now().Add(-time.Second)
+	if l.Allow("192.0.2.1") {
+		t.Error("allowed before a token came back")
+	}
+	l.buckets["192.0.2.1"].last = time.Now().Add(-20 * time.Second)
+	if !l.Allow("192.0.2.1") {
+		t.Error("refused once a token came back")
+	}
+
+	// buckets never hold more than the burst
+	l.buckets["192.0.2.1"].last = time.Now().Add(-time.Hour)
+	if !l.AllowN("192.0.2.1", 3) || l.Allow("192.0.2.1") {
+		t.Error("bucket refilled beyond its burst")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	for _, n := range []int64{0, -1} {
+		l := Per(n, time.Hour)
+		if l != nil {
+			t.Fatalf("Per(%d) = %+v, want nil", n, l)
+		}
+		for i := 0; i < 100; i++ {
+			if !l.Allow("192.0.2.1") {
+				t.Fatal("nil limiter refused an event")
+			}
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := PerMinute(60)
+	l.Allow("full")
+	l.Allow("draining")
+
+	// full refilled a minute ago, draining is still refilling
+	l.buckets["full"].last = time.Now().Add(-2 * time.Minute)
+	l.buckets["draining"].last = time.Now().Add(-time.Second)
+	l.last_sweep = time.Now().Add(-2 * time.Minute)
+	l.Allow("other")
+
+	if _, ok := l.buckets["full"]; ok {
+		t.Error("a full bucket was not swept")
+	}
+	if _, ok := l.buckets["draining"]; !ok {
+		t.Error("a draining bucket was swept")
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	list, err := ParseAllowlist([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::5", true},
+		{"2001:db9::5", false},
+		{"::1", true},
+		{"::ffff:10.0.0.1", true},
+	}
+
+	for _, test := range tests {
+		if got := list.Contains(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("Contains(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+
+	_, err = ParseAllowlist([]string{"10.0.0.0/33"})
+	if err == nil {
+		t.Error("parsed an invalid CIDR")
+	}
+}
@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/metrics"
+)
+
+var relay_messages = metrics.NewCounter(
+	"nthmail_relay_messages_total",
+	"Outbound delivery attempts, by result.",
+	"result",
+)
+
+const (
+	poll_interval = 10 * time.Second
+	batch_size    = 20
+	max_backoff   = 4 * time.Hour
+)
+
+// Queue persists outbound mail in the outbound_queue table and delivers it
+// through a Client, retrying deferred messages with exponential backoff.
+type Queue struct {
+	db             *sql.DB
+	client         Client
+	retry_interval time.Duration
+	max_age        time.Duration
+
+	wake chan struct{}
+}
+
+func NewQueue(db *sql.DB, client Client, retry_interval, max_age time.Duration) *Queue {
+	return &Queue{
+		db:             db,
+		client:         client,
+		retry_interval: retry_interval,
+		max_age:        max_age,
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Enqueue stores a message for delivery to rcpt. An empty from sends it with
+// the null sender, as bounces must be.
+func (queue *Queue) Enqueue(ctx context.Context, from, rcpt string, data []byte) error {
+	now := time.Now().UTC().Unix()
+	_, err := queue.db.ExecContext(ctx, "INSERT INTO outbound_queue (created_at, next_attempt_at, mail_from, rcpt_to, data) VALUES (?, ?, ?, ?, ?)", now, now, from, rcpt, data)
+	if err != nil {
+		return fmt.Errorf("could not queue outbound mail: %w", err)
+	}
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run delivers queued mail until ctx is cancelled.
+func (queue *Queue) Run(ctx context.Context) error {
+	slog.Info("starting relay queue", "smarthost", queue.client.Addr)
+
+	ticker := time.NewTicker(poll_interval)
+	defer ticker.Stop()
+
+	for {
+		err := queue.deliver_due(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("could not process relay queue", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-queue.wake:
+		}
+	}
+}
+
+type queued_mail struct {
+	id              int64
+	created_at      int64
+	attempts        int
+	mail_from, rcpt string
+	data            []byte
+}
+
+func (queue *Queue) deliver_due(ctx context.Context) error {
+	query_start := time.Now()
+	rows, err := queue.db.QueryContext(ctx, "SELECT id, created_at, attempts, mail_from, rcpt_to, data FROM outbound_queue WHERE failed = 0 AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?", time.Now().UTC().Unix(), batch_size)
+	if err != nil {
+		return fmt.Errorf("could not query outbound queue: %w", err)
+	}
+
+	var due []queued_mail
+	for rows.Next() {
+		var m queued_mail
+		err = rows.Scan(&m.id, &m.created_at, &m.attempts, &m.mail_from, &m.rcpt, &m.data)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan db row: %w", err)
+		}
+		due = append(due, m)
+	}
+	rows.Close()
+	metrics.DBQueryDuration.Since(query_start, "outbound_queue")
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		err = queue.deliver(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (queue *Queue) deliver(ctx context.Context, m queued_mail) error {
+	logger := slog.Default().With("queue_id", m.id, "from", m.mail_from, "rcpt", m.rcpt, "attempts", m.attempts+1)
+
+	send_err := queue.client.Send(ctx, m.mail_from, []string{m.rcpt}, m.data)
+	if send_err == nil {
+		relay_messages.Inc("sent")
+		logger.Info("relayed message")
+
+		_, err := queue.db.ExecContext(ctx, "DELETE FROM outbound_queue WHERE id = ?", m.id)
+		return err
+	}
+	if ctx.Err() != nil {
+		// shutting down, the attempt is retried on the next start
+		return nil
+	}
+
+	age := time.Since(time.Unix(m.created_at, 0))
+	if Permanent(send_err) || age > queue.max_age {
+		relay_messages.Inc("failed")
+		logger.Warn("giving up relaying message", "err", send_err)
+
+		_, err := queue.db.ExecContext(ctx, "UPDATE outbound_queue SET failed = 1, attempts = attempts + 1, last_error = ? WHERE id = ?", send_err.Error(), m.id)
+		return err
+	}
+
+	backoff := queue.retry_interval << m.attempts
+	if backoff > max_backoff || backoff <= 0 {
+		backoff = max_backoff
+	}
+
+	relay_messages.Inc("deferred")
+	logger.Warn("could not relay message, retrying later", "retry_in", backoff, "err", send_err)
+
+	next_attempt := time.Now().UTC().Add(backoff).Unix()
+	_, err := queue.db.ExecContext(ctx, "UPDATE outbound_queue SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?", next_attempt, send_err.Error(), m.id)
+	return err
+}
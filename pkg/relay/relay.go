@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// Client delivers outbound mail through a smarthost.
+type Client struct {
+	Addr     string
+	Username string
+	Password string
+	// "starttls", "tls" or "none"
+	TLS      string
+	HeloName string
+	Timeout  time.Duration
+}
+
+// Send delivers data from from to every address of to in one transaction.
+func (c Client) Send(ctx context.Context, from string, to []string, data []byte) error {
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return err
+	}
+	tls_config := &tls.Config{ServerName: host}
+
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to smarthost: %w", err)
+	}
+
+	if c.TLS == "tls" {
+		tls_conn := tls.Client(conn, tls_config)
+		err = tls_conn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("tls handshake with smarthost failed: %w", err)
+		}
+		conn = tls_conn
+	}
+
+	client := smtp.NewClient(conn)
+	client.CommandTimeout = c.Timeout
+	client.SubmissionTimeout = c.Timeout
+	defer client.Close()
+
+	// abort the session when ctx is cancelled mid transaction
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	err = client.Hello(c.HeloName)
+	if err != nil {
+		return fmt.Errorf("EHLO failed: %w", err)
+	}
+
+	if c.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smarthost does not support STARTTLS")
+		}
+
+		err = client.StartTLS(tls_config)
+		if err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	if c.Username != "" {
+		err = client.Auth(sasl.NewPlainClient("", c.Username, c.Password))
+		if err != nil {
+			return fmt.Errorf("AUTH failed: %w", err)
+		}
+	}
+
+	err = client.SendMail(from, to, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// Permanent reports whether err is a 5xx reply that retrying cannot fix.
+func Permanent(err error) bool {
+	var smtp_err *smtp.SMTPError
+	if errors.As(err, &smtp_err) {
+		return smtp_err.Code >= 500
+	}
+
+	return false
+}
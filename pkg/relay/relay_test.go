@@ -0,0 +1,297 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	"github.com/emersion/go-smtp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+// smarthost is a local SMTP stand-in accepting AUTH PLAIN as user/password.
+// Recipients at temp.test are deferred and those at perm.test refused.
+type smarthost struct {
+	mails chan received
+}
+
+func (host *smarthost) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &smarthost_session{host: host}, nil
+}
+
+type smarthost_session struct {
+	host *smarthost
+	mail received
+}
+
+func (session *smarthost_session) AuthPlain(username, password string) error {
+	if username != "user" || password != "password" {
+		return smtp.ErrAuthFailed
+	}
+
+	return nil
+}
+
+func (session *smarthost_session) Mail(from string, opts *smtp.MailOptions) error {
+	session.mail.from = from
+	return nil
+}
+
+func (session *smarthost_session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	switch {
+	case strings.HasSuffix(to, "@temp.test"):
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "try again later"}
+	case strings.HasSuffix(to, "@perm.test"):
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+	}
+
+	session.mail.to = append(session.mail.to, to)
+	return nil
+}
+
+func (session *smarthost_session) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	session.mail.data = string(data)
+	session.host.mails <- session.mail
+	return nil
+}
+
+func (session *smarthost_session) Reset() {
+	session.mail = received{}
+}
+
+func (session *smarthost_session) Logout() error {
+	return nil
+}
+
+func start_smarthost(t *testing.T) (string, <-chan received) {
+	t.Helper()
+
+	host := &smarthost{mails: make(chan received, 16)}
+	server := smtp.NewServer(host)
+	server.Domain = "smarthost.test"
+	server.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	return l.Addr().String(), host.mails
+}
+
+func receive(t *testing.T, mails <-chan received) received {
+	t.Helper()
+
+	select {
+	case mail := <-mails:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Fatal("the smarthost got no mail")
+		return received{}
+	}
+}
+
+func TestSend(t *testing.T) {
+	addr, mails := start_smarthost(t)
+
+	tests := []struct {
+		name     string
+		client   Client
+		to       []string
+		err      string
+		perm     bool
+		received *received
+	}{
+		{
+			name:     "plain",
+			client:   Client{Addr: addr, TLS: "none"},
+			to:       []string{"bob@example.com", "carol@example.com"},
+			received: &received{from: "alice@nthmail.test", to: []string{"bob@example.com", "carol@example.com"}, data: "Subject: hi\r\n\r\nhello\r\n"},
+		},
+		{
+			name:     "auth",
+			client:   Client{Addr: addr, TLS: "none", Username: "user", Password: "password"},
+			to:       []string{"bob@example.com"},
+			received: &received{from: "alice@nthmail.test", to: []string{"bob@example.com"}, data: "Subject: hi\r\n\r\nhello\r\n"},
+		},
+		{
+			name:   "wrong password",
+			client: Client{Addr: addr, TLS: "none", Username: "user", Password: "wrong"},
+			to:     []string{"bob@example.com"},
+			err:    "AUTH failed",
+			perm:   true,
+		},
+		{
+			name:   "no starttls",
+			client: Client{Addr: addr, TLS: "starttls"},
+			to:     []string{"bob@example.com"},
+			err:    "smarthost does not support STARTTLS",
+		},
+		{
+			name:   "deferred",
+			client: Client{Addr: addr, TLS: "none"},
+			to:     []string{"bob@temp.test"},
+			err:    "try again later",
+		},
+		{
+			name:   "refused",
+			client: Client{Addr: addr, TLS: "none"},
+			to:     []string{"bob@perm.test"},
+			err:    "no such user",
+			perm:   true,
+		},
+		{
+			name:   "unreachable",
+			client: Client{Addr: "127.0.0.1:1", TLS: "none"},
+			to:     []string{"bob@example.com"},
+			err:    "could not connect to smarthost",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.client.HeloName = "nthmail.test"
+			test.client.Timeout = 5 * time.Second
+
+			err := test.client.Send(context.Background(), "alice@nthmail.test", test.to, []byte("Subject: hi\r\n\r\nhello\r\n"))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("err = %v, want %s", err, test.err)
+				}
+				if Permanent(err) != test.perm {
+					t.Errorf("Permanent(%v) = %v, want %v", err, !test.perm, test.perm)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := receive(t, mails)
+			if got.from != test.received.from || strings.Join(got.to, ",") != strings.Join(test.received.to, ",") || got.data != test.received.data {
+				t.Errorf("smarthost got %+v, want %+v", got, *test.received)
+			}
+		})
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&smtp.SMTPError{Code: 550}, true},
+		{&smtp.SMTPError{Code: 451}, false},
+		{errors.New("connection reset"), false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := Permanent(test.err); got != test.want {
+			t.Errorf("Permanent(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func open_queue_db(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestQueue(t *testing.T) {
+	addr, mails := start_smarthost(t)
+
+	tests := []struct {
+		name     string
+		rcpt     string
+		age      time.Duration
+		sent     bool
+		attempts int
+		failed   bool
+	}{
+		{name: "sent", rcpt: "bob@example.com", sent: true},
+		{name: "deferred", rcpt: "bob@temp.test", attempts: 1},
+		{name: "deferred too long", rcpt: "bob@temp.test", age: 3 * time.Hour, attempts: 1, failed: true},
+		{name: "refused", rcpt: "bob@perm.test", attempts: 1, failed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := open_queue_db(t)
+			queue := NewQueue(db, Client{Addr: addr, TLS: "none", HeloName: "nthmail.test", Timeout: 5 * time.Second}, time.Minute, 2*time.Hour)
+
+			err := queue.Enqueue(context.Background(), "", test.rcpt, []byte("Subject: hi\r\n\r\nhello\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Exec("UPDATE outbound_queue SET created_at = created_at - ?", int64(test.age/time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = queue.deliver_due(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.sent {
+				if got := receive(t, mails); got.from != "" || got.to[0] != test.rcpt {
+					t.Errorf("smarthost got %+v", got)
+				}
+			}
+
+			var count, attempts int
+			var failed bool
+			var next_attempt_at int64
+			err = db.QueryRow("SELECT COUNT(*), coalesce(max(attempts), 0), coalesce(max(failed), 0), coalesce(max(next_attempt_at), 0) FROM outbound_queue").Scan(&count, &attempts, &failed, &next_attempt_at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.sent {
+				if count != 0 {
+					t.Errorf("%d mails left in the queue", count)
+				}
+				return
+			}
+			if count != 1 || attempts != test.attempts || failed != test.failed {
+				t.Errorf("queue holds %d mails, %d attempts, failed %v", count, attempts, failed)
+			}
+			if !test.failed && time.Until(time.Unix(next_attempt_at, 0)) < 50*time.Second {
+				t.Errorf("next attempt at %s, want a minute from now", time.Unix(next_attempt_at, 0))
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package rig
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A pattern is text with {token} or {token:n} placeholders:
+//
+//	{adjective}, {color}, {animal}  a word of the locale
+//	{number:n}                      n digits, 4 by default
+//	{code:n}                        n lower case letters and digits, 6 by default
+//	{syllables:n}                   n pronounceable syllables, 3 by default
+//
+// The text around the placeholders may only hold lower case letters,
+// digits, "-" and "_".
+
+const (
+	token_adjective = "adjective"
+	token_color     = "color"
+	token_animal    = "animal"
+	token_number    = "number"
+	token_code      = "code"
+	token_syllables = "syllables"
+)
+
+const (
+	digits       = "0123456789"
+	alphanumeric = "abcdefghijklmnopqrstuvwxyz0123456789"
+	consonants   = "bdfgklmnprstvz"
+	vowels       = "aeiou"
+
+	max_token_length = 32
+)
+
+var default_lengths = map[string]int{
+	token_number:    4,
+	token_code:      6,
+	token_syllables: 3,
+}
+
+var ErrInvalidPattern = errors.New("invalid pattern")
+
+type pattern_part struct {
+	literal string
+	token   string
+	length  int
+}
+
+type Pattern struct {
+	source string
+	parts  []pattern_part
+}
+
+func (pattern Pattern) String() string {
+	return pattern.source
+}
+
+func ParsePattern(source string) (Pattern, error) {
+	pattern := Pattern{source: source}
+
+	has_token := false
+	rest := source
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			start = len(rest)
+		}
+
+		if start > 0 {
+			literal := rest[:start]
+			if strings.ContainsFunc(literal, func(r rune) bool {
+				return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+			}) {
+				return pattern, ErrInvalidPattern
+			}
+			pattern.parts = append(pattern.parts, pattern_part{literal: literal})
+			rest = rest[start:]
+			continue
+		}
+
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			return pattern, ErrInvalidPattern
+		}
+
+		token, length, has_length := strings.Cut(rest[1:end], ":")
+		part := pattern_part{token: token}
+		switch token {
+		case token_adjective, token_color, token_animal:
+			if has_length {
+				return pattern, ErrInvalidPattern
+			}
+		case token_number, token_code, token_syllables:
+			part.length = default_lengths[token]
+			if has_length {
+				n, err := strconv.Atoi(length)
+				if err != nil || n < 1 || n > max_token_length {
+					return pattern, ErrInvalidPattern
+				}
+				part.length = n
+			}
+		default:
+			return pattern, ErrInvalidPattern
+		}
+
+		has_token = true
+		pattern.parts = append(pattern.parts, part)
+		rest = rest[end+1:]
+	}
+
+	if !has_token {
+		return pattern, ErrInvalidPattern
+	}
+
+	return pattern, nil
+}
+
+// Entropy is the number of bits of a name drawn from pattern with dict,
+// i.e. the log2 of the number of names it can produce.
+func (pattern Pattern) Entropy(dict *Dict) float64 {
+	bits := 0.0
+	for _, part := range pattern.parts {
+		switch part.token {
+		case token_adjective, token_color, token_animal:
+			bits += math.Log2(float64(len(dict.list(part.token))))
+		case token_number:
+			bits += float64(part.length) * math.Log2(float64(len(digits)))
+		case token_code:
+			bits += float64(part.length) * math.Log2(float64(len(alphanumeric)))
+		case token_syllables:
+			bits += float64(part.length) * math.Log2(float64(len(consonants)*len(vowels)))
+		}
+	}
+
+	return bits
+}
+
+// draw fills pattern in with dict, returning the name along with its words
+// and random parts, to be checked against the blocklist.
+func (pattern Pattern) draw(dict *Dict) (name string, words []string, random []string, err error) {
+	var sb strings.Builder
+	for _, part := range pattern.parts {
+		var value string
+		switch part.token {
+		case "":
+			value = part.literal
+		case token_adjective, token_color, token_animal:
+			value, err = pick(dict.list(part.token))
+			words = append(words, value)
+		case token_number:
+			value, err = pick_chars(digits, part.length)
+		case token_code:
+			value, err = pick_chars(alphanumeric, part.length)
+			random = append(random, value)
+		case token_syllables:
+			value, err = pick_syllables(part.length)
+			random = append(random, value)
+		}
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		sb.WriteString(value)
+	}
+
+	return sb.String(), words, random, nil
+}
+
+func pick_chars(alphabet string, n int) (string, error) {
+	chars := make([]byte, n)
+	for i := range chars {
+		c, err := pick([]byte(alphabet))
+		if err != nil {
+			return "", err
+		}
+		chars[i] = c
+	}
+
+	return string(chars), nil
+}
+
+func pick_syllables(n int) (string, error) {
+	syllables := make([]byte, 0, 2*n)
+	for range n {
+		consonant, err := pick([]byte(consonants))
+		if err != nil {
+			return "", err
+		}
+		vowel, err := pick([]byte(vowels))
+		if err != nil {
+			return "", err
+		}
+		syllables = append(syllables, consonant, vowel)
+	}
+
+	return string(syllables), nil
+}
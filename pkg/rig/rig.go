@@ -1,14 +1,283 @@
 package rig
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/GRFreire/nthmail/pkg/metrics"
+)
+
+const (
+	// max_attempts is how many names are drawn before giving up on finding
+	// one that holds no mail.
+	max_attempts = 10
+	// max_draws is how many names are drawn before giving up on finding one
+	// that is not blocked.
+	max_draws = 100
+	// max_name_length is the longest local part RFC 5321 allows, in octets.
+	max_name_length = 64
+)
+
+var (
+	ErrNoFreeName = errors.New("could not find an unused inbox name")
+	ErrAllBlocked = errors.New("every drawn name is blocked")
+	ErrTooLong    = errors.New("every drawn name is longer than 64 octets")
+)
+
+var name_collisions = metrics.NewCounter(
+	"nthmail_inbox_name_collisions_total",
+	"Generated inbox names that were already in use and drawn again.",
 )
 
-func GenerateRandomInboxName() string {
-	animal := animals[rand.Intn(len(animals))]
-	color := colors[rand.Intn(len(colors))]
-	adjective := adjectives[rand.Intn(len(adjectives))]
+// random is where names are drawn from, tests replace it to draw in a known
+// order.
+var random io.Reader = rand.Reader
+
+// pick returns a uniformly random element of list from crypto/rand.
+func pick[T any](list []T) (T, error) {
+	n, err := rand.Int(random, big.NewInt(int64(len(list))))
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("could not read random bytes: %w", err)
+	}
+
+	return list[n.Int64()], nil
+}
+
+// Name draws a name from pattern with the words of dict, without checking
+// whether it is in use.
+func (words *Words) Name(dict *Dict, pattern Pattern) (string, error) {
+	err := ErrAllBlocked
+	for range max_draws {
+		name, dict_words, random, draw_err := pattern.draw(dict)
+		if draw_err != nil {
+			return "", draw_err
+		}
+
+		// non-ASCII words take several octets a letter
+		if len(name) > max_name_length {
+			err = ErrTooLong
+			continue
+		}
+
+		if !words.is_blocked(dict_words, random) {
+			return name, nil
+		}
+	}
+
+	return "", err
+}
+
+// GenerateRandomInboxName draws a name with the built-in English words,
+// without checking whether it is in use.
+func GenerateRandomInboxName() (string, error) {
+	words, err := default_words()
+	if err != nil {
+		return "", err
+	}
+
+	dict, err := words.Dict(DefaultLocale)
+	if err != nil {
+		return "", err
+	}
+
+	return words.Name(dict, dict.Pattern)
+}
+
+// Options select the locale and pattern of a name, empty for the defaults.
+type Options struct {
+	Locale  string
+	Pattern string
+}
+
+// Scheme is how a name is drawn once the options are resolved.
+type Scheme struct {
+	Locale  string
+	Pattern string
+	Entropy float64
+}
+
+// Generator draws inbox names that hold no mail and are not claimed yet.
+type Generator struct {
+	db    *sql.DB
+	words *Words
+
+	locale         string
+	pattern        string
+	domain_locales map[string]string
+	// sub-address separators, refused in the patterns of Options
+	separators string
+}
+
+// New returns a generator using locale and pattern by default, or the
+// locale of domain_locales for an inbox at one of its domains. An empty
+// pattern uses the one of the locale. Patterns picked per request cannot
+// hold any of separators.
+func New(db *sql.DB, words *Words, locale, pattern, separators string, domain_locales map[string]string) (*Generator, error) {
+	generator := &Generator{
+		db:             db,
+		words:          words,
+		locale:         locale,
+		pattern:        pattern,
+		domain_locales: domain_locales,
+		separators:     separators,
+	}
+
+	for _, locale := range domain_locales {
+		if _, err := words.Dict(locale); err != nil {
+			return nil, fmt.Errorf("%w %q", err, locale)
+		}
+	}
+
+	_, _, err := generator.resolve("", Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	return generator, nil
+}
+
+// resolve picks the locale of opts, else the one of domain, else the
+// default one, and the pattern of opts, else the default one, else the one
+// of the locale.
+func (generator *Generator) resolve(domain string, opts Options) (*Dict, Pattern, error) {
+	locale := opts.Locale
+	if locale == "" {
+		locale = generator.domain_locales[strings.ToLower(domain)]
+	}
+	if locale == "" {
+		locale = generator.locale
+	}
+
+	dict, err := generator.words.Dict(locale)
+	if err != nil {
+		return nil, Pattern{}, fmt.Errorf("%w %q", err, locale)
+	}
+
+	source := opts.Pattern
+	if source == "" {
+		source = generator.pattern
+	}
+	if source == "" {
+		return dict, dict.Pattern, nil
+	}
+
+	pattern, err := ParsePattern(source)
+	if err != nil {
+		return nil, pattern, fmt.Errorf("%w %q", err, source)
+	}
+
+	// names holding a separator would all be tags of a few inboxes
+	if opts.Pattern != "" && strings.ContainsAny(pattern.String(), generator.separators) {
+		return nil, pattern, fmt.Errorf("%w %q: it contains a sub-address separator of %q", ErrInvalidPattern, source, generator.separators)
+	}
+
+	return dict, pattern, nil
+}
+
+// Scheme returns how names at domain are drawn with opts.
+func (generator *Generator) Scheme(domain string, opts Options) (Scheme, error) {
+	dict, pattern, err := generator.resolve(domain, opts)
+	if err != nil {
+		return Scheme{}, err
+	}
+
+	return Scheme{
+		Locale:  dict.Locale,
+		Pattern: pattern.String(),
+		Entropy: pattern.Entropy(dict),
+	}, nil
+}
+
+func (generator *Generator) Locales() []string {
+	return generator.words.Locales()
+}
+
+// InUse reports whether rcpt_addr holds mail or is claimed.
+func (generator *Generator) InUse(ctx context.Context, rcpt_addr string) (bool, error) {
+	query_start := time.Now()
+	var used bool
+	err := generator.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM mails WHERE rcpt_addr = ?1)
+		OR EXISTS (SELECT 1 FROM inbox_claims WHERE rcpt_addr = ?1)`, rcpt_addr).Scan(&used)
+	metrics.DBQueryDuration.Since(query_start, "inbox_name")
+	if err != nil {
+		return false, fmt.Errorf("could not check inbox name: %w", err)
+	}
+
+	return used, nil
+}
+
+// Generate returns an unused inbox address at domain, drawing again when a
+// name is taken.
+func (generator *Generator) Generate(ctx context.Context, domain string, opts Options) (string, error) {
+	dict, pattern, err := generator.resolve(domain, opts)
+	if err != nil {
+		return "", err
+	}
+
+	for range max_attempts {
+		name, err := generator.words.Name(dict, pattern)
+		if err != nil {
+			return "", err
+		}
+		rcpt_addr := name + "@" + domain
+
+		used, err := generator.InUse(ctx, rcpt_addr)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return rcpt_addr, nil
+		}
+		name_collisions.Inc()
+	}
+
+	return "", ErrNoFreeName
+}
+
+// Suggest returns n unused addresses at domain in place of local: local
+// with a number appended, and random names. An empty local only suggests
+// random names.
+func (generator *Generator) Suggest(ctx context.Context, domain, local string, n int) ([]string, error) {
+	// leaves room for the number in the 64 octets of a local part
+	for len(local) > max_name_length-5 {
+		_, size := utf8.DecodeLastRuneInString(local)
+		local = local[:len(local)-size]
+	}
+
+	var suggestions []string
+	for attempts := 0; local != "" && len(suggestions) < n-1 && attempts < max_attempts*n; attempts++ {
+		number, err := pick_chars(digits, 4)
+		if err != nil {
+			return nil, err
+		}
+		rcpt_addr := local + "-" + number + "@" + domain
+
+		used, err := generator.InUse(ctx, rcpt_addr)
+		if err != nil {
+			return nil, err
+		}
+		if !used && !slices.Contains(suggestions, rcpt_addr) {
+			suggestions = append(suggestions, rcpt_addr)
+		}
+	}
+
+	for len(suggestions) < n {
+		rcpt_addr, err := generator.Generate(ctx, domain, Options{})
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, rcpt_addr)
+	}
 
-	return fmt.Sprintf("%s-%s-%s", adjective, color, animal)
+	return suggestions, nil
 }
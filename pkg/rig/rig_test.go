@@ -0,0 +1,238 @@
+package rig
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// load_words loads the built-in lists along with a locale xx holding the
+// given lists, one word a line.
+func load_words(t *testing.T, adjectives, colors, animals string) *Words {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "xx")
+	err := os.Mkdir(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, list := range map[string]string{"adjectives.txt": adjectives, "colors.txt": colors, "animals.txt": animals} {
+		err = os.WriteFile(filepath.Join(dir, name), []byte(list), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	words, err := LoadWords(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return words
+}
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		source string
+		valid  bool
+	}{
+		{"{adjective}-{color}-{animal}-{number:4}", true},
+		{"{animal}", true},
+		{"mail_{code}", true},
+		{"{syllables:32}", true},
+		{"", false},
+		{"plain-text", false},
+		{"{animal:2}", false},
+		{"{number:0}", false},
+		{"{number:33}", false},
+		{"{number:x}", false},
+		{"{unknown}", false},
+		{"{animal", false},
+		{"Upper-{animal}", false},
+		{"a.b-{animal}", false},
+		{"a+b-{animal}", false},
+	}
+
+	for _, test := range tests {
+		_, err := ParsePattern(test.source)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("ParsePattern(%q) = %v, want valid %t", test.source, err, test.valid)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidPattern) {
+			t.Errorf("ParsePattern(%q) = %v, want %v", test.source, err, ErrInvalidPattern)
+		}
+	}
+}
+
+func TestPatternExpansion(t *testing.T) {
+	words := load_words(t, "quick\n", "red\n", "fox\n")
+	dict, err := words.Dict("xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"{adjective}-{color}-{animal}", `^quick-red-fox$`},
+		{"{animal}-{number}", `^fox-[0-9]{4}$`},
+		{"{animal}{number:2}", `^fox[0-9]{2}$`},
+		{"x_{code}", `^x_[a-z0-9]{6}$`},
+		{"{code:10}", `^[a-z0-9]{10}$`},
+		{"{syllables}", `^([bdfgklmnprstvz][aeiou]){3}$`},
+		{"{syllables:5}-{animal}", `^([bdfgklmnprstvz][aeiou]){5}-fox$`},
+	}
+
+	for _, test := range tests {
+		pattern, err := ParsePattern(test.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := regexp.MustCompile(test.want)
+		for range 20 {
+			name, err := words.Name(dict, pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !want.MatchString(name) {
+				t.Errorf("%q drew %q, want it to match %s", test.source, name, test.want)
+			}
+		}
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	words := load_words(t, "quick\nlazy\n", "red\nblue\ngreen\n", "fox\ndog\ncat\nowl\n")
+	dict, err := words.Dict("xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		source string
+		// number of names the pattern can draw
+		names float64
+		// small enough to draw them all
+		exhaustive bool
+	}{
+		{"{animal}", 4, true},
+		{"{adjective}-{color}-{animal}", 2 * 3 * 4, true},
+		{"{color}-{number:2}", 3 * 100, true},
+		{"{syllables:1}", 14 * 5, true},
+		{"{code:1}", 36, true},
+		{"{adjective}-{color}-{animal}-{number:4}", 2 * 3 * 4 * 1e4, false},
+		{"{code:8}", math.Pow(36, 8), false},
+	}
+
+	for _, test := range tests {
+		pattern, err := ParsePattern(test.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entropy := pattern.Entropy(dict)
+		if want := math.Log2(test.names); math.Abs(entropy-want) > 1e-9 {
+			t.Errorf("Entropy(%q) = %g, want %g", test.source, entropy, want)
+		}
+		if !test.exhaustive {
+			continue
+		}
+
+		// every one of the 2^entropy names comes up, and no other
+		seen := make(map[string]bool)
+		for range 100 * int(test.names) {
+			name, err := words.Name(dict, pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[name] = true
+		}
+		if float64(len(seen)) != test.names {
+			t.Errorf("%q drew %d distinct names, want %g", test.source, len(seen), test.names)
+		}
+	}
+}
+
+func TestDefaultEntropy(t *testing.T) {
+	words, err := LoadWords("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, locale := range words.Locales() {
+		dict, err := words.Dict(locale)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dict.Pattern.String() != default_pattern {
+			continue
+		}
+		want := math.Log2(float64(len(dict.Adjectives)*len(dict.Colors)*len(dict.Animals))) + 4*math.Log2(10)
+		if entropy := dict.Pattern.Entropy(dict); math.Abs(entropy-want) > 1e-9 {
+			t.Errorf("%s: Entropy = %g, want %g", locale, entropy, want)
+		}
+	}
+}
+
+func TestGenerateCollision(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	words := load_words(t, "quick\n", "red\n", "cat\ndog\n")
+	generator, err := New(db, words, "xx", "{animal}", "+", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cat holds mail
+	_, err = db.Exec("INSERT INTO mails (rcpt_addr, from_addr, arrived_at, data) VALUES ('cat@nthmail.test', '', 0, '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	default_random := random
+	t.Cleanup(func() { random = default_random })
+
+	// draws cat twice before dog
+	random = bytes.NewReader([]byte{0, 0, 1})
+	rcpt_addr, err := generator.Generate(ctx, "nthmail.test", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcpt_addr != "dog@nthmail.test" {
+		t.Errorf("Generate() = %s, want dog@nthmail.test", rcpt_addr)
+	}
+
+	_, err = db.Exec("INSERT INTO inbox_claims (rcpt_addr, created_at, expires_at) VALUES ('dog@nthmail.test', 0, 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random = bytes.NewReader(bytes.Repeat([]byte{0, 1}, max_attempts))
+	_, err = generator.Generate(ctx, "nthmail.test", Options{})
+	if !errors.Is(err, ErrNoFreeName) {
+		t.Errorf("Generate() = %v, want %v", err, ErrNoFreeName)
+	}
+}
@@ -0,0 +1,182 @@
+package smime
+
+import "errors"
+
+// Mail clients often encode PKCS #7 in BER, with indefinite lengths and
+// OCTET STRINGs split in segments, which encoding/asn1 refuses. to_der
+// rewrites them with definite lengths and joined OCTET STRINGs. Signed
+// attributes are DER already and come out unchanged.
+
+var errBER = errors.New("malformed BER")
+
+// max_ber_depth bounds the nesting of the elements decoded.
+const max_ber_depth = 64
+
+func to_der(ber []byte) ([]byte, error) {
+	der, rest, err := ber_element(ber, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errBER
+	}
+
+	return der, nil
+}
+
+// ber_element converts the first element of ber, returning what follows it.
+func ber_element(ber []byte, depth int) ([]byte, []byte, error) {
+	if depth > max_ber_depth || len(ber) < 2 {
+		return nil, nil, errBER
+	}
+
+	// the identifier, with high tag numbers spanning several octets
+	id_len := 1
+	if ber[0]&0x1f == 0x1f {
+		for id_len < len(ber) && ber[id_len]&0x80 != 0 {
+			id_len++
+		}
+		id_len++
+	}
+	if id_len >= len(ber) {
+		return nil, nil, errBER
+	}
+	id := ber[:id_len]
+	constructed := ber[0]&0x20 != 0
+
+	length, header_len, indefinite, err := ber_length(ber[id_len:])
+	if err != nil {
+		return nil, nil, err
+	}
+	ber = ber[id_len+header_len:]
+
+	if !constructed {
+		if indefinite || length > len(ber) {
+			return nil, nil, errBER
+		}
+		return der_element(id, ber[:length]), ber[length:], nil
+	}
+
+	var content []byte
+	if !indefinite {
+		if length > len(ber) {
+			return nil, nil, errBER
+		}
+		content, ber = ber[:length], ber[length:]
+	}
+
+	var children [][]byte
+	for {
+		if indefinite {
+			if len(ber) < 2 {
+				return nil, nil, errBER
+			}
+			// end-of-contents
+			if ber[0] == 0 && ber[1] == 0 {
+				ber = ber[2:]
+				break
+			}
+		} else if len(content) == 0 {
+			break
+		}
+
+		var child []byte
+		if indefinite {
+			child, ber, err = ber_element(ber, depth+1)
+		} else {
+			child, content, err = ber_element(content, depth+1)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		children = append(children, child)
+	}
+
+	// segmented OCTET STRINGs are joined into a primitive one
+	if id_len == 1 && ber_tag(id[0]) == 0x04 && id[0]&0xc0 == 0 {
+		var octets []byte
+		for _, child := range children {
+			_, value, err := der_value(child)
+			if err != nil {
+				return nil, nil, err
+			}
+			octets = append(octets, value...)
+		}
+		return der_element([]byte{0x04}, octets), ber, nil
+	}
+
+	var joined []byte
+	for _, child := range children {
+		joined = append(joined, child...)
+	}
+	return der_element(id, joined), ber, nil
+}
+
+func ber_tag(id byte) byte {
+	return id & 0x1f
+}
+
+// ber_length decodes a length, returning how many octets it took.
+func ber_length(ber []byte) (length int, n int, indefinite bool, err error) {
+	if len(ber) == 0 {
+		return 0, 0, false, errBER
+	}
+
+	if ber[0] == 0x80 {
+		return 0, 1, true, nil
+	}
+	if ber[0] < 0x80 {
+		return int(ber[0]), 1, false, nil
+	}
+
+	octets := int(ber[0] & 0x7f)
+	if octets > 4 || len(ber) < 1+octets {
+		return 0, 0, false, errBER
+	}
+	for _, b := range ber[1 : 1+octets] {
+		length = length<<8 | int(b)
+	}
+
+	return length, 1 + octets, false, nil
+}
+
+func der_element(id, value []byte) []byte {
+	element := append([]byte{}, id...)
+
+	switch n := len(value); {
+	case n < 0x80:
+		element = append(element, byte(n))
+	case n < 0x100:
+		element = append(element, 0x81, byte(n))
+	case n < 0x10000:
+		element = append(element, 0x82, byte(n>>8), byte(n))
+	case n < 0x1000000:
+		element = append(element, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	default:
+		element = append(element, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	return append(element, value...)
+}
+
+// der_value splits a DER element made by der_element into its identifier
+// and value.
+func der_value(der []byte) ([]byte, []byte, error) {
+	id_len := 1
+	if der[0]&0x1f == 0x1f {
+		for id_len < len(der) && der[id_len]&0x80 != 0 {
+			id_len++
+		}
+		id_len++
+	}
+	if id_len >= len(der) {
+		return nil, nil, errBER
+	}
+
+	length, n, _, err := ber_length(der[id_len:])
+	if err != nil || id_len+n+length != len(der) {
+		return nil, nil, errBER
+	}
+
+	return der[:id_len], der[id_len+n:], nil
+}
@@ -0,0 +1,70 @@
+package smime
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestToDER(t *testing.T) {
+	tests := []struct {
+		name string
+		ber  string
+		want string
+	}{
+		{name: "DER unchanged", ber: "3006020101040141", want: "3006020101040141"},
+		{name: "indefinite length", ber: "3080020101" + "0000", want: "3003020101"},
+		{name: "nested indefinite lengths", ber: "30803080020105" + "0000" + "0000", want: "30053003020105"},
+		{name: "context tag", ber: "a080040141" + "0000", want: "a003040141"},
+		{name: "segmented octet string", ber: "2480" + "04024142" + "040143" + "0000", want: "0403414243"},
+		{name: "segmented octet string, definite length", ber: "2407" + "04024142" + "040143", want: "0403414243"},
+		{name: "long form length", ber: "048103414243", want: "0403414243"},
+		{name: "high tag number", ber: "9f810001ff", want: "9f810001ff"},
+		{
+			name: "joined octet string needing a long form length",
+			ber:  "2480" + "0464" + strings.Repeat("41", 100) + "0464" + strings.Repeat("42", 100) + "0000",
+			want: "0481c8" + strings.Repeat("41", 100) + strings.Repeat("42", 100),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ber, _ := hex.DecodeString(test.ber)
+			der, err := to_der(ber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(der); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestToDERErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		ber  string
+	}{
+		{name: "empty", ber: ""},
+		{name: "truncated", ber: "040541"},
+		{name: "trailing data", ber: "02010100"},
+		{name: "no end-of-contents", ber: "3080020101"},
+		{name: "indefinite primitive", ber: "0480410000"},
+		{name: "length of five octets", ber: "04850000000001"},
+		{name: "child longer than its parent", ber: "3003020501"},
+		{name: "truncated identifier", ber: "9f81"},
+		{name: "too deep", ber: strings.Repeat("3080", max_ber_depth+2) + strings.Repeat("0000", max_ber_depth+2)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ber, _ := hex.DecodeString(test.ber)
+			_, err := to_der(ber)
+			if !errors.Is(err, errBER) {
+				t.Errorf("err = %v, want %v", err, errBER)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package smime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// S/MIME signatures, as of RFC 8551: a PKCS #7 (CMS, RFC 5652) SignedData
+// either holding the signed entity, for application/pkcs7-mime, or signing
+// the first part of a multipart/signed.
+
+var (
+	ErrMalformed    = errors.New("malformed PKCS #7 structure")
+	ErrNotSigned    = errors.New("not a PKCS #7 SignedData")
+	ErrNoSigner     = errors.New("no certificate of the signer")
+	ErrUnsupported  = errors.New("unsupported signature algorithm")
+	ErrBadSignature = errors.New("the signature does not match the content")
+)
+
+var (
+	oid_signed_data    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oid_message_digest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oid_signing_time   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oid_rsa            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oid_ecdsa_key      = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+)
+
+var digest_algorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// signature algorithms named by their own oid
+var signature_algorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+}
+
+type content_info struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signed_data struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encap_content_info
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signer_info `asn1:"set"`
+}
+
+type encap_content_info struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signer_info struct {
+	Version            int
+	Sid                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuer_and_serial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// SignedData is a parsed PKCS #7 SignedData.
+type SignedData struct {
+	// the signed content, nil for a detached signature
+	Content      []byte
+	Certificates []*x509.Certificate
+
+	signers []signer_info
+}
+
+// Parse parses a DER or BER encoded PKCS #7 ContentInfo holding a
+// SignedData.
+func Parse(data []byte) (*SignedData, error) {
+	der, err := to_der(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+
+	var info content_info
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	if !info.ContentType.Equal(oid_signed_data) {
+		return nil, ErrNotSigned
+	}
+
+	var sd signed_data
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+
+	signed := &SignedData{Content: sd.EncapContentInfo.EContent, signers: sd.SignerInfos}
+	if len(sd.Certificates.Bytes) != 0 {
+		signed.Certificates, err = x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+	}
+
+	return signed, nil
+}
+
+// Signer is the outcome of a verified signature.
+type Signer struct {
+	Certificate *x509.Certificate
+	// the certificate chains to the trusted roots
+	Trusted bool
+	// why it does not, when it does not
+	TrustError error
+	// the signing time the signer claims, zero when it gives none. It is
+	// only shown, the signer could have put any time there.
+	SigningTime time.Time
+}
+
+// Verify checks the first signature of sd over content, or over the
+// content sd holds when content is nil, and whether the certificate of its
+// signer chains to roots, valid for email protection now.
+// A nil roots trusts the system roots.
+func (sd *SignedData) Verify(content []byte, roots *x509.CertPool) (Signer, error) {
+	var signer Signer
+
+	if content == nil {
+		content = sd.Content
+	}
+	if len(sd.signers) == 0 {
+		return signer, ErrNoSigner
+	}
+	si := sd.signers[0]
+
+	cert := sd.find_certificate(si.Sid)
+	if cert == nil {
+		return signer, ErrNoSigner
+	}
+	signer.Certificate = cert
+
+	hash, ok := digest_algorithms[si.DigestAlgorithm.Algorithm.String()]
+	if !ok || !hash.Available() {
+		return signer, ErrUnsupported
+	}
+	algorithm, err := signature_algorithm(si, hash)
+	if err != nil {
+		return signer, err
+	}
+
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	signed := content
+	if len(si.SignedAttrs.Bytes) != 0 {
+		attrs, err := parse_attributes(si.SignedAttrs.Bytes)
+		if err != nil {
+			return signer, err
+		}
+
+		var message_digest []byte
+		if value, ok := attrs[oid_message_digest.String()]; !ok {
+			return signer, fmt.Errorf("%w: no message digest", ErrMalformed)
+		} else if _, err := asn1.Unmarshal(value, &message_digest); err != nil {
+			return signer, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		if !bytes.Equal(message_digest, digest) {
+			return signer, ErrBadSignature
+		}
+
+		if value, ok := attrs[oid_signing_time.String()]; ok {
+			var t time.Time
+			if _, err := asn1.Unmarshal(value, &t); err == nil {
+				signer.SigningTime = t
+			}
+		}
+
+		// the attributes are signed as a SET, not with their implicit tag
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	}
+
+	err = cert.CheckSignature(algorithm, signed, si.Signature)
+	if errors.Is(err, x509.ErrUnsupportedAlgorithm) {
+		return signer, ErrUnsupported
+	}
+	if err != nil {
+		return signer, fmt.Errorf("%w: %w", ErrBadSignature, err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range sd.Certificates {
+		intermediates.AddCert(c)
+	}
+	_, signer.TrustError = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	})
+	signer.Trusted = signer.TrustError == nil
+
+	return signer, nil
+}
+
+// find_certificate returns the certificate sid names, by issuer and serial
+// number or by subject key identifier.
+func (sd *SignedData) find_certificate(sid asn1.RawValue) *x509.Certificate {
+	if sid.Class == asn1.ClassContextSpecific && sid.Tag == 0 {
+		for _, cert := range sd.Certificates {
+			if bytes.Equal(cert.SubjectKeyId, sid.Bytes) {
+				return cert
+			}
+		}
+		return nil
+	}
+
+	var ias issuer_and_serial
+	if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+		return nil
+	}
+	for _, cert := range sd.Certificates {
+		if bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) && cert.SerialNumber.Cmp(ias.Serial) == 0 {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+// signature_algorithm maps the signature algorithm of si, which may only
+// name the key type, to the one of x509.
+func signature_algorithm(si signer_info, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	oid := si.SignatureAlgorithm.Algorithm
+	if algorithm, ok := signature_algorithms[oid.String()]; ok {
+		return algorithm, nil
+	}
+
+	switch {
+	case oid.Equal(oid_rsa):
+		switch hash {
+		case crypto.SHA1:
+			return x509.SHA1WithRSA, nil
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	case oid.Equal(oid_ecdsa_key):
+		switch hash {
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1, nil
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	}
+
+	return x509.UnknownSignatureAlgorithm, ErrUnsupported
+}
+
+// parse_attributes maps the oid of each attribute of a SET to its first
+// value.
+func parse_attributes(set []byte) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+	for len(set) != 0 {
+		var attr attribute
+		rest, err := asn1.Unmarshal(set, &attr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		set = rest
+
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(attr.Values.Bytes, &value); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+		}
+		attrs[attr.Type.String()] = value.FullBytes
+	}
+
+	return attrs, nil
+}
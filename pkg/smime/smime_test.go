@@ -0,0 +1,382 @@
+package smime
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var (
+	oid_data      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oid_sha256    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oid_md5       = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 5}
+	oid_ecdsa_256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type pki struct {
+	ca     *x509.Certificate
+	ca_key crypto.Signer
+	serial int64
+}
+
+func new_pki(t *testing.T) *pki {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &pki{ca: ca, ca_key: key, serial: 1}
+}
+
+// leaf issues a certificate for alice@example.com to key, valid between
+// not_before and not_after, for email protection unless other usages are
+// given.
+func (p *pki) leaf(t *testing.T, key crypto.Signer, not_before, not_after time.Time, usages ...x509.ExtKeyUsage) *x509.Certificate {
+	t.Helper()
+
+	if len(usages) == 0 {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	}
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(p.serial),
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		NotBefore:      not_before,
+		NotAfter:       not_after,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    usages,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, p.ca, key.Public(), p.ca_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+type signing struct {
+	cert         *x509.Certificate
+	key          crypto.Signer
+	certificates []*x509.Certificate
+	detached     bool
+	// sign the content directly, without signed attributes
+	no_attrs bool
+	// name the signer by subject key identifier
+	by_key_id    bool
+	digest       asn1.ObjectIdentifier
+	signing_time time.Time
+}
+
+// sign encodes a ContentInfo holding a SignedData over content.
+func sign(t *testing.T, content []byte, s signing) []byte {
+	t.Helper()
+
+	if s.digest == nil {
+		s.digest = oid_sha256
+	}
+	digest := sha256.Sum256(content)
+
+	var sid asn1.RawValue
+	if s.by_key_id {
+		sid.FullBytes = der_element([]byte{0x80}, s.cert.SubjectKeyId)
+	} else {
+		ias, err := asn1.Marshal(issuer_and_serial{Issuer: asn1.RawValue{FullBytes: s.cert.RawIssuer}, Serial: s.cert.SerialNumber})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sid.FullBytes = ias
+	}
+
+	si := signer_info{
+		Version:         1,
+		Sid:             sid,
+		DigestAlgorithm: pkix.AlgorithmIdentifier{Algorithm: s.digest},
+	}
+	if _, ok := s.key.(*rsa.PrivateKey); ok {
+		si.SignatureAlgorithm.Algorithm = oid_rsa
+	} else {
+		si.SignatureAlgorithm.Algorithm = oid_ecdsa_256
+	}
+
+	signed := content
+	if !s.no_attrs {
+		var attrs []byte
+		for _, attr := range []struct {
+			oid   asn1.ObjectIdentifier
+			value any
+		}{
+			{oid_message_digest, digest[:]},
+			{oid_signing_time, s.signing_time},
+		} {
+			if attr.oid.Equal(oid_signing_time) && s.signing_time.IsZero() {
+				continue
+			}
+			value, err := asn1.Marshal(attr.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := asn1.Marshal(attribute{Type: attr.oid, Values: asn1.RawValue{FullBytes: der_element([]byte{0x31}, value)}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			attrs = append(attrs, encoded...)
+		}
+		si.SignedAttrs.FullBytes = der_element([]byte{0xa0}, attrs)
+		signed = der_element([]byte{0x31}, attrs)
+	}
+
+	h := sha256.Sum256(signed)
+	signature, err := s.key.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si.Signature = signature
+
+	sd := signed_data{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: s.digest}},
+		EncapContentInfo: encap_content_info{EContentType: oid_data},
+		SignerInfos:      []signer_info{si},
+	}
+	if !s.detached {
+		sd.EncapContentInfo.EContent = content
+	}
+	var certificates []byte
+	for _, cert := range s.certificates {
+		certificates = append(certificates, cert.Raw...)
+	}
+	if len(certificates) != 0 {
+		sd.Certificates.FullBytes = der_element([]byte{0xa0}, certificates)
+	}
+
+	encoded, err := asn1.Marshal(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err = asn1.Marshal(content_info{ContentType: oid_signed_data, Content: asn1.RawValue{FullBytes: der_element([]byte{0xa0}, encoded)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded
+}
+
+func TestVerify(t *testing.T) {
+	p := new_pki(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca)
+
+	ec_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ec_cert := p.leaf(t, ec_key, now.Add(-time.Hour), now.Add(time.Hour))
+	rsa_cert := p.leaf(t, rsa_key, now.Add(-time.Hour), now.Add(time.Hour))
+	expired := p.leaf(t, ec_key, now.Add(-3*time.Hour), now.Add(-time.Hour))
+	server_auth := p.leaf(t, ec_key, now.Add(-time.Hour), now.Add(time.Hour), x509.ExtKeyUsageServerAuth)
+	other := new_pki(t)
+
+	content := []byte("Content-Type: text/plain\r\n\r\nhello\r\n")
+
+	tests := []struct {
+		name    string
+		signing signing
+		// the content handed to Verify, the one signed when nil
+		content []byte
+		roots   *x509.CertPool
+		trusted bool
+		err     error
+	}{
+		{
+			name:    "ecdsa",
+			signing: signing{cert: ec_cert, key: ec_key, certificates: []*x509.Certificate{ec_cert}},
+			trusted: true,
+		},
+		{
+			name:    "rsa without signed attributes",
+			signing: signing{cert: rsa_cert, key: rsa_key, certificates: []*x509.Certificate{rsa_cert}, no_attrs: true},
+			trusted: true,
+		},
+		{
+			name:    "detached",
+			signing: signing{cert: ec_cert, key: ec_key, certificates: []*x509.Certificate{ec_cert}, detached: true},
+			content: content,
+			trusted: true,
+		},
+		{
+			name:    "signer named by subject key identifier",
+			signing: signing{cert: ec_cert, key: ec_key, certificates: []*x509.Certificate{p.ca, ec_cert}, by_key_id: true},
+			trusted: true,
+		},
+		{
+			name:    "expired, signed while valid",
+			signing: signing{cert: expired, key: ec_key, certificates: []*x509.Certificate{expired}, signing_time: now.Add(-2 * time.Hour)},
+		},
+		{
+			name:    "expired",
+			signing: signing{cert: expired, key: ec_key, certificates: []*x509.Certificate{expired}},
+		},
+		{
+			name:    "not for email",
+			signing: signing{cert: server_auth, key: ec_key, certificates: []*x509.Certificate{server_auth}},
+		},
+		{
+			name:    "other roots",
+			signing: signing{cert: ec_cert, key: ec_key, certificates: []*x509.Certificate{ec_cert}},
+			roots:   func() *x509.CertPool { pool := x509.NewCertPool(); pool.AddCert(other.ca); return pool }(),
+		},
+		{
+			name:    "altered content",
+			signing: signing{cert: ec_cert, key: ec_key, certificates: []*x509.Certificate{ec_cert}, detached: true},
+			content: []byte("Content-Type: text/plain\r\n\r\nhello!\r\n"),
+			err:     ErrBadSignature,
+		},
+		{
+			name:    "altered content without signed attributes",
+			signing: signing{cert: rsa_cert, key: rsa_key, certificates: []*x509.Certificate{rsa_cert}, detached: true, no_attrs: true},
+			content: []byte("Content-Type: text/plain\r\n\r\nhello!\r\n"),
+			err:     ErrBadSignature,
+		},
+		{
+			name:    "signed by another key",
+			signing: signing{cert: rsa_cert, key: ec_key, certificates: []*x509.Certificate{rsa_cert}},
+			err:     ErrBadSignature,
+		},
+		{
+			name:    "no certificate",
+			signing: signing{cert: ec_cert, key: ec_key},
+			err:     ErrNoSigner,
+		},
+		{
+			name:    "certificate of someone else",
+			signing: signing{cert: ec_cert, key: ec_key, certificates: []*x509.Certificate{rsa_cert}},
+			err:     ErrNoSigner,
+		},
+		{
+			name:    "unsupported digest",
+			signing: signing{cert: ec_cert, key: ec_key, certificates: []*x509.Certificate{ec_cert}, digest: oid_md5},
+			err:     ErrUnsupported,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sd, err := Parse(sign(t, content, test.signing))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.signing.detached != (sd.Content == nil) {
+				t.Errorf("content = %q", sd.Content)
+			}
+
+			if test.roots == nil {
+				test.roots = roots
+			}
+			signer, err := sd.Verify(test.content, test.roots)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if signer.Certificate != nil && !signer.Certificate.Equal(test.signing.cert) {
+				t.Errorf("signed by %s", signer.Certificate.Subject)
+			}
+			if signer.Trusted != test.trusted || signer.Trusted != (signer.TrustError == nil) {
+				t.Errorf("trusted = %v, %v, want %v", signer.Trusted, signer.TrustError, test.trusted)
+			}
+			if !signer.SigningTime.Equal(test.signing.signing_time.Truncate(time.Second)) {
+				t.Errorf("signing time = %s, want %s", signer.SigningTime, test.signing.signing_time)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	p := new_pki(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := p.leaf(t, key, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	der := sign(t, []byte("hello"), signing{cert: cert, key: key, certificates: []*x509.Certificate{cert}})
+
+	// the outer SEQUENCE with an indefinite length, as mail clients send it
+	_, header, _, err := ber_length(der[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ber := append(append([]byte{0x30, 0x80}, der[1+header:]...), 0, 0)
+
+	data, err := asn1.Marshal(content_info{ContentType: oid_data, Content: asn1.RawValue{FullBytes: der_element([]byte{0xa0}, der_element([]byte{0x04}, []byte("hello")))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{name: "DER", data: der},
+		{name: "BER", data: ber},
+		{name: "not signed", data: data, err: ErrNotSigned},
+		{name: "truncated", data: der[:len(der)-1], err: ErrMalformed},
+		{name: "not ASN.1", data: []byte("hello"), err: ErrMalformed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sd, err := Parse(test.data)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if string(sd.Content) != "hello" || len(sd.Certificates) != 1 {
+				t.Errorf("parsed %q with %d certificates", sd.Content, len(sd.Certificates))
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package spam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/GRFreire/nthmail/pkg/mail_auth"
+)
+
+// dnsbl_name builds the query name of ip in zone, e.g. 2.0.0.127.zen.example
+// for 127.0.0.2 (RFC 5782).
+func dnsbl_name(ip net.IP, zone string) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], zone)
+	}
+
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip16[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString(zone)
+
+	return b.String()
+}
+
+func check_dnsbl(ctx context.Context, result *Result, resolver mail_auth.Resolver, zones []string, ip net.IP) {
+	if resolver == nil || ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return
+	}
+
+	for _, zone := range zones {
+		addrs, err := resolver.LookupIPAddr(ctx, dnsbl_name(ip, zone))
+		if err != nil {
+			// not listed, or the list is unreachable
+			continue
+		}
+
+		for _, addr := range addrs {
+			// 127.255.255.0/24 are error codes, e.g. a refused query
+			// through a public resolver, not listings
+			ip4 := addr.IP.To4()
+			if ip4 != nil && ip4[0] == 127 && ip4[1] != 255 {
+				result.hit("dnsbl", 3, "%s listed in %s (%s)", ip, zone, addr.IP)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package spam
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+func check_headers(result *Result, header mail.Header) {
+	if header.Get("Date") == "" {
+		result.hit("missing_date", 1, "")
+	} else if _, err := header.Date(); err != nil {
+		result.hit("invalid_date", 1, "%s", header.Get("Date"))
+	}
+
+	if header.Get("Message-Id") == "" {
+		result.hit("missing_message_id", 1, "")
+	}
+
+	from, err := header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		result.hit("invalid_from", 2, "%s", header.Get("From"))
+	} else if strings.Contains(from[0].Name, "@") && !strings.Contains(strings.ToLower(from[0].Name), strings.ToLower(from[0].Address)) {
+		// "support@bank.com" <random@elsewhere.net>
+		result.hit("from_name_spoof", 2, "%s", from[0].Name)
+	}
+
+	if header.Get("To") == "" && header.Get("Cc") == "" {
+		result.hit("no_recipient_header", 1, "")
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		subject = header.Get("Subject")
+	}
+
+	if strings.TrimSpace(subject) == "" {
+		result.hit("empty_subject", 0.5, "")
+		return
+	}
+
+	letters, upper := 0, 0
+	for _, r := range subject {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= 10 && upper*10 >= letters*9 {
+		result.hit("subject_all_caps", 1, "")
+	}
+
+	if strings.Count(subject, "!") >= 3 || strings.Contains(subject, "$$$") {
+		result.hit("subject_shouting", 1, "")
+	}
+}
@@ -0,0 +1,191 @@
+package spam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/mail_auth"
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+)
+
+type Action string
+
+const (
+	Accept Action = "accept"
+	Tag    Action = "tag"
+	Reject Action = "reject"
+)
+
+type Result struct {
+	Score float64               `json:"score"`
+	Hits  []mail_utils.Spam_hit `json:"hits"`
+}
+
+func (r *Result) hit(rule string, score float64, format string, args ...any) {
+	r.Score += score
+	r.Hits = append(r.Hits, mail_utils.Spam_hit{Rule: rule, Score: score, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Message is what the rules look at.
+type Message struct {
+	IP   net.IP
+	Data []byte
+
+	// nil when the message was not verified
+	Auth *mail_auth.Results
+	// Data with its bodies parsed, nil when they could not be, the message is
+	// then only scored on its headers
+	Mail *mail_utils.Mail_obj
+}
+
+// Scorer runs every rule over a message. A zero TagScore or RejectScore
+// disables that action.
+type Scorer struct {
+	Resolver    mail_auth.Resolver
+	DNSBLs      []string
+	URLPatterns []*regexp.Regexp
+	Timeout     time.Duration
+
+	TagScore    float64
+	RejectScore float64
+}
+
+func (s Scorer) Score(ctx context.Context, msg Message) Result {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	var result Result
+
+	mail_msg, err := mail.ReadMessage(bytes.NewReader(msg.Data))
+	if err != nil {
+		result.hit("unparsable", 5, "%s", err)
+		return result
+	}
+
+	check_headers(&result, mail_msg.Header)
+	check_auth(&result, msg.Auth)
+	check_dnsbl(ctx, &result, s.Resolver, s.DNSBLs, msg.IP)
+
+	if msg.Mail != nil {
+		check_bodies(&result, msg.Mail.Body)
+		check_urls(&result, s.URLPatterns, msg.Mail.Body)
+	}
+
+	return result
+}
+
+// Action picks what to do with a message of the given score.
+func (s Scorer) Action(score float64) Action {
+	if s.RejectScore > 0 && score >= s.RejectScore {
+		return Reject
+	}
+	if s.TagScore > 0 && score >= s.TagScore {
+		return Tag
+	}
+
+	return Accept
+}
+
+// Header formats the result as an X-Spam-Status header field, including
+// the trailing CRLF.
+func (r Result) Header(is_spam bool) string {
+	status := "No"
+	if is_spam {
+		status = "Yes"
+	}
+
+	return fmt.Sprintf("X-Spam-Status: %s, score=%.1f tests=%s\r\n", status, r.Score, strings.Join(r.Rules(), ","))
+}
+
+// Rules returns the names of the rules of hits, e.g. for logging.
+func (r Result) Rules() []string {
+	rules := make([]string, len(r.Hits))
+	for i, h := range r.Hits {
+		rules[i] = h.Rule
+	}
+
+	return rules
+}
+
+func check_auth(result *Result, auth *mail_auth.Results) {
+	if auth == nil {
+		return
+	}
+
+	switch auth.SPF {
+	case mail_auth.Fail:
+		result.hit("spf_fail", 3, "")
+	case mail_auth.SoftFail:
+		result.hit("spf_softfail", 1.5, "")
+	}
+
+	switch auth.DKIMSummary() {
+	case mail_auth.Fail:
+		result.hit("dkim_fail", 2, "")
+	case mail_auth.None:
+		result.hit("dkim_none", 0.5, "")
+	}
+
+	if auth.DMARC.Result == mail_auth.Fail {
+		score := 2.0
+		if auth.DMARC.Policy == "reject" || auth.DMARC.Policy == "quarantine" {
+			score = 4
+		}
+		result.hit("dmarc_fail", score, "policy=%s", auth.DMARC.Policy)
+	}
+
+	if auth.SPF != mail_auth.Pass && auth.DKIMSummary() != mail_auth.Pass {
+		result.hit("no_auth", 1, "neither spf nor dkim passed")
+	}
+}
+
+func check_bodies(result *Result, bodies []mail_utils.Mail_body) {
+	has_html, has_text := false, false
+	for _, b := range bodies {
+		switch b.MimeType {
+		case mail_utils.Html:
+			has_html = true
+		case mail_utils.PlainText, mail_utils.Markdown:
+			if strings.TrimSpace(b.Data) != "" {
+				has_text = true
+			}
+		}
+	}
+
+	if has_html && !has_text {
+		result.hit("html_only", 1, "")
+	}
+
+	if len(bodies) == 0 {
+		result.hit("empty_body", 1, "")
+	}
+}
+
+var url_pattern = regexp.MustCompile(`(?i)https?://[^\s"'<>]+`)
+
+func check_urls(result *Result, patterns []*regexp.Regexp, bodies []mail_utils.Mail_body) {
+	seen := make(map[string]bool)
+	for _, b := range bodies {
+		for _, url := range url_pattern.FindAllString(b.Data, -1) {
+			for _, pattern := range patterns {
+				if seen[pattern.String()] || !pattern.MatchString(url) {
+					continue
+				}
+
+				// every pattern counts once, a newsletter linking the same
+				// shortener twenty times is not twenty times worse
+				seen[pattern.String()] = true
+				result.hit("bad_url", 2, "%s", url)
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package spam
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/GRFreire/nthmail/pkg/mail_auth"
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+)
+
+// stub_resolver answers the A queries in ip, every other name does not
+// exist.
+type stub_resolver struct {
+	ip map[string]string
+}
+
+func (r stub_resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addr, exists := r.ip[host]
+	if !exists {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return []net.IPAddr{{IP: net.ParseIP(addr)}}, nil
+}
+
+func (r stub_resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r stub_resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r stub_resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+const clean_header = "Date: Mon, 19 Oct 2026 10:00:00 +0000\r\n" +
+	"Message-Id: <1@example.com>\r\n" +
+	"From: Alice <alice@example.com>\r\n" +
+	"To: bob@nthmail.test\r\n" +
+	"Subject: Lunch tomorrow\r\n"
+
+// with replaces the field of clean_header starting with name, or drops it
+// when field is empty.
+func with(name, field string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(clean_header, "\r\n") {
+		if strings.HasPrefix(line, name+":") {
+			line = field
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "")
+}
+
+func TestScore(t *testing.T) {
+	passed := &mail_auth.Results{SPF: mail_auth.Pass, DKIM: []mail_auth.DKIMResult{{Result: mail_auth.Pass}}}
+
+	tests := []struct {
+		name string
+		data string
+		ip   string
+		// nil is passed
+		auth       *mail_auth.Results
+		unverified bool
+		rules      []string
+		score      float64
+	}{
+		{name: "clean", data: clean_header + "\r\nSee you at noon.\r\n", auth: passed},
+		{name: "unverified", data: clean_header + "\r\nSee you at noon.\r\n", unverified: true},
+		{name: "unparsable", data: "not a header\r\n", rules: []string{"unparsable"}, score: 5},
+
+		{name: "missing date", data: with("Date", "") + "\r\nhi\r\n", rules: []string{"missing_date"}, score: 1},
+		{name: "invalid date", data: with("Date", "Date: yesterday\r\n") + "\r\nhi\r\n", rules: []string{"invalid_date"}, score: 1},
+		{name: "missing message id", data: with("Message-Id", "") + "\r\nhi\r\n", rules: []string{"missing_message_id"}, score: 1},
+		{name: "invalid from", data: with("From", "From: alice\r\n") + "\r\nhi\r\n", rules: []string{"invalid_from"}, score: 2},
+		{name: "from name spoof", data: with("From", "From: \"support@bank.example\" <x@elsewhere.example>\r\n") + "\r\nhi\r\n", rules: []string{"from_name_spoof"}, score: 2},
+		{name: "from name is the address", data: with("From", "From: \"alice@example.com\" <alice@example.com>\r\n") + "\r\nhi\r\n"},
+		{name: "no recipient header", data: with("To", "") + "\r\nhi\r\n", rules: []string{"no_recipient_header"}, score: 1},
+		{name: "empty subject", data: with("Subject", "") + "\r\nhi\r\n", rules: []string{"empty_subject"}, score: 0.5},
+		{name: "subject all caps", data: with("Subject", "Subject: FREE MONEY INSIDE\r\n") + "\r\nhi\r\n", rules: []string{"subject_all_caps"}, score: 1},
+		{name: "subject shouting", data: with("Subject", "Subject: Act now!!!\r\n") + "\r\nhi\r\n", rules: []string{"subject_shouting"}, score: 1},
+
+		{
+			name:  "spf fail",
+			data:  clean_header + "\r\nhi\r\n",
+			auth:  &mail_auth.Results{SPF: mail_auth.Fail, DKIM: []mail_auth.DKIMResult{{Result: mail_auth.Pass}}},
+			rules: []string{"spf_fail"},
+			score: 3,
+		},
+		{
+			name:  "spf softfail and unsigned",
+			data:  clean_header + "\r\nhi\r\n",
+			auth:  &mail_auth.Results{SPF: mail_auth.SoftFail},
+			rules: []string{"spf_softfail", "dkim_none", "no_auth"},
+			score: 3,
+		},
+		{
+			name:  "dkim fail",
+			data:  clean_header + "\r\nhi\r\n",
+			auth:  &mail_auth.Results{SPF: mail_auth.Pass, DKIM: []mail_auth.DKIMResult{{Result: mail_auth.Fail}}},
+			rules: []string{"dkim_fail"},
+			score: 2,
+		},
+		{
+			name:  "dmarc fail with a reject policy",
+			data:  clean_header + "\r\nhi\r\n",
+			auth:  &mail_auth.Results{SPF: mail_auth.Pass, DKIM: []mail_auth.DKIMResult{{Result: mail_auth.Pass}}, DMARC: mail_auth.DMARCResult{Result: mail_auth.Fail, Policy: "reject"}},
+			rules: []string{"dmarc_fail"},
+			score: 4,
+		},
+		{
+			name:  "dmarc fail without a policy",
+			data:  clean_header + "\r\nhi\r\n",
+			auth:  &mail_auth.Results{SPF: mail_auth.Pass, DKIM: []mail_auth.DKIMResult{{Result: mail_auth.Pass}}, DMARC: mail_auth.DMARCResult{Result: mail_auth.Fail, Policy: "none"}},
+			rules: []string{"dmarc_fail"},
+			score: 2,
+		},
+
+		{
+			name:  "html only",
+			data:  clean_header + "Content-Type: text/html\r\n\r\n<p>hi</p>\r\n",
+			rules: []string{"html_only"},
+			score: 1,
+		},
+		{
+			name: "html with text",
+			data: clean_header + "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>hi</p>\r\n--b--\r\n",
+		},
+		{
+			name:  "empty body",
+			data:  clean_header + "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b--\r\n",
+			rules: []string{"empty_body"},
+			score: 1,
+		},
+		{
+			name:  "bad url counted once per pattern",
+			data:  clean_header + "\r\nhttp://bit.ly/a http://bit.ly/b http://192.0.2.1/login\r\n",
+			rules: []string{"bad_url", "bad_url"},
+			score: 4,
+		},
+
+		{name: "dnsbl listing", data: clean_header + "\r\nhi\r\n", ip: "192.0.2.99", rules: []string{"dnsbl"}, score: 3},
+		{name: "dnsbl error code", data: clean_header + "\r\nhi\r\n", ip: "192.0.2.98"},
+		{name: "dnsbl not listed", data: clean_header + "\r\nhi\r\n", ip: "192.0.2.1"},
+		{name: "dnsbl private ip", data: clean_header + "\r\nhi\r\n", ip: "10.0.0.99"},
+	}
+
+	scorer := Scorer{
+		Resolver: stub_resolver{ip: map[string]string{
+			"99.2.0.192.dnsbl.example": "127.0.0.2",
+			"98.2.0.192.dnsbl.example": "127.255.255.254",
+			"99.0.0.10.dnsbl.example":  "127.0.0.2",
+		}},
+		DNSBLs: []string{"dnsbl.example"},
+		URLPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`^https?://\d+\.\d+\.\d+\.\d+([:/]|$)`),
+			regexp.MustCompile(`^https?://bit\.ly/`),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth := test.auth
+			if auth == nil {
+				auth = passed
+			}
+			if test.unverified {
+				auth = nil
+			}
+
+			msg := Message{IP: net.ParseIP(test.ip), Data: []byte(test.data), Auth: auth}
+			if m, err := mail_utils.Parse_mail(msg.Data, false); err == nil {
+				msg.Mail = &m
+			}
+
+			result := scorer.Score(context.Background(), msg)
+			if !slices.Equal(result.Rules(), test.rules) {
+				t.Errorf("rules = %q, want %q", result.Rules(), test.rules)
+			}
+			if result.Score != test.score {
+				t.Errorf("score = %g, want %g", result.Score, test.score)
+			}
+		})
+	}
+}
+
+// Bodies that could not be parsed are not scored as empty.
+func TestScoreUnparsedBodies(t *testing.T) {
+	result := Scorer{}.Score(context.Background(), Message{Data: []byte(clean_header + "\r\nhi\r\n")})
+	if len(result.Hits) != 0 {
+		t.Errorf("rules = %q, want none", result.Rules())
+	}
+}
+
+func TestAction(t *testing.T) {
+	tests := []struct {
+		name         string
+		tag_score    float64
+		reject_score float64
+		score        float64
+		want         Action
+	}{
+		{"below tag", 5, 10, 4.9, Accept},
+		{"at tag", 5, 10, 5, Tag},
+		{"between", 5, 10, 9.9, Tag},
+		{"at reject", 5, 10, 10, Reject},
+		{"tag only", 5, 0, 100, Tag},
+		{"reject only", 0, 10, 9, Accept},
+		{"reject only above", 0, 10, 10, Reject},
+		{"disabled", 0, 0, 100, Accept},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scorer := Scorer{TagScore: test.tag_score, RejectScore: test.reject_score}
+			if got := scorer.Action(test.score); got != test.want {
+				t.Errorf("Action(%g) = %s, want %s", test.score, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHeader(t *testing.T) {
+	result := Result{Score: 3.5, Hits: []mail_utils.Spam_hit{{Rule: "spf_fail", Score: 3}, {Rule: "empty_subject", Score: 0.5}}}
+
+	tests := []struct {
+		is_spam bool
+		want    string
+	}{
+		{false, "X-Spam-Status: No, score=3.5 tests=spf_fail,empty_subject\r\n"},
+		{true, "X-Spam-Status: Yes, score=3.5 tests=spf_fail,empty_subject\r\n"},
+	}
+	for _, test := range tests {
+		if got := result.Header(test.is_spam); got != test.want {
+			t.Errorf("Header(%t) = %q, want %q", test.is_spam, got, test.want)
+		}
+	}
+}
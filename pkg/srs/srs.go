@@ -0,0 +1,135 @@
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Sender Rewriting Scheme, as implemented by libsrs2 and postsrsd: a
+// forwarded message gets an envelope sender at our domain that encodes the
+// original one, so SPF passes at the destination and bounces can be routed
+// back.
+//
+//	SRS0=HHHH=TT=example.com=alice@forwarder.test
+
+const (
+	timestamp_alphabet  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timestamp_precision = 24 * time.Hour
+	// two base32 characters
+	timestamp_slots = 1024
+	hash_length     = 4
+)
+
+// MaxAge is how long a rewritten address accepts bounces.
+const MaxAge = 21 * 24 * time.Hour
+
+var (
+	ErrNotSRS     = errors.New("not an SRS address")
+	ErrInvalidSRS = errors.New("malformed SRS address")
+	ErrBadHash    = errors.New("SRS hash does not match")
+	ErrExpired    = errors.New("SRS address expired")
+)
+
+type Rewriter struct {
+	Secret []byte
+	Domain string
+}
+
+// Forward rewrites addr into an SRS0 address at r.Domain. The null sender
+// and addresses already at r.Domain are returned unchanged.
+func (r Rewriter) Forward(addr string) string {
+	index := strings.LastIndex(addr, "@")
+	if addr == "" || index < 0 {
+		return addr
+	}
+
+	local, domain := addr[:index], addr[index+1:]
+	if strings.EqualFold(domain, r.Domain) {
+		return addr
+	}
+
+	timestamp := encode_timestamp(time.Now())
+	hash := r.hash(timestamp, domain, local)
+
+	return "SRS0=" + hash + "=" + timestamp + "=" + domain + "=" + local + "@" + r.Domain
+}
+
+// IsSRS reports whether addr looks like an SRS0 address at r.Domain, without
+// validating it.
+func (r Rewriter) IsSRS(addr string) bool {
+	index := strings.LastIndex(addr, "@")
+	if index < 0 || !strings.EqualFold(addr[index+1:], r.Domain) {
+		return false
+	}
+
+	return len(addr) > 5 && strings.EqualFold(addr[:5], "SRS0=")
+}
+
+// Reverse validates an SRS0 address and returns the original address.
+func (r Rewriter) Reverse(addr string) (string, error) {
+	if !r.IsSRS(addr) {
+		return "", ErrNotSRS
+	}
+
+	local := addr[5:strings.LastIndex(addr, "@")]
+	parts := strings.SplitN(local, "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", ErrInvalidSRS
+	}
+	hash, timestamp, domain, user := parts[0], parts[1], parts[2], parts[3]
+
+	// mail servers may change the case of the local part
+	expected := r.hash(timestamp, domain, user)
+	if !hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(expected))) {
+		return "", ErrBadHash
+	}
+
+	age, err := timestamp_age(timestamp, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if age > MaxAge {
+		return "", ErrExpired
+	}
+
+	return user + "@" + domain, nil
+}
+
+func (r Rewriter) hash(timestamp, domain, local string) string {
+	mac := hmac.New(sha1.New, r.Secret)
+	mac.Write([]byte(strings.ToLower(timestamp + domain + local)))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hash_length]
+}
+
+func encode_timestamp(now time.Time) string {
+	days := now.Unix() / int64(timestamp_precision/time.Second) % timestamp_slots
+
+	return string([]byte{timestamp_alphabet[days>>5], timestamp_alphabet[days&31]})
+}
+
+// timestamp_age returns how long ago timestamp was encoded, modulo the 1024
+// days the timestamp wraps around in.
+func timestamp_age(timestamp string, now time.Time) (time.Duration, error) {
+	if len(timestamp) != 2 {
+		return 0, ErrInvalidSRS
+	}
+
+	var days int64
+	for _, c := range strings.ToUpper(timestamp) {
+		index := strings.IndexRune(timestamp_alphabet, c)
+		if index < 0 {
+			return 0, ErrInvalidSRS
+		}
+		days = days<<5 | int64(index)
+	}
+
+	today := now.Unix() / int64(timestamp_precision/time.Second) % timestamp_slots
+	elapsed := (today - days + timestamp_slots) % timestamp_slots
+
+	return time.Duration(elapsed) * timestamp_precision, nil
+}
@@ -0,0 +1,88 @@
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForward(t *testing.T) {
+	r := Rewriter{Secret: []byte("secret"), Domain: "forwarder.test"}
+	timestamp := encode_timestamp(time.Now())
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"", ""},
+		{"no-domain", "no-domain"},
+		{"bob@Forwarder.TEST", "bob@Forwarder.TEST"},
+		{"alice@example.com", "SRS0=" + r.hash(timestamp, "example.com", "alice") + "=" + timestamp + "=example.com=alice@forwarder.test"},
+		{"a=b@example.com", "SRS0=" + r.hash(timestamp, "example.com", "a=b") + "=" + timestamp + "=example.com=a=b@forwarder.test"},
+	}
+
+	for _, test := range tests {
+		if got := r.Forward(test.addr); got != test.want {
+			t.Errorf("Forward(%q) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	r := Rewriter{Secret: []byte("secret"), Domain: "forwarder.test"}
+	rewritten := func(age time.Duration, domain, local string) string {
+		timestamp := encode_timestamp(time.Now().Add(-age))
+		return "SRS0=" + r.hash(timestamp, domain, local) + "=" + timestamp + "=" + domain + "=" + local + "@forwarder.test"
+	}
+
+	tests := []struct {
+		name string
+		addr string
+		want string
+		err  error
+	}{
+		{name: "round trip", addr: r.Forward("alice@example.com"), want: "alice@example.com"},
+		{name: "separator in the local part", addr: r.Forward("a=b@example.com"), want: "a=b@example.com"},
+		{name: "case changed", addr: strings.ToUpper(r.Forward("alice@example.com")), want: "ALICE@EXAMPLE.COM"},
+		{name: "old", addr: rewritten(20*24*time.Hour, "example.com", "alice"), want: "alice@example.com"},
+		{name: "expired", addr: rewritten(22*24*time.Hour, "example.com", "alice"), err: ErrExpired},
+		{name: "other secret", addr: Rewriter{Secret: []byte("other"), Domain: "forwarder.test"}.Forward("alice@example.com"), err: ErrBadHash},
+		{name: "changed address", addr: strings.Replace(r.Forward("alice@example.com"), "alice", "eve", 1), err: ErrBadHash},
+		{name: "other domain", addr: Rewriter{Secret: []byte("secret"), Domain: "other.test"}.Forward("alice@example.com"), err: ErrNotSRS},
+		{name: "not rewritten", addr: "alice@forwarder.test", err: ErrNotSRS},
+		{name: "missing parts", addr: "SRS0=abcd=AA=example.com@forwarder.test", err: ErrInvalidSRS},
+		{name: "empty user", addr: "SRS0=abcd=AA=example.com=@forwarder.test", err: ErrInvalidSRS},
+		{name: "bad timestamp", addr: "SRS0=" + r.hash("A1", "example.com", "alice") + "=A1=example.com=alice@forwarder.test", err: ErrInvalidSRS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := r.Reverse(test.addr)
+			if !errors.Is(err, test.err) || got != test.want {
+				t.Errorf("Reverse(%q) = %q, %v, want %q, %v", test.addr, got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestTimestampAge(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		encoded time.Time
+		want    time.Duration
+	}{
+		{now, 0},
+		{now.Add(-3 * 24 * time.Hour), 3 * 24 * time.Hour},
+		// the timestamp wraps around every 1024 days
+		{now.Add(-1025 * 24 * time.Hour), 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		got, err := timestamp_age(encode_timestamp(test.encoded), now)
+		if err != nil || got != test.want {
+			t.Errorf("age of %s = %s, %v, want %s", test.encoded, got, err, test.want)
+		}
+	}
+}
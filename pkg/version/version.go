@@ -0,0 +1,39 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Version and Commit are set at build time with
+// -ldflags "-X github.com/GRFreire/nthmail/pkg/version.Version=..."
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+	}
+
+	if info.Commit == "" {
+		if build, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range build.Settings {
+				if s.Key == "vcs.revision" {
+					info.Commit = s.Value
+				}
+			}
+		}
+	}
+
+	return info
+}
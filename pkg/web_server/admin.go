@@ -0,0 +1,342 @@
+package web_server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/blocklist"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/go-chi/chi"
+)
+
+// The operator dashboard at /admin, behind the admin token given as the
+// password of HTTP basic auth or as a bearer token. Only registered when
+// admin.token is set.
+
+const (
+	volume_days       = 14
+	top_days          = 7
+	top_limit         = 10
+	recent_rejections = 50
+	search_limit      = 100
+)
+
+// sender_domain is the SQL expression of the domain of mails.from_addr.
+const sender_domain = "lower(substr(from_addr, instr(from_addr, '@') + 1))"
+
+type admin_count struct {
+	Name  string
+	Count int
+}
+
+type admin_rejection struct {
+	At        time.Time
+	Remote_ip string
+	From      string
+	Rcpts     string
+	Reason    string
+	Error     string
+}
+
+type admin_mail struct {
+	Id         int
+	Arrived_at time.Time
+	Rcpt_addr  string
+	From_addr  string
+	Subject    string
+}
+
+type admin_view struct {
+	Mails       int
+	Inboxes     int
+	DB_size     int64
+	Blob_size   int64
+	Volume      []admin_count
+	Top_inboxes []admin_count
+	Top_domains []admin_count
+	Rejections  []admin_rejection
+	Blocklist   []blocklist.Entry
+
+	Query   string
+	Results []admin_mail
+	Message string
+	CSRF    string
+}
+
+func (sr ServerResouces) admin_authorized(req *http.Request) bool {
+	token := bearer_token(req)
+	if _, password, ok := req.BasicAuth(); ok {
+		token = password
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(sr.admin_token)) == 1
+}
+
+// require_admin_page asks browsers for the admin token with basic auth,
+// and checks the CSRF token of forms.
+func (sr ServerResouces) require_admin_page(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !sr.admin_authorized(req) {
+			res.Header().Set("WWW-Authenticate", `Basic realm="nthmail admin"`)
+			res.WriteHeader(401)
+			res.Write([]byte("admin token required"))
+			return
+		}
+
+		if req.Method == http.MethodPost && subtle.ConstantTimeCompare([]byte(req.FormValue("csrf")), []byte(sr.admin_csrf())) != 1 {
+			res.WriteHeader(403)
+			res.Write([]byte("invalid csrf token"))
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+// admin_csrf is the CSRF token of the admin forms. Basic auth is sent by
+// the browser on every request, so forms must prove they come from a page
+// only an admin could load.
+func (sr ServerResouces) admin_csrf() string {
+	sum := sha256.Sum256([]byte("nthmail admin csrf:" + sr.admin_token))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (sr ServerResouces) query_counts(ctx context.Context, query string, args ...any) ([]admin_count, error) {
+	rows, err := sr.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []admin_count
+	for rows.Next() {
+		var c admin_count
+		err = rows.Scan(&c.Name, &c.Count)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+func (sr ServerResouces) query_admin_view(ctx context.Context) (admin_view, error) {
+	var view admin_view
+	now := time.Now().UTC()
+	query_start := time.Now()
+
+	err := sr.db.QueryRowContext(ctx, "SELECT COUNT(*), COUNT(DISTINCT rcpt_addr), COALESCE(SUM(length(data)), 0) FROM mails").Scan(&view.Mails, &view.Inboxes, &view.Blob_size)
+	if err != nil {
+		return view, fmt.Errorf("could not count mails: %w", err)
+	}
+
+	err = sr.db.QueryRowContext(ctx, "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&view.DB_size)
+	if err != nil {
+		return view, fmt.Errorf("could not query db size: %w", err)
+	}
+
+	// one bucket per day, oldest first, including the days without mail
+	today := now.Truncate(24 * time.Hour)
+	first_day := today.AddDate(0, 0, -(volume_days - 1))
+	per_day, err := sr.query_counts(ctx, "SELECT arrived_at / 86400, COUNT(*) FROM mails WHERE arrived_at >= ? GROUP BY 1", first_day.Unix())
+	if err != nil {
+		return view, fmt.Errorf("could not query mail volume: %w", err)
+	}
+	by_day := make(map[string]int, len(per_day))
+	for _, c := range per_day {
+		by_day[c.Name] = c.Count
+	}
+	for day := first_day; !day.After(today); day = day.AddDate(0, 0, 1) {
+		view.Volume = append(view.Volume, admin_count{
+			Name:  day.Format("02/01"),
+			Count: by_day[strconv.FormatInt(day.Unix()/86400, 10)],
+		})
+	}
+
+	since := now.AddDate(0, 0, -top_days).Unix()
+	view.Top_inboxes, err = sr.query_counts(ctx, "SELECT rcpt_addr, COUNT(*) FROM mails WHERE arrived_at >= ? GROUP BY rcpt_addr ORDER BY 2 DESC LIMIT ?", since, top_limit)
+	if err != nil {
+		return view, fmt.Errorf("could not query top inboxes: %w", err)
+	}
+
+	view.Top_domains, err = sr.query_counts(ctx, "SELECT "+sender_domain+", COUNT(*) FROM mails WHERE arrived_at >= ? GROUP BY 1 ORDER BY 2 DESC LIMIT ?", since, top_limit)
+	if err != nil {
+		return view, fmt.Errorf("could not query top sender domains: %w", err)
+	}
+
+	rows, err := sr.db.QueryContext(ctx, "SELECT rejected_at, remote_ip, from_addr, rcpts, reason, error FROM smtp_rejections ORDER BY id DESC LIMIT ?", recent_rejections)
+	if err != nil {
+		return view, fmt.Errorf("could not query rejections: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r admin_rejection
+		var at int64
+		err = rows.Scan(&at, &r.Remote_ip, &r.From, &r.Rcpts, &r.Reason, &r.Error)
+		if err != nil {
+			return view, fmt.Errorf("could not scan db row: %w", err)
+		}
+		r.At = time.Unix(at, 0)
+
+		view.Rejections = append(view.Rejections, r)
+	}
+	if err = rows.Err(); err != nil {
+		return view, err
+	}
+	metrics.DBQueryDuration.Since(query_start, "admin")
+
+	view.Blocklist, err = sr.blocklist.List(ctx)
+	return view, err
+}
+
+// search_mails finds mails of any inbox whose recipient, sender or subject
+// contains q.
+func (sr ServerResouces) search_mails(ctx context.Context, q string) ([]admin_mail, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+
+	query_start := time.Now()
+	rows, err := sr.db.QueryContext(ctx, `SELECT id, arrived_at, rcpt_addr, from_addr, COALESCE(subject, '') FROM mails
+		WHERE rcpt_addr LIKE ?1 ESCAPE '\' OR from_addr LIKE ?1 ESCAPE '\' OR subject LIKE ?1 ESCAPE '\'
+		ORDER BY arrived_at DESC LIMIT ?2`, pattern, search_limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not search mails: %w", err)
+	}
+	defer rows.Close()
+
+	var mails []admin_mail
+	for rows.Next() {
+		var m admin_mail
+		var arrived_at int64
+		err = rows.Scan(&m.Id, &arrived_at, &m.Rcpt_addr, &m.From_addr, &m.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+		m.Arrived_at = time.Unix(arrived_at, 0)
+
+		mails = append(mails, m)
+	}
+	metrics.DBQueryDuration.Since(query_start, "admin_search")
+
+	return mails, rows.Err()
+}
+
+func (sr ServerResouces) handleAdmin(res http.ResponseWriter, req *http.Request) {
+	view, err := sr.query_admin_view(req.Context())
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not query admin dashboard", "err", err)
+		return
+	}
+
+	view.Query = strings.TrimSpace(req.URL.Query().Get("q"))
+	if view.Query != "" {
+		view.Results, err = sr.search_mails(req.Context(), view.Query)
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte("internal server error"))
+
+			logging.FromContext(req.Context()).Error("could not search mails", "err", err)
+			return
+		}
+	}
+	view.Message = req.URL.Query().Get("message")
+	view.CSRF = sr.admin_csrf()
+
+	render_start := time.Now()
+	body := admin_page(view)
+	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "admin")
+}
+
+func admin_redirect(res http.ResponseWriter, req *http.Request, message string) {
+	http.Redirect(res, req, "/admin?message="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+func (sr ServerResouces) handleAdminDelete(res http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	sender := strings.ToLower(strings.TrimSpace(req.FormValue("sender")))
+	domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.FormValue("domain")), "@"))
+
+	var query, value string
+	switch {
+	case sender != "":
+		query, value = "DELETE FROM mails WHERE lower(from_addr) = ?", sender
+	case domain != "":
+		// like the blocklist, a domain covers its subdomains
+		query, value = "DELETE FROM mails WHERE "+sender_domain+" = ?1 OR "+sender_domain+" LIKE '%.' || ?1", domain
+	default:
+		admin_redirect(res, req, "give a sender or a domain to delete")
+		return
+	}
+
+	result, err := sr.db.ExecContext(req.Context(), query, value)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logger.Error("could not delete mails", "err", err)
+		return
+	}
+	n, _ := result.RowsAffected()
+
+	logger.Info("deleted mails from admin dashboard", "sender", sender, "domain", domain, "count", n)
+	admin_redirect(res, req, fmt.Sprintf("deleted %d mails from %s", n, value))
+}
+
+func (sr ServerResouces) handleAdminBlock(res http.ResponseWriter, req *http.Request) {
+	kind, value := req.FormValue("kind"), req.FormValue("value")
+
+	err := sr.blocklist.Add(req.Context(), kind, value)
+	if errors.Is(err, blocklist.ErrInvalidEntry) {
+		admin_redirect(res, req, fmt.Sprintf("invalid %s %q", kind, value))
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not add blocklist entry", "err", err)
+		return
+	}
+
+	logging.FromContext(req.Context()).Info("blocked sender", "kind", kind, "value", value)
+	admin_redirect(res, req, fmt.Sprintf("blocked %s %s", kind, value))
+}
+
+func (sr ServerResouces) handleAdminUnblock(res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "entry-id"))
+	if err != nil {
+		admin_redirect(res, req, "no such blocklist entry")
+		return
+	}
+
+	err = sr.blocklist.Remove(req.Context(), id)
+	if errors.Is(err, blocklist.ErrNotFound) {
+		admin_redirect(res, req, "no such blocklist entry")
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not remove blocklist entry", "err", err)
+		return
+	}
+
+	admin_redirect(res, req, "removed blocklist entry")
+}
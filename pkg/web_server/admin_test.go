@@ -0,0 +1,117 @@
+package web_server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+var admin_routes = []struct {
+	method, path, body string
+}{
+	{"GET", "/admin", ""},
+	{"POST", "/admin/delete", "sender=alice@example.com"},
+	{"POST", "/admin/blocklist", "kind=address&value=alice@example.com"},
+	{"POST", "/admin/blocklist/1/delete", ""},
+	{"GET", "/api/admin/keys", ""},
+	{"POST", "/api/admin/keys", `{"name": "test", "permissions": ["read"]}`},
+	{"DELETE", "/api/admin/keys/1", ""},
+}
+
+func form(header http.Header) http.Header {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return header
+}
+
+func basic(password string) http.Header {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("admin", password)
+
+	return req.Header
+}
+
+func count_mails(t *testing.T, sr ServerResouces) int {
+	t.Helper()
+
+	var count int
+	err := sr.db.QueryRow("SELECT COUNT(*) FROM mails").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestAdminDisabled(t *testing.T) {
+	sr, db := new_test_server(t)
+	router := sr.Routes()
+	insert_mail(t, db, "bob@nthmail.test")
+
+	for _, route := range admin_routes {
+		for _, header := range []http.Header{nil, bearer(""), basic("")} {
+			res := serve(router, route.method, route.path, route.body, form(header))
+			if res.Code != 404 {
+				t.Errorf("%s %s = %d, want 404", route.method, route.path, res.Code)
+			}
+		}
+	}
+
+	if count_mails(t, sr) != 1 {
+		t.Error("mails were deleted")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	sr, db := new_test_server(t)
+	sr.admin_token = "s3cret"
+	router := sr.Routes()
+	insert_mail(t, db, "bob@nthmail.test")
+
+	for _, route := range admin_routes {
+		for name, header := range map[string]http.Header{"no token": nil, "wrong bearer": bearer("wrong"), "wrong password": basic("wrong"), "empty password": basic("")} {
+			res := serve(router, route.method, route.path, route.body, form(header))
+			if res.Code != 401 {
+				t.Errorf("%s %s with %s = %d, want 401", route.method, route.path, name, res.Code)
+			}
+		}
+	}
+
+	if count_mails(t, sr) != 1 {
+		t.Fatal("mails were deleted without the admin token")
+	}
+
+	res := serve(router, "GET", "/admin", "", basic("s3cret"))
+	if res.Code != 200 {
+		t.Errorf("GET /admin = %d, want 200", res.Code)
+	}
+	res = serve(router, "GET", "/api/admin/keys", "", bearer("s3cret"))
+	if res.Code != 200 {
+		t.Errorf("GET /api/admin/keys = %d, want 200", res.Code)
+	}
+
+	// the forms must carry the csrf token, basic auth is sent by the browser
+	// on any request
+	for _, csrf := range []string{"", "wrong"} {
+		body := url.Values{"sender": {"alice@example.com"}, "csrf": {csrf}}.Encode()
+		res = serve(router, "POST", "/admin/delete", body, form(basic("s3cret")))
+		if res.Code != 403 {
+			t.Errorf("POST /admin/delete with csrf %q = %d, want 403", csrf, res.Code)
+		}
+	}
+	if count_mails(t, sr) != 1 {
+		t.Fatal("mails were deleted without the csrf token")
+	}
+
+	body := url.Values{"sender": {"alice@example.com"}, "csrf": {sr.admin_csrf()}}.Encode()
+	res = serve(router, "POST", "/admin/delete", body, form(basic("s3cret")))
+	if res.Code != http.StatusSeeOther {
+		t.Errorf("POST /admin/delete = %d, want 303", res.Code)
+	}
+	if count_mails(t, sr) != 0 {
+		t.Error("mails were not deleted")
+	}
+}
@@ -0,0 +1,253 @@
+package web_server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+	"github.com/go-chi/chi"
+)
+
+// JSON representation of the inbox and mail pages.
+
+type api_auth struct {
+	SPF   string `json:"spf"`
+	DKIM  string `json:"dkim"`
+	DMARC string `json:"dmarc"`
+}
+
+type api_spam struct {
+	Score float64               `json:"score"`
+	Spam  bool                  `json:"spam"`
+	Hits  []mail_utils.Spam_hit `json:"hits,omitempty"`
+}
+
+type api_body struct {
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+type api_header struct {
+	From            []mail_utils.Address      `json:"from,omitempty"`
+	Sender          *mail_utils.Address       `json:"sender,omitempty"`
+	ReplyTo         []mail_utils.Address      `json:"reply_to,omitempty"`
+	To              []mail_utils.Address      `json:"to,omitempty"`
+	Cc              []mail_utils.Address      `json:"cc,omitempty"`
+	Bcc             []mail_utils.Address      `json:"bcc,omitempty"`
+	ReturnPath      string                    `json:"return_path,omitempty"`
+	Date            *time.Time                `json:"date,omitempty"`
+	MessageId       string                    `json:"message_id,omitempty"`
+	InReplyTo       []string                  `json:"in_reply_to,omitempty"`
+	References      []string                  `json:"references,omitempty"`
+	ListUnsubscribe []string                  `json:"list_unsubscribe,omitempty"`
+	Fields          []mail_utils.Header_field `json:"fields"`
+}
+
+type api_signature struct {
+	Kind   string `json:"kind,omitempty"`
+	Status string `json:"status"`
+	Signer string `json:"signer,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// claimed by the signer, not verified
+	SigningTime *time.Time `json:"signing_time,omitempty"`
+}
+
+type api_mail struct {
+	Id        int            `json:"id"`
+	From      string         `json:"from"`
+	To        []string       `json:"to"`
+	Tag       string         `json:"tag,omitempty"`
+	Thread    int            `json:"thread_id"`
+	Cc        []string       `json:"cc,omitempty"`
+	Subject   string         `json:"subject"`
+	Date      time.Time      `json:"date"`
+	Auth      *api_auth      `json:"auth,omitempty"`
+	Spam      *api_spam      `json:"spam,omitempty"`
+	Virus     string         `json:"virus,omitempty"`
+	Header    *api_header    `json:"header,omitempty"`
+	Signature *api_signature `json:"signature,omitempty"`
+	Body      []api_body     `json:"body,omitempty"`
+	// message/rfc822 parts, only set for a single mail
+	Messages []api_mail `json:"messages,omitempty"`
+}
+
+type api_thread struct {
+	Id       int       `json:"id"`
+	Count    int       `json:"count"`
+	LatestId int       `json:"latest_id"`
+	Latest   time.Time `json:"latest"`
+	From     string    `json:"from"`
+	Subject  string    `json:"subject"`
+}
+
+var mime_type_names = map[mail_utils.MIMEType]string{
+	mail_utils.PlainText: "text/plain",
+	mail_utils.Html:      "text/html",
+	mail_utils.Markdown:  "text/markdown",
+}
+
+func to_api_mail(m mail_utils.Mail_obj) api_mail {
+	mail := api_mail{
+		Id:      m.Id,
+		From:    m.From,
+		To:      m.To,
+		Tag:     m.Tag,
+		Thread:  m.Thread_id,
+		Cc:      m.Cc,
+		Subject: m.Subject,
+		Date:    m.Date,
+		Virus:   m.Virus,
+	}
+
+	if m.Auth != (mail_utils.Auth_results{}) {
+		mail.Auth = &api_auth{
+			SPF:   m.Auth.SPF,
+			DKIM:  m.Auth.DKIM,
+			DMARC: m.Auth.DMARC,
+		}
+	}
+
+	if m.Spam.Scored || m.Spam.Spam {
+		mail.Spam = &api_spam{
+			Score: m.Spam.Score,
+			Spam:  m.Spam.Spam,
+			Hits:  m.Spam.Hits,
+		}
+	}
+
+	// only set for a single mail
+	if h := m.Header; len(h.Fields) != 0 {
+		mail.Header = &api_header{
+			From:            h.From,
+			Sender:          h.Sender,
+			ReplyTo:         h.Reply_to,
+			To:              h.To,
+			Cc:              h.Cc,
+			Bcc:             h.Bcc,
+			ReturnPath:      h.Return_path,
+			MessageId:       h.Message_id,
+			InReplyTo:       h.In_reply_to,
+			References:      h.References,
+			ListUnsubscribe: h.List_unsubscribe,
+			Fields:          h.Fields,
+		}
+		if !h.Date.IsZero() {
+			mail.Header.Date = &h.Date
+		}
+	}
+
+	if sig := m.Signature; sig != nil {
+		mail.Signature = &api_signature{
+			Kind:   sig.Kind,
+			Status: sig.Status,
+			Signer: sig.Signer,
+			Detail: sig.Detail,
+		}
+		if !sig.SigningTime.IsZero() {
+			mail.Signature.SigningTime = &sig.SigningTime
+		}
+	}
+
+	for _, b := range m.Body {
+		mail.Body = append(mail.Body, api_body{
+			MimeType: mime_type_names[b.MimeType],
+			Data:     b.Data,
+		})
+	}
+
+	for _, message := range m.Messages {
+		mail.Messages = append(mail.Messages, to_api_mail(message))
+	}
+
+	return mail
+}
+
+func write_api_error(res http.ResponseWriter, status int, message string) {
+	write_json(res, status, map[string]string{"error": message})
+}
+
+func (sr ServerResouces) handleApiInbox(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+	q := parse_inbox_query(req)
+
+	if q.Threads {
+		threads, err := sr.query_threads(req.Context(), rcpt_addr, q)
+		if err != nil {
+			write_api_error(res, 500, "internal server error")
+			logging.FromContext(req.Context()).Error("could not query inbox threads", "err", err)
+			return
+		}
+
+		api_threads := make([]api_thread, 0, len(threads))
+		for _, t := range threads {
+			api_threads = append(api_threads, api_thread{
+				Id:       t.Id,
+				Count:    t.Count,
+				LatestId: t.Latest_id,
+				Latest:   t.Latest,
+				From:     t.From,
+				Subject:  t.Subject,
+			})
+		}
+
+		write_json(res, 200, api_threads)
+		return
+	}
+
+	mails, err := sr.query_inbox(req.Context(), rcpt_addr, q)
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not query inbox", "err", err)
+		return
+	}
+
+	api_mails := make([]api_mail, 0, len(mails))
+	for _, m := range mails {
+		api_mails = append(api_mails, to_api_mail(m))
+	}
+
+	write_json(res, 200, api_mails)
+}
+
+func (sr ServerResouces) handleApiMail(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+	mail_id := chi.URLParam(req, "mail-id")
+
+	mail_obj, err := sr.query_mail(req.Context(), rcpt_addr, mail_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		write_api_error(res, 404, "mail not found")
+		return
+	}
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not query mail", "mail_id", mail_id, "err", err)
+		return
+	}
+
+	write_json(res, 200, to_api_mail(mail_obj))
+}
+
+func (sr ServerResouces) handleApiDeleteMail(res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "mail-id"))
+	if err != nil {
+		write_api_error(res, 404, "mail not found")
+		return
+	}
+
+	deleted, err := sr.delete_mail(req.Context(), chi.URLParam(req, "rcpt-addr"), id)
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not delete mail", "mail_id", id, "err", err)
+		return
+	}
+	if !deleted {
+		write_api_error(res, 404, "mail not found")
+		return
+	}
+
+	res.WriteHeader(204)
+}
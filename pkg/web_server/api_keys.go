@@ -0,0 +1,208 @@
+package web_server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/GRFreire/nthmail/pkg/apikey"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/ratelimit"
+	"github.com/go-chi/chi"
+)
+
+// API keys on the JSON inbox routes, and the admin API managing them.
+
+type key_ctx_key struct{}
+
+// request_key returns the api key that authorized req, if any.
+func request_key(req *http.Request) (apikey.Key, bool) {
+	key, ok := req.Context().Value(key_ctx_key{}).(apikey.Key)
+	return key, ok
+}
+
+func bearer_token(req *http.Request) string {
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// key_limits rate limits api keys, each at its own rate or the default one.
+type key_limits struct {
+	default_rate int64
+
+	mu      sync.Mutex
+	by_rate map[int64]*ratelimit.Limiter
+}
+
+func new_key_limits(default_rate int64) *key_limits {
+	return &key_limits{
+		default_rate: default_rate,
+		by_rate:      make(map[int64]*ratelimit.Limiter),
+	}
+}
+
+func (limits *key_limits) allow(key apikey.Key) bool {
+	rate := key.Rate_limit
+	if rate <= 0 {
+		rate = limits.default_rate
+	}
+
+	limits.mu.Lock()
+	limiter, exists := limits.by_rate[rate]
+	if !exists {
+		limiter = ratelimit.PerMinute(rate)
+		limits.by_rate[rate] = limiter
+	}
+	limits.mu.Unlock()
+
+	return limiter.Allow(key.Id)
+}
+
+// key_permission is the permission a request needs: read for GET and HEAD,
+// delete for DELETE and write for the other methods, which change things.
+func key_permission(req *http.Request) string {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return apikey.Read
+	case http.MethodDelete:
+		return apikey.Delete
+	default:
+		return apikey.Write
+	}
+}
+
+// require_api_key checks the api key of a JSON inbox request. A request with
+// a key in scope skips the claim check, one without a key is let through
+// unless keys are required.
+func (sr ServerResouces) require_api_key(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		token := bearer_token(req)
+		if !strings.HasPrefix(token, apikey.Prefix) {
+			if sr.require_key {
+				write_api_error(res, 401, "api key required")
+				return
+			}
+
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		key, err := sr.api_keys.Authenticate(req.Context(), token)
+		if errors.Is(err, apikey.ErrInvalidKey) {
+			key_requests.Inc("invalid")
+			write_api_error(res, 401, "invalid api key")
+			return
+		}
+		if err != nil {
+			write_api_error(res, 500, "internal server error")
+			logging.FromContext(req.Context()).Error("could not authenticate api key", "err", err)
+			return
+		}
+
+		if !key.Allows(chi.URLParam(req, "rcpt-addr"), key_permission(req)) {
+			key_requests.Inc("forbidden")
+			write_api_error(res, 403, "api key not allowed on this inbox")
+			return
+		}
+
+		if !sr.key_limits.allow(key) {
+			key_requests.Inc("ratelimited")
+			write_api_error(res, 429, "api key rate limit exceeded")
+			return
+		}
+
+		key_requests.Inc("allowed")
+		logging.FromContext(req.Context()).Debug("authorized api key", "key_id", key.Id)
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), key_ctx_key{}, key)))
+	})
+}
+
+// require_admin lets through requests bearing the admin token.
+func (sr ServerResouces) require_admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !sr.admin_authorized(req) {
+			write_api_error(res, 401, "admin token required")
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+func (sr ServerResouces) handleApiKeys(res http.ResponseWriter, req *http.Request) {
+	keys, err := sr.api_keys.List(req.Context())
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not query api keys", "err", err)
+		return
+	}
+
+	write_json(res, 200, keys)
+}
+
+type api_key_request struct {
+	Name        string   `json:"name"`
+	Domains     []string `json:"domains"`
+	Prefixes    []string `json:"prefixes"`
+	Permissions []string `json:"permissions"`
+	RateLimit   int64    `json:"rate_limit"`
+}
+
+type api_key_response struct {
+	apikey.Key
+	Token string `json:"token"`
+}
+
+func (sr ServerResouces) handleApiCreateKey(res http.ResponseWriter, req *http.Request) {
+	var body api_key_request
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil || body.RateLimit < 0 {
+		write_api_error(res, 400, "invalid json body")
+		return
+	}
+
+	key, token, err := sr.api_keys.Create(req.Context(), apikey.Key{
+		Name:        body.Name,
+		Domains:     apikey.ParseList(strings.Join(body.Domains, ",")),
+		Prefixes:    apikey.ParseList(strings.Join(body.Prefixes, ",")),
+		Permissions: apikey.ParseList(strings.Join(body.Permissions, ",")),
+		Rate_limit:  body.RateLimit,
+	})
+	if errors.Is(err, apikey.ErrInvalidPermission) {
+		write_api_error(res, 400, `permissions must be "read", "write" and/or "delete"`)
+		return
+	}
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not create api key", "err", err)
+		return
+	}
+
+	logging.FromContext(req.Context()).Info("created api key", "key_id", key.Id, "name", key.Name)
+	write_json(res, 201, api_key_response{Key: key, Token: token})
+}
+
+func (sr ServerResouces) handleApiRevokeKey(res http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "key-id")
+
+	err := sr.api_keys.Revoke(req.Context(), id)
+	if errors.Is(err, apikey.ErrNotFound) {
+		write_api_error(res, 404, "api key not found")
+		return
+	}
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not revoke api key", "err", err)
+		return
+	}
+
+	logging.FromContext(req.Context()).Info("revoked api key", "key_id", id)
+	res.WriteHeader(204)
+}
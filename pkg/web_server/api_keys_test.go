@@ -0,0 +1,128 @@
+package web_server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/apikey"
+	"github.com/GRFreire/nthmail/pkg/forward"
+	"github.com/GRFreire/nthmail/pkg/relay"
+)
+
+func TestKeyPermission(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{http.MethodGet, apikey.Read},
+		{http.MethodHead, apikey.Read},
+		{http.MethodPost, apikey.Write},
+		{http.MethodPut, apikey.Write},
+		{http.MethodPatch, apikey.Write},
+		{http.MethodDelete, apikey.Delete},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/api/alice@nthmail.test", nil)
+		if got := key_permission(req); got != test.want {
+			t.Errorf("key_permission(%s) = %s, want %s", test.method, got, test.want)
+		}
+	}
+}
+
+func TestApiKeys(t *testing.T) {
+	sr, db := new_test_server(t)
+	// forwarding gives the inbox api a POST route
+	queue := relay.NewQueue(db, relay.Client{}, time.Minute, time.Hour)
+	sr.forwarder = forward.New(db, queue, "secret", "nthmail.test", "http://nthmail.test", 10, time.Hour, 10)
+	router := sr.Routes()
+
+	alice_mail := insert_mail(t, db, "alice@nthmail.test")
+	bob_mail := insert_mail(t, db, "bob@nthmail.test")
+
+	create := func(permissions ...string) string {
+		_, token, err := sr.api_keys.Create(context.Background(), apikey.Key{Name: "test", Prefixes: []string{"alice@"}, Permissions: permissions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	read := create(apikey.Read)
+	all := create(apikey.Read, apikey.Write, apikey.Delete)
+
+	forward_body := `{"target": "carol@example.org"}`
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"read lists", read, "GET", "/api/alice@nthmail.test", "", 200},
+		{"read gets a mail", read, "GET", fmt.Sprintf("/api/alice@nthmail.test/%d", alice_mail), "", 200},
+		{"read cannot post", read, "POST", "/api/alice@nthmail.test/forwards", forward_body, 403},
+		{"read cannot delete", read, "DELETE", fmt.Sprintf("/api/alice@nthmail.test/%d", alice_mail), "", 403},
+		{"read out of scope", read, "GET", "/api/bob@nthmail.test", "", 403},
+
+		{"other inbox list", all, "GET", "/api/bob@nthmail.test", "", 403},
+		{"other inbox mail", all, "GET", fmt.Sprintf("/api/bob@nthmail.test/%d", bob_mail), "", 403},
+		{"other inbox post", all, "POST", "/api/bob@nthmail.test/forwards", forward_body, 403},
+		{"other inbox delete", all, "DELETE", fmt.Sprintf("/api/bob@nthmail.test/%d", bob_mail), "", 403},
+		// a tag is part of its inbox, and another spelling is the same inbox
+		{"tag in scope", all, "GET", "/api/Alice+news@nthmail.test", "", 200},
+		{"mail of another inbox", all, "GET", fmt.Sprintf("/api/alice@nthmail.test/%d", bob_mail), "", 404},
+
+		{"invalid key", apikey.Prefix + "0_0", "GET", "/api/alice@nthmail.test", "", 401},
+		{"write posts", all, "POST", "/api/alice@nthmail.test/forwards", forward_body, 201},
+		{"delete deletes", all, "DELETE", fmt.Sprintf("/api/alice@nthmail.test/%d", alice_mail), "", 204},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := serve(router, test.method, test.path, test.body, bearer(test.token))
+			if res.Code != test.want {
+				t.Errorf("%s %s = %d %s, want %d", test.method, test.path, res.Code, res.Body, test.want)
+			}
+		})
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM mails WHERE id = ?", bob_mail).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error("the mail of the other inbox was deleted")
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM forward_rules WHERE rcpt_addr = 'bob@nthmail.test'").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("a forwarding rule was created on the other inbox")
+	}
+}
+
+func TestApiKeysRequired(t *testing.T) {
+	sr, db := new_test_server(t)
+	sr.require_key = true
+	router := sr.Routes()
+	insert_mail(t, db, "alice@nthmail.test")
+
+	res := serve(router, "GET", "/api/alice@nthmail.test", "", nil)
+	if res.Code != 401 {
+		t.Errorf("GET without a key = %d, want 401", res.Code)
+	}
+
+	// the token of a claim is not an api key
+	res = serve(router, "GET", "/api/alice@nthmail.test", "", bearer("not-a-key"))
+	if res.Code != 401 {
+		t.Errorf("GET with another token = %d, want 401", res.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package web_server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/logging"
+)
+
+// suggestion_count is how many alternatives are offered for a name that
+// cannot be chosen.
+const suggestion_count = 3
+
+// name_choice is the outcome of checking a name typed on the index page.
+type name_choice struct {
+	Name        string   `json:"name"`
+	Address     string   `json:"address,omitempty"`
+	Available   bool     `json:"available"`
+	Error       string   `json:"error,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// check_name tells whether name can be chosen as an inbox at sr.domain,
+// with suggestions when it cannot.
+func (sr ServerResouces) check_name(ctx context.Context, name string) (name_choice, error) {
+	choice := name_choice{Name: strings.TrimSpace(name)}
+
+	local := choice.Name
+	if index := strings.LastIndex(local, "@"); index >= 0 {
+		domain, err := address.NormalizeDomain(local[index+1:])
+		if err != nil || domain != sr.domain {
+			choice.Error = "inboxes are at @" + sr.domain
+		}
+		local = local[:index]
+	}
+
+	// name+tag is only free when the name is
+	rcpt_addr, _ := sr.normalizer.Normalize(local + "@" + sr.domain)
+	inbox, _ := address.Split(rcpt_addr, sr.subaddress_separators)
+	inbox_local := strings.TrimSuffix(inbox, "@"+sr.domain)
+
+	// names based on local are only suggested when it is valid
+	suggest_from := ""
+	if choice.Error != "" {
+		// already refused
+	} else if err := address.ValidateLocalPart(local); err != nil {
+		choice.Error = err.Error()
+	} else if sr.reserved_names.Is(inbox_local, sr.domain) {
+		choice.Error = "the name is reserved"
+	} else {
+		choice.Address = rcpt_addr
+		suggest_from = inbox_local
+
+		used, err := sr.inbox_names.InUse(ctx, inbox)
+		if err != nil {
+			return choice, err
+		}
+		if used {
+			choice.Error = "this inbox is already in use"
+		}
+	}
+
+	if choice.Error == "" {
+		choice.Available = true
+		return choice, nil
+	}
+
+	suggestions, err := sr.inbox_names.Suggest(ctx, sr.domain, suggest_from, suggestion_count)
+	choice.Suggestions = suggestions
+	return choice, err
+}
+
+func (sr ServerResouces) handleChoose(res http.ResponseWriter, req *http.Request) {
+	choice, err := sr.check_name(req.Context(), req.URL.Query().Get("name"))
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not check inbox name", "err", err)
+		return
+	}
+
+	if choice.Available {
+		http.Redirect(res, req, inbox_path(choice.Address), http.StatusSeeOther)
+		return
+	}
+
+	if choice.Address != "" {
+		res.WriteHeader(409)
+	} else {
+		res.WriteHeader(400)
+	}
+
+	render_start := time.Now()
+	body := index_page(sr.domain, choice)
+	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "index")
+}
+
+func (sr ServerResouces) handleApiChoose(res http.ResponseWriter, req *http.Request) {
+	choice, err := sr.check_name(req.Context(), req.URL.Query().Get("name"))
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not check inbox name", "err", err)
+		return
+	}
+
+	write_json(res, 200, choice)
+}
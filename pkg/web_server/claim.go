@@ -0,0 +1,272 @@
+package web_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/claim"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/go-chi/chi"
+)
+
+// Claimed inboxes. A claimed inbox is read with its token in a cookie, set
+// by the claim, login and access link pages, or in an Authorization: Bearer
+// header. Only registered when claims are enabled.
+
+var (
+	errLoginLimited = errors.New("too many attempts, try again later")
+	errClaimLimited = errors.New("too many inboxes claimed, try again later")
+)
+
+// claim_cookie names the cookie holding the token of rcpt_addr, one per
+// inbox so a browser can hold several.
+func claim_cookie(rcpt_addr string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(rcpt_addr)))
+	return "nthmail_inbox_" + hex.EncodeToString(sum[:8])
+}
+
+func request_token(req *http.Request, rcpt_addr string) string {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		scheme, token, _ := strings.Cut(auth, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+
+	cookie, err := req.Cookie(claim_cookie(rcpt_addr))
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+func (sr ServerResouces) set_claim_cookie(res http.ResponseWriter, rcpt_addr, token string) {
+	http.SetCookie(res, &http.Cookie{
+		Name:     claim_cookie(rcpt_addr),
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sr.claim_ttl / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(sr.base_url, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// require_claim lets a request on a claimed inbox through only with one of
+// its tokens, or an api key allowed on it.
+func (sr ServerResouces) require_claim(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if _, ok := request_key(req); ok || sr.claims == nil {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		rcpt_addr := chi.URLParam(req, "rcpt-addr")
+		ok, err := sr.claims.Authorize(req.Context(), rcpt_addr, request_token(req, rcpt_addr))
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte("internal server error"))
+
+			logging.FromContext(req.Context()).Error("could not authorize inbox", "err", err)
+			return
+		}
+		if ok {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		if strings.HasPrefix(req.URL.Path, "/api/") {
+			write_api_error(res, 401, "inbox is claimed")
+			return
+		}
+
+		sr.render_claim(res, req, rcpt_addr, 401, true, "", "")
+	})
+}
+
+func (sr ServerResouces) render_claim(res http.ResponseWriter, req *http.Request, rcpt_addr string, status int, claimed bool, access_link, message string) {
+	res.WriteHeader(status)
+
+	render_start := time.Now()
+	body := claim_page(rcpt_addr, claimed, access_link, message)
+	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "claim")
+}
+
+func (sr ServerResouces) access_link(rcpt_addr, token string) string {
+	return fmt.Sprintf("%s%s/access/%s", sr.base_url, inbox_path(rcpt_addr), token)
+}
+
+func (sr ServerResouces) handleClaimPage(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+
+	claimed, err := sr.claims.Claimed(req.Context(), rcpt_addr)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not query inbox claim", "err", err)
+		return
+	}
+
+	sr.render_claim(res, req, rcpt_addr, 200, claimed, "", "")
+}
+
+// claim claims rcpt_addr, limiting the claims per client.
+func (sr ServerResouces) claim(req *http.Request, rcpt_addr, password string) (string, error) {
+	if !sr.claim_limit.Allow(client_ip(req)) {
+		return "", errClaimLimited
+	}
+
+	return sr.claims.Claim(req.Context(), rcpt_addr, password)
+}
+
+func (sr ServerResouces) handleClaim(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+
+	token, err := sr.claim(req, rcpt_addr, req.FormValue("password"))
+	switch {
+	case errors.Is(err, errClaimLimited):
+		sr.render_claim(res, req, rcpt_addr, 429, false, "", err.Error())
+		return
+	case errors.Is(err, claim.ErrAlreadyClaimed):
+		sr.render_claim(res, req, rcpt_addr, 409, true, "", "this inbox is already claimed")
+		return
+	case errors.Is(err, claim.ErrPasswordTooShort):
+		sr.render_claim(res, req, rcpt_addr, 400, false, "", "password too short")
+		return
+	case err != nil:
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not claim inbox", "err", err)
+		return
+	}
+
+	sr.set_claim_cookie(res, rcpt_addr, token)
+	sr.render_claim(res, req, rcpt_addr, 200, true, sr.access_link(rcpt_addr, token), "")
+}
+
+// login checks the password of rcpt_addr, limiting the attempts per inbox
+// and per client.
+func (sr ServerResouces) login(req *http.Request, rcpt_addr, password string) (string, error) {
+	if !sr.client_login_limit.Allow(client_ip(req)) || !sr.login_limit.Allow(rcpt_addr) {
+		return "", errLoginLimited
+	}
+
+	return sr.claims.Login(req.Context(), rcpt_addr, password)
+}
+
+func (sr ServerResouces) handleLogin(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+
+	token, err := sr.login(req, rcpt_addr, req.FormValue("password"))
+	switch {
+	case errors.Is(err, errLoginLimited):
+		sr.render_claim(res, req, rcpt_addr, 429, true, "", err.Error())
+		return
+	case errors.Is(err, claim.ErrInvalidCredentials):
+		sr.render_claim(res, req, rcpt_addr, 401, true, "", "wrong password")
+		return
+	case err != nil:
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not log in to inbox", "err", err)
+		return
+	}
+
+	sr.set_claim_cookie(res, rcpt_addr, token)
+	http.Redirect(res, req, inbox_path(rcpt_addr), http.StatusSeeOther)
+}
+
+func (sr ServerResouces) handleAccess(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+	token := chi.URLParam(req, "token")
+
+	ok, err := sr.claims.Authorize(req.Context(), rcpt_addr, token)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not authorize inbox", "err", err)
+		return
+	}
+	if !ok {
+		sr.render_claim(res, req, rcpt_addr, 401, true, "", "invalid or expired access link")
+		return
+	}
+
+	sr.set_claim_cookie(res, rcpt_addr, token)
+	http.Redirect(res, req, inbox_path(rcpt_addr), http.StatusSeeOther)
+}
+
+type api_claim_request struct {
+	Password string `json:"password"`
+}
+
+type api_claim_response struct {
+	Token string `json:"token"`
+}
+
+func (sr ServerResouces) handleApiClaim(res http.ResponseWriter, req *http.Request) {
+	var body api_claim_request
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			write_api_error(res, 400, "invalid json body")
+			return
+		}
+	}
+
+	token, err := sr.claim(req, chi.URLParam(req, "rcpt-addr"), body.Password)
+	switch {
+	case errors.Is(err, errClaimLimited):
+		write_api_error(res, 429, err.Error())
+		return
+	case errors.Is(err, claim.ErrAlreadyClaimed):
+		write_api_error(res, 409, "inbox already claimed")
+		return
+	case errors.Is(err, claim.ErrPasswordTooShort):
+		write_api_error(res, 400, "password too short")
+		return
+	case err != nil:
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not claim inbox", "err", err)
+		return
+	}
+
+	write_json(res, 201, api_claim_response{Token: token})
+}
+
+func (sr ServerResouces) handleApiLogin(res http.ResponseWriter, req *http.Request) {
+	var body api_claim_request
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		write_api_error(res, 400, "invalid json body")
+		return
+	}
+
+	token, err := sr.login(req, chi.URLParam(req, "rcpt-addr"), body.Password)
+	switch {
+	case errors.Is(err, errLoginLimited):
+		write_api_error(res, 429, err.Error())
+		return
+	case errors.Is(err, claim.ErrInvalidCredentials):
+		write_api_error(res, 401, "wrong password")
+		return
+	case err != nil:
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not log in to inbox", "err", err)
+		return
+	}
+
+	write_json(res, 200, api_claim_response{Token: token})
+}
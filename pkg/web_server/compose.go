@@ -0,0 +1,215 @@
+package web_server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/compose"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+	"github.com/go-chi/chi"
+)
+
+// Sending mail from an inbox. Only registered when sending is enabled.
+
+// compose_form holds the fields of the compose page.
+type compose_form struct {
+	To          string
+	Subject     string
+	In_reply_to string
+	References  string
+	Text        string
+}
+
+func parse_compose_form(req *http.Request) compose_form {
+	return compose_form{
+		To:          req.FormValue("to"),
+		Subject:     req.FormValue("subject"),
+		In_reply_to: req.FormValue("in_reply_to"),
+		References:  req.FormValue("references"),
+		Text:        req.FormValue("text"),
+	}
+}
+
+// reply_form prefills the compose page to answer m.
+func reply_form(m mail_utils.Mail_obj) compose_form {
+	form := compose_form{
+		To:          m.Reply_to,
+		Subject:     m.Subject,
+		In_reply_to: m.Message_id,
+		References:  strings.TrimSpace(m.References + " " + m.Message_id),
+	}
+
+	if form.To == "" {
+		from, err := compose.ParseRecipients(m.From)
+		if err == nil {
+			form.To = from[0]
+		}
+	}
+
+	if !strings.HasPrefix(strings.ToLower(form.Subject), "re:") {
+		form.Subject = "Re: " + form.Subject
+	}
+
+	for _, b := range m.Body {
+		if b.MimeType != mail_utils.PlainText {
+			continue
+		}
+
+		lines := strings.Split(strings.TrimRight(b.Data, "\r\n"), "\n")
+		for i, line := range lines {
+			lines[i] = "> " + strings.TrimRight(line, "\r")
+		}
+		form.Text = fmt.Sprintf("\n\nOn %s, %s wrote:\n%s\n", m.Date.Format("02/01/2006 15:04"), m.From, strings.Join(lines, "\n"))
+		break
+	}
+
+	return form
+}
+
+// compose_error_message maps the errors a user can fix to a message and a
+// status, reporting whether err is one of them.
+func compose_error_message(err error) (string, int, bool) {
+	switch {
+	case errors.Is(err, compose.ErrQuotaExceeded):
+		return "this inbox sent too many mails, try again later", 429, true
+	case errors.Is(err, compose.ErrInvalidSender), errors.Is(err, compose.ErrReservedSender), errors.Is(err, compose.ErrInvalidRecipient),
+		errors.Is(err, compose.ErrTooManyRecipients), errors.Is(err, compose.ErrBodyTooLarge):
+		return err.Error(), 400, true
+	default:
+		return "", 0, false
+	}
+}
+
+// allow_send applies the per client and global limits on sent mail, which
+// unlike the quota of an inbox cannot be dodged by using more inboxes.
+func (sr ServerResouces) allow_send(req *http.Request) bool {
+	return sr.send_limit.Allow(client_ip(req)) && sr.send_global_limit.Allow("")
+}
+
+// may_send reports whether rcpt_addr may send mail, which takes a claim
+// when send.require_claim is set. require_claim already checked that the
+// request holds it.
+func (sr ServerResouces) may_send(req *http.Request, rcpt_addr string) (bool, error) {
+	if !sr.send_require_claim {
+		return true, nil
+	}
+
+	return sr.claims.Claimed(req.Context(), rcpt_addr)
+}
+
+func (sr ServerResouces) render_compose(res http.ResponseWriter, req *http.Request, rcpt_addr string, status int, form compose_form, message string) {
+	res.WriteHeader(status)
+
+	render_start := time.Now()
+	body := compose_page(rcpt_addr, form, message)
+	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "compose")
+}
+
+func (sr ServerResouces) handleCompose(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+
+	ok, err := sr.may_send(req, rcpt_addr)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not query inbox claim", "err", err)
+		return
+	}
+	if !ok {
+		sr.render_compose(res, req, rcpt_addr, 403, compose_form{}, "claim this inbox to send mail from it")
+		return
+	}
+
+	var form compose_form
+	if mail_id := req.URL.Query().Get("reply"); mail_id != "" {
+		mail_obj, err := sr.query_mail(req.Context(), rcpt_addr, mail_id)
+		if errors.Is(err, sql.ErrNoRows) {
+			res.WriteHeader(404)
+			res.Write([]byte("mail not found"))
+			return
+		}
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte("internal server error"))
+
+			logging.FromContext(req.Context()).Error("could not query mail", "mail_id", mail_id, "err", err)
+			return
+		}
+
+		form = reply_form(mail_obj)
+	}
+
+	sr.render_compose(res, req, rcpt_addr, 200, form, "")
+}
+
+func (sr ServerResouces) handleSend(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+	form := parse_compose_form(req)
+
+	ok, err := sr.may_send(req, rcpt_addr)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not query inbox claim", "err", err)
+		return
+	}
+	if !ok {
+		sr.render_compose(res, req, rcpt_addr, 403, form, "claim this inbox to send mail from it")
+		return
+	}
+
+	if !sr.allow_send(req) {
+		sr.render_compose(res, req, rcpt_addr, 429, form, "too many mails were sent, try again later")
+		return
+	}
+
+	to, err := compose.ParseRecipients(form.To)
+	if err == nil {
+		err = sr.sender.Send(req.Context(), rcpt_addr, compose.Message{
+			To:          to,
+			Subject:     form.Subject,
+			In_reply_to: form.In_reply_to,
+			References:  form.References,
+			Text:        form.Text,
+		})
+	}
+	if message, status, ok := compose_error_message(err); ok {
+		sr.render_compose(res, req, rcpt_addr, status, form, message)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not send mail", "err", err)
+		return
+	}
+
+	http.Redirect(res, req, inbox_path(rcpt_addr)+"/sent", http.StatusSeeOther)
+}
+
+func (sr ServerResouces) handleSent(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+
+	mails, err := sr.sender.Sent(req.Context(), rcpt_addr)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not query sent mails", "err", err)
+		return
+	}
+
+	render_start := time.Now()
+	body := sent_page(rcpt_addr, mails)
+	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "sent")
+}
@@ -0,0 +1,79 @@
+package web_server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/claim"
+	"github.com/GRFreire/nthmail/pkg/compose"
+	"github.com/GRFreire/nthmail/pkg/relay"
+)
+
+func TestSendRequireClaim(t *testing.T) {
+	tests := []struct {
+		name          string
+		require_claim bool
+		claimed       bool
+		// sends the claim token in the cookie of the inbox
+		token bool
+		csrf  string
+		want  int
+	}{
+		{name: "unclaimed", require_claim: true, csrf: "tok", want: 403},
+		{name: "unclaimed, claim not required", csrf: "tok", want: 303},
+		{name: "claimed without the token", require_claim: true, claimed: true, csrf: "tok", want: 401},
+		{name: "claimed with the token", require_claim: true, claimed: true, token: true, csrf: "tok", want: 303},
+		{name: "wrong csrf", require_claim: true, claimed: true, token: true, csrf: "wrong", want: 403},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sr, db := new_test_server(t)
+			queue := relay.NewQueue(db, relay.Client{}, time.Minute, time.Hour)
+			sr.sender = compose.New(db, queue, "nthmail.test", address.NewReserved(nil, nil), 10, 10, 10, 1000)
+			sr.claims = claim.New(db, time.Hour, 8)
+			sr.claim_ttl = time.Hour
+			sr.send_require_claim = test.require_claim
+			router := sr.Routes()
+
+			header := form(http.Header{})
+			cookie := csrf_cookie + "=tok"
+			if test.claimed {
+				token, err := sr.claims.Claim(context.Background(), "bob@nthmail.test", "correct horse")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.token {
+					cookie += "; " + claim_cookie("bob@nthmail.test") + "=" + token
+				}
+			}
+			header.Set("Cookie", cookie)
+
+			body := url.Values{"to": {"alice@example.com"}, "subject": {"hi"}, "text": {"hello"}, "csrf": {test.csrf}}.Encode()
+			res := serve(router, "POST", "/bob@nthmail.test/compose", body, header)
+			if res.Code != test.want {
+				t.Fatalf("POST /bob@nthmail.test/compose = %d, want %d", res.Code, test.want)
+			}
+
+			var sent int
+			err := db.QueryRow("SELECT COUNT(*) FROM sent_mails").Scan(&sent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want_sent := 0
+			if test.want == 303 {
+				want_sent = 1
+				if location := res.Header().Get("Location"); location != "/bob@nthmail.test/sent" {
+					t.Errorf("redirected to %s, want /bob@nthmail.test/sent", location)
+				}
+			}
+			if sent != want_sent {
+				t.Errorf("%d mails sent, want %d", sent, want_sent)
+			}
+		})
+	}
+}
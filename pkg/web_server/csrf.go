@@ -0,0 +1,67 @@
+package web_server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/GRFreire/nthmail/pkg/logging"
+)
+
+// The inbox forms carry the token of a per browser cookie in their csrf
+// field. Another site can make a browser post a form, with its claim cookie
+// and from its ip, but cannot read the cookie to fill in the field.
+
+const csrf_cookie = "nthmail_csrf"
+
+type csrf_ctx_key struct{}
+
+// csrf_token is the token forms rendered for the request of ctx carry.
+func csrf_token(ctx context.Context) string {
+	token, _ := ctx.Value(csrf_ctx_key{}).(string)
+	return token
+}
+
+// check_csrf hands out the csrf cookie, and refuses POST requests whose
+// csrf field does not match it.
+func (sr ServerResouces) check_csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		token := ""
+		if cookie, err := req.Cookie(csrf_cookie); err == nil {
+			token = cookie.Value
+		}
+
+		if req.Method == http.MethodPost && (token == "" || subtle.ConstantTimeCompare([]byte(req.FormValue("csrf")), []byte(token)) != 1) {
+			res.WriteHeader(403)
+			res.Write([]byte("invalid csrf token, reload the page and try again"))
+			return
+		}
+
+		if token == "" {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				res.WriteHeader(500)
+				res.Write([]byte("internal server error"))
+
+				logging.FromContext(req.Context()).Error("could not generate csrf token", "err", err)
+				return
+			}
+			token = hex.EncodeToString(b)
+
+			http.SetCookie(res, &http.Cookie{
+				Name:     csrf_cookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   strings.HasPrefix(sr.base_url, "https://"),
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), csrf_ctx_key{}, token)))
+	})
+}
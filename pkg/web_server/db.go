@@ -0,0 +1,190 @@
+package web_server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+)
+
+type db_mail_header struct {
+	Id                   int
+	Arrived_at           int64
+	Rcpt_addr, From_addr string
+	Rcpt_tag             sql.NullString
+	Subject              string
+	Spam                 bool
+	Thread_id            int
+}
+
+type db_mail struct {
+	Id                      int
+	Arrived_at              int64
+	Rcpt_addr, From_addr    string
+	Rcpt_tag                sql.NullString
+	Data                    []byte
+	Spf_result, Dkim_result sql.NullString
+	Dmarc_result            sql.NullString
+	Spam_score              sql.NullFloat64
+	Spam_hits               sql.NullString
+	Spam                    bool
+	Virus_result            sql.NullString
+	Thread_id               int
+}
+
+// spam_filter selects which mails of an inbox are listed, from the "spam"
+// query parameter.
+type spam_filter string
+
+const (
+	spam_show spam_filter = ""
+	spam_hide spam_filter = "hide"
+	spam_only spam_filter = "only"
+)
+
+func parse_spam_filter(s string) spam_filter {
+	switch spam_filter(s) {
+	case spam_hide, spam_only:
+		return spam_filter(s)
+	default:
+		return spam_show
+	}
+}
+
+// query_inbox lists the mails of an inbox that q selects.
+func (sr ServerResouces) query_inbox(ctx context.Context, rcpt_addr string, q inbox_query) ([]mail_utils.Mail_obj, error) {
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Commit()
+
+	query := "SELECT mails.id, mails.arrived_at, mails.rcpt_addr, mails.rcpt_tag, mails.from_addr, mails.subject, mails.spam, COALESCE(mails.thread_id, mails.id) FROM mails WHERE mails.rcpt_addr = ? AND mails.quarantined = 0"
+	args := []any{rcpt_addr}
+	if q.Tag != "" {
+		query += " AND mails.rcpt_tag = ?"
+		args = append(args, q.Tag)
+	}
+	if q.Thread != 0 {
+		query += " AND COALESCE(mails.thread_id, mails.id) = ?"
+		args = append(args, q.Thread)
+	}
+	switch q.Filter {
+	case spam_hide:
+		query += " AND mails.spam = 0"
+	case spam_only:
+		query += " AND mails.spam = 1"
+	}
+	query += " ORDER BY mails.arrived_at DESC"
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare db stmt: %w", err)
+	}
+	defer stmt.Close()
+
+	query_start := time.Now()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query db stmt: %w", err)
+	}
+	defer rows.Close()
+
+	var mails []mail_utils.Mail_obj
+	for rows.Next() {
+		var m db_mail_header
+		err = rows.Scan(&m.Id, &m.Arrived_at, &m.Rcpt_addr, &m.Rcpt_tag, &m.From_addr, &m.Subject, &m.Spam, &m.Thread_id)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+
+		var mail_obj mail_utils.Mail_obj
+		mail_obj.Id = m.Id
+		mail_obj.Date = time.Unix(m.Arrived_at, 0)
+		mail_obj.To = []string{m.Rcpt_addr}
+		mail_obj.Tag = m.Rcpt_tag.String
+		mail_obj.From = m.From_addr
+		mail_obj.Subject = m.Subject
+		mail_obj.Spam.Spam = m.Spam
+		mail_obj.Thread_id = m.Thread_id
+
+		mails = append(mails, mail_obj)
+	}
+	metrics.DBQueryDuration.Since(query_start, "inbox")
+
+	return mails, rows.Err()
+}
+
+// query_mail loads and parses a single mail. It returns sql.ErrNoRows when
+// the inbox has no such mail or it is quarantined.
+func (sr ServerResouces) query_mail(ctx context.Context, rcpt_addr, mail_id string) (mail_utils.Mail_obj, error) {
+	var mail_obj mail_utils.Mail_obj
+
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return mail_obj, fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Commit()
+
+	stmt, err := tx.Prepare("SELECT mails.id, mails.arrived_at, mails.rcpt_addr, mails.rcpt_tag, mails.from_addr, mails.data, mails.spf_result, mails.dkim_result, mails.dmarc_result, mails.spam_score, mails.spam_hits, mails.spam, mails.virus_result, COALESCE(mails.thread_id, mails.id) FROM mails WHERE mails.rcpt_addr = ? AND mails.id = ? AND mails.quarantined = 0")
+	if err != nil {
+		return mail_obj, fmt.Errorf("could not prepare db stmt: %w", err)
+	}
+	defer stmt.Close()
+
+	query_start := time.Now()
+	row := stmt.QueryRow(rcpt_addr, mail_id)
+
+	var m db_mail
+	err = row.Scan(&m.Id, &m.Arrived_at, &m.Rcpt_addr, &m.Rcpt_tag, &m.From_addr, &m.Data, &m.Spf_result, &m.Dkim_result, &m.Dmarc_result, &m.Spam_score, &m.Spam_hits, &m.Spam, &m.Virus_result, &m.Thread_id)
+	metrics.DBQueryDuration.Since(query_start, "mail")
+	if err != nil {
+		return mail_obj, err
+	}
+
+	mail_obj, err = mail_utils.Parse_mail(m.Data, false)
+	if err != nil {
+		return mail_obj, fmt.Errorf("could not parse mail: %w", err)
+	}
+	mail_obj.Date = time.Unix(m.Arrived_at, 0)
+	mail_obj.Id = m.Id
+	mail_obj.Tag = m.Rcpt_tag.String
+	mail_obj.Thread_id = m.Thread_id
+	mail_obj.Auth = mail_utils.Auth_results{
+		SPF:   m.Spf_result.String,
+		DKIM:  m.Dkim_result.String,
+		DMARC: m.Dmarc_result.String,
+	}
+	mail_obj.Spam = mail_utils.Spam_results{
+		Scored: m.Spam_score.Valid,
+		Score:  m.Spam_score.Float64,
+		Spam:   m.Spam,
+	}
+	mail_obj.Virus = m.Virus_result.String
+	sr.verify_signature(mail_obj.Signature)
+	if m.Spam_hits.Valid {
+		err = json.Unmarshal([]byte(m.Spam_hits.String), &mail_obj.Spam.Hits)
+		if err != nil {
+			return mail_obj, fmt.Errorf("could not decode spam hits: %w", err)
+		}
+	}
+
+	return mail_obj, nil
+}
+
+// delete_mail deletes a mail of rcpt_addr, reporting whether it existed.
+func (sr ServerResouces) delete_mail(ctx context.Context, rcpt_addr string, mail_id int) (bool, error) {
+	query_start := time.Now()
+	result, err := sr.db.ExecContext(ctx, "DELETE FROM mails WHERE rcpt_addr = ? AND id = ?", rcpt_addr, mail_id)
+	metrics.DBQueryDuration.Since(query_start, "delete_mail")
+	if err != nil {
+		return false, fmt.Errorf("could not delete mail: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
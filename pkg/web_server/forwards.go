@@ -0,0 +1,193 @@
+package web_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/forward"
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/go-chi/chi"
+)
+
+// Forwarding rules, from the inbox page and the JSON API. Only registered
+// when forwarding is enabled.
+
+// forward_error_message maps the errors a user can fix to a status and a
+// message, reporting whether err is one of them.
+func forward_error_message(err error) (int, string, bool) {
+	switch {
+	case errors.Is(err, forward.ErrInvalidInbox):
+		return 400, "this inbox cannot forward mail", true
+	case errors.Is(err, forward.ErrInvalidTarget):
+		return 400, "invalid forwarding address", true
+	case errors.Is(err, forward.ErrTooManyRules):
+		return 400, "this inbox has too many forwarding rules", true
+	case errors.Is(err, forward.ErrNotFound):
+		return 404, "forwarding rule not found", true
+	case errors.Is(err, forward.ErrRateLimited):
+		return 429, "too many confirmation mails were sent to this address, try again later", true
+	default:
+		return 0, "", false
+	}
+}
+
+// allow_create_forward applies the per client and global limits on new
+// rules, each of which mails a confirmation to an outside address.
+func (sr ServerResouces) allow_create_forward(req *http.Request) bool {
+	return sr.forward_limit.Allow(client_ip(req)) && sr.forward_global_limit.Allow("")
+}
+
+func (sr ServerResouces) render_forwards(res http.ResponseWriter, req *http.Request, rcpt_addr string, status int, message string) {
+	rules, err := sr.forwarder.Rules(req.Context(), rcpt_addr)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not query forward rules", "err", err)
+		return
+	}
+
+	res.WriteHeader(status)
+
+	render_start := time.Now()
+	body := forwards_page(rcpt_addr, rules, message)
+	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "forwards")
+}
+
+func (sr ServerResouces) handleForwards(res http.ResponseWriter, req *http.Request) {
+	sr.render_forwards(res, req, chi.URLParam(req, "rcpt-addr"), 200, "")
+}
+
+func (sr ServerResouces) handleCreateForward(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+
+	if !sr.allow_create_forward(req) {
+		sr.render_forwards(res, req, rcpt_addr, 429, "too many forwarding rules were created, try again later")
+		return
+	}
+
+	rule, err := sr.forwarder.Create(req.Context(), rcpt_addr, req.FormValue("target"), req.FormValue("match_from"), req.FormValue("match_subject"))
+	if status, message, ok := forward_error_message(err); ok {
+		sr.render_forwards(res, req, rcpt_addr, status, message)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not create forward rule", "err", err)
+		return
+	}
+
+	sr.render_forwards(res, req, rcpt_addr, 200, fmt.Sprintf("a confirmation link was sent to %s", rule.Target_addr))
+}
+
+func (sr ServerResouces) handleDeleteForward(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr := chi.URLParam(req, "rcpt-addr")
+
+	id, err := strconv.Atoi(chi.URLParam(req, "rule-id"))
+	if err == nil {
+		err = sr.forwarder.Delete(req.Context(), rcpt_addr, id)
+	}
+	if err != nil && !errors.Is(err, forward.ErrNotFound) {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not delete forward rule", "err", err)
+		return
+	}
+
+	http.Redirect(res, req, inbox_path(rcpt_addr)+"/forwards", http.StatusSeeOther)
+}
+
+func (sr ServerResouces) handleConfirmForward(res http.ResponseWriter, req *http.Request) {
+	rule, err := sr.forwarder.Confirm(req.Context(), chi.URLParam(req, "token"))
+	if errors.Is(err, forward.ErrInvalidToken) {
+		res.WriteHeader(404)
+		res.Write([]byte("invalid or expired confirmation link"))
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not confirm forward rule", "err", err)
+		return
+	}
+
+	res.Write([]byte(fmt.Sprintf("mail to %s is now forwarded to %s", rule.Rcpt_addr, rule.Target_addr)))
+}
+
+func (sr ServerResouces) handleApiForwards(res http.ResponseWriter, req *http.Request) {
+	rules, err := sr.forwarder.Rules(req.Context(), chi.URLParam(req, "rcpt-addr"))
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not query forward rules", "err", err)
+		return
+	}
+
+	if rules == nil {
+		rules = []forward.Rule{}
+	}
+
+	write_json(res, 200, rules)
+}
+
+type api_forward_request struct {
+	Target       string `json:"target"`
+	MatchFrom    string `json:"match_from"`
+	MatchSubject string `json:"match_subject"`
+}
+
+func (sr ServerResouces) handleApiCreateForward(res http.ResponseWriter, req *http.Request) {
+	var body api_forward_request
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		write_api_error(res, 400, "invalid json body")
+		return
+	}
+
+	if !sr.allow_create_forward(req) {
+		write_api_error(res, 429, "too many forwarding rules were created, try again later")
+		return
+	}
+
+	rule, err := sr.forwarder.Create(req.Context(), chi.URLParam(req, "rcpt-addr"), body.Target, body.MatchFrom, body.MatchSubject)
+	if status, message, ok := forward_error_message(err); ok {
+		write_api_error(res, status, message)
+		return
+	}
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not create forward rule", "err", err)
+		return
+	}
+
+	write_json(res, 201, rule)
+}
+
+func (sr ServerResouces) handleApiDeleteForward(res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "rule-id"))
+	if err != nil {
+		write_api_error(res, 404, "forwarding rule not found")
+		return
+	}
+
+	err = sr.forwarder.Delete(req.Context(), chi.URLParam(req, "rcpt-addr"), id)
+	if errors.Is(err, forward.ErrNotFound) {
+		write_api_error(res, 404, "forwarding rule not found")
+		return
+	}
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not delete forward rule", "err", err)
+		return
+	}
+
+	res.WriteHeader(204)
+}
@@ -0,0 +1,90 @@
+package web_server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/mail_server"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	"github.com/GRFreire/nthmail/pkg/version"
+)
+
+func write_json(res http.ResponseWriter, status int, v any) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(v)
+}
+
+func (sr ServerResouces) handleHealthz(res http.ResponseWriter, req *http.Request) {
+	write_json(res, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (sr ServerResouces) handleVersion(res http.ResponseWriter, req *http.Request) {
+	write_json(res, http.StatusOK, version.Get())
+}
+
+func (sr ServerResouces) handleReadyz(res http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		"db":         sr.check_db,
+		"migrations": sr.check_migrations,
+		"smtp": func(ctx context.Context) error {
+			return mail_server.SelfCheck(ctx, sr.smtp_addr)
+		},
+	}
+	if sr.clamd != nil {
+		checks["clamd"] = sr.clamd.Ping
+	}
+
+	status := http.StatusOK
+	results := make(map[string]string)
+	for name, check := range checks {
+		err := check(ctx)
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			results[name] = err.Error()
+			logging.FromContext(req.Context()).Warn("readiness check failed", "check", name, "err", err)
+			continue
+		}
+
+		results[name] = "ok"
+	}
+
+	write_json(res, status, results)
+}
+
+// check_db checks the database is reachable and writable by taking the
+// write lock in a transaction that is then rolled back.
+func (sr ServerResouces) check_db(ctx context.Context) error {
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin db transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE mails SET id = id WHERE id = -1")
+	if err != nil {
+		return fmt.Errorf("db is not writable: %w", err)
+	}
+
+	return nil
+}
+
+func (sr ServerResouces) check_migrations(ctx context.Context) error {
+	current, err := migrations.Version(sr.db)
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %w", err)
+	}
+
+	if latest := migrations.Latest(); current < latest {
+		return fmt.Errorf("schema version is %d, expected %d", current, latest)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package web_server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/metrics"
+)
+
+// inbox_query selects what the inbox page and API list.
+type inbox_query struct {
+	Filter spam_filter
+	Tag    string
+	// only the mails of this thread, unless zero
+	Thread int
+	// list threads instead of mails
+	Threads bool
+}
+
+func parse_inbox_query(req *http.Request) inbox_query {
+	values := req.URL.Query()
+
+	q := inbox_query{
+		Filter:  parse_spam_filter(values.Get("spam")),
+		Tag:     request_tag(req),
+		Threads: values.Get("view") == "threads",
+	}
+	if thread, err := strconv.Atoi(values.Get("thread")); err == nil && thread > 0 {
+		q.Thread = thread
+		q.Threads = false
+	}
+
+	return q
+}
+
+// url links to the inbox page of rcpt_addr listing what q selects.
+func (q inbox_query) url(rcpt_addr string) string {
+	query := url.Values{}
+	if q.Tag != "" {
+		query.Set("tag", q.Tag)
+	}
+	if q.Filter != spam_show {
+		query.Set("spam", string(q.Filter))
+	}
+	if q.Thread != 0 {
+		query.Set("thread", strconv.Itoa(q.Thread))
+	} else if q.Threads {
+		query.Set("view", "threads")
+	}
+
+	if len(query) == 0 {
+		return inbox_path(rcpt_addr)
+	}
+	return inbox_path(rcpt_addr) + "?" + query.Encode()
+}
+
+func (q inbox_query) with_filter(filter spam_filter) inbox_query {
+	q.Filter = filter
+	return q
+}
+
+func (q inbox_query) with_tag(tag string) inbox_query {
+	q.Tag = tag
+	return q
+}
+
+func (q inbox_query) with_thread(thread int) inbox_query {
+	q.Thread = thread
+	q.Threads = false
+	return q
+}
+
+func (q inbox_query) with_threads(threads bool) inbox_query {
+	q.Thread = 0
+	q.Threads = threads
+	return q
+}
+
+// thread_summary is a thread of an inbox, with its latest mail.
+type thread_summary struct {
+	Id        int
+	Count     int
+	Latest_id int
+	Latest    time.Time
+	From      string
+	Subject   string
+}
+
+// query_threads lists the threads of an inbox with the mails q selects,
+// most recently active first.
+func (sr ServerResouces) query_threads(ctx context.Context, rcpt_addr string, q inbox_query) ([]thread_summary, error) {
+	where := "rcpt_addr = ? AND quarantined = 0"
+	args := []any{rcpt_addr}
+	if q.Tag != "" {
+		where += " AND rcpt_tag = ?"
+		args = append(args, q.Tag)
+	}
+	switch q.Filter {
+	case spam_hide:
+		where += " AND spam = 0"
+	case spam_only:
+		where += " AND spam = 1"
+	}
+
+	query := "SELECT threads.thread_id, threads.count, mails.id, mails.arrived_at, mails.from_addr, mails.subject FROM " +
+		"(SELECT COALESCE(thread_id, id) AS thread_id, COUNT(*) AS count, MAX(id) AS latest_id FROM mails WHERE " + where + " GROUP BY COALESCE(thread_id, id)) AS threads " +
+		"JOIN mails ON mails.id = threads.latest_id ORDER BY mails.arrived_at DESC, mails.id DESC"
+
+	query_start := time.Now()
+	rows, err := sr.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query inbox threads: %w", err)
+	}
+	defer rows.Close()
+
+	var threads []thread_summary
+	for rows.Next() {
+		var t thread_summary
+		var latest int64
+		err = rows.Scan(&t.Id, &t.Count, &t.Latest_id, &latest, &t.From, &t.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+		t.Latest = time.Unix(latest, 0)
+
+		threads = append(threads, t)
+	}
+	metrics.DBQueryDuration.Since(query_start, "inbox_threads")
+
+	return threads, rows.Err()
+}
@@ -0,0 +1,17 @@
+package web_server
+
+import (
+	"net"
+	"net/http"
+)
+
+// client_ip is the address req came from, without its port, which keys the
+// per client limits.
+func client_ip(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
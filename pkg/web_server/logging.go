@@ -0,0 +1,61 @@
+package web_server
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+// log_requests gives every request an id, echoed in the X-Request-Id
+// header, and a logger carrying it through the request context.
+func log_requests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		request_id := logging.NewID()
+		logger := slog.Default().With(
+			"request_id", request_id,
+			"remote_addr", req.RemoteAddr,
+		)
+		res.Header().Set("X-Request-Id", request_id)
+
+		ww := middleware.NewWrapResponseWriter(res, req.ProtoMajor)
+		next.ServeHTTP(ww, req.WithContext(logging.WithLogger(req.Context(), logger)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		logger.Info("http request",
+			"method", req.Method,
+			"path", log_path(req),
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// log_path is the path of req with the {token} parameter of the routes
+// taking one, like access links, left out of the log.
+func log_path(req *http.Request) string {
+	path := req.URL.Path
+
+	rctx := chi.RouteContext(req.Context())
+	if rctx == nil {
+		return path
+	}
+	for i, key := range rctx.URLParams.Keys {
+		if key == "token" && rctx.URLParams.Values[i] != "" {
+			path = strings.Replace(path, rctx.URLParams.Values[i], "<redacted>", 1)
+		}
+	}
+
+	return path
+}
@@ -1,99 +1,294 @@
 package web_server
 
 import (
+	"context"
+	"crypto/x509"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
 	"time"
 
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/apikey"
+	"github.com/GRFreire/nthmail/pkg/blocklist"
+	"github.com/GRFreire/nthmail/pkg/claim"
+	"github.com/GRFreire/nthmail/pkg/clamd"
+	"github.com/GRFreire/nthmail/pkg/compose"
+	"github.com/GRFreire/nthmail/pkg/config"
+	"github.com/GRFreire/nthmail/pkg/forward"
+	"github.com/GRFreire/nthmail/pkg/lifecycle"
+	"github.com/GRFreire/nthmail/pkg/logging"
 	"github.com/GRFreire/nthmail/pkg/mail_utils"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/GRFreire/nthmail/pkg/ratelimit"
 	"github.com/GRFreire/nthmail/pkg/rig"
 	"github.com/go-chi/chi"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/microcosm-cc/bluemonday"
 )
 
-func Start(db *sql.DB) error {
+// Start runs the web server until ctx is cancelled. It then stops accepting
+// connections and waits up to cfg.Web.ShutdownTimeout for in-flight requests.
+func Start(ctx context.Context, db *sql.DB, cfg config.Config, forwarder *forward.Forwarder, sender *compose.Sender) error {
 	server := &ServerResouces{}
 	server.db = db
+	server.forwarder = forwarder
+	server.forward_limit = ratelimit.Per(cfg.Forward.RulesPerHour, time.Hour)
+	server.forward_global_limit = ratelimit.Per(cfg.Forward.GlobalRulesPerHour, time.Hour)
+	server.sender = sender
+	server.send_limit = ratelimit.Per(cfg.Send.ClientPerHour, time.Hour)
+	server.send_global_limit = ratelimit.Per(cfg.Send.GlobalPerHour, time.Hour)
+	server.send_require_claim = cfg.Send.RequireClaim && cfg.Claim.Enabled
+	server.base_url = strings.TrimSuffix(cfg.Web.BaseURL, "/")
+	server.api_keys = apikey.New(db)
+	server.key_limits = new_key_limits(cfg.API.KeyRequestsPerMinute)
+	server.require_key = cfg.API.RequireKey
+	server.admin_token = cfg.Admin.Token
+	server.blocklist = blocklist.New(db)
+
+	words, err := rig.LoadWords(cfg.Inbox.WordsDir)
+	if err != nil {
+		return err
+	}
+	domain_locales, err := cfg.Inbox.ParseDomainLocales()
+	if err != nil {
+		return err
+	}
+	server.inbox_names, err = rig.New(db, words, cfg.Inbox.Locale, cfg.Inbox.Pattern, cfg.Mail.SubaddressSeparators, domain_locales)
+	if err != nil {
+		return fmt.Errorf("could not set up inbox names: %w", err)
+	}
 
-	server.policy = bluemonday.UGCPolicy()
-	server.policy.AllowAttrs("style").Globally()
-
-	domain, exists := os.LookupEnv("MAIL_SERVER_DOMAIN")
-	if !exists {
-		domain = "localhost"
+	domain_reserved_names, err := cfg.Inbox.ParseDomainReservedNames()
+	if err != nil {
+		return err
 	}
-	server.domain = domain
+	server.reserved_names = address.NewReserved(cfg.Inbox.ReservedNames, domain_reserved_names)
+	server.subaddress_separators = cfg.Mail.SubaddressSeparators
+	server.normalizer = cfg.Mail.Normalizer()
 
-	var port int
-	var err error
-	port_str, exists := os.LookupEnv("WEB_SERVER_PORT")
-	if exists {
-		port, err = strconv.Atoi(port_str)
+	// random names holding a separator would all be tags of a few inboxes
+	for _, locale := range words.Locales() {
+		scheme, err := server.inbox_names.Scheme(cfg.Mail.Domain, rig.Options{Locale: locale})
 		if err != nil {
-			return errors.New("env:WEB_SERVER_PORT is not a number")
+			return err
+		}
+		if strings.ContainsAny(scheme.Pattern, cfg.Mail.SubaddressSeparators) {
+			return fmt.Errorf("the inbox name pattern %q of locale %s contains a sub-address separator of %q, set inbox.pattern to one without it", scheme.Pattern, locale, cfg.Mail.SubaddressSeparators)
 		}
-	} else {
-		port = 3000
 	}
 
-	router := server.Routes()
+	scheme, err := server.inbox_names.Scheme(cfg.Mail.Domain, rig.Options{})
+	if err != nil {
+		return err
+	}
+	slog.Info("random inbox names", "locale", scheme.Locale, "pattern", scheme.Pattern, "entropy_bits", fmt.Sprintf("%.1f", scheme.Entropy), "locales", words.Locales())
+
+	if cfg.Claim.Enabled {
+		server.claims = claim.New(db, cfg.Claim.TTL, cfg.Claim.MinPasswordLength)
+		server.claim_ttl = cfg.Claim.TTL
+		server.login_limit = ratelimit.PerMinute(cfg.Claim.LoginsPerMinute)
+		server.client_login_limit = ratelimit.PerMinute(cfg.Claim.ClientLoginsPerMinute)
+		server.claim_limit = ratelimit.Per(cfg.Claim.ClaimsPerHour, time.Hour)
+		go server.claims.RunExpiry(ctx, time.Hour)
+	}
 
-	log.Println("Starting web server at port", port)
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), router)
+	server.signature_roots, err = load_signature_roots(cfg.Signature)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	server.policy = bluemonday.UGCPolicy()
+	server.policy.AllowAttrs("style").Globally()
 
-type ServerResouces struct {
-	db     *sql.DB
-	policy *bluemonday.Policy
-	domain string
-}
+	server.domain = cfg.Mail.Domain
+	server.serve_metrics = cfg.Metrics.Enabled && cfg.Metrics.Port == 0
+	server.smtp_addr = fmt.Sprintf("127.0.0.1:%d", cfg.Mail.Port)
+
+	if cfg.Mail.Antivirus.Enabled {
+		client, err := clamd.New(cfg.Mail.Antivirus.Address, cfg.Mail.Antivirus.Timeout)
+		if err != nil {
+			return err
+		}
+		server.clamd = client
+	}
 
-type db_mail_header struct {
-	Id                   int
-	Arrived_at           int64
-	Rcpt_addr, From_addr string
-	Subject              string
+	http_server := &http.Server{
+		Addr:     fmt.Sprintf(":%d", cfg.Web.Port),
+		Handler:  server.Routes(),
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	slog.Info("starting web server", "port", cfg.Web.Port)
+	return lifecycle.ServeHTTP(ctx, http_server, cfg.Web.ShutdownTimeout)
 }
-type db_mail struct {
-	Id                   int
-	Arrived_at           int64
-	Rcpt_addr, From_addr string
-	Data                 []byte
+
+type ServerResouces struct {
+	db            *sql.DB
+	policy        *bluemonday.Policy
+	domain        string
+	serve_metrics bool
+	smtp_addr     string
+
+	// nil when antivirus scanning is disabled
+	clamd *clamd.Client
+	// nil when forwarding is disabled
+	forwarder *forward.Forwarder
+	// new forwarding rules per client ip and over all clients
+	forward_limit        *ratelimit.Limiter
+	forward_global_limit *ratelimit.Limiter
+	// nil when sending is disabled
+	sender *compose.Sender
+	// mails sent per client ip and over all clients
+	send_limit         *ratelimit.Limiter
+	send_global_limit  *ratelimit.Limiter
+	send_require_claim bool
+	// nil when inboxes cannot be claimed
+	claims      *claim.Store
+	claim_ttl   time.Duration
+	login_limit *ratelimit.Limiter
+	// logins and claims per client ip
+	client_login_limit *ratelimit.Limiter
+	claim_limit        *ratelimit.Limiter
+
+	base_url string
+
+	api_keys    *apikey.Store
+	key_limits  *key_limits
+	require_key bool
+	// empty when the admin api and dashboard are disabled
+	admin_token string
+	blocklist   *blocklist.Store
+
+	inbox_names    *rig.Generator
+	reserved_names *address.Reserved
+	// empty when sub-addressing is disabled
+	subaddress_separators string
+	normalizer            address.Normalizer
+
+	signature_roots *x509.CertPool
 }
 
 func (sr ServerResouces) Routes() chi.Router {
 	router := chi.NewRouter()
+	router.Use(log_requests)
+	router.Use(instrument)
 
 	router.Get("/", func(res http.ResponseWriter, req *http.Request) {
-		page := index_page()
+		start := time.Now()
+		page := index_page(sr.domain, name_choice{})
 		page.Render(req.Context(), res)
+		render_duration.Since(start, "index")
 	})
 
-	router.Get("/random", func(res http.ResponseWriter, req *http.Request) {
-		inbox_name := rig.GenerateRandomInboxName()
-		inbox_addr := fmt.Sprintf("/%s@%s", inbox_name, sr.domain)
+	router.Get("/healthz", sr.handleHealthz)
+	router.Get("/readyz", sr.handleReadyz)
+	router.Get("/version", sr.handleVersion)
+
+	router.Get("/random", sr.handleRandom)
+	router.Get("/api/random", sr.handleApiRandom)
+	router.Get("/choose", sr.handleChoose)
+	router.Get("/api/choose", sr.handleApiChoose)
+
+	if sr.forwarder != nil {
+		router.Get("/forward/confirm/{token}", sr.handleConfirmForward)
+	}
+
+	if sr.admin_token != "" {
+		router.Group(func(router chi.Router) {
+			router.Use(sr.require_admin)
+
+			router.Get("/api/admin/keys", sr.handleApiKeys)
+			router.Post("/api/admin/keys", sr.handleApiCreateKey)
+			router.Delete("/api/admin/keys/{key-id}", sr.handleApiRevokeKey)
+
+			// metrics sharing the web port are not public
+			if sr.serve_metrics {
+				router.Handle("/metrics", metrics.Handler())
+			}
+		})
+
+		router.Group(func(router chi.Router) {
+			router.Use(sr.require_admin_page)
+
+			router.Get("/admin", sr.handleAdmin)
+			router.Post("/admin/delete", sr.handleAdminDelete)
+			router.Post("/admin/blocklist", sr.handleAdminBlock)
+			router.Post("/admin/blocklist/{entry-id}/delete", sr.handleAdminUnblock)
+		})
+	} else {
+		// not the inbox named admin
+		router.Handle("/admin", http.NotFoundHandler())
+		router.Handle("/admin/*", http.NotFoundHandler())
+		router.Handle("/api/admin/*", http.NotFoundHandler())
+	}
+
+	if sr.claims != nil {
+		router.Group(func(router chi.Router) {
+			router.Use(sr.resolve_rcpt_addr)
+			router.Use(sr.check_csrf)
+
+			router.Get("/{rcpt-addr}/claim", sr.handleClaimPage)
+			router.Post("/{rcpt-addr}/claim", sr.handleClaim)
+			router.Post("/{rcpt-addr}/login", sr.handleLogin)
+			router.Get("/{rcpt-addr}/access/{token}", sr.handleAccess)
+		})
+	}
+
+	router.Group(func(router chi.Router) {
+		router.Use(sr.resolve_rcpt_addr)
+		router.Use(sr.require_api_key)
+
+		if sr.claims != nil {
+			router.Post("/api/{rcpt-addr}/claim", sr.handleApiClaim)
+			router.Post("/api/{rcpt-addr}/login", sr.handleApiLogin)
+		}
+
+		router.Group(func(router chi.Router) {
+			router.Use(sr.require_claim)
+
+			if sr.forwarder != nil {
+				router.Get("/api/{rcpt-addr}/forwards", sr.handleApiForwards)
+				router.Post("/api/{rcpt-addr}/forwards", sr.handleApiCreateForward)
+				router.Delete("/api/{rcpt-addr}/forwards/{rule-id}", sr.handleApiDeleteForward)
+			}
 
-		http.Redirect(res, req, inbox_addr, 307)
+			router.Get("/api/{rcpt-addr}", sr.handleApiInbox)
+			router.Get("/api/{rcpt-addr}/{mail-id}", sr.handleApiMail)
+			router.Delete("/api/{rcpt-addr}/{mail-id}", sr.handleApiDeleteMail)
+		})
 	})
 
-	router.Get("/{rcpt-addr}", sr.handleInbox)
-	router.Get("/{rcpt-addr}/{mail-id}", sr.handleMail)
+	router.Group(func(router chi.Router) {
+		router.Use(sr.resolve_rcpt_addr)
+		router.Use(sr.check_csrf)
+		router.Use(sr.require_claim)
+
+		if sr.forwarder != nil {
+			router.Get("/{rcpt-addr}/forwards", sr.handleForwards)
+			router.Post("/{rcpt-addr}/forwards", sr.handleCreateForward)
+			router.Post("/{rcpt-addr}/forwards/{rule-id}/delete", sr.handleDeleteForward)
+		}
+
+		if sr.sender != nil {
+			router.Get("/{rcpt-addr}/compose", sr.handleCompose)
+			router.Post("/{rcpt-addr}/compose", sr.handleSend)
+			router.Get("/{rcpt-addr}/sent", sr.handleSent)
+		}
+
+		router.Get("/{rcpt-addr}", sr.handleInbox)
+		router.Get("/{rcpt-addr}/{mail-id}", sr.handleMail)
+	})
 
 	return router
 }
 
 func (sr ServerResouces) handleInbox(res http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
 	rcpt_addr := chi.URLParam(req, "rcpt-addr")
 	if len(rcpt_addr) == 0 {
 		res.WriteHeader(404)
@@ -101,76 +296,55 @@ func (sr ServerResouces) handleInbox(res http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	tx, err := sr.db.Begin()
-	if err != nil {
-		res.WriteHeader(500)
-		res.Write([]byte("internal server error"))
+	q := parse_inbox_query(req)
 
-		log.Println("could not begin db transaction")
-		return
+	var mails []mail_utils.Mail_obj
+	var threads []thread_summary
+	var err error
+	if q.Threads {
+		threads, err = sr.query_threads(req.Context(), rcpt_addr, q)
+	} else {
+		mails, err = sr.query_inbox(req.Context(), rcpt_addr, q)
 	}
-	defer tx.Commit()
-
-	stmt, err := tx.Prepare(
-        "SELECT "                  +
-            "mails.id, "           +
-            "mails.arrived_at, "   +
-            "mails.rcpt_addr, "    +
-            "mails.from_addr, "    +
-            "mails.subject "       +
-        "FROM "                    +
-            "mails "               +
-        "WHERE "                   +
-            "mails.rcpt_addr = ? " +
-        "ORDER BY "                +
-            "mails.arrived_at DESC",
-        )
 	if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte("internal server error"))
 
-		log.Println("could not prepare db stmt")
+		logger.Error("could not query inbox", "err", err)
 		return
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(rcpt_addr)
+	tags, err := sr.query_tags(req.Context(), rcpt_addr)
 	if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte("internal server error"))
 
-		log.Println("could not query db stmt")
+		logger.Error("could not query inbox tags", "err", err)
 		return
 	}
-	defer rows.Close()
 
-	var mails []mail_utils.Mail_obj
-	for rows.Next() {
-		var m db_mail_header
-		err = rows.Scan(&m.Id, &m.Arrived_at, &m.Rcpt_addr, &m.From_addr, &m.Subject)
+	claimable := false
+	if sr.claims != nil {
+		claimed, err := sr.claims.Claimed(req.Context(), rcpt_addr)
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte("internal server error"))
 
-			log.Println("could not scan db row")
+			logger.Error("could not query inbox claim", "err", err)
 			return
 		}
-
-		var mail_obj mail_utils.Mail_obj
-		mail_obj.Id = m.Id
-		mail_obj.Date = time.Unix(m.Arrived_at, 0)
-		mail_obj.To = []string{m.Rcpt_addr}
-		mail_obj.From = m.From_addr
-		mail_obj.Subject = m.Subject
-
-		mails = append(mails, mail_obj)
+		claimable = !claimed
 	}
 
-	body := inbox_body(rcpt_addr, mails)
+	render_start := time.Now()
+	body := inbox_body(rcpt_addr, mails, q, tags, threads, sr.forwarder != nil, sr.sender != nil, claimable)
 	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "inbox")
 }
 
 func (sr ServerResouces) handleMail(res http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
 	rcpt_addr := chi.URLParam(req, "rcpt-addr")
 	if len(rcpt_addr) == 0 {
 		res.WriteHeader(404)
@@ -179,57 +353,32 @@ func (sr ServerResouces) handleMail(res http.ResponseWriter, req *http.Request)
 	}
 
 	mail_id := chi.URLParam(req, "mail-id")
-	if len(rcpt_addr) == 0 {
+	if len(mail_id) == 0 {
 		res.WriteHeader(404)
 		res.Write([]byte("mail not found"))
 		return
 	}
 
-	tx, err := sr.db.Begin()
-	if err != nil {
-		res.WriteHeader(500)
-		res.Write([]byte("internal server error"))
-
-		log.Println("could not begin db transaction")
-		return
-	}
-	defer tx.Commit()
-
-	stmt, err := tx.Prepare("SELECT mails.id, mails.arrived_at, mails.rcpt_addr, mails.from_addr, mails.data FROM mails WHERE mails.rcpt_addr = ? AND mails.id = ?")
-	if err != nil {
-		res.WriteHeader(500)
-		res.Write([]byte("internal server error"))
-
-		log.Println("could not prepare db stmt")
-		return
-	}
-	defer stmt.Close()
-
-	row := stmt.QueryRow(rcpt_addr, mail_id)
-
 	format, f_pref := mail_utils.Parse_mime_format(req.URL.Query().Get("format"))
-	var m db_mail
-	err = row.Scan(&m.Id, &m.Arrived_at, &m.Rcpt_addr, &m.From_addr, &m.Data)
-	if err != nil {
-		res.Write([]byte("404 not found"))
 
+	mail_obj, err := sr.query_mail(req.Context(), rcpt_addr, mail_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		res.WriteHeader(404)
+		res.Write([]byte("404 not found"))
 		return
 	}
-
-	mail_obj, err := mail_utils.Parse_mail(m.Data, false)
-	mail_obj.Date = time.Unix(m.Arrived_at, 0)
-	mail_obj.Id = m.Id
 	if err != nil {
 		res.WriteHeader(500)
 		res.Write([]byte("internal server error"))
 
-		log.Println("could not parse mail")
-		log.Println(err)
+		logger.Error("could not query mail", "mail_id", mail_id, "err", err)
 		return
 	}
 
 	mail_obj = mail_utils.Set_format_index(mail_obj, format, f_pref)
 
-	body := mail_body_comp(rcpt_addr, mail_obj, sr.policy)
+	render_start := time.Now()
+	body := mail_body_comp(rcpt_addr, mail_obj, sr.policy, sr.sender != nil)
 	body.Render(req.Context(), res)
+	render_duration.Since(render_start, "mail")
 }
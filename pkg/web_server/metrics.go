@@ -0,0 +1,58 @@
+package web_server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+var (
+	http_requests = metrics.NewCounter(
+		"nthmail_http_requests_total",
+		"HTTP requests by route and status.",
+		"route", "status",
+	)
+	http_request_duration = metrics.NewHistogram(
+		"nthmail_http_request_duration_seconds",
+		"Latency of HTTP requests by route.",
+		metrics.DefaultBuckets,
+		"route",
+	)
+	render_duration = metrics.NewHistogram(
+		"nthmail_render_duration_seconds",
+		"Latency of page rendering by template.",
+		metrics.DefaultBuckets,
+		"template",
+	)
+	key_requests = metrics.NewCounter(
+		"nthmail_api_key_requests_total",
+		"Requests bearing an api key, by result.",
+		"result",
+	)
+)
+
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(res, req.ProtoMajor)
+
+		next.ServeHTTP(ww, req)
+
+		route := chi.RouteContext(req.Context()).RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		http_requests.Inc(route, strconv.Itoa(status))
+		http_request_duration.Since(start, route)
+	})
+}
@@ -0,0 +1,74 @@
+package web_server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/GRFreire/nthmail/pkg/logging"
+	"github.com/GRFreire/nthmail/pkg/rig"
+)
+
+type api_random struct {
+	Address     string  `json:"address"`
+	Locale      string  `json:"locale"`
+	Pattern     string  `json:"pattern"`
+	EntropyBits float64 `json:"entropy_bits"`
+}
+
+// random_options reads the locale and pattern of a new inbox name from the
+// query string.
+func random_options(req *http.Request) rig.Options {
+	return rig.Options{
+		Locale:  req.URL.Query().Get("locale"),
+		Pattern: req.URL.Query().Get("pattern"),
+	}
+}
+
+func is_invalid_options(err error) bool {
+	return errors.Is(err, rig.ErrUnknownLocale) || errors.Is(err, rig.ErrInvalidPattern) || errors.Is(err, rig.ErrAllBlocked)
+}
+
+func (sr ServerResouces) handleRandom(res http.ResponseWriter, req *http.Request) {
+	rcpt_addr, err := sr.inbox_names.Generate(req.Context(), sr.domain, random_options(req))
+	if is_invalid_options(err) {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte("internal server error"))
+
+		logging.FromContext(req.Context()).Error("could not generate inbox name", "err", err)
+		return
+	}
+
+	http.Redirect(res, req, inbox_path(rcpt_addr), 307)
+}
+
+func (sr ServerResouces) handleApiRandom(res http.ResponseWriter, req *http.Request) {
+	opts := random_options(req)
+
+	scheme, err := sr.inbox_names.Scheme(sr.domain, opts)
+	var rcpt_addr string
+	if err == nil {
+		rcpt_addr, err = sr.inbox_names.Generate(req.Context(), sr.domain, opts)
+	}
+	if is_invalid_options(err) {
+		write_api_error(res, 400, err.Error())
+		return
+	}
+	if err != nil {
+		write_api_error(res, 500, "internal server error")
+		logging.FromContext(req.Context()).Error("could not generate inbox name", "err", err)
+		return
+	}
+
+	write_json(res, 200, api_random{
+		Address:     rcpt_addr,
+		Locale:      scheme.Locale,
+		Pattern:     scheme.Pattern,
+		EntropyBits: math.Round(scheme.Entropy*10) / 10,
+	})
+}
@@ -0,0 +1,92 @@
+package web_server
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/apikey"
+	"github.com/GRFreire/nthmail/pkg/blocklist"
+	"github.com/GRFreire/nthmail/pkg/migrations"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// new_test_server returns the resources of a server for nthmail.test with
+// every optional feature disabled, and its database.
+func new_test_server(t *testing.T) (ServerResouces, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = migrations.Apply(db, address.Normalizer{FoldCase: true}, "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := ServerResouces{
+		db:                    db,
+		policy:                bluemonday.UGCPolicy(),
+		domain:                "nthmail.test",
+		base_url:              "http://nthmail.test",
+		api_keys:              apikey.New(db),
+		key_limits:            new_key_limits(600),
+		blocklist:             blocklist.New(db),
+		subaddress_separators: "+",
+		normalizer:            address.Normalizer{FoldCase: true},
+	}
+
+	return sr, db
+}
+
+// insert_mail stores a mail for rcpt_addr and returns its id.
+func insert_mail(t *testing.T, db *sql.DB, rcpt_addr string) int64 {
+	t.Helper()
+
+	data := "From: alice@example.com\r\nTo: " + rcpt_addr + "\r\nSubject: hi\r\n\r\nhello\r\n"
+	result, err := db.Exec("INSERT INTO mails (rcpt_addr, from_addr, subject, arrived_at, data) VALUES (?, 'alice@example.com', 'hi', 0, ?)", rcpt_addr, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE mails SET thread_id = id WHERE id = ?", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// serve sends a request to handler, with body as its JSON or form body, and
+// returns the response.
+func serve(handler http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	return res
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
@@ -0,0 +1,77 @@
+package web_server
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/GRFreire/nthmail/pkg/config"
+	"github.com/GRFreire/nthmail/pkg/mail_utils"
+	"github.com/GRFreire/nthmail/pkg/smime"
+)
+
+// load_signature_roots builds the pool S/MIME signers are trusted from.
+func load_signature_roots(cfg config.Signature) (*x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	if cfg.SystemRoots {
+		system, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("could not load the system roots: %w", err)
+		}
+		roots = system
+	}
+
+	if cfg.TrustedCerts != "" {
+		pem, err := os.ReadFile(cfg.TrustedCerts)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the trusted certificates: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", cfg.TrustedCerts)
+		}
+	}
+
+	return roots, nil
+}
+
+// verify_signature verifies the S/MIME signature of a mail. PGP signatures
+// are left unverified and say so.
+func (sr ServerResouces) verify_signature(sig *mail_utils.Signature) {
+	if sig == nil || sig.Status != mail_utils.Signature_unverified {
+		return
+	}
+	if sig.Kind != mail_utils.Signature_smime {
+		sig.Detail = "PGP signatures are not verified, the sender is not proven"
+		return
+	}
+
+	signed, err := smime.Parse(sig.Data)
+	if err != nil {
+		sig.Status = mail_utils.Signature_invalid
+		sig.Detail = err.Error()
+		return
+	}
+
+	signer, err := signed.Verify(sig.Content, sr.signature_roots)
+	sig.SigningTime = signer.SigningTime
+	if signer.Certificate != nil {
+		sig.Signer = signer.Certificate.Subject.CommonName
+		if len(signer.Certificate.EmailAddresses) != 0 {
+			sig.Signer = signer.Certificate.EmailAddresses[0]
+		}
+	}
+
+	switch {
+	case errors.Is(err, smime.ErrUnsupported):
+		sig.Detail = err.Error()
+	case err != nil:
+		sig.Status = mail_utils.Signature_invalid
+		sig.Detail = err.Error()
+	case !signer.Trusted:
+		sig.Status = mail_utils.Signature_untrusted
+		sig.Detail = signer.TrustError.Error()
+	default:
+		sig.Status = mail_utils.Signature_valid
+	}
+}
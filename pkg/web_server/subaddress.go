@@ -0,0 +1,96 @@
+package web_server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/GRFreire/nthmail/pkg/address"
+	"github.com/GRFreire/nthmail/pkg/metrics"
+	"github.com/go-chi/chi"
+)
+
+// Mail to name+tag@domain is stored in the name@domain inbox with its tag.
+// The pages and API of name+tag@domain are those of name@domain, listing
+// only the mails of the tag.
+
+type tag_ctx_key struct{}
+
+type tag_count struct {
+	Tag   string
+	Count int
+}
+
+// resolve_rcpt_addr replaces the rcpt-addr url parameter by the normalized
+// address of its inbox, keeping the tag of a sub-address for request_tag.
+func (sr ServerResouces) resolve_rcpt_addr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		rctx := chi.RouteContext(req.Context())
+		for i, key := range rctx.URLParams.Keys {
+			if key != "rcpt-addr" {
+				continue
+			}
+
+			// chi matches the escaped path when it holds escaped slashes
+			rcpt_addr := rctx.URLParams.Values[i]
+			if req.URL.RawPath != "" {
+				if unescaped, err := url.PathUnescape(rcpt_addr); err == nil {
+					rcpt_addr = unescaped
+				}
+			}
+			if normalized, err := sr.normalizer.Normalize(rcpt_addr); err == nil {
+				rcpt_addr = normalized
+			}
+
+			inbox, tag := address.Split(rcpt_addr, sr.subaddress_separators)
+			rctx.URLParams.Values[i] = inbox
+			if tag != "" {
+				req = req.WithContext(context.WithValue(req.Context(), tag_ctx_key{}, tag))
+			}
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+// request_tag is the tag of the address of req, else the "tag" query
+// parameter.
+func request_tag(req *http.Request) string {
+	if tag, ok := req.Context().Value(tag_ctx_key{}).(string); ok {
+		return tag
+	}
+
+	return req.URL.Query().Get("tag")
+}
+
+// inbox_path is the path of the pages of rcpt_addr, escaped so that any
+// local part stays a single path segment.
+func inbox_path(rcpt_addr string) string {
+	return "/" + url.PathEscape(rcpt_addr)
+}
+
+// query_tags counts the mails of each tag of an inbox.
+func (sr ServerResouces) query_tags(ctx context.Context, rcpt_addr string) ([]tag_count, error) {
+	query_start := time.Now()
+	rows, err := sr.db.QueryContext(ctx, "SELECT rcpt_tag, COUNT(*) FROM mails WHERE rcpt_addr = ? AND rcpt_tag IS NOT NULL AND quarantined = 0 GROUP BY rcpt_tag ORDER BY rcpt_tag", rcpt_addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not query inbox tags: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []tag_count
+	for rows.Next() {
+		var t tag_count
+		err = rows.Scan(&t.Tag, &t.Count)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan db row: %w", err)
+		}
+
+		tags = append(tags, t)
+	}
+	metrics.DBQueryDuration.Since(query_start, "inbox_tags")
+
+	return tags, rows.Err()
+}